@@ -1,22 +1,35 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
+	"io"
 	"log"
+	"math"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/creack/pty"
 	"github.com/godbus/dbus/v5"
@@ -68,6 +81,7 @@ const (
 	AuthErrorTokenExpired   AuthErrorCode = "token_expired"
 	AuthErrorNoSubscription AuthErrorCode = "no_subscription"
 	AuthErrorSetupRequired  AuthErrorCode = "setup_required"
+	AuthErrorSuspended      AuthErrorCode = "account_suspended"
 )
 
 // AuthError represents an authentication-related error
@@ -89,31 +103,93 @@ const (
 type Quota struct {
 	Type                 QuotaType `json:"type"`
 	Model                string    `json:"model,omitempty"`
+	Label                string    `json:"label,omitempty"`
 	PercentRemaining     float64   `json:"percent_remaining"`
 	ResetsAt             *string   `json:"resets_at,omitempty"`
 	ResetText            string    `json:"reset_text,omitempty"`
 	TimeRemainingSeconds *int64    `json:"time_remaining_seconds,omitempty"`
 	TimeRemainingHuman   string    `json:"time_remaining_human,omitempty"`
+	TimeRemainingISO     string    `json:"time_remaining_iso,omitempty"` // ISO 8601, e.g. "PT2H14M"
+	UsedSinceReset       *float64  `json:"used_since_reset,omitempty"`   // Points used since the daemon's post-reset baseline
+	LimitText            string    `json:"limit_text,omitempty"`
 }
 
 // CostUsage represents extra usage costs (Pro accounts)
 type CostUsage struct {
-	Spent     float64 `json:"spent,omitempty"`
-	Budget    float64 `json:"budget,omitempty"`
-	Unlimited bool    `json:"unlimited,omitempty"`
-	ResetsAt  *string `json:"resets_at,omitempty"`
+	Spent     float64     `json:"spent,omitempty"`
+	Budget    float64     `json:"budget,omitempty"`
+	Unlimited bool        `json:"unlimited,omitempty"`
+	ResetsAt  *string     `json:"resets_at,omitempty"`
+	Entries   []CostEntry `json:"entries,omitempty"` // Every cost line, when the section shows more than one
 }
 
+// CostEntry is one cost line of the extra usage section. Spent and Budget
+// above mirror the first line with a budget (for unlimited extra usage, the
+// first spend); entries keep the others, such as an all-time total next to
+// the monthly budget.
+type CostEntry struct {
+	Scope  string  `json:"scope,omitempty"` // monthly, weekly, daily or total; "" if the line names none
+	Spent  float64 `json:"spent"`
+	Budget float64 `json:"budget,omitempty"`
+}
+
+// APIUsage represents spend and credit information for API accounts,
+// which have no session/weekly quotas
+type APIUsage struct {
+	Spent         *float64 `json:"spent,omitempty"`
+	CreditBalance *float64 `json:"credit_balance,omitempty"`
+	CreditTotal   *float64 `json:"credit_total,omitempty"` // Prepaid credits the balance is out of, if shown
+}
+
+// snapshotSchemaVersion is the UsageSnapshot JSON shape written in
+// schema_version. Bump it when fields are added, renamed or change meaning;
+// files written before the field existed read as version 0.
+//
+//	1: schema_version added
+//	2: plan_name
+//	3: cost_usage.entries
+const snapshotSchemaVersion = 3
+
 // UsageSnapshot represents the complete usage information
 type UsageSnapshot struct {
-	AccountType  AccountType    `json:"account_type"`
-	Email        string         `json:"email,omitempty"`
-	Organization string         `json:"organization,omitempty"`
-	Quotas       []Quota        `json:"quotas"`
-	CostUsage    *CostUsage     `json:"cost_usage,omitempty"`
-	AuthError    *AuthError     `json:"auth_error,omitempty"`
-	CapturedAt   string         `json:"captured_at"`
-	RawOutput    string         `json:"raw_output,omitempty"`
+	SchemaVersion int           `json:"schema_version"`
+	AccountType   AccountType   `json:"account_type"`
+	PlanName      string        `json:"plan_name,omitempty"` // Header plan descriptor as shown, e.g. "Claude Max 20x"
+	Email         string        `json:"email,omitempty"`
+	Organization  string        `json:"organization,omitempty"`
+	Quotas        []Quota       `json:"quotas"`
+	CostUsage     *CostUsage    `json:"cost_usage,omitempty"`
+	APIUsage      *APIUsage     `json:"api_usage,omitempty"`
+	AuthError     *AuthError    `json:"auth_error,omitempty"`
+	ModelFallback string        `json:"model_fallback,omitempty"`
+	Warnings      []string      `json:"warnings,omitempty"`
+	Incomplete    bool          `json:"incomplete,omitempty"`
+	CapturedAt    string        `json:"captured_at"`
+	ValidUntil    *string       `json:"valid_until,omitempty"` // Soonest quota reset; re-query after this
+	Seq           uint64        `json:"seq,omitempty"`         // Daemon write counter, starts at 1 on each daemon run
+	Metrics       *QueryMetrics `json:"metrics,omitempty"`
+	Debug         *ParseDebug   `json:"debug,omitempty"`
+	RawOutput     string        `json:"raw_output,omitempty"`
+}
+
+// ParseDebug records where the parser found each field (query --debug), so
+// one JSON dump is a complete bug report. Line numbers are 1-based; quota
+// lines count in the output after wrapped headings were rejoined.
+type ParseDebug struct {
+	AccountLine      int          `json:"account_line,omitempty"`
+	EmailLine        int          `json:"email_line,omitempty"`
+	OrganizationLine int          `json:"organization_line,omitempty"`
+	Quotas           []QuotaDebug `json:"quotas,omitempty"`
+	Trace            []string     `json:"trace,omitempty"` // The --explain lines
+}
+
+// QuotaDebug records the lines a quota was parsed from
+type QuotaDebug struct {
+	Label        string `json:"label"`
+	HeadingLine  int    `json:"heading_line"`
+	PercentLine  int    `json:"percent_line"`
+	ResetLine    int    `json:"reset_line,omitempty"`
+	ResetVariant string `json:"reset_variant,omitempty"` // See resetVariant
 }
 
 // ErrorResponse for JSON error output
@@ -128,6 +204,13 @@ type HyprPanelOutput struct {
 	Alt     string `json:"alt"`
 	Class   string `json:"class"`
 	Tooltip string `json:"tooltip"`
+
+	// Percentage is the displayed quota's value in the --metric, rounded,
+	// for gauge widgets; unset when no quota is shown
+	Percentage *int `json:"percentage,omitempty"`
+
+	// Snapshot is the full usage data the fields were rendered from (--embed-snapshot)
+	Snapshot *UsageSnapshot `json:"snapshot,omitempty"`
 }
 
 var (
@@ -141,6 +224,12 @@ var (
 	// Used to replace cursor movements with spaces to preserve word boundaries
 	cursorForwardPattern = regexp.MustCompile(`\x1B\[(\d*)C`)
 
+	// Spinner frames at the start of a line: braille glyphs (⠋⠙⠹...) in any number.
+	// These are literal unicode, so stripANSI leaves them in place. The line
+	// separator and indentation are kept. Classic |/-\ frames are handled by
+	// stripSpinnerFrames, as they double as bullets and table borders.
+	spinnerPattern = regexp.MustCompile(`(^|[\r\n])([ \t]*)(?:[\x{2800}-\x{28FF}]+[ \t]*)+`)
+
 	// Account type patterns (case insensitive)
 	// v2.1.x format: "Claude Max" without leading ·
 	// v2.0.x format: "· claude max" with leading ·
@@ -148,8 +237,20 @@ var (
 	maxPattern = regexp.MustCompile(`(?i)(?:·\s*)?claude\s+max`)
 	apiPattern = regexp.MustCompile(`(?i)(?:·\s*)?claude\s+api`)
 
-	// Percentage pattern: "X% used" or "X% left"
-	percentPattern = regexp.MustCompile(`(\d{1,3})\s*%\s*(used|left)`)
+	// Full plan descriptor, e.g. "Claude Max 20x" or "Claude Max (5x)"; group 1 is the plan
+	planNamePattern = regexp.MustCompile(`(?i)\bclaude\s+(pro|max|api)\b(?:\s+\(?\d+(?:\.\d+)?x\)?)?`)
+
+	// Percentage pattern: "X% used", "X% left" or "X% remaining"
+	// A leading minus is captured so malformed values can be clamped rather than misread.
+	// The number must not be the tail of a longer one, and the wording must be a whole
+	// word, so plan multipliers and other bare numbers near a quota are never taken.
+	percentPattern = regexp.MustCompile(`(?i)(?:^|[^\d.,])(-?\d{1,3}(?:\.\d+|,\d{1,2})?)\s*%\s*(used|left|remaining)\b`)
+	// Anything else with a digit or letter before "% used" is a corrupt percentage ("1O% used", "12.3.4% left")
+	malformedPercentPattern = regexp.MustCompile(`(?i)([^\s│]*[\p{L}\d][^\s│]*)\s*%\s*(?:used|left|remaining)\b`)
+
+	// Comma decimal separator ending a number as printed in some locales: "7,5",
+	// "12,50". At most two digits after the comma, so "1,234" stays a thousands group.
+	decimalCommaPattern = regexp.MustCompile(`(\d),(\d{1,2})$`)
 
 	// Time patterns for reset parsing (relative durations)
 	daysPattern    = regexp.MustCompile(`(\d+)\s*d(?:ays?)?`)
@@ -160,6 +261,23 @@ var (
 	// Note: No leading \b because ANSI stripping may remove spaces (e.g., "Resets8pm")
 	timeOnlyPattern = regexp.MustCompile(`(\d{1,2})(?::(\d{2}))?(am|pm)\b`)
 
+	// 24-hour clock time without am/pm: "Resets 18:59 (+02:00)"
+	clock24Pattern = regexp.MustCompile(`\b([01]?\d|2[0-3]):([0-5]\d)\b`)
+
+	// Epoch reset from JSON-ish debug output: "resetsAt: 1767225540", "resets_at": 1767225540000
+	epochResetPattern = regexp.MustCompile(`(?i)resets_?at["']?\s*[:=]\s*(\d{9,13})\b`)
+
+	// Availability phrasing of a reset, only when a duration follows, so prose
+	// like "come back in a moment" is not taken: "Back in 1h 30m", "again in 45m"
+	availableInPattern = regexp.MustCompile(`(?i)\b(?:again|back)\s+in\s+\d`)
+
+	// UTC offsets instead of a zone name: "UTC+2", "GMT-05:30", "(+02:00)", "-0500"
+	utcNamedOffsetPattern = regexp.MustCompile(`(?i)\b(?:UTC|GMT)\s*([+-])(\d{1,2})(?::?(\d{2}))?\b`)
+	utcBareOffsetPattern  = regexp.MustCompile(`(?:^|[\s(])([+-])(\d{2}):?(\d{2})\b`)
+
+	// Named clock times: "Resets at midnight", "Resets at noon"
+	namedTimePattern = regexp.MustCompile(`(?i)\b(midnight|noon)\b`)
+
 	// Full date pattern: "Jan 4, 2026, 12:59am" or "Jan 4, 2026, 1am"
 	fullDatePattern = regexp.MustCompile(`\b(Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec)\s+(\d{1,2}),?\s+(\d{4}),?\s+(\d{1,2})(?::(\d{2}))?(am|pm)\b`)
 
@@ -167,20 +285,51 @@ var (
 	// Hour is restricted to 1-12 to ensure valid 12-hour times and avoid ambiguity with 2-digit year formats
 	dateNoYearPattern = regexp.MustCompile(`\b(Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec)\s+(\d{1,2}),?\s+(1[0-2]|[1-9])(?::(\d{2}))?(am|pm)\b`)
 
+	// Date without a clock time, optionally led by a weekday and followed by a year:
+	// "Monday, Jan 6", "Jan 6", "Jan 6, 2026". Midnight local time is assumed.
+	dateOnlyPattern = regexp.MustCompile(`\b(?:(?:Mon|Tue|Wed|Thu|Fri|Sat|Sun)[a-z]*,?\s+)?(Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec)\s+(\d{1,2})\b(?:,?\s+(\d{4})\b)?`)
+
+	// Standalone weekday token, as in compact views like "Opus · Mon"
+	weekdayHintPattern = regexp.MustCompile(`(?i)(?:^|[^\p{L}])(mon|tue|wed|thu|fri|sat|sun)(?:day|sday|nesday|rsday|urday)?(?:$|[^\p{L}])`)
+
 	// Timezone pattern to extract location
 	timezonePattern = regexp.MustCompile(`\(([^)]+)\)`)
 
 	// Email patterns
 	emailHeaderPattern = regexp.MustCompile(`(?i)·\s*Claude\s+(?:Max|Pro)\s*·\s*([^\s@]+@[^\s@']+)`)
 	emailLegacyPattern = regexp.MustCompile(`(?i)(?:Account|Email):\s*([^\s@]+@[^\s@]+)`)
+	// Any email address, stopping at a possessive ("user@example.com's")
+	accountEmailPattern = regexp.MustCompile(`[^\s@'·│()]+@[^\s@'·│(),]+`)
 
 	// Organization patterns
 	orgHeaderPattern = regexp.MustCompile(`(?i)·\s*Claude\s+(?:Max|Pro)\s*·\s*(.+?)(?:\s*$|\n)`)
 	orgLegacyPattern = regexp.MustCompile(`(?i)(?:Org|Organization):\s*(.+)`)
 
+	// Org switcher entries marked active: "● Acme Corp", "❯ Acme Corp", "Acme Corp (active)"
+	orgActiveMarkerPattern = regexp.MustCompile(`^\s*[●❯✔✓*>]\s*(.+?)\s*$`)
+	orgActiveSuffixPattern = regexp.MustCompile(`(?i)^\s*(?:[○◯·-]\s*)?(.+?)\s*\((?:active|current)\)\s*$`)
+
+	// Heading of an account switcher list: "Accounts", "Switch account"
+	accountListPattern = regexp.MustCompile(`(?i)^[\s│]*(?:accounts|(?:switch|select|choose)\s+accounts?)\s*:?[\s│]*$`)
+
 	// Cost pattern for extra usage
 	costPattern = regexp.MustCompile(`\$?([\d,]+\.?\d*)\s*/\s*\$?([\d,]+\.?\d*)\s*spent`)
 
+	// Spend without a budget, as shown for unlimited extra usage: "$12.30 spent"
+	spentOnlyPattern = regexp.MustCompile(`\$([\d,]+\.?\d*)\s*spent`)
+
+	// Model fallback notice: "Opus limit reached ∙ using Sonnet until 6pm (Europe/Berlin)"
+	modelFallbackPattern = regexp.MustCompile(`(?i)\b(?:now\s+)?using\s+(opus|sonnet|haiku)\b[^\n]*?\buntil\s+([^\n│·∙]+)`)
+
+	// Plan limit description: "Max 5x: up to ~225 messages / 5h"
+	limitTextPattern = regexp.MustCompile(`(?i)\bup\s+to\s+~?\s*[\d,]+`)
+
+	// API account patterns: "Total cost: $1.23" / "Spent: $1.23" and "Credit balance: $4.56"
+	apiSpentPattern   = regexp.MustCompile(`(?i)(?:total\s+cost|spent|spend)\s*:?\s*\$([\d,]+\.?\d*)`)
+	apiBalancePattern = regexp.MustCompile(`(?i)(?:credit\s+balance|credits?\s+remaining|balance)\s*:?\s*\$([\d,]+\.?\d*)`)
+	// Prepaid credits: "$37.50 of $50.00 credits remaining"
+	apiCreditsPattern = regexp.MustCompile(`(?i)\$([\d,]+\.?\d*)\s+of\s+\$([\d,]+\.?\d*)\s+credits?\s+remaining`)
+
 	// Authentication error patterns
 	// Login prompt patterns - these indicate the user needs to authenticate
 	loginPromptPattern = regexp.MustCompile(`(?i)(sign\s*in|log\s*in|authenticate)\s*(to\s+continue|required|to\s+use)`)
@@ -193,15 +342,101 @@ var (
 	// No subscription patterns - user is logged in but doesn't have Pro/Max
 	noSubscriptionPattern = regexp.MustCompile(`(?i)(free\s+tier|no\s+(active\s+)?subscription|upgrade\s+to\s+(pro|max)|subscribe\s+to)`)
 
+	// Another claude holding its lock, e.g. an open interactive session
+	instanceConflictPattern = regexp.MustCompile(`(?i)(another\s+(?:claude\s+)?(?:instance|process|session)\b[^\n]*\balready\s+running|already\s+running\s+in\s+another|(?:could\s+not|unable\s+to|failed\s+to)\s+acquire\s+(?:the\s+)?lock|lock\s*file\b[^\n]*\b(?:is\s+)?(?:held|in\s+use|exists))`)
+
+	// A claude without /usage --json rejecting the command or flag
+	jsonRejectedPattern = regexp.MustCompile(`(?i)\b(?:unknown|unrecognized|unsupported|invalid)\s+(?:slash\s+)?(?:command|option|flag|argument)`)
+
 	// Generic not logged in indicators
 	notLoggedInPattern = regexp.MustCompile(`(?i)(not\s+logged\s+in|please\s+(log|sign)\s*in|login\s+required)`)
 
+	// Suspended account or failed billing banners shown instead of quotas
+	accountSuspendedPattern = regexp.MustCompile(`(?i)(account\s+(?:has\s+been\s+|is\s+|was\s+)?(?:suspended|paused|disabled|deactivated)|(?:subscription|plan)\s+(?:has\s+been\s+|is\s+|was\s+)?(?:paused|suspended)|(?:payment|billing)\s+(?:has\s+|was\s+)?(?:failed|declined)|payment\s+method\s+(?:was\s+)?declined)`)
+
 	// First-run setup screen pattern - "Let's get started" with theme selection
 	// Note: Handle various apostrophe types and be lenient with whitespace
 	setupRequiredPattern  = regexp.MustCompile(`(?i)let.?s\s+get\s+started`)
 	themeSelectionPattern = regexp.MustCompile(`(?i)(choose\s+(the\s+)?text\s+style|run\s+/theme|dark\s+mode|light\s+mode)`)
 )
 
+// namedPatterns returns every parser regex by its variable name, for the
+// --print-regexes diagnostic
+func namedPatterns() map[string]*regexp.Regexp {
+	return map[string]*regexp.Regexp{
+		"ansiPattern":             ansiPattern,
+		"cursorForwardPattern":    cursorForwardPattern,
+		"spinnerPattern":          spinnerPattern,
+		"proPattern":              proPattern,
+		"maxPattern":              maxPattern,
+		"apiPattern":              apiPattern,
+		"planNamePattern":         planNamePattern,
+		"percentPattern":          percentPattern,
+		"malformedPercentPattern": malformedPercentPattern,
+		"decimalCommaPattern":     decimalCommaPattern,
+		"daysPattern":             daysPattern,
+		"hoursPattern":            hoursPattern,
+		"minutesPattern":          minutesPattern,
+		"timeOnlyPattern":         timeOnlyPattern,
+		"clock24Pattern":          clock24Pattern,
+		"epochResetPattern":       epochResetPattern,
+		"availableInPattern":      availableInPattern,
+		"utcNamedOffsetPattern":   utcNamedOffsetPattern,
+		"utcBareOffsetPattern":    utcBareOffsetPattern,
+		"namedTimePattern":        namedTimePattern,
+		"fullDatePattern":         fullDatePattern,
+		"dateNoYearPattern":       dateNoYearPattern,
+		"dateOnlyPattern":         dateOnlyPattern,
+		"weekdayHintPattern":      weekdayHintPattern,
+		"timezonePattern":         timezonePattern,
+		"emailHeaderPattern":      emailHeaderPattern,
+		"emailLegacyPattern":      emailLegacyPattern,
+		"accountEmailPattern":     accountEmailPattern,
+		"orgHeaderPattern":        orgHeaderPattern,
+		"orgLegacyPattern":        orgLegacyPattern,
+		"orgActiveMarkerPattern":  orgActiveMarkerPattern,
+		"orgActiveSuffixPattern":  orgActiveSuffixPattern,
+		"accountListPattern":      accountListPattern,
+		"costPattern":             costPattern,
+		"spentOnlyPattern":        spentOnlyPattern,
+		"modelFallbackPattern":    modelFallbackPattern,
+		"limitTextPattern":        limitTextPattern,
+		"apiSpentPattern":         apiSpentPattern,
+		"apiBalancePattern":       apiBalancePattern,
+		"apiCreditsPattern":       apiCreditsPattern,
+		"loginPromptPattern":      loginPromptPattern,
+		"loginURLPattern":         loginURLPattern,
+		"tokenExpiredPattern":     tokenExpiredPattern,
+		"authErrorPattern":        authErrorPattern,
+		"noSubscriptionPattern":   noSubscriptionPattern,
+		"instanceConflictPattern": instanceConflictPattern,
+		"jsonRejectedPattern":     jsonRejectedPattern,
+		"notLoggedInPattern":      notLoggedInPattern,
+		"accountSuspendedPattern": accountSuspendedPattern,
+		"setupRequiredPattern":    setupRequiredPattern,
+		"themeSelectionPattern":   themeSelectionPattern,
+		"lineBreakPattern":        lineBreakPattern,
+	}
+}
+
+// writePatterns prints the name and source of every parser regex as JSON,
+// along with the phrases that mark a reset line (resetKeywords plus the
+// extra ones) and the completion markers the poll loop waits for
+// (defaultCompletionMarkers unless overridden)
+func writePatterns(w io.Writer, extraResetKeywords []string, completionMarkers []string) {
+	sources := map[string]any{}
+	for name, pattern := range namedPatterns() {
+		sources[name] = pattern.String()
+	}
+	sources["resetKeywords"] = append(append([]string{}, resetKeywords...), extraResetKeywords...)
+	if len(completionMarkers) == 0 {
+		completionMarkers = defaultCompletionMarkers
+	}
+	sources["completionMarkers"] = completionMarkers
+	jsonBytes, _ := json.MarshalIndent(sources, "", "  ")
+	fmt.Fprintln(w, string(jsonBytes))
+}
+
 func stripANSI(text string) string {
 	// First, replace cursor forward sequences with appropriate spaces
 	// This preserves word boundaries that the terminal would display
@@ -230,6 +465,107 @@ func stripANSI(text string) string {
 	return ansiPattern.ReplaceAllString(text, "")
 }
 
+// stripSpinnerFrames removes spinner glyph runs that some claude builds render
+// in front of the usage table (and occasionally in front of a percentage).
+func stripSpinnerFrames(text string) string {
+	text = spinnerPattern.ReplaceAllString(text, "$1$2")
+
+	// A classic |/-\ frame is only dropped when it is all its line holds,
+	// so "- item" and "| cell" survive
+	var b strings.Builder
+	start := 0
+	for i := 0; i <= len(text); i++ {
+		if i < len(text) && text[i] != '\n' && text[i] != '\r' {
+			continue
+		}
+		if frame := strings.TrimSpace(text[start:i]); len(frame) != 1 || !strings.Contains(`|/-\`, frame) {
+			b.WriteString(text[start:i])
+		}
+		if i < len(text) {
+			b.WriteByte(text[i])
+		}
+		start = i + 1
+	}
+	return b.String()
+}
+
+// parseExplainer receives a line-by-line account of parse decisions (--explain).
+// A nil *parseExplainer discards everything, so parse functions can call it unconditionally.
+type parseExplainer struct {
+	w     io.Writer   // nil = no text output
+	debug *ParseDebug // Also collects structured records if set (query --debug)
+
+	// Reset line recorded by parseResetTime for the quota being parsed
+	resetLine    int
+	resetVariant string
+}
+
+func (e *parseExplainer) printf(format string, args ...any) {
+	if e == nil {
+		return
+	}
+	if e.w != nil {
+		fmt.Fprintf(e.w, "explain: "+format+"\n", args...)
+	}
+	if e.debug != nil {
+		e.debug.Trace = append(e.debug.Trace, fmt.Sprintf(format, args...))
+	}
+}
+
+// reset notes the reset line (1-based) and variant of the quota being parsed
+func (e *parseExplainer) reset(line int, variant string) {
+	if e == nil {
+		return
+	}
+	e.resetLine, e.resetVariant = line, variant
+}
+
+// quota adds a QuotaDebug record, taking the reset noted since the last one
+func (e *parseExplainer) quota(label string, headingLine, percentLine int) {
+	if e == nil {
+		return
+	}
+	if e.debug != nil {
+		e.debug.Quotas = append(e.debug.Quotas, QuotaDebug{
+			Label:        label,
+			HeadingLine:  headingLine,
+			PercentLine:  percentLine,
+			ResetLine:    e.resetLine,
+			ResetVariant: e.resetVariant,
+		})
+	}
+	e.resetLine, e.resetVariant = 0, ""
+}
+
+// lineOf returns the 1-based number of the first line of text containing
+// value, or 0
+func lineOf(text, value string) int {
+	if value == "" {
+		return 0
+	}
+	offset := strings.Index(text, value)
+	if offset < 0 {
+		return 0
+	}
+	lineNum, _ := matchLine(text, offset)
+	return lineNum
+}
+
+// matchLine returns the 1-based line number and text of the line containing offset
+func matchLine(text string, offset int) (int, string) {
+	start := strings.LastIndexAny(text[:offset], "\r\n") + 1
+	end := strings.IndexAny(text[offset:], "\r\n")
+	if end < 0 {
+		end = len(text)
+	} else {
+		end += offset
+	}
+	// Count separators the way parseQuotas splits lines: \r\n, \n and \r each end a line
+	prefix := strings.ReplaceAll(text[:start], "\r\n", "\n")
+	lineNum := strings.Count(prefix, "\n") + strings.Count(prefix, "\r") + 1
+	return lineNum, strings.TrimSpace(text[start:end])
+}
+
 // detectAuthError checks the CLI output for authentication-related errors
 // Returns nil if no auth error is detected
 func detectAuthError(text string) *AuthError {
@@ -243,7 +579,22 @@ func detectAuthError(text string) *AuthError {
 		}
 	}
 
-	// Check for token expiration first (most specific)
+	// Check for a suspended account or failed payment banner, which replaces
+	// the quotas: next to quota data the same words are only a notice
+	if accountSuspendedPattern.MatchString(text) && !percentPattern.MatchString(text) {
+		if strings.Contains(textLower, "payment") || strings.Contains(textLower, "billing") {
+			return &AuthError{
+				Code:    AuthErrorSuspended,
+				Message: "Claude payment failed and the account is on hold. Update your payment method at claude.ai.",
+			}
+		}
+		return &AuthError{
+			Code:    AuthErrorSuspended,
+			Message: "Claude account is suspended or paused. Check your account at claude.ai.",
+		}
+	}
+
+	// Check for token expiration (the most specific login problem)
 	if tokenExpiredPattern.MatchString(text) {
 		return &AuthError{
 			Code:    AuthErrorTokenExpired,
@@ -300,40 +651,98 @@ func detectAuthError(text string) *AuthError {
 	return nil
 }
 
-func detectAccountType(text string) AccountType {
-	if proPattern.MatchString(text) {
-		return AccountTypePro
-	}
-	if maxPattern.MatchString(text) {
-		return AccountTypeMax
+// detectAccountType identifies the plan from the usage header. Without a header,
+// quota-like content is assumed to mean max unless strict is set, in which
+// case the result is unknown so consumers can tell a guess from a reading.
+func detectAccountType(text string, strict bool, explain *parseExplainer) AccountType {
+	for _, candidate := range []struct {
+		pattern     *regexp.Regexp
+		accountType AccountType
+	}{
+		{proPattern, AccountTypePro},
+		{maxPattern, AccountTypeMax},
+		{apiPattern, AccountTypeAPI},
+	} {
+		if loc := candidate.pattern.FindStringIndex(text); loc != nil {
+			lineNum, line := matchLine(text, loc[0])
+			explain.printf("account: line %d %q matched %s header", lineNum, line, candidate.accountType)
+			if explain != nil && explain.debug != nil {
+				explain.debug.AccountLine = lineNum
+			}
+			return candidate.accountType
+		}
 	}
-	if apiPattern.MatchString(text) {
+	// Only API accounts are billed against prepaid credits
+	if loc := apiCreditsPattern.FindStringIndex(text); loc != nil {
+		lineNum, line := matchLine(text, loc[0])
+		explain.printf("account: line %d %q matched api credits", lineNum, line)
 		return AccountTypeAPI
 	}
 	// Fallback: if we see quota-like content, assume max
-	if strings.Contains(strings.ToLower(text), "current") && strings.Contains(text, "%") {
+	if !strict && strings.Contains(strings.ToLower(text), "current") && strings.Contains(text, "%") {
+		explain.printf("account: no header matched, inferred max from quota content")
 		return AccountTypeMax
 	}
+	explain.printf("account: no header matched, unknown")
 	return AccountTypeUnknown
 }
 
+// normalizeDecimalComma rewrites the comma decimal separator of a captured
+// number ("7,5") to a dot; the rest of the line is never touched
+func normalizeDecimalComma(number string) string {
+	return decimalCommaPattern.ReplaceAllString(number, "$1.$2")
+}
+
 func parsePercentage(text string) (float64, bool) {
+	value, _, ok := rawPercentage(text)
+	if !ok {
+		return 0, false
+	}
+	// Clamp to [0,100] so odd output like "105% used" never yields negative
+	// remaining; parseWarnings reports the clamp (see clampedPercentage)
+	return math.Max(0, math.Min(100, value)), true
+}
+
+// rawPercentage returns the percentage remaining on a line before clamping,
+// along with the figure as shown (e.g. "105% used")
+func rawPercentage(text string) (float64, string, bool) {
 	matches := percentPattern.FindStringSubmatch(text)
 	if len(matches) < 3 {
-		return 0, false
+		return 0, "", false
 	}
 
-	value, err := strconv.ParseFloat(matches[1], 64)
+	value, err := strconv.ParseFloat(normalizeDecimalComma(matches[1]), 64)
 	if err != nil {
-		return 0, false
+		return 0, "", false
 	}
 
 	// Convert "used" to remaining
 	if strings.ToLower(matches[2]) == "used" {
 		value = 100 - value
 	}
+	return value, matches[1] + "% " + matches[2], true
+}
+
+// clampedPercentage returns the percentage on line as shown if it is outside
+// [0,100] and parsePercentage clamps it, or "" otherwise
+func clampedPercentage(line string) string {
+	value, shown, ok := rawPercentage(line)
+	if !ok || (value >= 0 && value <= 100) {
+		return ""
+	}
+	return shown
+}
 
-	return value, true
+// malformedPercentage returns the corrupt percentage on a line that reads
+// like one ("1O% used") but does not parse, or "" if there is none
+func malformedPercentage(line string) string {
+	if _, ok := parsePercentage(line); ok {
+		return ""
+	}
+	if matches := malformedPercentPattern.FindStringSubmatch(line); len(matches) > 0 {
+		return strings.TrimSpace(matches[0])
+	}
+	return ""
 }
 
 // monthMap for parsing month names
@@ -346,6 +755,26 @@ var monthMap = map[string]time.Month{
 
 // parseAbsoluteTime attempts to parse absolute time from text and returns reset time and duration
 func parseAbsoluteTime(text string) (*time.Time, *int64) {
+	resetTime, duration, _ := parseAbsoluteTimeRollover(text, true)
+	return resetTime, duration
+}
+
+// rollsOverDaily reports whether a clock time without a date that has
+// already passed today means the same time tomorrow. That holds for the
+// session window; a weekly quota showing a past time has already reset today,
+// and pushing it 24h ahead would invent a duration.
+func rollsOverDaily(qType QuotaType) bool {
+	return qType == QuotaTypeSession
+}
+
+// parseAbsoluteTimeRollover is parseAbsoluteTime with control over whether
+// a past time-only reset rolls over to tomorrow. Without rollover such a
+// time is returned as today with no duration, like any past reset. It also
+// names the pattern that matched: full_date, date_no_year, time_only,
+// clock_24 or date_only ("" if none).
+func parseAbsoluteTimeRollover(text string, rollover bool) (*time.Time, *int64, string) {
+	text = normalizeNamedTimes(text)
+
 	// Try to extract timezone location
 	var loc *time.Location
 	if tzMatches := timezonePattern.FindStringSubmatch(text); len(tzMatches) > 1 {
@@ -354,6 +783,9 @@ func parseAbsoluteTime(text string) (*time.Time, *int64) {
 			loc = l
 		}
 	}
+	if loc == nil {
+		loc = parseUTCOffset(text)
+	}
 	if loc == nil {
 		loc = time.Local
 	}
@@ -368,6 +800,9 @@ func parseAbsoluteTime(text string) (*time.Time, *int64) {
 		hour, _ := strconv.Atoi(matches[4])
 		min, _ := strconv.Atoi(matches[5]) // Will be 0 if minutes not specified
 		ampm := strings.ToLower(matches[6])
+		if !validClock12(hour, min) || !validDay(year, month, day) {
+			return nil, nil, ""
+		}
 
 		// Convert to 24-hour format
 		if ampm == "pm" && hour != 12 {
@@ -379,9 +814,9 @@ func parseAbsoluteTime(text string) (*time.Time, *int64) {
 		resetTime := time.Date(year, month, day, hour, min, 0, 0, loc)
 		duration := int64(resetTime.Sub(now).Seconds())
 		if duration > 0 {
-			return &resetTime, &duration
+			return &resetTime, &duration, "full_date"
 		}
-		return &resetTime, nil
+		return &resetTime, nil, "full_date"
 	}
 
 	// Try date without year pattern: "Jan 4, 1am" or "Jan 4, 12:59pm"
@@ -393,6 +828,9 @@ func parseAbsoluteTime(text string) (*time.Time, *int64) {
 		// since missing minutes should default to 0
 		min, _ := strconv.Atoi(matches[4])
 		ampm := strings.ToLower(matches[5])
+		if !validClock12(hour, min) || (!validDay(now.Year(), month, day) && !validDay(now.Year()+1, month, day)) {
+			return nil, nil, ""
+		}
 
 		// Convert to 24-hour format
 		if ampm == "pm" && hour != 12 {
@@ -402,8 +840,6 @@ func parseAbsoluteTime(text string) (*time.Time, *int64) {
 		}
 
 		// Assume current year first
-		// Note: time.Date normalizes invalid dates (e.g., Feb 30 → Mar 2).
-		// We rely on Claude CLI producing valid dates; no explicit validation added.
 		year := now.Year()
 		resetTime := time.Date(year, month, day, hour, min, 0, 0, loc)
 
@@ -414,9 +850,9 @@ func parseAbsoluteTime(text string) (*time.Time, *int64) {
 
 		duration := int64(resetTime.Sub(now).Seconds())
 		if duration > 0 {
-			return &resetTime, &duration
+			return &resetTime, &duration, "date_no_year"
 		}
-		return &resetTime, nil
+		return &resetTime, nil, "date_no_year"
 	}
 
 	// Try time-only pattern: "5:59am" or "6am"
@@ -424,6 +860,9 @@ func parseAbsoluteTime(text string) (*time.Time, *int64) {
 		hour, _ := strconv.Atoi(matches[1])
 		min, _ := strconv.Atoi(matches[2]) // Will be 0 if minutes not specified
 		ampm := strings.ToLower(matches[3])
+		if !validClock12(hour, min) {
+			return nil, nil, ""
+		}
 
 		// Convert to 24-hour format
 		if ampm == "pm" && hour != 12 {
@@ -436,18 +875,175 @@ func parseAbsoluteTime(text string) (*time.Time, *int64) {
 		resetTime := time.Date(now.Year(), now.Month(), now.Day(), hour, min, 0, 0, loc)
 
 		// If the time has already passed today, it means tomorrow
-		if resetTime.Before(now) {
+		if rollover && resetTime.Before(now) {
+			resetTime = resetTime.Add(24 * time.Hour)
+		}
+
+		duration := int64(resetTime.Sub(now).Seconds())
+		if duration > 0 {
+			return &resetTime, &duration, "time_only"
+		}
+		return &resetTime, nil, "time_only"
+	}
+
+	// Try 24-hour time-only: "18:59". am/pm times matched above; a line with
+	// a date is left to the date-only pattern as before.
+	if matches := clock24Pattern.FindStringSubmatch(text); len(matches) > 2 && !dateOnlyPattern.MatchString(text) {
+		hour, _ := strconv.Atoi(matches[1])
+		min, _ := strconv.Atoi(matches[2])
+
+		resetTime := time.Date(now.Year(), now.Month(), now.Day(), hour, min, 0, 0, loc)
+		if rollover && resetTime.Before(now) {
 			resetTime = resetTime.Add(24 * time.Hour)
 		}
 
 		duration := int64(resetTime.Sub(now).Seconds())
 		if duration > 0 {
-			return &resetTime, &duration
+			return &resetTime, &duration, "clock_24"
+		}
+		return &resetTime, nil, "clock_24"
+	}
+
+	// Try date-only pattern: "Monday, Jan 6" or "Jan 6" (assume midnight)
+	if matches := dateOnlyPattern.FindStringSubmatch(text); len(matches) > 3 {
+		month := monthMap[strings.ToLower(matches[1])]
+		day, _ := strconv.Atoi(matches[2])
+		if !validDay(now.Year(), month, day) && !validDay(now.Year()+1, month, day) {
+			return nil, nil, ""
+		}
+
+		var resetTime time.Time
+		if matches[3] != "" {
+			year, _ := strconv.Atoi(matches[3])
+			if !validDay(year, month, day) {
+				return nil, nil, ""
+			}
+			resetTime = time.Date(year, month, day, 0, 0, 0, 0, loc)
+		} else {
+			// Without a year, a date in the past means next year
+			resetTime = time.Date(now.Year(), month, day, 0, 0, 0, 0, loc)
+			if resetTime.Before(now) {
+				resetTime = time.Date(now.Year()+1, month, day, 0, 0, 0, 0, loc)
+			}
+		}
+
+		duration := int64(resetTime.Sub(now).Seconds())
+		if duration > 0 {
+			return &resetTime, &duration, "date_only"
+		}
+		return &resetTime, nil, "date_only"
+	}
+
+	return nil, nil, ""
+}
+
+// validClock12 reports whether hour and min form a 12-hour clock time. The
+// patterns accept any one or two digits, and time.Date would silently roll
+// "13pm" or "5:75am" into another time.
+func validClock12(hour, min int) bool {
+	return hour >= 1 && hour <= 12 && min < 60
+}
+
+// validDay reports whether day exists in month of year, which time.Date
+// would otherwise normalize (Feb 30 -> Mar 2)
+func validDay(year int, month time.Month, day int) bool {
+	return day >= 1 && day <= time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// parseUTCOffset returns a fixed zone for an explicit UTC offset in a reset
+// line ("UTC+2", "(+02:00)", "-0500"), or nil if there is none. Offsets
+// beyond ±14:00 are rejected.
+func parseUTCOffset(text string) *time.Location {
+	matches := utcNamedOffsetPattern.FindStringSubmatch(text)
+	if matches == nil {
+		matches = utcBareOffsetPattern.FindStringSubmatch(text)
+	}
+	if matches == nil {
+		return nil
+	}
+	hours, _ := strconv.Atoi(matches[2])
+	minutes, _ := strconv.Atoi(matches[3])
+	if hours > 14 || minutes >= 60 || (hours == 14 && minutes > 0) {
+		return nil
+	}
+	seconds := hours*3600 + minutes*60
+	if matches[1] == "-" {
+		seconds = -seconds
+	}
+	return time.FixedZone(fmt.Sprintf("UTC%s%02d:%02d", matches[1], hours, minutes), seconds)
+}
+
+// parseRelativeReset sums the day/hour/minute components of a reset line
+// ("Resets in 2d 3h"), returning 0 if there are none or one does not parse
+// (an overflowing number), so the line is reported as unparsed rather than
+// read with that component dropped
+func parseRelativeReset(text string) int64 {
+	var totalSeconds int64
+	for _, component := range []struct {
+		pattern *regexp.Regexp
+		seconds int64
+	}{
+		{daysPattern, 24 * 60 * 60},
+		{hoursPattern, 60 * 60},
+		{minutesPattern, 60},
+	} {
+		matches := component.pattern.FindStringSubmatch(text)
+		if len(matches) < 2 {
+			continue
+		}
+		n, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil || n > math.MaxInt64/component.seconds {
+			return 0
 		}
-		return &resetTime, nil
+		totalSeconds += n * component.seconds
+	}
+	return totalSeconds
+}
+
+// clockSkewTolerance is how far an absolute reset time may disagree with a
+// relative one on the same line before the host clock is considered wrong
+const clockSkewTolerance = 10 * time.Minute
+
+// resetClockSkew cross-checks a reset line that gives both an absolute time
+// and a relative duration ("Resets 6pm (Europe/Berlin) (in 3h 20m)"). The
+// time remaining until the absolute time is measured with the host clock, so
+// a disagreement means the clock is off or one of the two was misread.
+// Returns the absolute duration in seconds and whether it disagrees with the
+// relative one by more than clockSkewTolerance.
+func resetClockSkew(text string) (int64, bool) {
+	relSeconds := parseRelativeReset(text)
+	if relSeconds == 0 {
+		return 0, false
+	}
+	// A bare date is not compared: the relative duration is used instead
+	_, absSeconds, variant := parseAbsoluteTimeRollover(text, true)
+	if absSeconds == nil || variant == "date_only" {
+		return 0, false
 	}
+	diff := time.Duration(*absSeconds-relSeconds) * time.Second
+	if diff < 0 {
+		diff = -diff
+	}
+	return *absSeconds, diff > clockSkewTolerance
+}
+
+// normalizeNamedTimes rewrites "midnight" and "noon" as 12am and 12pm so the
+// numeric patterns (and their rollover logic) handle them
+func normalizeNamedTimes(text string) string {
+	return namedTimePattern.ReplaceAllStringFunc(text, func(name string) string {
+		if strings.EqualFold(name, "noon") {
+			return "12pm"
+		}
+		return "12am"
+	})
+}
 
-	return nil, nil
+// isDateOnlyReset reports whether a reset line gives a date but neither a
+// clock time nor a relative duration, in which case parseAbsoluteTime
+// assumed midnight
+func isDateOnlyReset(text string) bool {
+	text = normalizeNamedTimes(text)
+	return dateOnlyPattern.MatchString(text) && !timeOnlyPattern.MatchString(text) && parseRelativeReset(text) == 0
 }
 
 // quotaSectionMarkers are keywords that indicate the start of a new quota section.
@@ -459,6 +1055,30 @@ var quotaSectionMarkers = []string{
 	"sonnet usage",
 }
 
+// resetKeywords are lowercase phrases that mark a line as carrying a quota's
+// reset time. Besides "Resets ..." some outputs phrase it as availability,
+// e.g. "Available again in 2h"; "again in 45m" and "back in 1h" are matched
+// by availableInPattern. Never modified: extra phrases travel in
+// QueryOptions.ResetKeywords.
+var resetKeywords = []string{
+	"reset",
+	"renew",
+	"available again",
+	"unlocks in",
+}
+
+// splitResetKeywords parses a comma-separated --reset-keywords value into
+// lowercase phrases
+func splitResetKeywords(list string) []string {
+	var keywords []string
+	for _, keyword := range strings.Split(list, ",") {
+		if keyword = strings.ToLower(strings.TrimSpace(keyword)); keyword != "" {
+			keywords = append(keywords, keyword)
+		}
+	}
+	return keywords
+}
+
 // isQuotaSectionMarker checks if a lowercased line contains a quota section marker.
 // The input should already be lowercase for efficiency.
 func isQuotaSectionMarker(lineLower string) bool {
@@ -471,12 +1091,18 @@ func isQuotaSectionMarker(lineLower string) bool {
 }
 
 // looksLikeResetLine checks if a line appears to be a reset time line.
-// Handles both normal "reset"/"renew" keywords and garbled text from
-// cursor movement artifacts (e.g., "rese s" instead of "resets").
+// Handles both the resetKeywords phrases, plus any extra ones, and garbled
+// text from cursor movement artifacts (e.g., "rese s" instead of "resets").
 // The input should already be lowercase for efficiency.
-func looksLikeResetLine(lineLower string) bool {
-	// Standard keywords
-	if strings.Contains(lineLower, "reset") || strings.Contains(lineLower, "renew") {
+func looksLikeResetLine(lineLower string, extra []string) bool {
+	for _, keywords := range [][]string{resetKeywords, extra} {
+		for _, keyword := range keywords {
+			if strings.Contains(lineLower, keyword) {
+				return true
+			}
+		}
+	}
+	if availableInPattern.MatchString(lineLower) {
 		return true
 	}
 	// Garbled patterns from cursor movement artifacts in Claude CLI v2.1.17+
@@ -490,59 +1116,219 @@ func looksLikeResetLine(lineLower string) bool {
 	return false
 }
 
-func parseResetTime(lines []string, startIdx int) (string, *time.Time, *int64) {
+// parseEpochReset converts a resetsAt/resets_at epoch to a reset time.
+// Values of 1e12 and above are taken as milliseconds, smaller ones as
+// seconds (1e12 ms is 2001, 1e12 s is tens of millennia away).
+func parseEpochReset(text string) (*time.Time, bool) {
+	matches := epochResetPattern.FindStringSubmatch(text)
+	if matches == nil {
+		return nil, false
+	}
+	epoch, err := strconv.ParseInt(matches[1], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	var resetTime time.Time
+	if epoch >= 1e12 {
+		resetTime = time.UnixMilli(epoch)
+	} else {
+		resetTime = time.Unix(epoch, 0)
+	}
+	return &resetTime, true
+}
+
+// parseResetTime finds and parses the reset line for the percentage line at
+// startIdx, whose quota heading is at headingIdx; rollover is passed on to
+// parseAbsoluteTimeRollover and resetKeywords (extra reset phrases, may be
+// nil) to looksLikeResetLine
+func parseResetTime(lines []string, headingIdx, startIdx int, rollover bool, resetKeywords []string, explain *parseExplainer) (string, *time.Time, *int64) {
+	i := nearestResetLine(lines, headingIdx, startIdx, resetKeywords, explain)
+	if i < 0 {
+		return "", nil, nil
+	}
+
+	// Debug builds may give the reset as an epoch, which needs no guessing
+	if resetTime, ok := parseEpochReset(lines[i]); ok {
+		explain.printf("reset: line %d %q -> epoch %s", i+1, strings.TrimSpace(lines[i]), resetTime.Format(time.RFC3339))
+		explain.reset(i+1, "epoch")
+		duration := int64(time.Until(*resetTime).Seconds())
+		if duration > 0 {
+			return lines[i], resetTime, &duration
+		}
+		return lines[i], resetTime, nil
+	}
+
+	// A line may give both an absolute time and a relative duration
+	// ("Resets 6pm (Europe/Berlin) (in 3h 20m)"). An absolute time of day
+	// names a fixed instant, so it wins; the relative one, which drifts with
+	// capture time, is the fallback. parseWarnings flags the two disagreeing.
+	// A bare date ("Resets Oct 18 (in 2d 2h)") only gives midnight, so there
+	// the relative duration is more precise.
+	totalSeconds := parseRelativeReset(lines[i])
+	resetTime, duration, variant := parseAbsoluteTimeRollover(lines[i], rollover)
+	if resetTime != nil && variant == "date_only" && totalSeconds > 0 {
+		explain.printf("reset: line %d date without a time of day; using relative", i+1)
+	} else if resetTime != nil {
+		explain.printf("reset: line %d %q -> absolute %s", i+1, strings.TrimSpace(lines[i]), resetTime.Format(time.RFC3339))
+		explain.reset(i+1, variant)
+		if _, skewed := resetClockSkew(lines[i]); skewed {
+			explain.printf("reset: line %d relative %s disagrees with absolute; using absolute", i+1, formatDuration(totalSeconds))
+		}
+		return lines[i], resetTime, duration
+	}
+
+	if totalSeconds > 0 {
+		resetTime := time.Now().Add(time.Duration(totalSeconds) * time.Second)
+		explain.printf("reset: line %d %q -> relative %s", i+1, strings.TrimSpace(lines[i]), formatDuration(totalSeconds))
+		explain.reset(i+1, "relative")
+		return lines[i], &resetTime, &totalSeconds
+	}
+
+	explain.printf("reset: line %d %q -> unparsed", i+1, strings.TrimSpace(lines[i]))
+	explain.reset(i+1, "unparsed")
+	return lines[i], nil, nil
+}
+
+// resetLookbehind is how many lines above the percentage line may still
+// hold its reset text (e.g. "Current week · resets Monday" headings)
+const resetLookbehind = 4
+
+// nearestResetLine returns the index of the reset line closest to the
+// percentage line at startIdx, or -1. Some blocks list several resets for
+// different metrics, so the first match in the window is not necessarily
+// the one belonging to this quota. The search never crosses into another
+// quota section, nor looks back past the heading at headingIdx; on a tie the
+// line below wins.
+func nearestResetLine(lines []string, headingIdx, startIdx int, resetKeywords []string, explain *parseExplainer) int {
 	// Look within next 14 lines for reset information, but stop if we hit another quota section
 	endIdx := startIdx + 14
 	if endIdx > len(lines) {
 		endIdx = len(lines)
 	}
 
+	below := -1
 	for i := startIdx; i < endIdx; i++ {
 		line := strings.ToLower(lines[i])
 
 		// Stop searching if we encounter another quota section marker (but not on the start line)
 		if i > startIdx && isQuotaSectionMarker(line) {
+			explain.printf("reset: stopped at line %d %q (next quota section)", i+1, strings.TrimSpace(lines[i]))
+			break
+		}
+		if looksLikeResetLine(line, resetKeywords) {
+			below = i
 			break
 		}
+	}
 
-		if looksLikeResetLine(line) {
-			// First try parsing relative duration components
-			var totalSeconds int64
+	// Look back up to our own heading; anything above it belongs to the previous quota
+	above := -1
+	for i := startIdx - 1; i >= headingIdx && i >= startIdx-resetLookbehind; i-- {
+		line := strings.ToLower(lines[i])
+		if looksLikeResetLine(line, resetKeywords) {
+			above = i
+			break
+		}
+		if isQuotaSectionMarker(line) {
+			break
+		}
+	}
 
-			if matches := daysPattern.FindStringSubmatch(lines[i]); len(matches) > 1 {
-				days, _ := strconv.ParseInt(matches[1], 10, 64)
-				totalSeconds += days * 24 * 60 * 60
-			}
-			if matches := hoursPattern.FindStringSubmatch(lines[i]); len(matches) > 1 {
-				hours, _ := strconv.ParseInt(matches[1], 10, 64)
-				totalSeconds += hours * 60 * 60
-			}
-			if matches := minutesPattern.FindStringSubmatch(lines[i]); len(matches) > 1 {
-				mins, _ := strconv.ParseInt(matches[1], 10, 64)
-				totalSeconds += mins * 60
-			}
+	switch {
+	case above < 0:
+		return below
+	case below < 0 || startIdx-above < below-startIdx:
+		if below >= 0 {
+			explain.printf("reset: line %d is closer than line %d", above+1, below+1)
+		}
+		return above
+	default:
+		return below
+	}
+}
 
-			if totalSeconds > 0 {
-				resetTime := time.Now().Add(time.Duration(totalSeconds) * time.Second)
-				return lines[i], &resetTime, &totalSeconds
-			}
+// DurationStyle selects how human-readable durations are rendered
+type DurationStyle string
 
-			// Fallback: try absolute time parsing
-			resetTime, duration := parseAbsoluteTime(lines[i])
-			if resetTime != nil {
-				return lines[i], resetTime, duration
-			}
+const (
+	DurationStyleShort   DurationStyle = "short"   // 2d 3h 4m
+	DurationStyleLong    DurationStyle = "long"    // 2 days, 3 hours, 4 minutes
+	DurationStyleMinutes DurationStyle = "minutes" // 3064m
+	DurationStyleCoarse  DurationStyle = "coarse"  // 2d
+)
 
-			return lines[i], nil, nil
-		}
+// parseDurationStyle validates a --duration-style value
+func parseDurationStyle(value string) (DurationStyle, error) {
+	switch style := DurationStyle(value); style {
+	case DurationStyleShort, DurationStyleLong, DurationStyleMinutes, DurationStyleCoarse:
+		return style, nil
 	}
-	return "", nil, nil
+	return "", fmt.Errorf("invalid duration style %q: expected short, long, minutes or coarse", value)
 }
 
 // formatDuration converts seconds to a human-readable duration string
 func formatDuration(seconds int64) string {
+	return formatDurationStyle(seconds, DurationStyleShort)
+}
+
+// coarseDuration renders only the most significant unit of seconds,
+// truncated: "3d", "2h", "14m"
+func coarseDuration(seconds int64) string {
+	switch {
+	case seconds >= 24*60*60:
+		return fmt.Sprintf("%dd", seconds/(24*60*60))
+	case seconds >= 60*60:
+		return fmt.Sprintf("%dh", seconds/(60*60))
+	case seconds > 0:
+		return fmt.Sprintf("%dm", seconds/60)
+	}
+	return "0m"
+}
+
+// formatISODuration renders seconds as an ISO 8601 duration ("P1DT3H",
+// "PT2H14M", "PT45S"), with days as a date component
+func formatISODuration(seconds int64) string {
 	if seconds <= 0 {
-		return "0m"
+		return "PT0S"
+	}
+	days := seconds / (24 * 60 * 60)
+	seconds %= 24 * 60 * 60
+	hours := seconds / (60 * 60)
+	seconds %= 60 * 60
+	minutes := seconds / 60
+	seconds %= 60
+
+	var b strings.Builder
+	b.WriteString("P")
+	if days > 0 {
+		fmt.Fprintf(&b, "%dD", days)
+	}
+	if hours > 0 || minutes > 0 || seconds > 0 {
+		b.WriteString("T")
+	}
+	if hours > 0 {
+		fmt.Fprintf(&b, "%dH", hours)
+	}
+	if minutes > 0 {
+		fmt.Fprintf(&b, "%dM", minutes)
+	}
+	if seconds > 0 {
+		fmt.Fprintf(&b, "%dS", seconds)
+	}
+	return b.String()
+}
+
+// formatDurationStyle renders seconds in the given style ("" = short)
+func formatDurationStyle(seconds int64, style DurationStyle) string {
+	if seconds < 0 {
+		seconds = 0
+	}
+
+	if style == DurationStyleMinutes {
+		return fmt.Sprintf("%dm", seconds/60)
+	}
+	if style == DurationStyleCoarse {
+		return coarseDuration(seconds)
 	}
 
 	days := seconds / (24 * 60 * 60)
@@ -551,6 +1337,26 @@ func formatDuration(seconds int64) string {
 	seconds %= 60 * 60
 	minutes := seconds / 60
 
+	if style == DurationStyleLong {
+		plural := func(n int64, unit string) string {
+			if n == 1 {
+				return fmt.Sprintf("1 %s", unit)
+			}
+			return fmt.Sprintf("%d %ss", n, unit)
+		}
+		var parts []string
+		if days > 0 {
+			parts = append(parts, plural(days, "day"))
+		}
+		if hours > 0 {
+			parts = append(parts, plural(hours, "hour"))
+		}
+		if minutes > 0 || len(parts) == 0 {
+			parts = append(parts, plural(minutes, "minute"))
+		}
+		return strings.Join(parts, ", ")
+	}
+
 	var parts []string
 	if days > 0 {
 		parts = append(parts, fmt.Sprintf("%dd", days))
@@ -565,23 +1371,140 @@ func formatDuration(seconds int64) string {
 	return strings.Join(parts, " ")
 }
 
-// recalculateTimeRemaining recalculates time remaining from a ResetsAt timestamp
-func recalculateTimeRemaining(resetsAt *string) string {
-	if resetsAt == nil {
-		return "unknown"
-	}
-	resetTime, err := time.Parse(time.RFC3339, *resetsAt)
-	if err != nil {
-		return "unknown"
-	}
-	seconds := int64(time.Until(resetTime).Seconds())
-	if seconds <= 0 {
-		return "0m"
+// ResetAs selects whether reset times are shown as a duration or a wall clock
+type ResetAs string
+
+const (
+	ResetAsDuration ResetAs = "duration" // 2h 30m
+	ResetAsClock    ResetAs = "clock"    // 18:59 (local time)
+)
+
+// parseResetAs validates a --reset-as value
+func parseResetAs(value string) (ResetAs, error) {
+	switch resetAs := ResetAs(value); resetAs {
+	case ResetAsDuration, ResetAsClock:
+		return resetAs, nil
 	}
-	return formatDuration(seconds)
+	return "", fmt.Errorf("invalid reset display %q: expected duration or clock", value)
 }
 
-// calculateNextResetRefresh finds the earliest quota reset time and returns
+// quotaResetTime returns when a quota resets: its ResetsAt, or, if only a
+// duration was stored, CapturedAt plus that duration
+func quotaResetTime(q *Quota, capturedAt string) (time.Time, bool) {
+	if q.ResetsAt != nil {
+		if resetTime, err := time.Parse(time.RFC3339, *q.ResetsAt); err == nil {
+			return resetTime, true
+		}
+	}
+	if q.TimeRemainingSeconds != nil {
+		if captured, err := time.Parse(time.RFC3339, capturedAt); err == nil {
+			return captured.Add(time.Duration(*q.TimeRemainingSeconds) * time.Second), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// formatResetClock renders a reset time in loc (nil = local time) with the
+// Go time layout (see parseTimeLayout). The default ("") is "18:59" within
+// the next day, "Mon 18:59" further out.
+func formatResetClock(resetTime, now time.Time, loc *time.Location, layout string) string {
+	if loc == nil {
+		loc = time.Local
+	}
+	local := resetTime.In(loc)
+	if layout != "" {
+		return local.Format(layout)
+	}
+	if resetTime.Sub(now) >= 24*time.Hour {
+		return local.Format("Mon 15:04")
+	}
+	return local.Format("15:04")
+}
+
+// formatQuotaReset renders when a quota resets as of now, recomputed from the
+// snapshot so stale files stay accurate: a duration in style, or a wall clock
+// in loc (nil = local time) and layout ("" = default)
+func formatQuotaReset(q *Quota, capturedAt string, resetAs ResetAs, style DurationStyle, loc *time.Location, layout string, now time.Time) string {
+	resetTime, ok := quotaResetTime(q, capturedAt)
+	if !ok {
+		return "unknown"
+	}
+	if resetAs == ResetAsClock {
+		return formatResetClock(resetTime, now, loc, layout)
+	}
+	return formatDurationStyle(int64(resetTime.Sub(now).Seconds()), style)
+}
+
+// timeLayoutCheckTimes are two instants differing in every layout field, used
+// to tell a --time-layout that renders the time from one that never does
+var timeLayoutCheckTimes = [2]time.Time{
+	time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC),
+	time.Date(2017, time.November, 28, 9, 51, 36, 0, time.FixedZone("X", 3600)),
+}
+
+// parseTimeLayout validates a --time-layout Go time layout such as
+// "15:04 MST" or time.RFC1123. Any string is a valid Go layout, so one that
+// renders empty or contains no time element is rejected with a warning and
+// the default clock format ("") is used instead.
+func parseTimeLayout(layout string) (string, string) {
+	if layout == "" {
+		return "", ""
+	}
+	first := timeLayoutCheckTimes[0].Format(layout)
+	if strings.TrimSpace(first) == "" {
+		return "", fmt.Sprintf("--time-layout %q renders an empty time, using the default", layout)
+	}
+	if first == timeLayoutCheckTimes[1].Format(layout) {
+		return "", fmt.Sprintf("--time-layout %q contains no time elements (e.g. 15:04), using the default", layout)
+	}
+	return layout, ""
+}
+
+// parseDisplayTZ loads a --display-tz zone name; "" means local time (nil)
+func parseDisplayTZ(name string) (*time.Location, error) {
+	if name == "" {
+		return nil, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid display timezone %q: %w", name, err)
+	}
+	return loc, nil
+}
+
+// applyDisplayTZ re-renders the snapshot's RFC3339 reset times in loc, so
+// every consumer sees one zone whatever the host's. The instants are unchanged.
+func applyDisplayTZ(snapshot *UsageSnapshot, loc *time.Location) {
+	if loc == nil {
+		return
+	}
+	convert := func(ts *string) {
+		if ts == nil {
+			return
+		}
+		if t, err := time.Parse(time.RFC3339, *ts); err == nil {
+			*ts = t.In(loc).Format(time.RFC3339)
+		}
+	}
+	for i := range snapshot.Quotas {
+		convert(snapshot.Quotas[i].ResetsAt)
+	}
+	if snapshot.CostUsage != nil {
+		convert(snapshot.CostUsage.ResetsAt)
+	}
+	convert(snapshot.ValidUntil)
+}
+
+// applyDurationStyle re-renders each quota's TimeRemainingHuman in the given style
+func applyDurationStyle(snapshot *UsageSnapshot, style DurationStyle) {
+	for i := range snapshot.Quotas {
+		if q := &snapshot.Quotas[i]; q.TimeRemainingSeconds != nil {
+			q.TimeRemainingHuman = formatDurationStyle(*q.TimeRemainingSeconds, style)
+		}
+	}
+}
+
+// calculateNextResetRefresh finds the earliest quota reset time and returns
 // a duration for when to schedule the next refresh (60 seconds after reset).
 // Returns nil if no valid reset times are found.
 func calculateNextResetRefresh(quotas []Quota) *time.Duration {
@@ -604,7 +1527,77 @@ func calculateNextResetRefresh(quotas []Quota) *time.Duration {
 	return &refreshDelay
 }
 
-func parseQuotas(text string) []Quota {
+// quotaLabels maps lowercased quota headings to the quota they introduce
+var quotaLabels = map[string]struct {
+	qType QuotaType
+	model string
+}{
+	"current session":            {QuotaTypeSession, ""},
+	"current week (all models)":  {QuotaTypeWeekly, ""},
+	"current week (opus)":        {QuotaTypeModelSpecific, "opus"},
+	"current week (sonnet)":      {QuotaTypeModelSpecific, "sonnet"},
+	"current week (opus only)":   {QuotaTypeModelSpecific, "opus"},   // v2.1.x format
+	"current week (sonnet only)": {QuotaTypeModelSpecific, "sonnet"}, // v2.1.x format
+	"opus usage":                 {QuotaTypeModelSpecific, "opus"},
+	"sonnet usage":               {QuotaTypeModelSpecific, "sonnet"},
+}
+
+// quotaHeadingLabel returns the quota label a line is a heading for, or ""
+// if the line only mentions one in passing. A heading starts with the label
+// (inside the box border) and has no further words directly after it:
+// "Current session", "Opus usage · Mon" or "Current session ███"
+// are headings, "Tip: your current session resets soon" and "Current session
+// limits apply" are not.
+func quotaHeadingLabel(line string) string {
+	trimmed := strings.ToLower(strings.TrimSpace(strings.Trim(line, "│ \t")))
+	for label := range quotaLabels {
+		rest, ok := strings.CutPrefix(trimmed, label)
+		if !ok {
+			continue
+		}
+		if next, _ := utf8.DecodeRuneInString(strings.TrimSpace(rest)); !unicode.IsLetter(next) {
+			return label
+		}
+	}
+	return ""
+}
+
+// findTruncatedQuotaLabels returns the quota headings that have no percentage
+// within the window parseQuotas searches. This happens when the claude process
+// is killed mid-render and the output is cut off after a heading. Labels
+// mentioned in prose (tips, banners) are not headings and never count.
+func findTruncatedQuotaLabels(text string) []string {
+	normalized := strings.ReplaceAll(text, "\r\n", "\n")
+	normalized = strings.ReplaceAll(normalized, "\r", "\n")
+	lines := strings.Split(normalized, "\n")
+	var truncated []string
+
+	for i, line := range lines {
+		if quotaHeadingLabel(line) == "" {
+			continue
+		}
+		searchEnd := i + 5
+		if searchEnd > len(lines) {
+			searchEnd = len(lines)
+		}
+
+		// A corrupt percentage is reported by parseWarnings, not as truncation
+		found := false
+		for j := i; j < searchEnd; j++ {
+			if _, ok := parsePercentage(lines[j]); ok || malformedPercentage(lines[j]) != "" {
+				found = true
+				break
+			}
+		}
+		if !found {
+			truncated = append(truncated, strings.TrimSpace(strings.Trim(line, "│ \t")))
+		}
+	}
+
+	return truncated
+}
+
+func parseQuotas(text string, resetKeywords []string, explain *parseExplainer) []Quota {
 	// Normalize line endings: \r\n -> \n, then \r -> \n
 	// Claude CLI v2.1.11 uses \r for some line separators within quota sections
 	normalized := strings.ReplaceAll(text, "\r\n", "\n")
@@ -612,25 +1605,13 @@ func parseQuotas(text string) []Quota {
 	lines := strings.Split(normalized, "\n")
 	var quotas []Quota
 
-	quotaLabels := map[string]struct {
-		qType QuotaType
-		model string
-	}{
-		"current session":            {QuotaTypeSession, ""},
-		"current week (all models)":  {QuotaTypeWeekly, ""},
-		"current week (opus)":        {QuotaTypeModelSpecific, "opus"},
-		"current week (sonnet)":      {QuotaTypeModelSpecific, "sonnet"},
-		"current week (opus only)":   {QuotaTypeModelSpecific, "opus"},   // v2.1.x format
-		"current week (sonnet only)": {QuotaTypeModelSpecific, "sonnet"}, // v2.1.x format
-		"opus usage":                 {QuotaTypeModelSpecific, "opus"},
-		"sonnet usage":               {QuotaTypeModelSpecific, "sonnet"},
-	}
-
 	for i, line := range lines {
 		lineLower := strings.ToLower(line)
 
 		for label, info := range quotaLabels {
 			if strings.Contains(lineLower, label) {
+				explain.printf("quota: line %d %q matched label %q", i+1, strings.TrimSpace(line), label)
+
 				// Look for percentage in this line and next few lines
 				searchEnd := i + 5
 				if searchEnd > len(lines) {
@@ -638,16 +1619,35 @@ func parseQuotas(text string) []Quota {
 				}
 
 				for j := i; j < searchEnd; j++ {
+					// Don't read past a corrupt percentage into the next quota's
+					if bad := malformedPercentage(lines[j]); bad != "" {
+						explain.printf("quota: line %d %q -> malformed percentage, skipping quota", j+1, strings.TrimSpace(lines[j]))
+						break
+					}
 					if percent, ok := parsePercentage(lines[j]); ok {
-						resetText, resetTime, durationSeconds := parseResetTime(lines, j)
+						explain.printf("quota: line %d %q -> %g%% remaining", j+1, strings.TrimSpace(lines[j]), percent)
+						resetText, resetTime, durationSeconds := parseResetTime(lines, i, j, rollsOverDaily(info.qType), resetKeywords, explain)
 
 						quota := Quota{
 							Type:             info.qType,
 							Model:            info.model,
+							Label:            strings.TrimSpace(strings.Trim(line, "│ \t")),
 							PercentRemaining: percent,
 							ResetText:        strings.TrimSpace(resetText),
 						}
 
+						// Compact views give model-specific quotas just a weekday
+						if resetText == "" && info.qType == QuotaTypeModelSpecific {
+							if hint, k, weekday := findWeekdayResetHint(lines, i, j); hint != "" {
+								resetAt := nextWeekdayMidnight(time.Now(), weekday)
+								seconds := int64(time.Until(resetAt).Seconds())
+								explain.printf("reset: line %d %q -> weekday hint, assuming %s", k+1, hint, resetAt.Format(time.RFC3339))
+								explain.reset(k+1, "weekday_hint")
+								quota.ResetText = hint
+								resetTime, durationSeconds = &resetAt, &seconds
+							}
+						}
+
 						if resetTime != nil {
 							ts := resetTime.Format(time.RFC3339)
 							quota.ResetsAt = &ts
@@ -656,8 +1656,15 @@ func parseQuotas(text string) []Quota {
 						if durationSeconds != nil {
 							quota.TimeRemainingSeconds = durationSeconds
 							quota.TimeRemainingHuman = formatDuration(*durationSeconds)
+							quota.TimeRemainingISO = formatISODuration(*durationSeconds)
+						}
+
+						if limitText, k := findLimitText(lines, i); limitText != "" {
+							explain.printf("quota: line %d %q -> limit text", k+1, limitText)
+							quota.LimitText = limitText
 						}
 
+						explain.quota(quota.Label, i+1, j+1)
 						quotas = append(quotas, quota)
 						break
 					}
@@ -670,6 +1677,187 @@ func parseQuotas(text string) []Quota {
 	return quotas
 }
 
+// lineBreakPattern matches the line separators parseQuotas splits on
+var lineBreakPattern = regexp.MustCompile(`\r\n|\r|\n`)
+
+// dewrapQuotaHeadings joins quota headings that a narrow terminal wrapped onto
+// two lines ("Current week (all" / "models)") so label matching sees them
+// whole. Everything else, including the line separators, is left untouched.
+func dewrapQuotaHeadings(text string, explain *parseExplainer) string {
+	lines := lineBreakPattern.Split(text, -1)
+	separators := lineBreakPattern.FindAllString(text, -1)
+	var b strings.Builder
+	for i := 0; i < len(lines); i++ {
+		if joined, ok := unwrapQuotaHeading(lines, i); ok {
+			explain.printf("quota: joined wrapped heading %q", joined)
+			b.WriteString(joined)
+			i++
+		} else {
+			b.WriteString(lines[i])
+		}
+		if i < len(separators) {
+			b.WriteString(separators[i])
+		}
+	}
+	return b.String()
+}
+
+// isBoxed reports whether a line sits inside the usage box border
+func isBoxed(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), "│")
+}
+
+// quotaTypeEntry describes one heading the parser recognizes (types command)
+type quotaTypeEntry struct {
+	Label string    `json:"label"`
+	Type  QuotaType `json:"type"`
+	Model string    `json:"model,omitempty"`
+}
+
+// supportedQuotaTypes lists quotaLabels sorted by label, so the types
+// command always matches what parseQuotas can emit
+func supportedQuotaTypes() []quotaTypeEntry {
+	entries := make([]quotaTypeEntry, 0, len(quotaLabels))
+	for label, info := range quotaLabels {
+		entries = append(entries, quotaTypeEntry{Label: label, Type: info.qType, Model: info.model})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Label < entries[j].Label
+	})
+	return entries
+}
+
+// unwrapQuotaHeading joins line i with the next line when a quota label only
+// appears across the two, as when a narrow terminal wraps "Current week (all
+// models)". To avoid merging unrelated lines, the label must start on line i
+// and end on the next one, and both lines must be framed alike (both inside
+// the box border or both outside). Returns the joined heading with box
+// characters stripped.
+func unwrapQuotaHeading(lines []string, i int) (string, bool) {
+	if i+1 >= len(lines) || isBoxed(lines[i]) != isBoxed(lines[i+1]) {
+		return "", false
+	}
+	first := strings.TrimSpace(strings.Trim(lines[i], "│ \t"))
+	second := strings.TrimSpace(strings.Trim(lines[i+1], "│ \t"))
+	if first == "" || second == "" {
+		return "", false
+	}
+	firstLower := strings.ToLower(first)
+	joined := first + " " + second
+	joinedLower := strings.ToLower(joined)
+	for label := range quotaLabels {
+		if strings.Contains(firstLower, label) {
+			return "", false
+		}
+	}
+	for label := range quotaLabels {
+		if idx := strings.Index(joinedLower, label); idx >= 0 && idx < len(first) && idx+len(label) > len(first) {
+			return joined, true
+		}
+	}
+	return "", false
+}
+
+// findWeekdayResetHint looks for a line carrying nothing but a weekday hint
+// ("Opus · Mon") between a quota's heading at start and a few lines past its
+// percentage at pctLine. Lines with digits are left to parseResetTime. Returns
+// the trimmed line, its index and the weekday, or "" if there is none.
+func findWeekdayResetHint(lines []string, start, pctLine int) (string, int, time.Weekday) {
+	end := pctLine + 4
+	if end > len(lines) {
+		end = len(lines)
+	}
+	for k := start; k < end; k++ {
+		lineLower := strings.ToLower(lines[k])
+		if k > start && isQuotaSectionMarker(lineLower) {
+			break
+		}
+		if strings.ContainsAny(lines[k], "0123456789%") {
+			continue
+		}
+		if weekday, ok := parseWeekdayHint(lines[k]); ok {
+			return strings.TrimSpace(strings.Trim(lines[k], "│ \t")), k, weekday
+		}
+	}
+	return "", -1, time.Sunday
+}
+
+// parseWeekdayHint extracts a standalone weekday name ("Mon", "Monday")
+func parseWeekdayHint(text string) (time.Weekday, bool) {
+	matches := weekdayHintPattern.FindStringSubmatch(text)
+	if matches == nil {
+		return time.Sunday, false
+	}
+	weekdays := map[string]time.Weekday{
+		"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+		"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+	}
+	return weekdays[strings.ToLower(matches[1])], true
+}
+
+// isWeekdayResetHint reports whether a quota's reset text is a bare weekday
+// hint rather than a reset line, in which case midnight was assumed
+func isWeekdayResetHint(text string, resetKeywords []string) bool {
+	if looksLikeResetLine(strings.ToLower(text), resetKeywords) || strings.ContainsAny(text, "0123456789") {
+		return false
+	}
+	_, ok := parseWeekdayHint(text)
+	return ok
+}
+
+// nextWeekdayMidnight returns the next midnight that starts weekday, in
+// now's location. On that weekday itself midnight has passed, so it is a
+// week out.
+func nextWeekdayMidnight(now time.Time, weekday time.Weekday) time.Time {
+	days := (int(weekday) - int(now.Weekday()) + 7) % 7
+	if days == 0 {
+		days = 7
+	}
+	return time.Date(now.Year(), now.Month(), now.Day()+days, 0, 0, 0, 0, now.Location())
+}
+
+// findLimitText returns the plan limit description ("Max 5x: up to ~225
+// messages / 5h") in the quota section starting at the heading on line start,
+// with box characters stripped, and the line it was found on
+func findLimitText(lines []string, start int) (string, int) {
+	end := start + 6
+	if end > len(lines) {
+		end = len(lines)
+	}
+	for k := start; k < end; k++ {
+		lineLower := strings.ToLower(lines[k])
+		if k > start && isQuotaHeading(lineLower) {
+			break
+		}
+		if limitTextPattern.MatchString(lines[k]) {
+			return strings.TrimSpace(strings.Trim(lines[k], "│ \t")), k
+		}
+	}
+	return "", -1
+}
+
+// isQuotaHeading reports whether a lowercased line introduces a quota section
+func isQuotaHeading(lineLower string) bool {
+	for label := range quotaLabels {
+		if strings.Contains(lineLower, label) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePlanName returns the plan descriptor from the header as shown, tier
+// multiplier included ("Claude Max 20x"), for the plan detectAccountType
+// settled on. It returns "" if the header names no plan of that type.
+func parsePlanName(text string, accountType AccountType) string {
+	for _, matches := range planNamePattern.FindAllStringSubmatch(text, -1) {
+		if AccountType(strings.ToLower(matches[1])) == accountType {
+			return strings.Join(strings.Fields(matches[0]), " ")
+		}
+	}
+	return ""
+}
+
 func parseEmail(text string) string {
 	// Try header format first
 	if matches := emailHeaderPattern.FindStringSubmatch(text); len(matches) > 1 {
@@ -682,7 +1870,98 @@ func parseEmail(text string) string {
 	return ""
 }
 
+// splitAccountSwitcher handles output listing several accounts, one email
+// per line under an account list heading (accountListPattern), as shown
+// after switching accounts. It returns the entry marked active (same markers
+// as the org switcher) and text with the inactive entries removed, so the
+// email, plan and org parsers cannot latch onto an account that is not
+// logged in. Lines outside the list, such as the plan header, are kept, and
+// "…'s Organization" entries are not accounts. Without such a list it
+// returns "" and text.
+func splitAccountSwitcher(text string) (string, string) {
+	lines := strings.Split(strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\r", "\n"), "\n")
+	for heading, line := range lines {
+		if !accountListPattern.MatchString(line) {
+			continue
+		}
+
+		var entries []int
+		for i := heading + 1; i < len(lines) && i <= heading+20; i++ {
+			entry := strings.TrimSpace(strings.Trim(lines[i], "│ \t"))
+			if entry == "" {
+				break
+			}
+			if accountEmailPattern.MatchString(entry) && !strings.HasSuffix(strings.ToLower(entry), "'s organization") {
+				entries = append(entries, i)
+			}
+		}
+		if len(entries) < 2 {
+			continue
+		}
+
+		active := -1
+		var entry string
+		for _, i := range entries {
+			line := strings.TrimSpace(strings.Trim(lines[i], "│ \t"))
+			if matches := orgActiveSuffixPattern.FindStringSubmatch(line); len(matches) > 1 {
+				active, entry = i, matches[1]
+				break
+			}
+			if matches := orgActiveMarkerPattern.FindStringSubmatch(line); len(matches) > 1 {
+				active, entry = i, matches[1]
+				break
+			}
+		}
+		if active < 0 {
+			continue
+		}
+
+		inactive := map[int]bool{}
+		for _, i := range entries {
+			inactive[i] = i != active
+		}
+		kept := make([]string, 0, len(lines))
+		for i, line := range lines {
+			if !inactive[i] {
+				kept = append(kept, line)
+			}
+		}
+		return entry, strings.Join(kept, "\n")
+	}
+	return "", text
+}
+
+// parseActiveOrganization picks the entry marked active from an organization
+// switcher list (a heading mentioning "organizations" followed by one org per
+// line). Returns "" if there is no such list.
+func parseActiveOrganization(lines []string) string {
+	for i, line := range lines {
+		if !strings.Contains(strings.ToLower(line), "organizations") {
+			continue
+		}
+		for j := i + 1; j < len(lines) && j <= i+20; j++ {
+			entry := strings.TrimSpace(strings.Trim(lines[j], "│ \t"))
+			if entry == "" {
+				break
+			}
+			if matches := orgActiveSuffixPattern.FindStringSubmatch(entry); len(matches) > 1 {
+				return matches[1]
+			}
+			if matches := orgActiveMarkerPattern.FindStringSubmatch(entry); len(matches) > 1 {
+				return matches[1]
+			}
+		}
+	}
+	return ""
+}
+
 func parseOrganization(text string) string {
+	// Users in several orgs may get a switcher list; the active entry wins
+	switcherLines := strings.Split(strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\r", "\n"), "\n")
+	if org := parseActiveOrganization(switcherLines); org != "" {
+		return org
+	}
+
 	// Look for the pattern: "email@domain.com's\nOrganization" or "email@domain.com's Organization"
 	// The org name follows the email's possessive
 	// Normalize line endings for consistent parsing
@@ -731,7 +2010,32 @@ func parseOrganization(text string) string {
 	return ""
 }
 
-func parseCostUsage(text string) *CostUsage {
+// parseAmount parses a dollar amount with optional thousands separators
+// ("1,012.34") or a comma decimal separator ("7,50")
+func parseAmount(text string) (float64, error) {
+	return strconv.ParseFloat(strings.ReplaceAll(normalizeDecimalComma(text), ",", ""), 64)
+}
+
+// malformedCostAmount returns the first extra usage amount in text that
+// matches a cost pattern but does not parse ("$,/$50 spent"), or ""
+func malformedCostAmount(text string) string {
+	for _, line := range strings.Split(text, "\n") {
+		for _, pattern := range []*regexp.Regexp{costPattern, spentOnlyPattern} {
+			matches := pattern.FindStringSubmatch(line)
+			if matches == nil {
+				continue
+			}
+			for _, amount := range matches[1:] {
+				if _, err := parseAmount(amount); err != nil {
+					return strings.TrimSpace(matches[0])
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func parseCostUsage(text string, explain *parseExplainer) *CostUsage {
 	textLower := strings.ToLower(text)
 
 	// Check if extra usage is mentioned
@@ -756,27 +2060,29 @@ func parseCostUsage(text string) *CostUsage {
 			if endIdx > len(lines) {
 				endIdx = len(lines)
 			}
+			entries, primary := parseCostEntries(lines, i, endIdx, explain)
 
+			// Check for unlimited, keeping any spend shown anywhere in the section
 			for j := i; j < endIdx; j++ {
-				lineLower := strings.ToLower(lines[j])
-
-				// Check for unlimited
-				if strings.Contains(lineLower, "unlimited") {
-					return &CostUsage{
-						Unlimited: true,
+				if strings.Contains(strings.ToLower(lines[j]), "unlimited") {
+					explain.printf("cost: line %d %q -> unlimited", j+1, strings.TrimSpace(lines[j]))
+					cost := &CostUsage{Unlimited: true}
+					if len(entries) > 0 {
+						cost.Spent = entries[0].Spent
+					}
+					if len(entries) > 1 {
+						cost.Entries = entries
 					}
+					return cost
 				}
+			}
 
-				// Check for spent/budget pattern
-				if matches := costPattern.FindStringSubmatch(lines[j]); len(matches) > 2 {
-					spent, _ := strconv.ParseFloat(strings.ReplaceAll(matches[1], ",", ""), 64)
-					budget, _ := strconv.ParseFloat(strings.ReplaceAll(matches[2], ",", ""), 64)
-
-					return &CostUsage{
-						Spent:  spent,
-						Budget: budget,
-					}
+			if primary >= 0 {
+				cost := &CostUsage{Spent: entries[primary].Spent, Budget: entries[primary].Budget}
+				if len(entries) > 1 {
+					cost.Entries = entries
 				}
+				return cost
 			}
 		}
 	}
@@ -784,6 +2090,102 @@ func parseCostUsage(text string) *CostUsage {
 	return nil
 }
 
+// parseCostEntries collects the cost lines in lines[start:end], both
+// spent/budget lines ("$5 / $20 spent this month") and spend-only ones
+// ("$120 spent all time"), each with its scope. primary is the index of the
+// first spent/budget line, or -1 if there is none.
+func parseCostEntries(lines []string, start, end int, explain *parseExplainer) (entries []CostEntry, primary int) {
+	primary = -1
+	for j := start; j < end; j++ {
+		line := lines[j]
+		if matches := costPattern.FindStringSubmatch(line); len(matches) > 2 {
+			spent, errSpent := parseAmount(matches[1])
+			budget, errBudget := parseAmount(matches[2])
+			if errSpent != nil || errBudget != nil {
+				explain.printf("cost: line %d %q -> unparsed amount", j+1, strings.TrimSpace(lines[j]))
+				continue
+			}
+			explain.printf("cost: line %d %q -> spent %.2f of %.2f", j+1, strings.TrimSpace(lines[j]), spent, budget)
+			if primary < 0 {
+				primary = len(entries)
+			}
+			entries = append(entries, CostEntry{Scope: costScope(line), Spent: spent, Budget: budget})
+		} else if matches := spentOnlyPattern.FindStringSubmatch(line); len(matches) > 1 {
+			spent, err := parseAmount(matches[1])
+			if err != nil {
+				explain.printf("cost: line %d %q -> unparsed amount", j+1, strings.TrimSpace(lines[j]))
+				continue
+			}
+			explain.printf("cost: line %d %q -> spent %.2f", j+1, strings.TrimSpace(lines[j]), spent)
+			entries = append(entries, CostEntry{Scope: costScope(line), Spent: spent})
+		}
+	}
+	return entries, primary
+}
+
+// costScope names the period a cost line covers from its wording
+func costScope(line string) string {
+	lineLower := strings.ToLower(line)
+	switch {
+	case strings.Contains(lineLower, "month"):
+		return "monthly"
+	case strings.Contains(lineLower, "week"):
+		return "weekly"
+	case strings.Contains(lineLower, "today") || strings.Contains(lineLower, "daily"):
+		return "daily"
+	case strings.Contains(lineLower, "total") || strings.Contains(lineLower, "all time") ||
+		strings.Contains(lineLower, "all-time") || strings.Contains(lineLower, "lifetime"):
+		return "total"
+	}
+	return ""
+}
+
+// parseAPIUsage extracts spend and credit balance for API accounts. A
+// "$X of $Y credits remaining" line gives both balance and total, and spend
+// is derived from them when not shown. Returns nil if no figure is present.
+func parseAPIUsage(text string) *APIUsage {
+	var usage APIUsage
+	if matches := apiCreditsPattern.FindStringSubmatch(text); len(matches) > 2 {
+		balance, errBalance := strconv.ParseFloat(strings.ReplaceAll(matches[1], ",", ""), 64)
+		total, errTotal := strconv.ParseFloat(strings.ReplaceAll(matches[2], ",", ""), 64)
+		if errBalance == nil && errTotal == nil {
+			usage.CreditBalance = &balance
+			usage.CreditTotal = &total
+		}
+	}
+	if matches := apiSpentPattern.FindStringSubmatch(text); len(matches) > 1 {
+		spent, err := strconv.ParseFloat(strings.ReplaceAll(matches[1], ",", ""), 64)
+		if err == nil {
+			usage.Spent = &spent
+		}
+	}
+	if matches := apiBalancePattern.FindStringSubmatch(text); usage.CreditBalance == nil && len(matches) > 1 {
+		balance, err := strconv.ParseFloat(strings.ReplaceAll(matches[1], ",", ""), 64)
+		if err == nil {
+			usage.CreditBalance = &balance
+		}
+	}
+	if usage.Spent == nil && usage.CreditTotal != nil {
+		spent := *usage.CreditTotal - *usage.CreditBalance
+		usage.Spent = &spent
+	}
+	if usage.Spent == nil && usage.CreditBalance == nil {
+		return nil
+	}
+	return &usage
+}
+
+// detectModelFallback finds a notice that claude switched to another model
+// after a limit was hit, e.g. "using sonnet until 6pm". Returns "" if none.
+func detectModelFallback(text string) string {
+	matches := modelFallbackPattern.FindStringSubmatch(text)
+	if len(matches) < 3 {
+		return ""
+	}
+	until := strings.TrimRight(strings.TrimSpace(matches[2]), ".")
+	return fmt.Sprintf("using %s until %s", strings.ToLower(matches[1]), until)
+}
+
 // findClaudeBinary returns the path to the claude CLI binary.
 // It tries "claude" first, then falls back to "claude-bun" (NixOS alias).
 func findClaudeBinary() (string, error) {
@@ -795,7 +2197,7 @@ func findClaudeBinary() (string, error) {
 	if path, err := exec.LookPath("claude-bun"); err == nil {
 		return path, nil
 	}
-	return "", fmt.Errorf("claude CLI not found: tried 'claude' and 'claude-bun'")
+	return "", errClaudeNotFound
 }
 
 // killProcessTree kills a process and all its descendants by process group.
@@ -809,43 +2211,186 @@ func killProcessTree(pid int) {
 	}
 }
 
-func executeClaudeCLI(ctx context.Context, timeout time.Duration, debug bool) (string, error) {
-	// Find the claude binary
-	claudeBin, err := findClaudeBinary()
-	if err != nil {
-		return "", err
-	}
+// claudeUsageArgs are the arguments claude is spawned with. /usage needs no
+// tool permissions, so no permission-bypass flags are passed.
+var claudeUsageArgs = []string{"/usage"}
 
-	// Run claude directly with PTY (no script wrapper)
-	// This ensures bun is a direct child that can be reliably killed
-	cmd := exec.Command(claudeBin, "/usage")
-	cmd.Dir = "/tmp"
+// claudeUsageJSONArgs ask claude for /usage as JSON in print mode, for
+// --json-mode. Builds without this fail or print text, and the query falls
+// back to scraping the TUI.
+var claudeUsageJSONArgs = []string{"-p", "/usage --json"}
 
-	// Set environment to ensure PTY works without a controlling terminal
-	cmd.Env = append(os.Environ(), "TERM=xterm-256color")
+// errUsageJSONUnsupported is returned when claude clearly rejects /usage
+// --json (see usageJSONRejected), i.e. this claude has no JSON mode
+var errUsageJSONUnsupported = errors.New("claude does not support /usage --json")
 
-	// Note: pty.Start() internally sets Setsid: true, making the child a session
-	// leader (and thus process group leader). We can kill by process group using
-	// -pid since the child leads its own process group. Do NOT set Setpgid here
-	// as it conflicts with pty.Start()'s internal Setsid and causes EPERM.
+// errUsageJSONInvalid is returned when a /usage --json response is not a
+// usage object. Unlike errUsageJSONUnsupported this may be a one-off (e.g.
+// output cut short), so JSON mode stays on.
+var errUsageJSONInvalid = errors.New("claude /usage --json returned no usage object")
+
+// errClaudeNotFound is returned when neither claude binary is on PATH.
+// Retrying cannot fix this, so runQuery fails immediately.
+var errClaudeNotFound = errors.New("claude CLI not found: tried 'claude' and 'claude-bun'")
+
+// errInstanceConflict is returned when claude refuses to start because
+// another instance, usually an open interactive session, holds its lock
+var errInstanceConflict = errors.New("another claude instance is already running: close the interactive claude session and try again")
+
+// detectInstanceConflict reports whether claude output says another
+// instance is running or its lock is taken
+func detectInstanceConflict(output string) bool {
+	return instanceConflictPattern.MatchString(stripANSI(output))
+}
+
+// errNoClaudeOutput is returned when claude exits without printing anything
+// (e.g. it was killed before rendering /usage). Parsing such a transcript
+// would yield a hollow snapshot with an unknown account and no quotas.
+var errNoClaudeOutput = errors.New("no output from claude")
+
+// claudeExecutor spawns claude and returns its raw (ANSI-encoded) output.
+// It is a field on QueryOptions so tests can inject canned transcripts.
+type claudeExecutor func(ctx context.Context, opts *QueryOptions) (string, error)
+
+// QueryOptions controls how a single usage query is executed and parsed
+type QueryOptions struct {
+	IncludeRaw        bool
+	Timeout           time.Duration   // Per-attempt timeout for the claude process
+	Debug             bool            // Mirror claude output to stderr while polling
+	MaxRetries        int             // Additional spawn attempts after a retryable failure
+	RetryBackoff      time.Duration   // Linear backoff: attempt N waits N*RetryBackoff
+	ClaudeBin         string          // Path to the claude binary ("" = auto-detect)
+	Executor          claudeExecutor  // nil = executeClaudeCLI
+	Metrics           *QueryMetrics   // Records each claude spawn attempt (nil = not tracked)
+	Explain           io.Writer       // Receives an account of parse decisions (nil = off)
+	StrictAccountType bool            // Report unknown instead of guessing max from quota content
+	Org               string          // Organization the usage is expected for ("" = whichever claude reports)
+	CompletionMarkers []string        // Output substrings that mean usage has rendered (nil = defaultCompletionMarkers)
+	ResetKeywords     []string        // Extra phrases marking a reset line, besides resetKeywords
+	ParseDebug        bool            // Attach a ParseDebug record to the snapshot
+	JSONMode          bool            // Try /usage --json before scraping the TUI; cleared once claude rejects it
+	JSONExecutor      claudeExecutor  // nil = executeClaudeJSON
+	Captures          int             // Parse up to this many captures and keep the most complete (0 or 1 = one)
+	CaptureGap        time.Duration   // Pause between captures
+	Context           context.Context // Cancelled on shutdown: no new query, retry or capture starts (nil = never)
+}
+
+// sleepContext pauses for d, returning false early if ctx is cancelled first.
+// A nil ctx never cancels.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if ctx == nil {
+		time.Sleep(d)
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// QueryMetrics tracks claude spawn attempts for observing the daemon itself.
+// The daemon embeds a copy in every snapshot it writes.
+type QueryMetrics struct {
+	LastDurationSeconds float64 `json:"claude_query_duration_seconds"`
+	FailuresTotal       uint64  `json:"claude_query_failures_total"`
+	SuccessTotal        uint64  `json:"claude_query_success_total"`
+}
 
-	// Start the command with a PTY
-	ptmx, err := pty.Start(cmd)
+// record updates the metrics after one spawn attempt
+func (m *QueryMetrics) record(duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.LastDurationSeconds = duration.Seconds()
 	if err != nil {
-		return "", fmt.Errorf("failed to start claude CLI with PTY: %w", err)
+		m.FailuresTotal++
+	} else {
+		m.SuccessTotal++
 	}
-	defer ptmx.Close()
+}
 
-	// Buffer to capture output
-	var stdout bytes.Buffer
-	var outputMu sync.Mutex
+// PTY size for the claude process; wide enough that usage lines never wrap
+const (
+	ptyColumns = 200
+	ptyRows    = 50
+)
 
-	// Channel to signal when the reader goroutine is done
-	readerDone := make(chan struct{})
+// defaultCompletionMarkers tell executeClaudeCLI that the usage screen has
+// rendered. A localized claude needs its own (--completion-markers).
+var defaultCompletionMarkers = []string{"% used", "% left"}
 
-	// Read from PTY in a goroutine
-	go func() {
-		defer close(readerDone)
+// hasCompletionMarker reports whether output contains any of markers
+func hasCompletionMarker(output string, markers []string) bool {
+	for _, marker := range markers {
+		if strings.Contains(output, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitCompletionMarkers parses a comma-separated --completion-markers value.
+// Markers are matched verbatim, so surrounding spaces are kept except at the
+// ends of the list.
+func splitCompletionMarkers(list string) []string {
+	var markers []string
+	for _, marker := range strings.Split(strings.TrimSpace(list), ",") {
+		if marker != "" {
+			markers = append(markers, marker)
+		}
+	}
+	return markers
+}
+
+func executeClaudeCLI(ctx context.Context, opts *QueryOptions) (string, error) {
+	timeout := opts.Timeout
+	debug := opts.Debug
+
+	// Find the claude binary unless one was given explicitly
+	claudeBin := opts.ClaudeBin
+	if claudeBin == "" {
+		var err error
+		claudeBin, err = findClaudeBinary()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Run claude directly with PTY (no script wrapper)
+	// This ensures bun is a direct child that can be reliably killed
+	cmd := exec.Command(claudeBin, claudeUsageArgs...)
+	cmd.Dir = "/tmp"
+
+	// Set environment to ensure PTY works without a controlling terminal
+	cmd.Env = append(os.Environ(), "TERM=xterm-256color", fmt.Sprintf("COLUMNS=%d", ptyColumns))
+
+	// Note: pty.StartWithSize() internally sets Setsid: true, making the child a session
+	// leader (and thus process group leader). We can kill by process group using
+	// -pid since the child leads its own process group. Do NOT set Setpgid here
+	// as it conflicts with pty.StartWithSize()'s internal Setsid and causes EPERM.
+
+	// Start the command with a wide PTY so claude does not wrap the usage
+	// table (and split quota headings) at the default 80 columns
+	ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{Cols: ptyColumns, Rows: ptyRows})
+	if err != nil {
+		return "", fmt.Errorf("failed to start claude CLI with PTY: %w", err)
+	}
+	defer ptmx.Close()
+
+	// Buffer to capture output
+	var stdout bytes.Buffer
+	var outputMu sync.Mutex
+
+	// Channel to signal when the reader goroutine is done
+	readerDone := make(chan struct{})
+
+	// Read from PTY in a goroutine
+	go func() {
+		defer close(readerDone)
 		buf := make([]byte, 4096)
 		for {
 			n, err := ptmx.Read(buf)
@@ -883,8 +2428,12 @@ func executeClaudeCLI(ctx context.Context, timeout time.Duration, debug bool) (s
 	defer ticker.Stop()
 
 	// Helper to check if output contains usage data
+	markers := opts.CompletionMarkers
+	if len(markers) == 0 {
+		markers = defaultCompletionMarkers
+	}
 	hasUsageData := func(output string) bool {
-		return strings.Contains(output, "% used") || strings.Contains(output, "% left")
+		return hasCompletionMarker(output, markers)
 	}
 
 	// Helper to check if output indicates an auth error (so we can stop waiting)
@@ -941,7 +2490,9 @@ func executeClaudeCLI(ctx context.Context, timeout time.Duration, debug bool) (s
 				return getOutput(), nil
 			}
 			// Also check for auth errors - no point waiting for usage data if not logged in
-			if hasAuthError(output) {
+			// or stuck on the first-run setup screen, which never renders usage.
+			// The same goes for another instance holding claude's lock.
+			if hasAuthError(output) || detectInstanceConflict(output) {
 				// Give it a moment to capture the full error message
 				time.Sleep(300 * time.Millisecond)
 				if cmd.Process != nil {
@@ -954,13 +2505,157 @@ func executeClaudeCLI(ctx context.Context, timeout time.Duration, debug bool) (s
 	}
 }
 
-// formatHyprPanelOutput converts a UsageSnapshot to HyprPanel JSON format
-func formatHyprPanelOutput(snapshot *UsageSnapshot) *HyprPanelOutput {
+// HyprPanelOptions controls how a snapshot is rendered for HyprPanel
+type HyprPanelOptions struct {
+	Display        string         // Quota that drives text and class (see findQuota)
+	DurationStyle  DurationStyle  // Rendering of time-remaining values ("" = short)
+	LastGoodWindow time.Duration  // Fall back to <file>.last-good this recent on error states (0 = disabled)
+	TextFormat     string         // Template for the text field, see expandTextFormat ("" = "<percent>% <plan>")
+	Decimals       int            // Decimal places for displayed percentages
+	ResetAs        ResetAs        // Show reset times as a duration or wall clock ("" = duration)
+	DisplayTZ      *time.Location // Zone for wall-clock times (nil = local time)
+	TimeLayout     string         // Go time layout for wall-clock times ("" = "15:04", or "Mon 15:04" beyond a day)
+	Metric         Metric         // Show percentages as used or remaining ("" = used)
+	EmbedSnapshot  bool           // Include the full snapshot in the output
+	AltMeta        bool           // Encode account type and quota count into alt, see hyprPanelAltMeta
+	Classes        LevelClasses   // Names emitted in place of the low/medium/high/error levels
+}
+
+// LevelClasses overrides the level names written to class and alt, for
+// stylesheets that use their own class names. Empty fields keep the default.
+type LevelClasses struct {
+	Low    string
+	Medium string
+	High   string
+	Error  string
+}
+
+// name returns the configured name for level, or level itself if it is not
+// overridden
+func (c LevelClasses) name(level string) string {
+	custom := map[string]string{"low": c.Low, "medium": c.Medium, "high": c.High, "error": c.Error}[level]
+	if custom == "" {
+		return level
+	}
+	return custom
+}
+
+// relabelHyprPanelLevels renames the level words in output's class and alt
+// according to classes. Other words, like "budget_high", "warn" or an error
+// category in alt, are left alone.
+func relabelHyprPanelLevels(output *HyprPanelOutput, classes LevelClasses) *HyprPanelOutput {
+	words := strings.Fields(output.Class)
+	for i, word := range words {
+		words[i] = classes.name(word)
+	}
+	output.Class = strings.Join(words, " ")
+	output.Alt = classes.name(output.Alt)
+	return output
+}
+
+// Metric selects whether displayed percentages count usage or what is left
+type Metric string
+
+const (
+	MetricUsed      Metric = "used"      // higher is worse
+	MetricRemaining Metric = "remaining" // higher is better
+)
+
+// parseMetric validates a --metric value
+func parseMetric(value string) (Metric, error) {
+	switch metric := Metric(value); metric {
+	case MetricUsed, MetricRemaining:
+		return metric, nil
+	}
+	return "", fmt.Errorf("invalid metric %q: expected used or remaining", value)
+}
+
+// metricValue returns the percentage of q to display for metric
+func metricValue(q *Quota, metric Metric) float64 {
+	if metric == MetricRemaining {
+		return q.PercentRemaining
+	}
+	return 100 - q.PercentRemaining
+}
+
+// metricLevel maps a displayed percentage to low/medium/high severity. For
+// the remaining metric the comparison is inverted, so a high number is still
+// the "low" (green) level.
+func metricLevel(value float64, metric Metric) string {
+	if metric == MetricRemaining {
+		switch {
+		case value < 20:
+			return "high"
+		case value < 50:
+			return "medium"
+		default:
+			return "low"
+		}
+	}
+	return usageLevel(value)
+}
+
+// maxDecimals bounds --decimals; the CLI prints at most one decimal place anyway
+const maxDecimals = 3
+
+// formatPercent renders a percentage with the given number of decimals,
+// rounding half away from zero (72.5 -> 73) rather than fmt's half-to-even
+func formatPercent(value float64, decimals int) string {
+	scale := math.Pow(10, float64(decimals))
+	return strconv.FormatFloat(math.Round(value*scale)/scale, 'f', decimals, 64)
+}
+
+// expandTextFormat fills the {s}, {w}, {opus} and {sonnet} tokens in
+// opts.TextFormat with the session, weekly and model quotas' percentage in
+// opts.Metric, rounded to opts.Decimals places, {reset_clock} with the
+// local wall-clock time the display quota resets at, and {reset_coarse} with
+// the time until then in its largest unit. Tokens for absent quotas or resets
+// expand to "".
+func expandTextFormat(snapshot *UsageSnapshot, display *Quota, opts HyprPanelOptions, now time.Time) string {
+	used := func(name string) string {
+		q := findQuota(snapshot.Quotas, name)
+		if q == nil {
+			return ""
+		}
+		return formatPercent(metricValue(q, opts.Metric), opts.Decimals)
+	}
+	resetClock, resetCoarse := "", ""
+	if resetTime, ok := quotaResetTime(display, snapshot.CapturedAt); ok {
+		resetClock = formatResetClock(resetTime, now, opts.DisplayTZ, opts.TimeLayout)
+		resetCoarse = coarseDuration(int64(resetTime.Sub(now).Seconds()))
+	}
+	return strings.NewReplacer(
+		"{s}", used("session"),
+		"{w}", used("weekly"),
+		"{opus}", used("opus"),
+		"{sonnet}", used("sonnet"),
+		"{reset_clock}", resetClock,
+		"{reset_coarse}", resetCoarse,
+	).Replace(opts.TextFormat)
+}
+
+// formatHyprPanelOutput converts a UsageSnapshot to HyprPanel JSON format.
+// If the snapshot has no quota matching opts.Display, the first quota is used.
+func formatHyprPanelOutput(snapshot *UsageSnapshot, opts HyprPanelOptions) *HyprPanelOutput {
+	output := relabelHyprPanelLevels(formatHyprPanelFields(snapshot, opts), opts.Classes)
+	if opts.EmbedSnapshot {
+		output.Snapshot = snapshot
+	}
+	return output
+}
+
+// formatHyprPanelFields renders the text, alt, class and tooltip fields
+func formatHyprPanelFields(snapshot *UsageSnapshot, opts HyprPanelOptions) *HyprPanelOutput {
 	// Check for auth errors first
 	if snapshot != nil && snapshot.AuthError != nil {
 		return formatHyprPanelAuthError(snapshot.AuthError)
 	}
 
+	// API accounts have no quotas; show the dollar figures instead
+	if snapshot != nil && len(snapshot.Quotas) == 0 && snapshot.APIUsage != nil {
+		return markHyprPanelDegraded(formatHyprPanelAPIUsage(snapshot.APIUsage), snapshot.Warnings)
+	}
+
 	if snapshot == nil || len(snapshot.Quotas) == 0 {
 		return &HyprPanelOutput{
 			Text:    "--",
@@ -970,39 +2665,59 @@ func formatHyprPanelOutput(snapshot *UsageSnapshot) *HyprPanelOutput {
 		}
 	}
 
-	// Calculate session usage percentage (used, not remaining)
-	sessionUsed := 100 - snapshot.Quotas[0].PercentRemaining
-	// Recalculate time remaining from ResetsAt to avoid stale values
-	sessionTime := recalculateTimeRemaining(snapshot.Quotas[0].ResetsAt)
+	displayQuota := findQuota(snapshot.Quotas, opts.Display)
+	if displayQuota == nil {
+		displayQuota = snapshot.Worst()
+	}
+	displayValue := metricValue(displayQuota, opts.Metric)
+
+	// Calculate session and weekly usage for the tooltip
+	now := time.Now()
+	sessionUsed := 0.0
+	sessionTime := "unknown"
+	if q := snapshot.Session(); q != nil {
+		sessionUsed = 100 - q.PercentRemaining
+		// Recalculate from the reset time to avoid stale values
+		sessionTime = formatQuotaReset(q, snapshot.CapturedAt, opts.ResetAs, opts.DurationStyle, opts.DisplayTZ, opts.TimeLayout, now)
+	}
 
-	// Calculate weekly usage if available
 	weeklyUsed := 0.0
 	weeklyTime := "unknown"
-	if len(snapshot.Quotas) > 1 {
-		weeklyUsed = 100 - snapshot.Quotas[1].PercentRemaining
-		weeklyTime = recalculateTimeRemaining(snapshot.Quotas[1].ResetsAt)
+	if q := snapshot.Weekly(); q != nil {
+		weeklyUsed = 100 - q.PercentRemaining
+		weeklyTime = formatQuotaReset(q, snapshot.CapturedAt, opts.ResetAs, opts.DurationStyle, opts.DisplayTZ, opts.TimeLayout, now)
 	}
 
-	// Determine level based on session usage
-	var level string
-	switch {
-	case sessionUsed > 80:
+	resetFormat := "%s left"
+	if opts.ResetAs == ResetAsClock {
+		resetFormat = "resets %s"
+	}
+
+	// Determine level based on the displayed quota
+	level := metricLevel(displayValue, opts.Metric)
+
+	// Extra-usage spend close to the budget is high regardless of quota usage
+	class := level
+	if isBudgetNearlyExhausted(snapshot.CostUsage) {
 		level = "high"
-	case sessionUsed > 50:
-		level = "medium"
-	default:
-		level = "low"
+		class = "high budget_high"
 	}
 
 	// Build tooltip
 	tooltipLines := []string{
-		fmt.Sprintf("Session: %.0f%% used (%s left)", sessionUsed, sessionTime),
-		fmt.Sprintf("Weekly: %.0f%% used (%s left)", weeklyUsed, weeklyTime),
+		fmt.Sprintf("Session: %s%% used ("+resetFormat+")", formatPercent(sessionUsed, opts.Decimals), sessionTime),
+		fmt.Sprintf("Weekly: %s%% used ("+resetFormat+")", formatPercent(weeklyUsed, opts.Decimals), weeklyTime),
+	}
+
+	if snapshot.ModelFallback != "" {
+		tooltipLines = append(tooltipLines, "Fallback: "+snapshot.ModelFallback)
 	}
 
 	// Add extra usage info if available
 	if snapshot.CostUsage != nil {
-		if snapshot.CostUsage.Unlimited {
+		if snapshot.CostUsage.Unlimited && snapshot.CostUsage.Spent > 0 {
+			tooltipLines = append(tooltipLines, fmt.Sprintf("Extra: $%.2f (unlimited)", snapshot.CostUsage.Spent))
+		} else if snapshot.CostUsage.Unlimited {
 			tooltipLines = append(tooltipLines, "Extra: Unlimited")
 		} else if snapshot.CostUsage.Budget > 0 {
 			tooltipLines = append(tooltipLines, fmt.Sprintf("Extra: $%.2f / $%.0f", snapshot.CostUsage.Spent, snapshot.CostUsage.Budget))
@@ -1018,19 +2733,156 @@ func formatHyprPanelOutput(snapshot *UsageSnapshot) *HyprPanelOutput {
 		accountLabel = "Pro"
 	}
 
+	text := fmt.Sprintf("%s%% %s", formatPercent(displayValue, opts.Decimals), accountLabel)
+	if opts.TextFormat != "" {
+		text = expandTextFormat(snapshot, displayQuota, opts, now)
+	}
+
+	alt := level
+	if opts.AltMeta {
+		alt = hyprPanelAltMeta(snapshot, opts.Classes.name(level))
+	}
+
+	percentage := int(math.Round(displayValue))
+	return markHyprPanelDegraded(&HyprPanelOutput{
+		Text:       text,
+		Alt:        alt,
+		Class:      class,
+		Tooltip:    strings.Join(tooltipLines, "\n"),
+		Percentage: &percentage,
+	}, snapshot.Warnings)
+}
+
+// usageLevel maps a used percentage to the low/medium/high level shown in
+// HyprPanel and badges
+func usageLevel(used float64) string {
+	switch {
+	case used > 80:
+		return "high"
+	case used > 50:
+		return "medium"
+	default:
+		return "low"
+	}
+}
+
+// budgetHighRatio is the spent/budget ratio above which extra usage is flagged
+const budgetHighRatio = 0.9
+
+// isBudgetNearlyExhausted reports whether extra-usage spend exceeds
+// budgetHighRatio of a finite budget. Unlimited budgets never qualify.
+func isBudgetNearlyExhausted(cost *CostUsage) bool {
+	if cost == nil || cost.Unlimited || cost.Budget <= 0 {
+		return false
+	}
+	return cost.Spent/cost.Budget > budgetHighRatio
+}
+
+// hyprPanelAltMeta composes the --alt-meta alt value
+// "<account type>-<quota count>q-<level>", e.g. "max-4q-low", so a bar can
+// read plan and quota count without parsing the tooltip. The level keeps
+// its meaning and is also in class.
+func hyprPanelAltMeta(snapshot *UsageSnapshot, level string) string {
+	return fmt.Sprintf("%s-%dq-%s", snapshot.AccountType, len(snapshot.Quotas), level)
+}
+
+// markHyprPanelDegraded appends a "warn" class and the warnings to the tooltip
+// when the snapshot was parsed on a best-effort basis
+func markHyprPanelDegraded(output *HyprPanelOutput, warnings []string) *HyprPanelOutput {
+	if len(warnings) == 0 {
+		return output
+	}
+	output.Class += " warn"
+	output.Tooltip += "\nBest-effort data: " + strings.Join(warnings, "; ")
+	return output
+}
+
+// stripNonASCIISymbols removes emoji and other non-ASCII symbols, such as
+// warning glyphs, that some bars render as tofu. ASCII, letters and digits
+// in any script and whitespace are kept; a removed symbol also takes the
+// space that separated it from the text ("⚠ stale" -> "stale").
+func stripNonASCIISymbols(text string) string {
+	runes := []rune(text)
+	out := make([]rune, 0, len(runes))
+	atWordStart := func() bool { return len(out) == 0 || out[len(out)-1] == '\n' || out[len(out)-1] == ' ' }
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if r < utf8.RuneSelf || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			out = append(out, r)
+			continue
+		}
+		if unicode.IsSpace(r) {
+			out = append(out, ' ')
+			continue
+		}
+		if i+1 < len(runes) && runes[i+1] == ' ' && atWordStart() {
+			i++
+		} else if (i+1 == len(runes) || runes[i+1] == '\n') && len(out) > 0 && out[len(out)-1] == ' ' {
+			out = out[:len(out)-1]
+		}
+	}
+	return string(out)
+}
+
+// stripHyprPanelSymbols applies stripNonASCIISymbols to the text and tooltip
+// (--strip-emoji)
+func stripHyprPanelSymbols(output *HyprPanelOutput) *HyprPanelOutput {
+	output.Text = stripNonASCIISymbols(output.Text)
+	output.Tooltip = stripNonASCIISymbols(output.Tooltip)
+	return output
+}
+
+// formatHyprPanelAPIUsage formats API account spend for HyprPanel.
+// The text shows spend if known, otherwise the remaining credit balance;
+// prepaid credits show what is left of the total instead.
+func formatHyprPanelAPIUsage(usage *APIUsage) *HyprPanelOutput {
+	var tooltipLines []string
+	text := "-- API"
+	if usage.Spent != nil {
+		text = fmt.Sprintf("$%.2f API", *usage.Spent)
+		tooltipLines = append(tooltipLines, fmt.Sprintf("API spend: $%.2f", *usage.Spent))
+	}
+	if usage.CreditBalance != nil && usage.CreditTotal != nil {
+		text = fmt.Sprintf("$%.2f/$%.0f API", *usage.CreditBalance, *usage.CreditTotal)
+		tooltipLines = append(tooltipLines, fmt.Sprintf("Credits: $%.2f of $%.2f remaining", *usage.CreditBalance, *usage.CreditTotal))
+	} else if usage.CreditBalance != nil {
+		if usage.Spent == nil {
+			text = fmt.Sprintf("$%.2f API", *usage.CreditBalance)
+		}
+		tooltipLines = append(tooltipLines, fmt.Sprintf("Credit balance: $%.2f", *usage.CreditBalance))
+	}
+
 	return &HyprPanelOutput{
-		Text:    fmt.Sprintf("%.0f%% %s", sessionUsed, accountLabel),
-		Alt:     level,
-		Class:   level,
+		Text:    text,
+		Alt:     "api",
+		Class:   "api",
 		Tooltip: strings.Join(tooltipLines, "\n"),
 	}
 }
 
+// HyprPanel error categories. These are emitted as `alt` so bar click handlers
+// can branch on the failure origin; `class` stays "error" for styling.
+const (
+	hyprPanelErrorGeneric     = "error"
+	hyprPanelErrorFileMissing = "file_missing"
+	hyprPanelErrorReadFailed  = "read_error"
+	hyprPanelErrorParse       = "parse_error"
+	hyprPanelErrorNoData      = "no_data"
+	hyprPanelErrorStale       = "stale"
+	hyprPanelErrorQuery       = "query_failed"
+)
+
 // formatHyprPanelError returns an error HyprPanelOutput
 func formatHyprPanelError(message string) *HyprPanelOutput {
+	return formatHyprPanelErrorCategory(hyprPanelErrorGeneric, message)
+}
+
+// formatHyprPanelErrorCategory returns an error HyprPanelOutput whose alt
+// carries a machine-readable error category
+func formatHyprPanelErrorCategory(category, message string) *HyprPanelOutput {
 	return &HyprPanelOutput{
 		Text:    "--",
-		Alt:     "error",
+		Alt:     category,
 		Class:   "error",
 		Tooltip: message,
 	}
@@ -1053,6 +2905,8 @@ func formatHyprPanelAuthError(authErr *AuthError) *HyprPanelOutput {
 		alt = "no_subscription"
 	case AuthErrorSetupRequired:
 		alt = "setup_required"
+	case AuthErrorSuspended:
+		alt = "account_suspended"
 	}
 
 	return &HyprPanelOutput{
@@ -1063,17 +2917,64 @@ func formatHyprPanelAuthError(authErr *AuthError) *HyprPanelOutput {
 	}
 }
 
-func parseClaudeOutput(rawOutput string, includeRaw bool) *UsageSnapshot {
-	cleanOutput := stripANSI(rawOutput)
+// parseClaudeOutput runs the full parse pipeline on raw CLI output.
+// strictAccountType disables the max fallback in detectAccountType.
+// resetKeywords are extra reset phrases (--reset-keywords), nil for none.
+// explain may be nil; otherwise it receives an account of each parse decision.
+func parseClaudeOutput(rawOutput string, includeRaw bool, strictAccountType bool, resetKeywords []string, explain *parseExplainer) *UsageSnapshot {
+	cleanOutput := stripSpinnerFrames(stripANSI(rawOutput))
+	// Quota parsing needs headings whole, even if a narrow terminal wrapped them
+	quotaText := dewrapQuotaHeadings(cleanOutput, explain)
+
+	// After an account switch the output may list several accounts
+	activeAccount, accountText := splitAccountSwitcher(cleanOutput)
+	if activeAccount != "" {
+		explain.printf("account: several accounts listed, using active entry %q", activeAccount)
+	}
 
 	snapshot := &UsageSnapshot{
-		AccountType:  detectAccountType(cleanOutput),
-		Email:        parseEmail(cleanOutput),
-		Organization: parseOrganization(cleanOutput),
-		Quotas:       parseQuotas(cleanOutput),
-		CostUsage:    parseCostUsage(cleanOutput),
-		AuthError:    detectAuthError(cleanOutput),
-		CapturedAt:   time.Now().Format(time.RFC3339),
+		SchemaVersion: snapshotSchemaVersion,
+		AccountType:   detectAccountType(accountText, strictAccountType, explain),
+		Email:         parseEmail(accountText),
+		Organization:  parseOrganization(accountText),
+		Quotas:        parseQuotas(quotaText, resetKeywords, explain),
+		CostUsage:     parseCostUsage(cleanOutput, explain),
+		AuthError:     detectAuthError(cleanOutput),
+		ModelFallback: detectModelFallback(cleanOutput),
+		CapturedAt:    time.Now().Format(time.RFC3339),
+	}
+	snapshot.PlanName = parsePlanName(accountText, snapshot.AccountType)
+	if snapshot.Email == "" && activeAccount != "" {
+		snapshot.Email = accountEmailPattern.FindString(activeAccount)
+	}
+	if snapshot.Email != "" {
+		explain.printf("email: %s", snapshot.Email)
+	}
+	if explain != nil && explain.debug != nil {
+		explain.debug.EmailLine = lineOf(cleanOutput, snapshot.Email)
+		explain.debug.OrganizationLine = lineOf(cleanOutput, snapshot.Organization)
+	}
+	if snapshot.AuthError != nil {
+		explain.printf("auth: %s", snapshot.AuthError.Code)
+	}
+
+	if validUntil := soonestReset(snapshot.Quotas); validUntil != nil {
+		ts := validUntil.Format(time.RFC3339)
+		snapshot.ValidUntil = &ts
+	}
+
+	snapshot.Warnings = parseWarnings(cleanOutput, snapshot, resetKeywords)
+
+	// A heading without a percentage means the output was cut off mid-render
+	if truncated := findTruncatedQuotaLabels(quotaText); len(truncated) > 0 {
+		snapshot.Incomplete = true
+		snapshot.Warnings = append(snapshot.Warnings,
+			fmt.Sprintf("output truncated: no percentage for %s", strings.Join(truncated, ", ")))
+	}
+
+	// API accounts report spend instead of quotas
+	if snapshot.AccountType == AccountTypeAPI {
+		snapshot.APIUsage = parseAPIUsage(cleanOutput)
 	}
 
 	if includeRaw {
@@ -1088,696 +2989,3959 @@ func parseClaudeOutput(rawOutput string, includeRaw bool) *UsageSnapshot {
 	return snapshot
 }
 
-// runQuery executes a single query and returns the snapshot, raw CLI output, and error.
-// The raw output is always returned (even on error) for debugging purposes.
-func runQuery(includeRaw bool, timeout time.Duration, debug bool) (*UsageSnapshot, string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	rawOutput, err := executeClaudeCLI(ctx, timeout, debug)
-	if err != nil {
-		return nil, rawOutput, err
+// soonestReset returns the earliest ResetsAt across quotas, after which the
+// snapshot no longer reflects usage. Returns nil if no quota has a reset time.
+func soonestReset(quotas []Quota) *time.Time {
+	var soonest *time.Time
+	for _, q := range quotas {
+		if q.ResetsAt == nil {
+			continue
+		}
+		resetTime, err := time.Parse(time.RFC3339, *q.ResetsAt)
+		if err != nil {
+			continue
+		}
+		if soonest == nil || resetTime.Before(*soonest) {
+			soonest = &resetTime
+		}
 	}
-
-	return parseClaudeOutput(rawOutput, includeRaw), rawOutput, nil
+	return soonest
 }
 
-// writeSnapshotToFile atomically writes a snapshot to the given file path
-func writeSnapshotToFile(snapshot *UsageSnapshot, outputFile string) error {
-	jsonBytes, err := json.MarshalIndent(snapshot, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to encode JSON: %w", err)
-	}
+// parseWarnings lists the places where the parsed snapshot is a best guess
+// rather than a direct reading of the CLI output
+func parseWarnings(cleanOutput string, snapshot *UsageSnapshot, resetKeywords []string) []string {
+	var warnings []string
 
-	// Ensure directory exists
-	dir := filepath.Dir(outputFile)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+	// detectAccountType falls back to max when it only sees quota-like content
+	if snapshot.AccountType == AccountTypeMax && !maxPattern.MatchString(cleanOutput) {
+		warnings = append(warnings, "account type inferred from quota layout")
 	}
 
-	// Write to temp file first
-	tmpFile := outputFile + ".tmp"
-	if err := os.WriteFile(tmpFile, jsonBytes, 0644); err != nil {
-		return fmt.Errorf("failed to write temp file: %w", err)
+	// Numbers that look like data but do not parse are reported, never read as 0
+	for _, line := range strings.Split(cleanOutput, "\n") {
+		if bad := malformedPercentage(line); bad != "" {
+			warnings = append(warnings, fmt.Sprintf("could not parse percentage %q", bad))
+		}
+		if shown := clampedPercentage(line); shown != "" {
+			warnings = append(warnings, fmt.Sprintf("clamped out-of-range percentage %q", shown))
+		}
+	}
+	if bad := malformedCostAmount(cleanOutput); bad != "" {
+		warnings = append(warnings, fmt.Sprintf("could not parse extra usage amount %q", bad))
 	}
 
-	// Atomic rename
-	if err := os.Rename(tmpFile, outputFile); err != nil {
-		os.Remove(tmpFile) // Clean up on failure
-		return fmt.Errorf("failed to rename temp file: %w", err)
+	for _, q := range snapshot.Quotas {
+		name := string(q.Type)
+		if q.Model != "" {
+			name = q.Model
+		}
+		if q.ResetText != "" && q.ResetsAt == nil {
+			warnings = append(warnings, fmt.Sprintf("could not parse %s reset time %q", name, q.ResetText))
+		} else if q.ResetsAt != nil && isDateOnlyReset(q.ResetText) {
+			warnings = append(warnings, fmt.Sprintf("assumed midnight for %s reset %q", name, q.ResetText))
+		} else if q.ResetsAt != nil && isWeekdayResetHint(q.ResetText, resetKeywords) {
+			warnings = append(warnings, fmt.Sprintf("assumed %s resets at midnight from weekday hint %q", name, q.ResetText))
+		}
+		if absSeconds, skewed := resetClockSkew(q.ResetText); skewed {
+			warnings = append(warnings, fmt.Sprintf("clock skew: %s reset %q is %s away by the host clock, not %s; using the absolute time",
+				name, q.ResetText, formatDuration(absSeconds), formatDuration(parseRelativeReset(q.ResetText))))
+		}
 	}
 
-	return nil
+	return warnings
 }
 
-// startDBusService registers the D-Bus service and blocks forever
-func startDBusService(refreshChan chan struct{}) {
-	conn, err := dbus.SessionBus()
-	if err != nil {
-		log.Printf("Failed to connect to session bus: %v", err)
-		return
+// isRetryableQueryError reports whether a failed spawn is worth retrying.
+// Transient failures (timeouts, early exits while node starts up) are retried;
+// a missing binary or a cancelled parent context is not.
+func isRetryableQueryError(err error) bool {
+	if err == nil {
+		return false
 	}
+	if errors.Is(err, errClaudeNotFound) || errors.Is(err, errInstanceConflict) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	return true
+}
 
-	service := &DBusService{refreshChan: refreshChan}
-
-	// Export the service methods
-	err = conn.Export(service, dbus.ObjectPath(dbusObjectPath), dbusInterface)
-	if err != nil {
-		log.Printf("Failed to export D-Bus service: %v", err)
-		return
+// executeClaudeJSON runs claude in print mode for /usage --json. Unlike the
+// TUI capture it needs no PTY or completion polling: the response is the
+// process's stdout.
+func executeClaudeJSON(ctx context.Context, opts *QueryOptions) (string, error) {
+	claudeBin := opts.ClaudeBin
+	if claudeBin == "" {
+		var err error
+		claudeBin, err = findClaudeBinary()
+		if err != nil {
+			return "", err
+		}
 	}
 
-	// Export introspection data for dbus-send compatibility
-	introNode := &introspect.Node{
-		Name: dbusObjectPath,
-		Interfaces: []introspect.Interface{
-			introspect.IntrospectData,
-			{
-				Name: dbusInterface,
-				Methods: []introspect.Method{
-					{
-						Name: "RefreshNow",
-					},
-				},
-			},
-		},
+	cmd := exec.CommandContext(ctx, claudeBin, claudeUsageJSONArgs...)
+	cmd.Dir = "/tmp"
+	cmd.WaitDelay = time.Second
+	output, err := cmd.Output()
+	if ctx.Err() != nil {
+		return string(output), ctx.Err()
 	}
-	err = conn.Export(introspect.NewIntrospectable(introNode), dbus.ObjectPath(dbusObjectPath),
-		"org.freedesktop.DBus.Introspectable")
 	if err != nil {
-		log.Printf("Failed to export introspection: %v", err)
-		return
+		return string(output), fmt.Errorf("claude /usage --json failed: %w", err)
 	}
+	return string(output), nil
+}
 
-	// Request the service name
-	reply, err := conn.RequestName(dbusServiceName, dbus.NameFlagDoNotQueue)
-	if err != nil {
-		log.Printf("Failed to request D-Bus name: %v", err)
-		return
+// parseUsageJSON decodes a /usage --json response. It uses the snapshot's
+// own field names, so it unmarshals straight into a UsageSnapshot; the
+// fields the TUI parser derives (time remaining, valid_until) are filled in
+// the same way. Returns errUsageJSONInvalid if output is not a usage object.
+func parseUsageJSON(output string, now time.Time) (*UsageSnapshot, error) {
+	var snapshot UsageSnapshot
+	if err := json.Unmarshal([]byte(strings.TrimSpace(output)), &snapshot); err != nil {
+		return nil, errUsageJSONInvalid
 	}
-	if reply != dbus.RequestNameReplyPrimaryOwner {
-		log.Printf("D-Bus name %s already taken", dbusServiceName)
-		return
+	if snapshot.AccountType == "" && snapshot.Quotas == nil && snapshot.AuthError == nil {
+		return nil, errUsageJSONInvalid
 	}
 
-	log.Printf("D-Bus service registered: %s", dbusServiceName)
-	select {} // Block forever, methods are called in separate goroutines
+	snapshot.SchemaVersion = snapshotSchemaVersion
+	if snapshot.CapturedAt == "" {
+		snapshot.CapturedAt = now.Format(time.RFC3339)
+	}
+	for i := range snapshot.Quotas {
+		q := &snapshot.Quotas[i]
+		if q.ResetsAt == nil || q.TimeRemainingSeconds != nil {
+			continue
+		}
+		resetTime, err := time.Parse(time.RFC3339, *q.ResetsAt)
+		if err != nil {
+			continue
+		}
+		seconds := int64(resetTime.Sub(now).Seconds())
+		if seconds < 0 {
+			seconds = 0
+		}
+		q.TimeRemainingSeconds = &seconds
+		q.TimeRemainingHuman = formatDuration(seconds)
+		q.TimeRemainingISO = formatISODuration(seconds)
+	}
+	if validUntil := soonestReset(snapshot.Quotas); validUntil != nil && snapshot.ValidUntil == nil {
+		ts := validUntil.Format(time.RFC3339)
+		snapshot.ValidUntil = &ts
+	}
+	return &snapshot, nil
 }
 
-// sendNotification sends a desktop notification via D-Bus (org.freedesktop.Notifications)
-func sendNotification(summary, body, iconPath string, timeoutMs int32) error {
-	conn, err := dbus.SessionBus()
-	if err != nil {
-		return fmt.Errorf("failed to connect to session bus: %w", err)
+// usageJSONRejected reports whether a failed /usage --json call means claude
+// has no JSON mode: it names the command or flag as unknown (on stdout or
+// stderr), or it exited non-zero without printing anything
+func usageJSONRejected(output string, err error) bool {
+	if jsonRejectedPattern.MatchString(stripANSI(output)) {
+		return true
 	}
-
-	obj := conn.Object("org.freedesktop.Notifications", "/org/freedesktop/Notifications")
-	call := obj.Call("org.freedesktop.Notifications.Notify", 0,
-		"claude-o-meter",              // app_name
-		uint32(0),                     // replaces_id (0 = new notification)
-		iconPath,                      // app_icon
-		summary,                       // summary
-		body,                          // body
-		[]string{},                    // actions (empty for simple notification)
-		map[string]dbus.Variant{},     // hints (empty for basic notification)
-		timeoutMs,                     // expire_timeout (-1 = server default, 0 = never, >0 = ms)
-	)
-
-	if call.Err != nil {
-		return fmt.Errorf("failed to send notification: %w", call.Err)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && jsonRejectedPattern.MatchString(stripANSI(string(exitErr.Stderr))) {
+		return true
 	}
-
-	return nil
+	return err != nil && strings.TrimSpace(output) == ""
 }
 
-// NotifyConfig holds notification configuration for the daemon
-type NotifyConfig struct {
-	Threshold int    // Percentage threshold (0-100), 0 = disabled
-	TimeoutMs int32  // Notification timeout in milliseconds (-1 = server default, 0 = never)
-	IconPath  string // Path to icon file
-}
-
-// runDaemon runs the query in a loop, writing results to the output file
-func runDaemon(interval time.Duration, outputFile string, timeout time.Duration, debug bool, enableDbus bool, notifyConfig *NotifyConfig) {
-	log.Printf("Starting daemon: interval=%s, output=%s, debug=%v, dbus=%v", interval, outputFile, debug, enableDbus)
-	if notifyConfig != nil && notifyConfig.Threshold > 0 {
-		log.Printf("Notifications enabled: threshold=%d%%, timeout=%dms, icon=%s",
-			notifyConfig.Threshold, notifyConfig.TimeoutMs, notifyConfig.IconPath)
+// queryUsageJSON is the --json-mode capture: one claude /usage --json call,
+// decoded by parseUsageJSON, given timeout. Returns the raw response
+// alongside the snapshot, and errUsageJSONUnsupported only if claude
+// rejected the call (see usageJSONRejected).
+func queryUsageJSON(opts *QueryOptions, timeout time.Duration) (*UsageSnapshot, string, error) {
+	executor := opts.JSONExecutor
+	if executor == nil {
+		executor = executeClaudeJSON
 	}
 
-	// Create refresh channel for D-Bus triggers
-	refreshChan := make(chan struct{}, 1)
-
-	// Start D-Bus service if enabled
-	if enableDbus {
-		go startDBusService(refreshChan)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	output, err := executor(ctx, opts)
+	if err != nil && (ctx.Err() != nil || errors.Is(err, errClaudeNotFound)) {
+		return nil, output, err
+	}
+	if usageJSONRejected(output, err) {
+		return nil, output, errUsageJSONUnsupported
+	}
+	if err != nil {
+		return nil, output, err
+	}
+	snapshot, err := parseUsageJSON(output, time.Now())
+	if err != nil {
+		return nil, output, err
+	}
+	opts.Metrics.record(time.Since(start), nil)
+	if opts.IncludeRaw {
+		snapshot.RawOutput = output
 	}
+	return snapshot, output, nil
+}
 
-	// Handle signals for graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+// runQuery runs opts.Captures sequential queries (at least one) and returns
+// the most complete snapshot with its raw output, see bestOf. Captures stop
+// early once one is complete or reports an auth error. The error is returned
+// only if every capture failed.
+func runQuery(opts *QueryOptions) (*UsageSnapshot, string, error) {
+	if opts.Captures <= 1 {
+		return runQueryOnce(opts)
+	}
 
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+	var snapshots []*UsageSnapshot
+	rawOutputs := map[*UsageSnapshot]string{}
+	var lastRaw string
+	var lastErr error
+	for i := 0; i < opts.Captures; i++ {
+		if i > 0 && !sleepContext(opts.Context, opts.CaptureGap) {
+			break
+		}
+		snapshot, rawOutput, err := runQueryOnce(opts)
+		if err != nil {
+			lastRaw, lastErr = rawOutput, err
+			if !isRetryableQueryError(err) {
+				break
+			}
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+		rawOutputs[snapshot] = rawOutput
+		if snapshot.AuthError != nil || isCompleteSnapshot(snapshot) {
+			break
+		}
+	}
+	if best := bestOf(snapshots); best != nil {
+		return best, rawOutputs[best], nil
+	}
+	return nil, lastRaw, lastErr
+}
 
-	// Reset timer for auto-refresh when quota resets
-	var resetTimer *time.Timer
-	var resetTimerChan <-chan time.Time
+// isCompleteSnapshot reports whether a capture has nothing left to gain from
+// another one: API usage, or session and weekly quotas (which every plan
+// shows) with none truncated and a reset time for each quota
+func isCompleteSnapshot(snapshot *UsageSnapshot) bool {
+	if snapshot.APIUsage != nil {
+		return true
+	}
+	if snapshot.Incomplete || snapshot.Session() == nil || snapshot.Weekly() == nil {
+		return false
+	}
+	for _, q := range snapshot.Quotas {
+		if q.ResetsAt == nil {
+			return false
+		}
+	}
+	return true
+}
 
-	// scheduleResetRefresh calculates and schedules the next reset-based refresh
-	scheduleResetRefresh := func(quotas []Quota) {
-		// Stop existing timer if any and drain channel if it already fired
-		if resetTimer != nil {
-			if !resetTimer.Stop() {
-				select {
-				case <-resetTimer.C:
-				default:
-				}
+// bestOf picks the most complete of several captures: one that was not cut
+// off, then the most quotas, then the most parsed reset times, then the
+// fewest warnings. Ties go to the later capture, which is fresher. Nil
+// entries are skipped; returns nil if there is no snapshot.
+func bestOf(snapshots []*UsageSnapshot) *UsageSnapshot {
+	score := func(s *UsageSnapshot) [4]int {
+		resets := 0
+		for _, q := range s.Quotas {
+			if q.ResetsAt != nil {
+				resets++
 			}
 		}
+		complete := 1
+		if s.Incomplete {
+			complete = 0
+		}
+		return [4]int{complete, len(s.Quotas), resets, -len(s.Warnings)}
+	}
 
-		delay := calculateNextResetRefresh(quotas)
-		if delay == nil {
-			resetTimerChan = nil
-			return
+	var best *UsageSnapshot
+	var bestScore [4]int
+	for _, s := range snapshots {
+		if s == nil {
+			continue
 		}
+		sc := score(s)
+		if best == nil || !scoreLess(sc, bestScore) {
+			best, bestScore = s, sc
+		}
+	}
+	return best
+}
 
-		resetTimer = time.NewTimer(*delay)
-		resetTimerChan = resetTimer.C
-		log.Printf("Scheduled reset refresh in %s", delay)
+// scoreLess compares bestOf scores field by field
+func scoreLess(a, b [4]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
 	}
+	return false
+}
 
-	// Track notification state to avoid spamming
-	// Reset when usage drops below threshold
-	notificationSent := false
+// runQueryOnce executes a single query and returns the snapshot, raw CLI output, and error.
+// The raw output is always returned (even on error) for debugging purposes.
+// Failed spawns are retried up to opts.MaxRetries times with a linear backoff.
+// Auth errors are not retried: they are reported in the snapshot, not as an error.
+// Empty or whitespace-only output is treated as a failed spawn (errNoClaudeOutput).
+// With opts.JSONMode, /usage --json is tried first and the TUI is scraped only
+// if that fails; both captures produce the same UsageSnapshot. The two share
+// one opts.Timeout: the JSON call gets at most half, and the first TUI attempt
+// the rest.
+func runQueryOnce(opts *QueryOptions) (*UsageSnapshot, string, error) {
+	// Shutting down: only a query already in flight may finish
+	if opts.Context != nil && opts.Context.Err() != nil {
+		return nil, "", opts.Context.Err()
+	}
+	firstTimeout := opts.Timeout
+	if opts.JSONMode {
+		jsonStart := time.Now()
+		snapshot, output, err := queryUsageJSON(opts, opts.Timeout/2)
+		firstTimeout = opts.Timeout - time.Since(jsonStart)
+		if err == nil {
+			stampRequestedOrg(snapshot, opts.Org)
+			return snapshot, output, nil
+		}
+		if errors.Is(err, errClaudeNotFound) {
+			return nil, output, err
+		}
+		if errors.Is(err, errUsageJSONUnsupported) {
+			// Don't pay for a second spawn on every later query
+			opts.JSONMode = false
+		}
+		log.Printf("JSON usage query failed, scraping the TUI instead: %v", err)
+	}
 
-	// Track query success for retry behavior.
-	// On failure, retry at a fixed 1-minute interval until success.
-	// During startup (before first successful query), use faster 5s retries
-	// to recover quickly when network becomes available.
-	lastQuerySucceeded := true
-	retryInterval := 1 * time.Minute
-	startupMode := true
-	startupRetryInterval := 5 * time.Second
+	executor := opts.Executor
+	if executor == nil {
+		executor = executeClaudeCLI
+	}
 
-	// Run immediately on start
-	doQuery := func() bool {
-		snapshot, rawOutput, err := runQuery(false, timeout, debug)
-		if err != nil {
-			log.Printf("Query failed: %v", err)
-			// Log raw CLI output for debugging
-			if rawOutput != "" {
-				log.Printf("Raw CLI output:\n%s", stripANSI(rawOutput))
-			}
-			// Write error response to file so consumers know there was an issue
-			errResp := &UsageSnapshot{
-				AccountType: AccountTypeUnknown,
-				CapturedAt:  time.Now().Format(time.RFC3339),
-			}
-			if writeErr := writeSnapshotToFile(errResp, outputFile); writeErr != nil {
-				log.Printf("Failed to write error state: %v", writeErr)
+	var rawOutput string
+	var err error
+	for attempt := 0; attempt <= opts.MaxRetries; attempt++ {
+		if attempt > 0 {
+			backoff := time.Duration(attempt) * opts.RetryBackoff
+			log.Printf("Query attempt %d/%d failed: %v (retrying in %s)", attempt, opts.MaxRetries+1, err, backoff)
+			if !sleepContext(opts.Context, backoff) {
+				break
 			}
-			return false
 		}
 
-		// Check for authentication errors
-		if snapshot.AuthError != nil {
-			log.Printf("Authentication error: %s - %s", snapshot.AuthError.Code, snapshot.AuthError.Message)
+		// The spawn itself is not tied to opts.Context: a query already
+		// running at shutdown finishes so its snapshot can still be written
+		timeout := opts.Timeout
+		if attempt == 0 {
+			timeout = firstTimeout
 		}
-
-		if err := writeSnapshotToFile(snapshot, outputFile); err != nil {
-			log.Printf("Failed to write snapshot: %v", err)
-			// File write failed - trigger retry interval since output file wasn't updated
-			return false
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		start := time.Now()
+		rawOutput, err = executor(ctx, opts)
+		if err == nil && strings.TrimSpace(rawOutput) == "" {
+			err = errNoClaudeOutput
 		}
-
-		if snapshot.AuthError != nil {
-			// Already logged above, just note the write succeeded
-			log.Printf("Auth error state written to file")
-		} else if len(snapshot.Quotas) > 0 {
-			log.Printf("Query successful: %s quota at %.0f%%",
-				snapshot.AccountType,
-				100-snapshot.Quotas[0].PercentRemaining)
-
-			// Check if notification threshold is exceeded (session quota only)
-			if notifyConfig != nil && notifyConfig.Threshold > 0 {
-				sessionUsed := 100 - snapshot.Quotas[0].PercentRemaining
-				if sessionUsed >= float64(notifyConfig.Threshold) {
-					if !notificationSent {
-						err := sendNotification(
-							"Claude Usage High",
-							fmt.Sprintf("Session usage at %.0f%% (threshold: %d%%)", sessionUsed, notifyConfig.Threshold),
-							notifyConfig.IconPath,
-							notifyConfig.TimeoutMs,
-						)
-						if err != nil {
-							log.Printf("Failed to send notification: %v", err)
-						} else {
-							log.Printf("Notification sent: session usage at %.0f%%", sessionUsed)
-							notificationSent = true
-						}
-					}
-				} else {
-					// Reset notification state when usage drops below threshold
-					if notificationSent {
-						log.Printf("Usage dropped below threshold, notification reset")
-					}
-					notificationSent = false
-				}
-			}
-		} else {
-			log.Printf("Query returned no quota data")
+		// Explain a conflict instead of reporting whatever it led to (a timeout)
+		if detectInstanceConflict(rawOutput) {
+			err = errInstanceConflict
 		}
+		opts.Metrics.record(time.Since(start), err)
+		cancel()
 
-		// Schedule next reset-based refresh
-		scheduleResetRefresh(snapshot.Quotas)
-		return true
+		if err == nil || !isRetryableQueryError(err) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, rawOutput, err
 	}
 
-	lastQuerySucceeded = doQuery()
-	if !lastQuerySucceeded {
-		ticker.Reset(startupRetryInterval)
-		log.Printf("Initial query failed (startup mode), retrying in %s", startupRetryInterval)
-	} else {
-		ticker.Reset(interval)
-		startupMode = false
+	var explain *parseExplainer
+	if opts.Explain != nil || opts.ParseDebug {
+		explain = &parseExplainer{w: opts.Explain}
+	}
+	if opts.ParseDebug {
+		explain.debug = &ParseDebug{}
 	}
+	snapshot := parseClaudeOutput(rawOutput, opts.IncludeRaw, opts.StrictAccountType, opts.ResetKeywords, explain)
+	if opts.ParseDebug {
+		snapshot.Debug = explain.debug
+	}
+	stampRequestedOrg(snapshot, opts.Org)
+	return snapshot, rawOutput, nil
+}
 
-	for {
-		select {
-		case <-ticker.C:
-			wasSuccessful := lastQuerySucceeded
-			lastQuerySucceeded = doQuery()
-			if lastQuerySucceeded {
-				if startupMode {
-					startupMode = false
-					ticker.Reset(interval)
-					log.Printf("Startup completed, switching to normal polling interval: %s", interval)
-				} else if !wasSuccessful {
-					// Recovered from failure during normal operation
-					ticker.Reset(interval)
-					log.Printf("Query recovered, resuming normal interval: %s", interval)
-				}
-			} else {
-				if startupMode {
-					ticker.Reset(startupRetryInterval)
-					log.Printf("Startup query failed, retrying in %s", startupRetryInterval)
-				} else if wasSuccessful {
-					// Just failed during normal operation
-					ticker.Reset(retryInterval)
-					log.Printf("Switching to retry interval: %s", retryInterval)
-				} else {
-					// Continuing failure during normal operation
-					ticker.Reset(retryInterval)
-				}
-			}
-		case <-refreshChan:
-			log.Printf("D-Bus refresh requested")
-			wasSuccessful := lastQuerySucceeded
-			lastQuerySucceeded = doQuery()
-			if lastQuerySucceeded {
-				if startupMode {
-					startupMode = false
-					log.Printf("Startup completed via D-Bus refresh")
-				}
-				ticker.Reset(interval) // Reset timer after successful manual refresh
-				if !wasSuccessful {
-					log.Printf("Query recovered, resuming normal interval: %s", interval)
-				}
-			} else {
-				// Failed via D-Bus trigger - use appropriate retry interval
-				if startupMode {
-					ticker.Reset(startupRetryInterval)
-				} else {
-					ticker.Reset(retryInterval)
-					if wasSuccessful {
-						log.Printf("Switching to retry interval: %s", retryInterval)
-					}
-				}
-			}
-		case <-resetTimerChan:
-			log.Printf("Quota reset timer fired, refreshing...")
-			wasSuccessful := lastQuerySucceeded
-			lastQuerySucceeded = doQuery()
-			if lastQuerySucceeded {
-				if startupMode {
-					startupMode = false
-					log.Printf("Startup completed via reset timer refresh")
-				}
-				ticker.Reset(interval) // Reset regular ticker after successful reset refresh
-				if !wasSuccessful {
-					log.Printf("Query recovered, resuming normal interval: %s", interval)
-				}
-			} else {
-				// Failed via reset trigger - use appropriate retry interval
-				if startupMode {
-					ticker.Reset(startupRetryInterval)
-				} else {
-					ticker.Reset(retryInterval)
-					if wasSuccessful {
-						log.Printf("Switching to retry interval: %s", retryInterval)
-					}
-				}
-			}
-		case sig := <-sigChan:
-			log.Printf("Received signal %v, shutting down...", sig)
-			if resetTimer != nil {
-				resetTimer.Stop()
-			}
-			return
-		}
+// stampRequestedOrg records the organization requested with --org. The claude
+// CLI has no option to scope /usage to an org, so the active org cannot be
+// switched; a mismatch with the org claude reports is flagged as a warning.
+func stampRequestedOrg(snapshot *UsageSnapshot, org string) {
+	if org == "" {
+		return
+	}
+	if snapshot.Organization == "" {
+		snapshot.Organization = org
+		return
+	}
+	if !strings.EqualFold(snapshot.Organization, org) {
+		snapshot.Warnings = append(snapshot.Warnings,
+			fmt.Sprintf("usage is for organization %q, not the requested %q", snapshot.Organization, org))
 	}
 }
 
-func printUsage() {
-	fmt.Printf(`claude-o-meter %s - Get Claude usage metrics as JSON
+// isBrokenPipe reports whether err comes from writing to a pipe whose
+// reader has gone away
+func isBrokenPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE)
+}
 
-Usage: claude-o-meter <command> [options]
+// snapshotStdout receives snapshots written to the "-" output path
+var snapshotStdout io.Writer = os.Stdout
 
-Commands:
-  query     Query usage once and output to stdout (default if no command given)
-  daemon    Run as a daemon, periodically querying and writing to file
-  hyprpanel Read from file and output HyprPanel-compatible JSON
-  refresh   Trigger immediate daemon refresh via D-Bus
+// writeSnapshotToFile atomically writes a snapshot to the given file path.
+// The path "-" writes a compact JSON line to stdout instead (JSONL streaming).
+func writeSnapshotToFile(snapshot *UsageSnapshot, outputFile string) error {
+	if outputFile == "-" {
+		jsonBytes, err := json.Marshal(snapshot)
+		if err != nil {
+			return fmt.Errorf("failed to encode JSON: %w", err)
+		}
+		if _, err := fmt.Fprintln(snapshotStdout, string(jsonBytes)); err != nil {
+			return fmt.Errorf("failed to write to stdout: %w", err)
+		}
+		return nil
+	}
 
-Global options:
-  -v, --version         Show version
-  -h, --help            Show help
+	jsonBytes, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode JSON: %w", err)
+	}
 
-Query options:
-  -d, --debug           Enable debug mode (includes raw output)
-  -r, --raw             Include raw CLI output in JSON
-  --hyprpanel-json      Output in HyprPanel module format
+	// Ensure directory exists
+	dir := filepath.Dir(outputFile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
 
-Daemon options:
-  -i, --interval        Query interval (default: 60s)
-  -f, --file            Output file path (required)
-  -b, --dbus            Enable D-Bus service for external refresh triggers
-  --debug               Print claude CLI output in real-time
-  -t, --notify-threshold  Notify when session usage >= this %% (0 = disabled)
-  --notify-timeout      Notification display timeout (e.g., 5s; 0 = never)
-  --notify-icon         Path to notification icon (PNG/SVG)
+	// Write to temp file first
+	tmpFile := outputFile + ".tmp"
+	if err := os.WriteFile(tmpFile, jsonBytes, 0644); err != nil {
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
 
-HyprPanel options:
-  -f, --file       Input file path (required)
+	// Atomic rename
+	if err := os.Rename(tmpFile, outputFile); err != nil {
+		os.Remove(tmpFile) // Clean up on failure
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+
+	return nil
+}
+
+// defaultSnapshotPath returns the snapshot file used when -f is omitted:
+// $XDG_RUNTIME_DIR/claude-o-meter/usage.json, or under /tmp if XDG_RUNTIME_DIR is unset
+func defaultSnapshotPath() string {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = "/tmp"
+	}
+	return filepath.Join(runtimeDir, "claude-o-meter", "usage.json")
+}
+
+// writeSequencedSnapshot writes a snapshot stamped with the next sequence number.
+// seq holds the number of the last successful write and is only advanced on success.
+func writeSequencedSnapshot(snapshot *UsageSnapshot, outputFile string, seq *uint64) error {
+	snapshot.Seq = *seq + 1
+	if err := writeSnapshotToFile(snapshot, outputFile); err != nil {
+		return err
+	}
+	*seq = snapshot.Seq
+	return nil
+}
+
+// isFailureSnapshot reports whether a snapshot records a broken state: an
+// auth error or output without any usage figures
+func isFailureSnapshot(snapshot *UsageSnapshot) bool {
+	return snapshot.AuthError != nil || !hasUsageData(snapshot)
+}
+
+// writeOnlyErrors implements daemon --only-errors: failure snapshots are
+// written like writeSequencedSnapshot does, successful ones are not, and a
+// file left behind by an earlier failure is removed once queries recover
+func writeOnlyErrors(snapshot *UsageSnapshot, outputFile string, seq *uint64) error {
+	if isFailureSnapshot(snapshot) {
+		return writeSequencedSnapshot(snapshot, outputFile, seq)
+	}
+	if outputFile == "-" {
+		return nil
+	}
+	if err := os.Remove(outputFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to clear error state: %w", err)
+	}
+	return nil
+}
+
+// parseSinceCutoff parses a --since value: either a duration relative to now
+// (e.g. "24h") or an absolute RFC3339 timestamp
+func parseSinceCutoff(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		if d < 0 {
+			return time.Time{}, fmt.Errorf("--since duration must not be negative: %s", value)
+		}
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --since value %q: expected a duration (24h) or RFC3339 timestamp", value)
+}
+
+// filterSince returns the snapshots captured at or after cutoff.
+// Snapshots with an unparseable CapturedAt are skipped with a warning.
+func filterSince(snapshots []*UsageSnapshot, cutoff time.Time) []*UsageSnapshot {
+	var filtered []*UsageSnapshot
+	for _, snapshot := range snapshots {
+		capturedAt, err := time.Parse(time.RFC3339, snapshot.CapturedAt)
+		if err != nil {
+			log.Printf("Warning: skipping snapshot with invalid captured_at %q", snapshot.CapturedAt)
+			continue
+		}
+		if !capturedAt.Before(cutoff) {
+			filtered = append(filtered, snapshot)
+		}
+	}
+	return filtered
+}
+
+// readSnapshotHistory reads newline-delimited snapshot JSON (one snapshot per line).
+// Blank lines are ignored and malformed lines are skipped with a warning.
+func readSnapshotHistory(r io.Reader) ([]*UsageSnapshot, error) {
+	var snapshots []*UsageSnapshot
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024) // raw_output can make lines long
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var snapshot UsageSnapshot
+		if err := json.Unmarshal([]byte(line), &snapshot); err != nil {
+			log.Printf("Warning: skipping malformed snapshot on line %d: %v", lineNum, err)
+			continue
+		}
+		snapshots = append(snapshots, &snapshot)
+	}
+	if err := scanner.Err(); err != nil {
+		return snapshots, fmt.Errorf("failed to read history: %w", err)
+	}
+	return snapshots, nil
+}
+
+// loadSeries reads every *.json snapshot in dir and returns them sorted by
+// captured_at, oldest first. Malformed files and snapshots without a valid
+// captured_at are skipped with a warning.
+func loadSeries(dir string) ([]*UsageSnapshot, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot directory: %w", err)
+	}
+
+	type timedSnapshot struct {
+		snapshot   *UsageSnapshot
+		capturedAt time.Time
+	}
+	var timed []timedSnapshot
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		snapshot, err := readSnapshotFile(path)
+		if err != nil {
+			log.Printf("Warning: skipping malformed snapshot %s: %v", path, err)
+			continue
+		}
+		capturedAt, err := time.Parse(time.RFC3339, snapshot.CapturedAt)
+		if err != nil {
+			log.Printf("Warning: skipping snapshot %s with invalid captured_at %q", path, snapshot.CapturedAt)
+			continue
+		}
+		timed = append(timed, timedSnapshot{snapshot, capturedAt})
+	}
+
+	sort.SliceStable(timed, func(i, j int) bool {
+		return timed[i].capturedAt.Before(timed[j].capturedAt)
+	})
+	snapshots := make([]*UsageSnapshot, len(timed))
+	for i, t := range timed {
+		snapshots[i] = t.snapshot
+	}
+	return snapshots, nil
+}
+
+// seriesPoint is one entry of the series command output. Used values are
+// nil when the snapshot has no such quota.
+type seriesPoint struct {
+	CapturedAt  string   `json:"captured_at"`
+	SessionUsed *float64 `json:"session_used"`
+	WeeklyUsed  *float64 `json:"weekly_used"`
+}
+
+// seriesPoints extracts session and weekly used percentages from snapshots
+func seriesPoints(snapshots []*UsageSnapshot) []seriesPoint {
+	used := func(snapshot *UsageSnapshot, name string) *float64 {
+		q := findQuota(snapshot.Quotas, name)
+		if q == nil {
+			return nil
+		}
+		v := 100 - q.PercentRemaining
+		return &v
+	}
+	points := make([]seriesPoint, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		points = append(points, seriesPoint{
+			CapturedAt:  snapshot.CapturedAt,
+			SessionUsed: used(snapshot, "session"),
+			WeeklyUsed:  used(snapshot, "weekly"),
+		})
+	}
+	return points
+}
+
+// writeSeriesCSV writes points as CSV with a header row; missing values are empty
+func writeSeriesCSV(w io.Writer, points []seriesPoint) error {
+	field := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'f', -1, 64)
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"captured_at", "session_used", "weekly_used"})
+	for _, p := range points {
+		cw.Write([]string{p.CapturedAt, field(p.SessionUsed), field(p.WeeklyUsed)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// minRemaining returns the quota with the least percentage remaining,
+// or nil if there are no quotas
+func minRemaining(quotas []Quota) *Quota {
+	var worst *Quota
+	for i := range quotas {
+		if worst == nil || quotas[i].PercentRemaining < worst.PercentRemaining {
+			worst = &quotas[i]
+		}
+	}
+	return worst
+}
+
+// alertExitCode is returned by query --alert-below when a quota is below the
+// threshold. It differs from 1 (query failed) and 2 (bad flags).
+const alertExitCode = 3
+
+// setupRequiredExitCode is returned by query when claude shows its first-run
+// setup screen instead of usage, which only an interactive run can get past
+const setupRequiredExitCode = 4
+
+// setupRequiredHint tells the user how to get past the first-run setup screen
+const setupRequiredHint = "Claude CLI has not been set up yet: run `claude` once interactively, complete the setup (theme, login), then try again."
+
+// unchangedExitCode is returned by query --changed-from when no quota moved
+// by at least --changed-by since the stored snapshot
+const unchangedExitCode = 10
+
+// quotaKey identifies a quota across snapshots
+func quotaKey(q *Quota) string {
+	return string(q.Type) + "/" + q.Model
+}
+
+// changedBeyond reports whether cur differs meaningfully from prev: a quota
+// appeared or disappeared, or its rounded used percentage moved by at least
+// threshold points. A nil prev (no earlier snapshot) always counts as changed.
+func changedBeyond(prev, cur *UsageSnapshot, threshold float64) bool {
+	if prev == nil {
+		return true
+	}
+	if len(prev.Quotas) != len(cur.Quotas) {
+		return true
+	}
+	prevUsed := make(map[string]float64, len(prev.Quotas))
+	for i := range prev.Quotas {
+		prevUsed[quotaKey(&prev.Quotas[i])] = math.Round(100 - prev.Quotas[i].PercentRemaining)
+	}
+	for i := range cur.Quotas {
+		used, ok := prevUsed[quotaKey(&cur.Quotas[i])]
+		if !ok {
+			return true
+		}
+		if math.Abs(math.Round(100-cur.Quotas[i].PercentRemaining)-used) >= threshold {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshotReadRetryDelay is how long readSnapshotData waits before re-reading
+// a snapshot file that looked partially written
+const snapshotReadRetryDelay = 50 * time.Millisecond
+
+// readSnapshotData reads a snapshot file written by the daemon. Even with an
+// atomic rename, some filesystems let a reader see an empty file during the
+// rename window, so content that is not a JSON object with at least one field
+// is read once more after snapshotReadRetryDelay. Callers still decode and
+// report errors on the returned data as before.
+func readSnapshotData(path string) ([]byte, error) {
+	return retryPartialRead(func() ([]byte, error) { return os.ReadFile(path) }, snapshotReadRetryDelay)
+}
+
+// retryPartialRead calls read and, if the data holds no JSON fields, calls it
+// once more after delay and returns that result instead
+func retryPartialRead(read func() ([]byte, error), delay time.Duration) ([]byte, error) {
+	data, err := read()
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(data, &fields) == nil && len(fields) > 0 {
+		return data, nil
+	}
+	time.Sleep(delay)
+	return read()
+}
+
+// readSnapshotFile loads a snapshot written by writeSnapshotToFile
+func readSnapshotFile(path string) (*UsageSnapshot, error) {
+	data, err := readSnapshotData(path)
+	if err != nil {
+		return nil, err
+	}
+	var snapshot UsageSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return &snapshot, nil
+}
+
+// quotaBelow returns the quota with the least remaining if it is below
+// threshold percent remaining, or nil otherwise
+func quotaBelow(quotas []Quota, threshold float64) *Quota {
+	worst := minRemaining(quotas)
+	if worst == nil || worst.PercentRemaining >= threshold {
+		return nil
+	}
+	return worst
+}
+
+// findQuota selects a quota by name: "session", "weekly", a model name such
+// as "opus" or "sonnet", or "worst" for the quota with the least remaining.
+// Returns nil if the snapshot has no such quota.
+func findQuota(quotas []Quota, name string) *Quota {
+	switch name {
+	case "worst":
+		return minRemaining(quotas)
+	case "session":
+		return quotaOfType(quotas, QuotaTypeSession, "")
+	case "weekly":
+		return quotaOfType(quotas, QuotaTypeWeekly, "")
+	}
+	return quotaOfType(quotas, QuotaTypeModelSpecific, name)
+}
+
+// quotaOfType returns the first quota of qType (with the given model, for
+// model-specific quotas), or nil
+func quotaOfType(quotas []Quota, qType QuotaType, model string) *Quota {
+	for i := range quotas {
+		if q := &quotas[i]; q.Type == qType && (qType != QuotaTypeModelSpecific || q.Model == model) {
+			return q
+		}
+	}
+	return nil
+}
+
+// Session returns the session quota, or nil if the snapshot has none
+func (s *UsageSnapshot) Session() *Quota {
+	return quotaOfType(s.Quotas, QuotaTypeSession, "")
+}
+
+// Weekly returns the all-models weekly quota, or nil if the snapshot has none
+func (s *UsageSnapshot) Weekly() *Quota {
+	return quotaOfType(s.Quotas, QuotaTypeWeekly, "")
+}
+
+// Model returns the model-specific quota for model ("opus", "sonnet"), or nil
+func (s *UsageSnapshot) Model(model string) *Quota {
+	return quotaOfType(s.Quotas, QuotaTypeModelSpecific, model)
+}
+
+// Worst returns the quota with the least remaining, or nil if there are none
+func (s *UsageSnapshot) Worst() *Quota {
+	return minRemaining(s.Quotas)
+}
+
+// sparklineGlyphs are the eight block elements used by sparkline, lowest first
+var sparklineGlyphs = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline renders used percentages (0-100) as a row of block glyphs.
+// Values are mapped on the absolute 0-100 scale so a flat series stays flat.
+func sparkline(values []float64) string {
+	var sb strings.Builder
+	for _, v := range values {
+		v = math.Max(0, math.Min(100, v))
+		idx := int(math.Round(v / 100 * float64(len(sparklineGlyphs)-1)))
+		sb.WriteRune(sparklineGlyphs[idx])
+	}
+	return sb.String()
+}
+
+// startDBusService registers the D-Bus service and blocks forever
+func startDBusService(refreshChan chan struct{}) {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		log.Printf("Failed to connect to session bus: %v", err)
+		return
+	}
+
+	service := &DBusService{refreshChan: refreshChan}
+
+	// Export the service methods
+	err = conn.Export(service, dbus.ObjectPath(dbusObjectPath), dbusInterface)
+	if err != nil {
+		log.Printf("Failed to export D-Bus service: %v", err)
+		return
+	}
+
+	// Export introspection data for dbus-send compatibility
+	introNode := &introspect.Node{
+		Name: dbusObjectPath,
+		Interfaces: []introspect.Interface{
+			introspect.IntrospectData,
+			{
+				Name: dbusInterface,
+				Methods: []introspect.Method{
+					{
+						Name: "RefreshNow",
+					},
+				},
+			},
+		},
+	}
+	err = conn.Export(introspect.NewIntrospectable(introNode), dbus.ObjectPath(dbusObjectPath),
+		"org.freedesktop.DBus.Introspectable")
+	if err != nil {
+		log.Printf("Failed to export introspection: %v", err)
+		return
+	}
+
+	// Request the service name
+	reply, err := conn.RequestName(dbusServiceName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		log.Printf("Failed to request D-Bus name: %v", err)
+		return
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		log.Printf("D-Bus name %s already taken", dbusServiceName)
+		return
+	}
+
+	log.Printf("D-Bus service registered: %s", dbusServiceName)
+	select {} // Block forever, methods are called in separate goroutines
+}
+
+// sendNotification sends a desktop notification via D-Bus (org.freedesktop.Notifications)
+func sendNotification(summary, body, iconPath string, timeoutMs int32) error {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return fmt.Errorf("failed to connect to session bus: %w", err)
+	}
+
+	obj := conn.Object("org.freedesktop.Notifications", "/org/freedesktop/Notifications")
+	call := obj.Call("org.freedesktop.Notifications.Notify", 0,
+		"claude-o-meter",              // app_name
+		uint32(0),                     // replaces_id (0 = new notification)
+		iconPath,                      // app_icon
+		summary,                       // summary
+		body,                          // body
+		[]string{},                    // actions (empty for simple notification)
+		map[string]dbus.Variant{},     // hints (empty for basic notification)
+		timeoutMs,                     // expire_timeout (-1 = server default, 0 = never, >0 = ms)
+	)
+
+	if call.Err != nil {
+		return fmt.Errorf("failed to send notification: %w", call.Err)
+	}
+
+	return nil
+}
+
+// snapshotSocket serves the latest snapshot over a Unix domain socket:
+// each connection receives one JSON line and is then closed
+type snapshotSocket struct {
+	path     string
+	listener net.Listener
+
+	mu     sync.RWMutex
+	latest []byte
+}
+
+// listenSnapshotSocket starts serving snapshots on the socket at path.
+// A stale socket file left behind by a previous daemon is replaced.
+func listenSnapshotSocket(path string) (*snapshotSocket, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on socket: %w", err)
+	}
+
+	s := &snapshotSocket{path: path, listener: listener}
+	go s.serve()
+	return s, nil
+}
+
+// Update replaces the snapshot returned to new connections
+func (s *snapshotSocket) Update(snapshot *UsageSnapshot) {
+	jsonBytes, err := json.Marshal(snapshot)
+	if err != nil {
+		log.Printf("Failed to encode snapshot for socket: %v", err)
+		return
+	}
+	s.mu.Lock()
+	s.latest = jsonBytes
+	s.mu.Unlock()
+}
+
+// Close stops accepting connections and removes the socket file
+func (s *snapshotSocket) Close() error {
+	err := s.listener.Close()
+	if rmErr := os.Remove(s.path); rmErr != nil && !errors.Is(rmErr, os.ErrNotExist) && err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+func (s *snapshotSocket) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Socket accept failed: %v", err)
+			continue
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *snapshotSocket) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+
+	s.mu.RLock()
+	data := s.latest
+	s.mu.RUnlock()
+
+	if data == nil {
+		// No query has completed yet
+		data, _ = json.Marshal(ErrorResponse{Error: "No snapshot available yet"})
+	}
+	line := make([]byte, 0, len(data)+1)
+	line = append(append(line, data...), '\n')
+	if _, err := conn.Write(line); err != nil {
+		log.Printf("Socket write failed: %v", err)
+	}
+}
+
+// maxWatchWait caps how long a /usage/watch request is held open
+const maxWatchWait = 5 * time.Minute
+
+// snapshotHTTP serves the latest snapshot over HTTP. GET /usage returns it
+// immediately; GET /usage/watch holds the request until a snapshot with a new
+// seq is published or the wait times out (204 No Content).
+type snapshotHTTP struct {
+	server   *http.Server
+	draining chan struct{} // closed by Shutdown to end held watch requests
+
+	mu      sync.RWMutex
+	latest  []byte
+	seq     uint64
+	changed chan struct{} // closed and replaced on every Update (broadcast)
+}
+
+// newSnapshotHTTP creates the HTTP snapshot handler without listening
+func newSnapshotHTTP() *snapshotHTTP {
+	return &snapshotHTTP{changed: make(chan struct{}), draining: make(chan struct{})}
+}
+
+// listenSnapshotHTTP starts serving snapshots on addr (e.g. 127.0.0.1:8765)
+func listenSnapshotHTTP(addr string) (*snapshotHTTP, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	h := newSnapshotHTTP()
+	h.server = &http.Server{Handler: h.Handler(), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := h.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("HTTP server failed: %v", err)
+		}
+	}()
+	return h, nil
+}
+
+// Handler returns the mux serving /usage and /usage/watch
+func (h *snapshotHTTP) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/usage", h.handleUsage)
+	mux.HandleFunc("/usage/watch", h.handleWatch)
+	return mux
+}
+
+// Update publishes a snapshot and wakes all waiting watch requests
+func (h *snapshotHTTP) Update(snapshot *UsageSnapshot) {
+	jsonBytes, err := json.Marshal(snapshot)
+	if err != nil {
+		log.Printf("Failed to encode snapshot for HTTP: %v", err)
+		return
+	}
+	h.mu.Lock()
+	h.latest = jsonBytes
+	h.seq = snapshot.Seq
+	close(h.changed)
+	h.changed = make(chan struct{})
+	h.mu.Unlock()
+}
+
+// Close stops the HTTP server
+func (h *snapshotHTTP) Close() error {
+	if h.server == nil {
+		return nil
+	}
+	return h.server.Close()
+}
+
+// httpDrainTimeout bounds how long Shutdown waits for in-flight requests
+const httpDrainTimeout = 5 * time.Second
+
+// Shutdown stops accepting connections and lets in-flight requests finish
+// within timeout; held watch requests are answered with 204 right away.
+// Connections still open after timeout are closed.
+func (h *snapshotHTTP) Shutdown(timeout time.Duration) error {
+	if h.server == nil {
+		return nil
+	}
+	close(h.draining)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := h.server.Shutdown(ctx); err != nil {
+		h.server.Close()
+		return err
+	}
+	return nil
+}
+
+func (h *snapshotHTTP) handleUsage(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	data := h.latest
+	h.mu.RUnlock()
+	writeSnapshotResponse(w, data)
+}
+
+// handleWatch implements /usage/watch?since=<seq>&timeout=<duration>. If the
+// current snapshot's seq differs from since it is returned at once; otherwise
+// the request waits for the next Update (default 30s, at most maxWatchWait).
+func (h *snapshotHTTP) handleWatch(w http.ResponseWriter, r *http.Request) {
+	wait := 30 * time.Second
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+		wait = min(d, maxWatchWait)
+	}
+
+	h.mu.RLock()
+	data, seq, changed := h.latest, h.seq, h.changed
+	h.mu.RUnlock()
+
+	if value := r.URL.Query().Get("since"); value != "" {
+		since, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+		if data != nil && seq != since {
+			writeSnapshotResponse(w, data)
+			return
+		}
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-changed:
+		h.mu.RLock()
+		data = h.latest
+		h.mu.RUnlock()
+		writeSnapshotResponse(w, data)
+	case <-timer.C:
+		w.WriteHeader(http.StatusNoContent)
+	case <-h.draining:
+		w.WriteHeader(http.StatusNoContent)
+	case <-r.Context().Done():
+	}
+}
+
+// writeSnapshotResponse writes snapshot JSON, or a 503 error before the first query
+func writeSnapshotResponse(w http.ResponseWriter, data []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	if data == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		data, _ = json.Marshal(ErrorResponse{Error: "No snapshot available yet"})
+	}
+	w.Write(append(data, '\n'))
+}
+
+// appendLog appends JSON lines to a history file. It reopens the file after
+// external rotation so writes never keep going to a renamed-away inode.
+type appendLog struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// openAppendLog opens (creating if needed) the history file at path for appending
+func openAppendLog(path string) (*appendLog, error) {
+	l := &appendLog{path: path}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reopen closes the current handle and opens path again (SIGUSR2, rotation)
+func (l *appendLog) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.reopenLocked()
+}
+
+func (l *appendLog) reopenLocked() error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return fmt.Errorf("failed to create history directory: %w", err)
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open history file: %w", err)
+	}
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f = f
+	return nil
+}
+
+// rotatedLocked reports whether path no longer refers to the open file
+func (l *appendLog) rotatedLocked() bool {
+	pathInfo, err := os.Stat(l.path)
+	if err != nil {
+		return true
+	}
+	fileInfo, err := l.f.Stat()
+	if err != nil {
+		return true
+	}
+	return !os.SameFile(pathInfo, fileInfo)
+}
+
+// WriteSnapshot appends a snapshot as one compact JSON line (raw output omitted).
+// The file is reopened first if it was rotated, and once more if the write fails.
+func (l *appendLog) WriteSnapshot(snapshot *UsageSnapshot) error {
+	entry := *snapshot
+	entry.RawOutput = ""
+	entry.Debug = nil
+	jsonBytes, err := json.Marshal(&entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode JSON: %w", err)
+	}
+	line := append(jsonBytes, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rotatedLocked() {
+		if err := l.reopenLocked(); err != nil {
+			return err
+		}
+	}
+	if _, err := l.f.Write(line); err != nil {
+		// Stale handle (e.g. NFS ESTALE, file removed): reopen and retry once
+		if reopenErr := l.reopenLocked(); reopenErr != nil {
+			return fmt.Errorf("failed to write history: %w", err)
+		}
+		if _, err := l.f.Write(line); err != nil {
+			return fmt.Errorf("failed to write history: %w", err)
+		}
+	}
+	return nil
+}
+
+// Close closes the history file
+func (l *appendLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// rawTranscriptMarker ends each transcript written to the daemon's --raw-input
+// FIFO. It must appear on a line of its own.
+const rawTranscriptMarker = "---END-CLAUDE-TRANSCRIPT---"
+
+// readRawTranscripts reads marker-delimited raw transcripts from r and sends
+// each complete one to out. Text after the last marker is discarded at EOF.
+func readRawTranscripts(r io.Reader, out chan<- string) error {
+	reader := bufio.NewReader(r)
+	var transcript strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		if strings.TrimRight(line, "\r\n") == rawTranscriptMarker {
+			out <- transcript.String()
+			transcript.Reset()
+		} else {
+			transcript.WriteString(line)
+		}
+		if err == io.EOF {
+			if strings.TrimSpace(transcript.String()) != "" {
+				log.Printf("Discarding raw input without end marker (%d bytes)", transcript.Len())
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read raw input: %w", err)
+		}
+	}
+}
+
+// streamRawInput feeds transcripts from path to out until the input ends.
+// A FIFO is reopened after each writer closes it; a regular file is read once.
+func streamRawInput(path string, out chan<- string) {
+	defer close(out)
+	for {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Printf("Failed to open raw input: %v", err)
+			return
+		}
+		err = readRawTranscripts(f, out)
+		info, statErr := f.Stat()
+		f.Close()
+		if err != nil {
+			log.Printf("%v", err)
+			return
+		}
+		if statErr != nil || info.Mode()&os.ModeNamedPipe == 0 {
+			return
+		}
+	}
+}
+
+// minQueryInterval is the shortest interval at which the daemon spawns claude.
+// Shorter intervals are fine for re-reading the snapshot file (hyprpanel --watch),
+// but would busy-spawn claude and trip its rate limits.
+const minQueryInterval = 5 * time.Second
+
+// clampQueryInterval raises a daemon query interval to minQueryInterval,
+// logging a warning when it does
+func clampQueryInterval(interval time.Duration) time.Duration {
+	if interval < minQueryInterval {
+		log.Printf("Warning: interval %s is below the minimum of %s for claude queries, using %s",
+			interval, minQueryInterval, minQueryInterval)
+		return minQueryInterval
+	}
+	return interval
+}
+
+// querySuccessLogLine describes a snapshot with quotas for the daemon log:
+// account type, quota count, the session quota (or the worst one if there is
+// no session quota) and the number of parse warnings
+func querySuccessLogLine(snapshot *UsageSnapshot) string {
+	account := string(snapshot.AccountType) + " account"
+	if snapshot.AccountType == AccountTypeUnknown {
+		account = "unknown account (plan not detected)"
+	}
+
+	q := snapshot.Session()
+	if q == nil {
+		q = snapshot.Worst()
+	}
+	name := string(q.Type)
+	if q.Model != "" {
+		name = q.Model
+	}
+
+	plural := func(n int, noun string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s", noun)
+		}
+		return fmt.Sprintf("%d %ss", n, noun)
+	}
+	line := fmt.Sprintf("Query successful: %s, %s, %s at %.0f%% used",
+		account, plural(len(snapshot.Quotas), "quota"), name, 100-q.PercentRemaining)
+	if len(snapshot.Warnings) > 0 {
+		line += fmt.Sprintf(", %s: %s", plural(len(snapshot.Warnings), "warning"), strings.Join(snapshot.Warnings, "; "))
+	}
+	return line
+}
+
+// splitQuotaName is the file name stem of a quota in --split-dir:
+// session, weekly, or the model of a model-specific quota
+func splitQuotaName(q *Quota) string {
+	if q.Type == QuotaTypeModelSpecific && q.Model != "" {
+		return q.Model
+	}
+	return string(q.Type)
+}
+
+// writeSplitFiles writes one small file per quota into dir for bars that
+// can only read a plain value: <name>.pct with the used percentage and
+// <name>.reset with the time remaining ("2h 14m"). Each file is replaced
+// atomically. Files of quotas that are no longer present, as during an
+// auth error, are removed so the bar does not show stale numbers.
+func writeSplitFiles(snapshot *UsageSnapshot, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	files := map[string]string{}
+	for i := range snapshot.Quotas {
+		q := &snapshot.Quotas[i]
+		name := splitQuotaName(q)
+		if _, ok := files[name+".pct"]; ok {
+			continue
+		}
+		files[name+".pct"] = fmt.Sprintf("%.0f\n", 100-q.PercentRemaining)
+		if q.TimeRemainingHuman != "" {
+			files[name+".reset"] = q.TimeRemainingHuman + "\n"
+		}
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		tmpFile := path + ".tmp"
+		if err := os.WriteFile(tmpFile, []byte(content), 0644); err != nil {
+			return fmt.Errorf("failed to write temp file: %w", err)
+		}
+		if err := os.Rename(tmpFile, path); err != nil {
+			os.Remove(tmpFile)
+			return fmt.Errorf("failed to rename temp file: %w", err)
+		}
+	}
+
+	for _, pattern := range []string{"*.pct", "*.reset"} {
+		stale, _ := filepath.Glob(filepath.Join(dir, pattern))
+		for _, path := range stale {
+			if _, ok := files[filepath.Base(path)]; !ok {
+				os.Remove(path)
+			}
+		}
+	}
+	return nil
+}
+
+// quotaBaseline is the first reading of a quota after its last reset
+type quotaBaseline struct {
+	Used       float64 `json:"used"`
+	ResetsAt   string  `json:"resets_at,omitempty"`
+	CapturedAt string  `json:"captured_at"`
+}
+
+// quotaBaselines holds a baseline per quota (by quotaKey), from which the
+// daemon reports used_since_reset. It is kept in a small JSON state file
+// (--baseline-file) so a restart does not lose the day's baseline.
+type quotaBaselines map[string]quotaBaseline
+
+// loadBaselines reads the state file; a missing or unreadable file starts
+// with no baselines
+func loadBaselines(path string) quotaBaselines {
+	baselines := quotaBaselines{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return baselines
+	}
+	if err := json.Unmarshal(data, &baselines); err != nil {
+		log.Printf("Warning: ignoring unreadable baseline file %s: %v", path, err)
+		return quotaBaselines{}
+	}
+	return baselines
+}
+
+// save writes the state file atomically
+func (b quotaBaselines) save(path string) error {
+	jsonBytes, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode JSON: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	tmpFile := path + ".tmp"
+	if err := os.WriteFile(tmpFile, jsonBytes, 0644); err != nil {
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	if err := os.Rename(tmpFile, path); err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+	return nil
+}
+
+// baselineResetDrop is how many used-percent points a quota must fall below
+// its baseline to count as reset; smaller drops are rounding jitter
+const baselineResetDrop = 5
+
+// apply sets UsedSinceReset on each quota of snapshot. A quota without a
+// baseline, or that has reset since its baseline (the baseline's reset time
+// has passed, or usage dropped more than baselineResetDrop below it), gets
+// the current reading as its new baseline. Returns whether any baseline
+// changed.
+func (b quotaBaselines) apply(snapshot *UsageSnapshot) bool {
+	now, err := time.Parse(time.RFC3339, snapshot.CapturedAt)
+	if err != nil {
+		now = time.Now()
+	}
+	changed := false
+	for i := range snapshot.Quotas {
+		q := &snapshot.Quotas[i]
+		key := quotaKey(q)
+		used := 100 - q.PercentRemaining
+
+		baseline, ok := b[key]
+		reset := !ok || baseline.Used-used > baselineResetDrop
+		if resetsAt, err := time.Parse(time.RFC3339, baseline.ResetsAt); ok && err == nil && !now.Before(resetsAt) {
+			reset = true
+		}
+		if reset {
+			baseline = quotaBaseline{Used: used, CapturedAt: snapshot.CapturedAt}
+			if q.ResetsAt != nil {
+				baseline.ResetsAt = *q.ResetsAt
+			}
+			b[key] = baseline
+			changed = true
+		}
+
+		sinceReset := math.Max(0, math.Round((used-baseline.Used)*10)/10)
+		q.UsedSinceReset = &sinceReset
+	}
+	return changed
+}
+
+// NotifyConfig holds notification configuration for the daemon
+type NotifyConfig struct {
+	Threshold int    // Percentage threshold (0-100), 0 = disabled
+	TimeoutMs int32  // Notification timeout in milliseconds (-1 = server default, 0 = never)
+	IconPath  string // Path to icon file
+	OnErrors  bool   // Also notify when queries start failing (--notify-errors)
+	OnAlert   string // Shell command run instead of a notification on a threshold crossing
+}
+
+// alertHookTimeout bounds an --on-alert command so a hanging hook is killed
+const alertHookTimeout = 30 * time.Second
+
+// alertHookEnv describes the snapshot to an --on-alert command
+func alertHookEnv(snapshot *UsageSnapshot, threshold int) []string {
+	env := []string{fmt.Sprintf("CLAUDE_ALERT_THRESHOLD=%d", threshold)}
+	for _, q := range []struct {
+		name  string
+		quota *Quota
+	}{
+		{"SESSION", snapshot.Session()},
+		{"WEEKLY", snapshot.Weekly()},
+	} {
+		if q.quota == nil {
+			continue
+		}
+		env = append(env,
+			fmt.Sprintf("CLAUDE_%s_USED=%.0f", q.name, 100-q.quota.PercentRemaining),
+			fmt.Sprintf("CLAUDE_%s_REMAINING=%.0f", q.name, q.quota.PercentRemaining))
+		if q.quota.ResetsAt != nil {
+			env = append(env, fmt.Sprintf("CLAUDE_%s_RESETS_AT=%s", q.name, *q.quota.ResetsAt))
+		}
+	}
+	return env
+}
+
+// runAlertHook starts command with sh in the background, with env added to
+// the daemon's environment, and kills it after alertHookTimeout
+func runAlertHook(command string, env []string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), alertHookTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Env = append(os.Environ(), env...)
+		cmd.WaitDelay = time.Second
+		if out, err := cmd.CombinedOutput(); err != nil {
+			log.Printf("Alert hook failed: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+	}()
+}
+
+// sessionThresholdAlert alerts once each time session usage rises to the
+// notify threshold, and re-arms when it drops back below. A snapshot without
+// a session quota is judged by its most used quota (see Worst).
+type sessionThresholdAlert struct {
+	config *NotifyConfig
+	sent   bool
+}
+
+// check alerts if snapshot crosses the threshold: via the --on-alert hook if
+// set, else a desktop notification, which is retried on the next query if
+// it could not be sent
+func (a *sessionThresholdAlert) check(snapshot *UsageSnapshot) {
+	session := snapshot.Session()
+	if session == nil {
+		session = snapshot.Worst()
+	}
+	if session == nil || a.config == nil || a.config.Threshold <= 0 {
+		return
+	}
+	sessionUsed := 100 - session.PercentRemaining
+	if sessionUsed < float64(a.config.Threshold) {
+		// Reset notification state when usage drops below threshold
+		if a.sent {
+			log.Printf("Usage dropped below threshold, notification reset")
+		}
+		a.sent = false
+		return
+	}
+	if a.sent {
+		return
+	}
+
+	if a.config.OnAlert != "" {
+		runAlertHook(a.config.OnAlert, alertHookEnv(snapshot, a.config.Threshold))
+		log.Printf("Alert hook started: session usage at %.0f%%", sessionUsed)
+		a.sent = true
+		return
+	}
+	err := sendNotification(
+		"Claude Usage High",
+		fmt.Sprintf("Session usage at %.0f%% (threshold: %d%%)", sessionUsed, a.config.Threshold),
+		a.config.IconPath,
+		a.config.TimeoutMs,
+	)
+	if err != nil {
+		log.Printf("Failed to send notification: %v", err)
+		return
+	}
+	log.Printf("Notification sent: session usage at %.0f%%", sessionUsed)
+	a.sent = true
+}
+
+// DaemonOptions configures runDaemon
+type DaemonOptions struct {
+	Interval       time.Duration // Time between claude queries
+	OutputFile     string        // Where each snapshot is written ("-" = stdout)
+	SocketPath     string        // Serve snapshots on this Unix domain socket ("" = off)
+	HTTPAddr       string        // Serve snapshots over HTTP on this address ("" = off, see snapshotHTTP)
+	HistoryFile    string        // Append each snapshot here, reopened on SIGUSR2 ("" = off)
+	SplitDir       string        // Also write one plain file per quota here ("" = off, see writeSplitFiles)
+	BaselineFile   string        // Keep quota baselines here for used_since_reset ("" = off, see quotaBaselines)
+	RawTranscripts <-chan string // Parse these transcripts instead of spawning claude (nil = spawn on a timer)
+	Query          *QueryOptions // Options for each query
+	EnableDbus     bool          // Accept refresh requests over D-Bus
+	RefreshChan    chan struct{} // Receives refresh requests
+	OnlyErrors     bool          // Keep the output file only while queries fail (see writeOnlyErrors)
+	Notify         *NotifyConfig // Threshold and error notifications (nil = off)
+}
+
+// runDaemon runs the query in a loop, writing results to the output file
+// and to whichever extra sinks opts enables. With RawTranscripts set,
+// snapshots come only from transcripts, so the interval, reset timer and
+// refresh requests are ignored.
+func runDaemon(opts DaemonOptions) {
+	log.Printf("Starting daemon: interval=%s, output=%s, socket=%s, http=%s, history=%s, split-dir=%s, baseline=%s, debug=%v, dbus=%v, max-retries=%d, only-errors=%v",
+		opts.Interval, opts.OutputFile, opts.SocketPath, opts.HTTPAddr, opts.HistoryFile, opts.SplitDir, opts.BaselineFile, opts.Query.Debug, opts.EnableDbus, opts.Query.MaxRetries, opts.OnlyErrors)
+	if opts.Notify != nil && opts.Notify.Threshold > 0 {
+		log.Printf("Notifications enabled: threshold=%d%%, timeout=%dms, icon=%s",
+			opts.Notify.Threshold, opts.Notify.TimeoutMs, opts.Notify.IconPath)
+	}
+
+	// Start D-Bus service if enabled
+	if opts.EnableDbus {
+		go startDBusService(opts.RefreshChan)
+	}
+
+	// Start the snapshot socket if requested
+	var socket *snapshotSocket
+	if opts.SocketPath != "" {
+		var err error
+		socket, err = listenSnapshotSocket(opts.SocketPath)
+		if err != nil {
+			log.Fatalf("Failed to start snapshot socket: %v", err)
+		}
+		defer socket.Close()
+		log.Printf("Serving snapshots on %s", opts.SocketPath)
+	}
+
+	// Start the HTTP endpoint if requested
+	var httpServer *snapshotHTTP
+	if opts.HTTPAddr != "" {
+		var err error
+		httpServer, err = listenSnapshotHTTP(opts.HTTPAddr)
+		if err != nil {
+			log.Fatalf("Failed to start HTTP server: %v", err)
+		}
+		defer func() {
+			if err := httpServer.Shutdown(httpDrainTimeout); err != nil {
+				log.Printf("HTTP server did not drain: %v", err)
+			}
+		}()
+		log.Printf("Serving snapshots on http://%s/usage", opts.HTTPAddr)
+	}
+
+	// Open the history append log if requested
+	var history *appendLog
+	if opts.HistoryFile != "" {
+		var err error
+		history, err = openAppendLog(opts.HistoryFile)
+		if err != nil {
+			log.Fatalf("Failed to open history file: %v", err)
+		}
+		defer history.Close()
+	}
+
+	// Handle signals for graceful shutdown. The signal cancels the query
+	// context, so pending retries and captures are skipped, but a query in
+	// flight still finishes and its snapshot is written before exiting.
+	// A second signal exits immediately, without waiting for that query.
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigChan)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case sig := <-sigChan:
+			log.Printf("Received signal %v, shutting down (again to exit immediately)...", sig)
+			cancel()
+		case <-stopped:
+			return
+		}
+		select {
+		case sig := <-sigChan:
+			log.Fatalf("Received signal %v again, exiting immediately", sig)
+		case <-stopped:
+		}
+	}()
+	opts.Query.Context = ctx
+
+	// SIGUSR2 reopens the history file after rotation
+	reopenChan := make(chan os.Signal, 1)
+	signal.Notify(reopenChan, syscall.SIGUSR2)
+	defer signal.Stop(reopenChan)
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+
+	// Raw input stays the only snapshot source even after the pipe closes
+	rawMode := opts.RawTranscripts != nil
+
+	// Reset timer for auto-refresh when quota resets
+	var resetTimer *time.Timer
+	var resetTimerChan <-chan time.Time
+
+	// scheduleResetRefresh calculates and schedules the next reset-based refresh
+	scheduleResetRefresh := func(quotas []Quota) {
+		// Stop existing timer if any and drain channel if it already fired
+		if resetTimer != nil {
+			if !resetTimer.Stop() {
+				select {
+				case <-resetTimer.C:
+				default:
+				}
+			}
+		}
+
+		delay := calculateNextResetRefresh(quotas)
+		if delay == nil {
+			resetTimerChan = nil
+			return
+		}
+
+		resetTimer = time.NewTimer(*delay)
+		resetTimerChan = resetTimer.C
+		log.Printf("Scheduled reset refresh in %s", delay)
+	}
+
+	// Track notification state to avoid spamming
+	sessionAlert := &sessionThresholdAlert{config: opts.Notify}
+
+	// Error notifications are sent once per failure streak
+	errorNotified := false
+	notifyFailure := func(reason string) {
+		if opts.Notify == nil || !opts.Notify.OnErrors || errorNotified {
+			return
+		}
+		if err := sendNotification("Claude Usage Unavailable", reason, opts.Notify.IconPath, opts.Notify.TimeoutMs); err != nil {
+			log.Printf("Failed to send notification: %v", err)
+			return
+		}
+		errorNotified = true
+	}
+
+	writeSnapshot := writeSequencedSnapshot
+	if opts.OnlyErrors {
+		writeSnapshot = writeOnlyErrors
+	}
+
+	// Sequence number of the last written snapshot, so consumers can tell
+	// new data from the same data rewritten
+	var seq uint64
+
+	var baselines quotaBaselines
+	if opts.BaselineFile != "" {
+		baselines = loadBaselines(opts.BaselineFile)
+	}
+
+	// Once a complete snapshot has been written, truncated results are not
+	// allowed to overwrite it; the query is retried instead
+	wroteComplete := false
+
+	// Track query success for retry behavior.
+	// On failure, retry at a fixed 1-minute interval until success.
+	// During startup (before first successful query), use faster 5s retries
+	// to recover quickly when network becomes available.
+	lastQuerySucceeded := true
+	retryInterval := 1 * time.Minute
+	startupMode := true
+	startupRetryInterval := 5 * time.Second
+
+	// Run immediately on start
+	if opts.Query.Metrics == nil {
+		opts.Query.Metrics = &QueryMetrics{}
+	}
+
+	doQuery := func() bool {
+		// A trigger that won the select against shutdown must not start a new query
+		if ctx.Err() != nil {
+			return false
+		}
+		snapshot, rawOutput, err := runQuery(opts.Query)
+		metrics := *opts.Query.Metrics
+		if err != nil {
+			log.Printf("Query failed: %v", err)
+			// Log raw CLI output for debugging
+			if rawOutput != "" {
+				log.Printf("Raw CLI output:\n%s", stripANSI(rawOutput))
+			}
+			// Write error response to file so consumers know there was an issue
+			errResp := &UsageSnapshot{
+				SchemaVersion: snapshotSchemaVersion,
+				AccountType:   AccountTypeUnknown,
+				CapturedAt:    time.Now().Format(time.RFC3339),
+				Metrics:       &metrics,
+			}
+			if writeErr := writeSnapshot(errResp, opts.OutputFile, &seq); writeErr != nil {
+				log.Printf("Failed to write error state: %v", writeErr)
+			}
+			notifyFailure(fmt.Sprintf("Query failed: %v", err))
+			if opts.SplitDir != "" {
+				if err := writeSplitFiles(errResp, opts.SplitDir); err != nil {
+					log.Printf("Failed to write split files: %v", err)
+				}
+			}
+			if socket != nil {
+				socket.Update(errResp)
+			}
+			if httpServer != nil {
+				httpServer.Update(errResp)
+			}
+			return false
+		}
+
+		snapshot.Metrics = &metrics
+
+		if baselines != nil && snapshot.AuthError == nil && !snapshot.Incomplete {
+			if baselines.apply(snapshot) {
+				if err := baselines.save(opts.BaselineFile); err != nil {
+					log.Printf("Failed to write baseline file: %v", err)
+				}
+			}
+		}
+
+		// Check for authentication errors
+		if snapshot.AuthError != nil {
+			log.Printf("Authentication error: %s - %s", snapshot.AuthError.Code, snapshot.AuthError.Message)
+			notifyFailure(snapshot.AuthError.Message)
+		} else if !hasUsageData(snapshot) {
+			notifyFailure("No usage data in claude output")
+		} else {
+			errorNotified = false
+		}
+
+		if snapshot.Incomplete && wroteComplete {
+			log.Printf("Query output was truncated, keeping previous snapshot")
+			return false
+		}
+
+		err = writeSnapshot(snapshot, opts.OutputFile, &seq)
+		if socket != nil {
+			socket.Update(snapshot)
+		}
+		if httpServer != nil {
+			httpServer.Update(snapshot)
+		}
+		if err != nil {
+			log.Printf("Failed to write snapshot: %v", err)
+			// File write failed - trigger retry interval since output file wasn't updated
+			return false
+		}
+		if !snapshot.Incomplete {
+			wroteComplete = true
+		}
+
+		if history != nil {
+			if err := history.WriteSnapshot(snapshot); err != nil {
+				log.Printf("Failed to append to history: %v", err)
+			}
+		}
+
+		if opts.SplitDir != "" {
+			if err := writeSplitFiles(snapshot, opts.SplitDir); err != nil {
+				log.Printf("Failed to write split files: %v", err)
+			}
+		}
+
+		// Keep the last good snapshot so readers can ride out transient failures
+		if !opts.OnlyErrors {
+			if err := saveLastGood(snapshot, opts.OutputFile); err != nil {
+				log.Printf("Failed to write last-good snapshot: %v", err)
+			}
+		}
+
+		if snapshot.AuthError != nil {
+			// Already logged above, just note the write succeeded
+			log.Printf("Auth error state written to file")
+		} else if len(snapshot.Quotas) > 0 {
+			log.Print(querySuccessLogLine(snapshot))
+
+			// Check if notification threshold is exceeded (session quota, else the first)
+			sessionAlert.check(snapshot)
+		} else if snapshot.APIUsage != nil {
+			log.Printf("Query successful: api account, no quotas")
+		} else {
+			log.Printf("Query returned no quota data")
+		}
+
+		// Schedule next reset-based refresh; raw input has no claude to re-query
+		if !rawMode {
+			scheduleResetRefresh(snapshot.Quotas)
+		}
+		return true
+	}
+
+	// With raw input, snapshots are driven by incoming transcripts; the
+	// executor hands the latest one to runQuery instead of spawning claude
+	var latestTranscript string
+	tickerChan := ticker.C
+	if rawMode {
+		opts.Query.Executor = func(ctx context.Context, _ *QueryOptions) (string, error) {
+			return latestTranscript, nil
+		}
+		opts.Query.MaxRetries = 0
+		ticker.Stop()
+		tickerChan = nil
+		log.Printf("Reading raw transcripts instead of spawning claude")
+	} else if lastQuerySucceeded = doQuery(); !lastQuerySucceeded {
+		ticker.Reset(startupRetryInterval)
+		log.Printf("Initial query failed (startup mode), retrying in %s", startupRetryInterval)
+	} else {
+		ticker.Reset(opts.Interval)
+		startupMode = false
+	}
+
+	for {
+		select {
+		case <-tickerChan:
+			wasSuccessful := lastQuerySucceeded
+			lastQuerySucceeded = doQuery()
+			if lastQuerySucceeded {
+				if startupMode {
+					startupMode = false
+					ticker.Reset(opts.Interval)
+					log.Printf("Startup completed, switching to normal polling interval: %s", opts.Interval)
+				} else if !wasSuccessful {
+					// Recovered from failure during normal operation
+					ticker.Reset(opts.Interval)
+					log.Printf("Query recovered, resuming normal interval: %s", opts.Interval)
+				}
+			} else {
+				if startupMode {
+					ticker.Reset(startupRetryInterval)
+					log.Printf("Startup query failed, retrying in %s", startupRetryInterval)
+				} else if wasSuccessful {
+					// Just failed during normal operation
+					ticker.Reset(retryInterval)
+					log.Printf("Switching to retry interval: %s", retryInterval)
+				} else {
+					// Continuing failure during normal operation
+					ticker.Reset(retryInterval)
+				}
+			}
+		case <-opts.RefreshChan:
+			if rawMode {
+				log.Printf("Refresh ignored: snapshots come from raw input")
+				continue
+			}
+			log.Printf("D-Bus refresh requested")
+			wasSuccessful := lastQuerySucceeded
+			lastQuerySucceeded = doQuery()
+			if lastQuerySucceeded {
+				if startupMode {
+					startupMode = false
+					log.Printf("Startup completed via D-Bus refresh")
+				}
+				ticker.Reset(opts.Interval) // Reset timer after successful manual refresh
+				if !wasSuccessful {
+					log.Printf("Query recovered, resuming normal interval: %s", opts.Interval)
+				}
+			} else {
+				// Failed via D-Bus trigger - use appropriate retry interval
+				if startupMode {
+					ticker.Reset(startupRetryInterval)
+				} else {
+					ticker.Reset(retryInterval)
+					if wasSuccessful {
+						log.Printf("Switching to retry interval: %s", retryInterval)
+					}
+				}
+			}
+		case <-resetTimerChan:
+			log.Printf("Quota reset timer fired, refreshing...")
+			wasSuccessful := lastQuerySucceeded
+			lastQuerySucceeded = doQuery()
+			if lastQuerySucceeded {
+				if startupMode {
+					startupMode = false
+					log.Printf("Startup completed via reset timer refresh")
+				}
+				ticker.Reset(opts.Interval) // Reset regular ticker after successful reset refresh
+				if !wasSuccessful {
+					log.Printf("Query recovered, resuming normal interval: %s", opts.Interval)
+				}
+			} else {
+				// Failed via reset trigger - use appropriate retry interval
+				if startupMode {
+					ticker.Reset(startupRetryInterval)
+				} else {
+					ticker.Reset(retryInterval)
+					if wasSuccessful {
+						log.Printf("Switching to retry interval: %s", retryInterval)
+					}
+				}
+			}
+		case transcript, ok := <-opts.RawTranscripts:
+			if !ok {
+				log.Printf("Raw input closed, no further snapshots will be written")
+				opts.RawTranscripts = nil
+				continue
+			}
+			latestTranscript = transcript
+			lastQuerySucceeded = doQuery()
+			startupMode = false
+		case <-reopenChan:
+			if history != nil {
+				if err := history.Reopen(); err != nil {
+					log.Printf("Failed to reopen history file: %v", err)
+				} else {
+					log.Printf("Reopened history file %s", opts.HistoryFile)
+				}
+			}
+		case <-ctx.Done():
+			if resetTimer != nil {
+				resetTimer.Stop()
+			}
+			return
+		}
+	}
+}
+
+// queryEnvVars maps CLAUDE_O_METER_* environment variables to query flags.
+// Where a flag has a short and long form, the short form is set so that an
+// explicit long flag still takes precedence.
+var queryEnvVars = map[string]string{
+	"CLAUDE_O_METER_DEBUG":              "d",
+	"CLAUDE_O_METER_RAW":                "r",
+	"CLAUDE_O_METER_HYPRPANEL":          "hyprpanel-json",
+	"CLAUDE_O_METER_TIMEOUT":            "timeout",
+	"CLAUDE_O_METER_CLAUDE_BIN":         "claude-bin",
+	"CLAUDE_O_METER_FILE":               "f",
+	"CLAUDE_O_METER_MAX_RETRIES":        "max-retries",
+	"CLAUDE_O_METER_DURATION_STYLE":     "duration-style",
+	"CLAUDE_O_METER_RESET_AS":           "reset-as",
+	"CLAUDE_O_METER_DISPLAY_TZ":         "display-tz",
+	"CLAUDE_O_METER_TIME_LAYOUT":        "time-layout",
+	"CLAUDE_O_METER_RESET_KEYWORDS":     "reset-keywords",
+	"CLAUDE_O_METER_COMPLETION_MARKERS": "completion-markers",
+	"CLAUDE_O_METER_CLASS_LOW":          "class-low",
+	"CLAUDE_O_METER_CLASS_MEDIUM":       "class-medium",
+	"CLAUDE_O_METER_CLASS_HIGH":         "class-high",
+	"CLAUDE_O_METER_CLASS_ERROR":        "class-error",
+}
+
+// applyEnvDefaults sets flag values from environment variables.
+// It must run before Parse so that command-line flags override the environment.
+func applyEnvDefaults(fs *flag.FlagSet, envVars map[string]string) error {
+	for envName, flagName := range envVars {
+		value, ok := os.LookupEnv(envName)
+		if !ok || value == "" {
+			continue
+		}
+		if err := fs.Set(flagName, value); err != nil {
+			return fmt.Errorf("invalid %s=%q: %w", envName, value, err)
+		}
+	}
+	return nil
+}
+
+// resolveBoolPair returns the value of a short/long bool flag pair. The
+// short form may hold an environment default (see queryEnvVars), so the long
+// form decides whenever it was given: --debug=false beats
+// CLAUDE_O_METER_DEBUG=1.
+func resolveBoolPair(fs *flag.FlagSet, longName string, short, long bool) bool {
+	longSet := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == longName {
+			longSet = true
+		}
+	})
+	if longSet {
+		return long
+	}
+	return short
+}
+
+// configSetting is one resolved flag reported by the config command
+type configSetting struct {
+	Flag   string `json:"flag"`
+	Value  string `json:"value"`
+	Source string `json:"source"` // default, env or flag
+	Env    string `json:"env,omitempty"`
+}
+
+// flagRecorder stands in for a flag's value when args are parsed a second
+// time to find out which flags the command line set
+type flagRecorder struct{ isBool bool }
+
+func (r flagRecorder) String() string   { return "" }
+func (r flagRecorder) Set(string) error { return nil }
+func (r flagRecorder) IsBoolFlag() bool { return r.isBool }
+
+// resolveConfig reports the effective value of every flag in fs and where it
+// came from. fs must already have had applyEnvDefaults and Parse(args) run,
+// so a flag given on the command line wins over its environment variable.
+// pairs maps short flags to their long form; a pair is reported once, under
+// the long name, taking the long flag if given, else the short one. effective
+// holds the values the command really uses where its defaulting or clamping
+// changes them (e.g. the daemon's default file or minimum interval).
+func resolveConfig(fs *flag.FlagSet, envVars map[string]string, args []string, pairs, effective map[string]string) []configSetting {
+	fromArgs := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	fromArgs.SetOutput(io.Discard)
+	fs.VisitAll(func(f *flag.Flag) {
+		boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool })
+		fromArgs.Var(flagRecorder{ok && boolFlag.IsBoolFlag()}, f.Name, "")
+	})
+	fromArgs.Parse(args)
+	setByArgs := map[string]bool{}
+	fromArgs.Visit(func(f *flag.Flag) { setByArgs[f.Name] = true })
+
+	envFor := map[string]string{}
+	for envName, flagName := range envVars {
+		if os.Getenv(envName) != "" {
+			envFor[flagName] = envName
+		}
+	}
+	shortOf := map[string]string{}
+	for short, long := range pairs {
+		shortOf[long] = short
+	}
+
+	var settings []configSetting
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "h" || f.Name == "help" || f.Name == "print-config" || f.Name == "print-regexes" {
+			return
+		}
+		if _, isShort := pairs[f.Name]; isShort {
+			return
+		}
+		names := []string{f.Name}
+		if short, ok := shortOf[f.Name]; ok {
+			names = append(names, short)
+		}
+
+		setting := configSetting{Flag: f.Name, Value: f.Value.String(), Source: "default"}
+		for _, name := range names {
+			if setByArgs[name] {
+				setting.Value, setting.Source = fs.Lookup(name).Value.String(), "flag"
+				break
+			}
+		}
+		if setting.Source == "default" {
+			for _, name := range names {
+				if envName, ok := envFor[name]; ok {
+					setting.Value, setting.Source, setting.Env = fs.Lookup(name).Value.String(), "env", envName
+					break
+				}
+			}
+		}
+		if value, ok := effective[f.Name]; ok {
+			setting.Value = value
+		}
+		settings = append(settings, setting)
+	})
+	return settings
+}
+
+// writeResolvedConfig prints the config command's JSON for a parsed command
+// (see resolveConfig)
+func writeResolvedConfig(w io.Writer, command string, fs *flag.FlagSet, envVars map[string]string, args []string, pairs, effective map[string]string) {
+	jsonBytes, _ := json.MarshalIndent(struct {
+		Command  string          `json:"command"`
+		Settings []configSetting `json:"settings"`
+	}{command, resolveConfig(fs, envVars, args, pairs, effective)}, "", "  ")
+	fmt.Fprintln(w, string(jsonBytes))
+}
+
+// runConfigCommand prints the effective query (default) or daemon settings
+// for the given flags, by running that command's flag handling with the
+// hidden --print-config flag
+func runConfigCommand(args []string) {
+	command := "query"
+	if len(args) > 0 && (args[0] == "query" || args[0] == "daemon") {
+		command, args = args[0], args[1:]
+	}
+	args = append([]string{"--print-config"}, args...)
+	if command == "daemon" {
+		runDaemonCommand(args)
+		return
+	}
+	runQueryCommand(args)
+}
+
+func printUsage() {
+	fmt.Printf(`claude-o-meter %s - Get Claude usage metrics as JSON
+
+Usage: claude-o-meter <command> [options]
+
+Commands:
+  query     Query usage once and output to stdout (default if no command given)
+  daemon    Run as a daemon, periodically querying and writing to file
+  hyprpanel Read from file and output HyprPanel-compatible JSON
+  refresh   Trigger immediate daemon refresh via D-Bus
+  sparkline Print a sparkline of recent usage from a snapshot history
+  badge     Render the snapshot file as a shields.io-style SVG badge
+  doctor    Check that claude, a PTY, tzdata and login are all in place
+  sketchybar Print sketchybar --set arguments for the snapshot file
+  series    Print session/weekly usage over time from a directory of snapshots
+  types     Print the quota headings, types and models this version recognizes as JSON
+  config    Print the effective query (or daemon) settings and their source as JSON
+  motd      Print a one-line usage summary for login banners
+  oneshot   Query once and write the snapshot file like the daemon (for systemd timers)
+
+Global options:
+  -v, --version         Show version
+  -h, --help            Show help
+
+Query options:
+  -d, --debug           Enable debug mode (includes raw output and a "debug" parse trace)
+  -r, --raw             Include raw CLI output in JSON
+  --hyprpanel-json      Output in HyprPanel module format
+  --max-retries         Retry a failed claude spawn up to N times (default: 0)
+  --count               Capture up to N times, 1s apart, and keep the most complete result (default: 1)
+  --timeout             Timeout for the claude process (default: 30s)
+  --claude-bin          Path to the claude binary (default: auto-detect)
+  -f, --file            Also write the snapshot JSON to this file
+  --duration-style      Time remaining format: short (2d 3h), long (2 days, 3 hours), minutes, coarse (2d) (default: short)
+  --reset-as            Show resets in --hyprpanel-json as a duration or local clock time (default: duration)
+  --display-tz          IANA zone for resets_at and clock times, e.g. Europe/Berlin (default: local time)
+  --time-layout         Go time layout for clock reset times in --hyprpanel-json, e.g. "15:04 MST" or
+                        "Mon, 02 Jan 2006 15:04:05 MST" (RFC1123) (default: "15:04", "Mon 15:04" beyond a day)
+  --metric              Percentage in --hyprpanel-json: used or remaining (default: used)
+  --explain             Describe on stderr which line matched what while parsing
+  --print-regexes       Print every parser regex and its source, the reset keywords and the
+                        completion markers in effect as JSON and exit
+  --alert-below         Exit with code 3 if any quota has less than this percentage remaining
+  --changed-from        Compare with the snapshot in this file: exit 10 if no quota's used %% moved
+                        by --changed-by, otherwise rewrite the file with the new snapshot
+  --changed-by          Used-percent points that count as a change (default: 1)
+  --strict-account-type Report "unknown" instead of guessing "max" when no plan header is found
+  --json-mode           Read usage from claude /usage --json; falls back to scraping the TUI if unsupported
+  --decimals            Decimal places for percentages in --hyprpanel-json output (default: 0)
+  --class-low, --class-medium, --class-high, --class-error
+                        Names emitted instead of low/medium/high/error in --hyprpanel-json class and alt
+  --strip-emoji, --ascii
+                        Remove emoji and other non-ASCII symbols from --hyprpanel-json text and tooltip
+                        (HyprPanel output only; other formats are left as they are)
+  --org                 Organization the usage is expected for (warns if claude reports another)
+  --reset-keywords      Comma-separated extra phrases marking a reset line, besides "resets",
+                        "available again", "unlocks in", and "back in" before a duration
+  --completion-markers  Comma-separated output substrings that mean the usage screen has rendered,
+                        for a localized claude (default: "%% used,%% left")
+
+  --coverage            Print on stderr the share of expected fields that were parsed (account type,
+                        quotas, a reset time, extra usage cost if shown), e.g. with --from-file
+  --cache-ttl           Reuse a snapshot cached for the current claude profile (CLAUDE_CONFIG_DIR)
+                        if it is this recent, e.g. 30s (default: 0 = off)
+  --stream              Query every --interval and print each snapshot as a JSON line until interrupted
+  --interval            Query interval for --stream (default: 60s, minimum: 5s)
+
+  Exit codes: 0 ok, 1 query failed, 3 --alert-below hit, 4 claude needs first-run setup,
+  10 unchanged (--changed-from)
+
+  Query options can also be set via environment variables; flags take precedence:
+  CLAUDE_O_METER_DEBUG, CLAUDE_O_METER_RAW, CLAUDE_O_METER_HYPRPANEL,
+  CLAUDE_O_METER_TIMEOUT, CLAUDE_O_METER_CLAUDE_BIN, CLAUDE_O_METER_FILE,
+  CLAUDE_O_METER_MAX_RETRIES, CLAUDE_O_METER_DURATION_STYLE, CLAUDE_O_METER_RESET_AS,
+  CLAUDE_O_METER_RESET_KEYWORDS, CLAUDE_O_METER_COMPLETION_MARKERS, CLAUDE_O_METER_DISPLAY_TZ
+
+Daemon options:
+  -i, --interval        Query interval (default: 60s, minimum: 5s)
+  -f, --file            Output file path, "-" = JSON lines on stdout (default: $XDG_RUNTIME_DIR/claude-o-meter/usage.json)
+  -b, --dbus            Enable D-Bus service for external refresh triggers
+  --debug               Print claude CLI output in real-time
+  -t, --notify-threshold  Notify when session usage >= this %% (0 = disabled)
+  --notify-timeout      Notification display timeout (e.g., 5s; 0 = never)
+  --notify-icon         Path to notification icon (PNG/SVG)
+  --on-alert            Shell command run instead of a notification on a threshold crossing
+                        (gets CLAUDE_SESSION_USED, CLAUDE_WEEKLY_USED, ... in its environment)
+  --max-retries         Retry a failed claude spawn up to N times per query (default: 0)
+  --socket              Serve the latest snapshot as one JSON line per connection on this Unix socket
+  --http                Serve GET /usage and long-poll GET /usage/watch on this address (e.g. 127.0.0.1:8765)
+  --history             Append each snapshot as a JSON line to this file (reopened on SIGUSR2)
+  --split-dir           Also write <quota>.pct (used %%) and <quota>.reset (time left) files here
+  --baseline-file       State file for per-quota post-reset baselines; adds used_since_reset to quotas
+  --raw-input           Parse marker-delimited raw transcripts from this FIFO instead of spawning claude
+  --strict-account-type Report "unknown" instead of guessing "max" when no plan header is found
+  --json-mode           Read usage from claude /usage --json; falls back to scraping the TUI if unsupported
+  --org                 Organization the usage is expected for (warns if claude reports another)
+  --reset-keywords      Comma-separated extra phrases marking a reset line
+  --completion-markers  Comma-separated output substrings that mean usage has rendered (default: "%% used,%% left")
+  --only-errors         Write the output file only on auth errors or failed queries; remove it on recovery
+  --notify-errors       Send a notification once when queries start failing
+
+HyprPanel options:
+  -f, --file       Input file path (default: same as daemon)
+  --max-age        Report data older than this as stale (e.g., 10m; 0 = disabled)
+  --display        Quota shown in text/class: session, weekly, opus, sonnet, worst (default: session)
+  --duration-style Time remaining format: short, long, minutes, coarse (default: short)
+  --reset-as       Show resets as a duration or local clock time, e.g. 18:59 (default: duration)
+  --display-tz     IANA zone for clock reset times, e.g. Europe/Berlin (default: local time)
+  --time-layout    Go time layout for clock reset times and {reset_clock}, e.g. "15:04 MST"
+                   (default: "15:04", "Mon 15:04" beyond a day)
+  --last-good-window  Show <file>.last-good this recent when the file holds an error state (default: 15m; 0 = disabled)
+  --watch          Re-read the file at this interval (e.g., 500ms) and print a line each time
+  --metric         Percentage shown: used (higher is worse) or remaining (higher is better) (default: used)
+  --remaining      Same as --metric remaining: text and percentage count down, nearly empty is "high"
+                   (an error together with --metric used)
+  --text-format    Text template, e.g. "S{s} W{w}"; tokens {s}, {w}, {opus}, {sonnet} are the --metric %%,
+                   {reset_clock} is the local time the displayed quota resets,
+                   {reset_coarse} the time until then in its largest unit, e.g. "2h"
+  --decimals       Decimal places for displayed percentages (default: 0)
+  --embed-snapshot Include the full usage snapshot as a "snapshot" field
+  --alt-meta       Set alt to <account>-<quotas>q-<level>, e.g. "max-4q-low" (level stays in class)
+  --class-low, --class-medium, --class-high, --class-error
+                   Names emitted instead of low/medium/high/error in class and alt, e.g. for existing CSS
+  --strip-emoji, --ascii
+                   Remove emoji and other non-ASCII symbols from text and tooltip, for bars that show tofu
+                   (HyprPanel output only: sketchybar, motd and badge ignore it)
+
+Refresh options:
+  -d, --debug      Print confirmation message
+
+Sparkline options:
+  -f, --file       History file with one snapshot JSON per line ("-" = stdin, required)
+  --quota          Quota to plot: session, weekly, opus, sonnet (default: session)
+  --count          Number of most recent values to plot (default: 20)
+  --since          Only plot snapshots newer than a duration (24h) or RFC3339 time
+
+Series options:
+  -d, --dir        Directory of snapshot *.json files (required)
+  --csv            Print CSV instead of a JSON array
+
+Badge options:
+  -f, --file       Input file path (default: same as daemon)
+  --out            Write the SVG to this file instead of stdout
+
+Sketchybar options:
+  -f, --file       Input file path (default: same as daemon)
+  --item           sketchybar item to update (default: claude)
+
+MOTD options:
+  -f, --file       Input file path (default: same as daemon)
+  --query          Query claude instead of reading the file
+  --timeout        Timeout for the claude process with --query (default: 30s)
+  --max-retries    Retry a failed claude spawn up to N times with --query (default: 0)
+  --claude-bin     Path to the claude binary for --query (default: auto-detect)
+
+Oneshot options:
+  -f, --file       Output file path (default: same as daemon)
+  --lock           Lock file; a run that finds it held exits 0 without querying (default: <file>.lock)
+  --timeout        Timeout for the claude process (default: 30s)
+  --max-retries    Retry a failed claude spawn up to N times (default: 0)
+  --claude-bin     Path to the claude binary (default: auto-detect)
+
+Doctor options:
+  --claude-bin     Path to the claude binary (default: auto-detect)
+  --timeout        Timeout for the claude process (default: 30s)
+  --skip-auth      Skip the auth check (which runs one usage query)
+
+Examples:
+  claude-o-meter                           # Query once, output to stdout
+  claude-o-meter query                     # Same as above
+  claude-o-meter query --raw               # Include raw CLI output
+  claude-o-meter query --hyprpanel-json    # Output for HyprPanel (one-shot)
+  claude-o-meter daemon -i 60s -f /tmp/claude.json -b
+  claude-o-meter hyprpanel -f /tmp/claude.json  # Read file, output HyprPanel JSON
+  claude-o-meter daemon -b                      # Write to the default runtime path
+  claude-o-meter hyprpanel                      # Read from the default runtime path
+  claude-o-meter refresh                        # Trigger daemon to refresh now
+  claude-o-meter sparkline -f ~/claude.jsonl    # Plot recent session usage
+  claude-o-meter badge --out usage.svg          # Render an SVG badge
+  claude-o-meter doctor                         # Diagnose setup problems
+  eval "sketchybar $(claude-o-meter sketchybar)" # Update a sketchybar item
+  claude-o-meter series -d ~/snapshots --csv   # Usage over time as CSV
+  claude-o-meter types                         # List recognized quota types
+  claude-o-meter config daemon -i 30s          # Show effective daemon settings
+  claude-o-meter motd                          # One-line summary for /etc/profile.d
+
+Requires the 'claude' CLI to be installed and authenticated.
+`, Version)
+}
+
+func main() {
+	// A bar piping us into `head` or restarting closes stdout mid-write;
+	// turn the resulting SIGPIPE into an EPIPE error the writers can handle
+	signal.Ignore(syscall.SIGPIPE)
+
+	if len(os.Args) < 2 {
+		// Default to query command
+		runQueryCommand(os.Args[1:])
+		return
+	}
+
+	switch os.Args[1] {
+	case "query":
+		runQueryCommand(os.Args[2:])
+	case "daemon":
+		runDaemonCommand(os.Args[2:])
+	case "hyprpanel":
+		runHyprPanelCommand(os.Args[2:])
+	case "refresh":
+		runRefreshCommand(os.Args[2:])
+	case "sparkline":
+		runSparklineCommand(os.Args[2:])
+	case "badge":
+		runBadgeCommand(os.Args[2:])
+	case "doctor":
+		runDoctorCommand(os.Args[2:])
+	case "sketchybar":
+		runSketchybarCommand(os.Args[2:])
+	case "series":
+		runSeriesCommand(os.Args[2:])
+	case "motd":
+		runMOTDCommand(os.Args[2:])
+	case "oneshot":
+		runOneshotCommand(os.Args[2:])
+	case "config":
+		runConfigCommand(os.Args[2:])
+	case "types":
+		jsonBytes, _ := json.MarshalIndent(supportedQuotaTypes(), "", "  ")
+		fmt.Println(string(jsonBytes))
+	case "-h", "--help", "help":
+		printUsage()
+		os.Exit(0)
+	case "-v", "--version", "version":
+		fmt.Printf("claude-o-meter %s\n", Version)
+		os.Exit(0)
+	default:
+		// Check if it's a flag for query command
+		if strings.HasPrefix(os.Args[1], "-") {
+			runQueryCommand(os.Args[1:])
+		} else {
+			fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", os.Args[1])
+			printUsage()
+			os.Exit(1)
+		}
+	}
+}
+
+func runQueryCommand(args []string) {
+	if code := queryCommand(args, os.Stdout, os.Stderr, nil); code != 0 {
+		os.Exit(code)
+	}
+}
+
+// queryCommand implements the query command and returns the process exit code.
+// executor is passed through to QueryOptions (nil = executeClaudeCLI).
+func queryCommand(args []string, stdout, stderr io.Writer, executor claudeExecutor) int {
+	queryFlags := flag.NewFlagSet("query", flag.ExitOnError)
+	debug := queryFlags.Bool("d", false, "Enable debug mode")
+	debugLong := queryFlags.Bool("debug", false, "Enable debug mode")
+	raw := queryFlags.Bool("r", false, "Include raw output")
+	rawLong := queryFlags.Bool("raw", false, "Include raw output")
+	hyprpanelJSON := queryFlags.Bool("hyprpanel-json", false, "Output in HyprPanel format")
+	maxRetries := queryFlags.Int("max-retries", 0, "Retry a failed claude spawn up to N times")
+	count := queryFlags.Int("count", 1, "Capture up to N times and keep the most complete result")
+	timeout := queryFlags.Duration("timeout", 30*time.Second, "Timeout for the claude process")
+	durationStyle := queryFlags.String("duration-style", "short", "Time remaining format: short, long, minutes, coarse")
+	resetAs := queryFlags.String("reset-as", "duration", "Show resets as a duration or local clock time: duration, clock")
+	displayTZ := queryFlags.String("display-tz", "", "IANA zone for rendered reset times, e.g. Europe/Berlin (default: local time)")
+	timeLayout := queryFlags.String("time-layout", "", "Go time layout for clock reset times in --hyprpanel-json, e.g. \"15:04 MST\" (default: \"15:04\")")
+	metric := queryFlags.String("metric", "used", "Percentage shown in --hyprpanel-json output: used, remaining")
+	claudeBin := queryFlags.String("claude-bin", "", "Path to the claude binary (default: auto-detect)")
+	outputFile := queryFlags.String("f", "", "Also write the snapshot JSON to this file")
+	outputFileLong := queryFlags.String("file", "", "Also write the snapshot JSON to this file")
+	// Hidden: parse a captured raw transcript instead of spawning claude, so users
+	// can check parser fixes against their own output
+	fromFile := queryFlags.String("from-file", "", "Parse a raw transcript file instead of running claude")
+	explain := queryFlags.Bool("explain", false, "Describe parse decisions on stderr")
+	org := queryFlags.String("org", "", "Organization the usage is expected for (warns if claude reports another)")
+	decimals := queryFlags.Int("decimals", 0, "Decimal places for percentages in --hyprpanel-json output")
+	classLow := queryFlags.String("class-low", "", "Name emitted instead of \"low\" in --hyprpanel-json class/alt")
+	classMedium := queryFlags.String("class-medium", "", "Name emitted instead of \"medium\" in --hyprpanel-json class/alt")
+	classHigh := queryFlags.String("class-high", "", "Name emitted instead of \"high\" in --hyprpanel-json class/alt")
+	classError := queryFlags.String("class-error", "", "Name emitted instead of \"error\" in --hyprpanel-json class/alt")
+	stripEmoji := queryFlags.Bool("strip-emoji", false, "Remove emoji and other non-ASCII symbols from --hyprpanel-json text and tooltip")
+	ascii := queryFlags.Bool("ascii", false, "Same as --strip-emoji")
+	strictAccountType := queryFlags.Bool("strict-account-type", false, "Report unknown instead of guessing max when no plan header is found")
+	jsonMode := queryFlags.Bool("json-mode", false, "Read usage from claude /usage --json, falling back to scraping the TUI if unsupported")
+	alertBelow := queryFlags.Float64("alert-below", 0, "Exit with code 3 if any quota has less than this percentage remaining (0 = disabled)")
+	changedFrom := queryFlags.String("changed-from", "", "Compare with the snapshot in this file; exit 10 if unchanged, else rewrite it")
+	changedBy := queryFlags.Float64("changed-by", 1, "Used-percent points a quota must move to count as changed for --changed-from")
+	completionMarkers := queryFlags.String("completion-markers", "", "Comma-separated output substrings that mean usage has rendered (default: \"% used,% left\")")
+	extraResetKeywords := queryFlags.String("reset-keywords", "", "Comma-separated extra phrases that mark a reset line (e.g. \"refills in\")")
+	coverage := queryFlags.Bool("coverage", false, "Print on stderr what fraction of expected fields the parser populated")
+	cacheTTL := queryFlags.Duration("cache-ttl", 0, "Reuse a cached snapshot of the current claude profile this recent instead of querying (0 = off)")
+	stream := queryFlags.Bool("stream", false, "Query repeatedly and print each snapshot as a JSON line until interrupted")
+	streamInterval := queryFlags.Duration("interval", 60*time.Second, "Query interval for --stream")
+	// Hidden: set by the config command
+	printConfig := queryFlags.Bool("print-config", false, "Print the resolved settings as JSON and exit")
+	printRegexes := queryFlags.Bool("print-regexes", false, "Print every parser regex and its source, the reset keywords and completion markers as JSON and exit")
+	help := queryFlags.Bool("h", false, "Show help")
+	helpLong := queryFlags.Bool("help", false, "Show help")
+
+	if err := applyEnvDefaults(queryFlags, queryEnvVars); err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	queryFlags.Parse(args)
+
+	if *printRegexes {
+		writePatterns(stdout, splitResetKeywords(*extraResetKeywords), splitCompletionMarkers(*completionMarkers))
+		return 0
+	}
+
+	if *help || *helpLong {
+		printUsage()
+		return 0
+	}
+
+	if *maxRetries < 0 {
+		fmt.Fprintln(stderr, "Error: --max-retries must not be negative")
+		return 1
+	}
+
+	if *count < 1 {
+		fmt.Fprintln(stderr, "Error: --count must be at least 1")
+		return 1
+	}
+
+	if *timeout <= 0 {
+		fmt.Fprintln(stderr, "Error: --timeout must be positive")
+		return 1
+	}
+
+	if *alertBelow < 0 || *alertBelow > 100 {
+		fmt.Fprintln(stderr, "Error: --alert-below must be between 0 and 100")
+		return 1
+	}
+
+	if *changedBy <= 0 {
+		fmt.Fprintln(stderr, "Error: --changed-by must be positive")
+		return 1
+	}
+
+	if *stream && (*hyprpanelJSON || *changedFrom != "" || *alertBelow > 0) {
+		fmt.Fprintln(stderr, "Error: --stream cannot be combined with --hyprpanel-json, --changed-from or --alert-below")
+		return 1
+	}
+
+	if *decimals < 0 || *decimals > maxDecimals {
+		fmt.Fprintf(stderr, "Error: --decimals must be between 0 and %d\n", maxDecimals)
+		return 1
+	}
+
+	style, err := parseDurationStyle(*durationStyle)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	resetDisplay, err := parseResetAs(*resetAs)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	displayLoc, err := parseDisplayTZ(*displayTZ)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	clockLayout, warning := parseTimeLayout(*timeLayout)
+	if warning != "" {
+		fmt.Fprintf(stderr, "Warning: %s\n", warning)
+	}
+
+	displayMetric, err := parseMetric(*metric)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	levelClasses := LevelClasses{Low: *classLow, Medium: *classMedium, High: *classHigh, Error: *classError}
+
+	actualOutputFile := *outputFile
+	if *outputFileLong != "" {
+		actualOutputFile = *outputFileLong
+	}
+	debugMode := resolveBoolPair(queryFlags, "debug", *debug, *debugLong)
+	rawMode := resolveBoolPair(queryFlags, "raw", *raw, *rawLong)
+
+	if *printConfig {
+		writeResolvedConfig(stdout, "query", queryFlags, queryEnvVars, args,
+			map[string]string{"d": "debug", "r": "raw", "f": "file"},
+			map[string]string{
+				"debug":    strconv.FormatBool(debugMode),
+				"raw":      strconv.FormatBool(rawMode),
+				"file":     actualOutputFile,
+				"interval": clampQueryInterval(*streamInterval).String(),
+			})
+		return 0
+	}
+
+	if *fromFile != "" {
+		transcriptPath := *fromFile
+		executor = func(ctx context.Context, opts *QueryOptions) (string, error) {
+			data, err := os.ReadFile(transcriptPath)
+			if err != nil {
+				return "", fmt.Errorf("failed to read transcript: %w", err)
+			}
+			return string(data), nil
+		}
+	}
+
+	queryOpts := &QueryOptions{
+		IncludeRaw:        debugMode || rawMode,
+		Timeout:           *timeout,
+		Debug:             debugMode,
+		ParseDebug:        debugMode,
+		MaxRetries:        *maxRetries,
+		RetryBackoff:      2 * time.Second,
+		ClaudeBin:         *claudeBin,
+		Executor:          executor,
+		StrictAccountType: *strictAccountType,
+		Org:               *org,
+		CompletionMarkers: splitCompletionMarkers(*completionMarkers),
+		ResetKeywords:     splitResetKeywords(*extraResetKeywords),
+		JSONMode:          *jsonMode && *fromFile == "", // A transcript is always TUI output
+		Captures:          *count,
+		CaptureGap:        time.Second,
+	}
+	if *explain {
+		queryOpts.Explain = stderr
+	}
+
+	if *stream {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		streamQueries(ctx, queryOpts, clampQueryInterval(*streamInterval), style, stdout, stderr)
+		return 0
+	}
+
+	cachePath := ""
+	if *cacheTTL > 0 {
+		cachePath = cachePathForProfile(claudeProfile())
+	}
+	snapshot, rawOutput, err := cachedQuery(queryOpts, cachePath, *cacheTTL, stderr)
+	if err != nil {
+		// Print raw CLI output for debugging (mimics --debug behavior on failure)
+		if rawOutput != "" {
+			fmt.Fprintln(stderr, "--- Raw CLI Output ---")
+			fmt.Fprintln(stderr, stripANSI(rawOutput))
+			fmt.Fprintln(stderr, "---")
+		}
+		if *hyprpanelJSON {
+			output := relabelHyprPanelLevels(formatHyprPanelErrorCategory(hyprPanelErrorQuery, err.Error()), levelClasses)
+			if *stripEmoji || *ascii {
+				stripHyprPanelSymbols(output)
+			}
+			jsonBytes, _ := json.Marshal(output)
+			fmt.Fprintln(stdout, string(jsonBytes))
+			return 0 // Don't exit with error for HyprPanel
+		}
+		errResp := ErrorResponse{
+			Error:   "Failed to get usage data",
+			Details: err.Error(),
+		}
+		jsonBytes, _ := json.MarshalIndent(errResp, "", "  ")
+		fmt.Fprintln(stderr, string(jsonBytes))
+		return 1
+	}
+
+	applyDurationStyle(snapshot, style)
+	applyDisplayTZ(snapshot, displayLoc)
+
+	if *coverage {
+		writeCoverage(stderr, snapshot, rawOutput)
+	}
+
+	if actualOutputFile != "" {
+		if err := writeSnapshotToFile(snapshot, actualOutputFile); err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+
+	unchanged := false
+	if *changedFrom != "" {
+		prev, err := readSnapshotFile(*changedFrom)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(stderr, "Warning: %v, treating as changed\n", err)
+		}
+		if changedBeyond(prev, snapshot, *changedBy) {
+			if err := writeSnapshotToFile(snapshot, *changedFrom); err != nil {
+				fmt.Fprintf(stderr, "Error: %v\n", err)
+				return 1
+			}
+		} else {
+			unchanged = true
+		}
+	}
+	exitCode := func() int {
+		if snapshot.AuthError != nil && snapshot.AuthError.Code == AuthErrorSetupRequired {
+			fmt.Fprintln(stderr, setupRequiredHint)
+			return setupRequiredExitCode
+		}
+		if code := alertCode(snapshot, *alertBelow, stderr); code != 0 || !unchanged {
+			return code
+		}
+		return unchangedExitCode
+	}
+
+	if *hyprpanelJSON {
+		output := formatHyprPanelOutput(snapshot, HyprPanelOptions{Display: "session", DurationStyle: style, Decimals: *decimals, ResetAs: resetDisplay, DisplayTZ: displayLoc, TimeLayout: clockLayout, Metric: displayMetric, Classes: levelClasses})
+		if *stripEmoji || *ascii {
+			stripHyprPanelSymbols(output)
+		}
+		jsonBytes, _ := json.Marshal(output)
+		fmt.Fprintln(stdout, string(jsonBytes))
+		return exitCode()
+	}
+
+	jsonBytes, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		errResp := ErrorResponse{
+			Error:   "Failed to encode JSON",
+			Details: err.Error(),
+		}
+		jsonBytes, _ := json.MarshalIndent(errResp, "", "  ")
+		fmt.Fprintln(stderr, string(jsonBytes))
+		return 1
+	}
+
+	fmt.Fprintln(stdout, string(jsonBytes))
+	return exitCode()
+}
+
+// coverageCheck is one expected field looked for by query --coverage
+type coverageCheck struct {
+	Name string
+	OK   bool
+}
+
+// coverageChecks lists the fields a healthy parse of rawText populates. The
+// cost check only applies when the output mentions extra usage.
+func coverageChecks(snapshot *UsageSnapshot, rawText string) []coverageCheck {
+	resetParsed := false
+	for _, q := range snapshot.Quotas {
+		if q.ResetsAt != nil {
+			resetParsed = true
+			break
+		}
+	}
+	checks := []coverageCheck{
+		{"account type", snapshot.AccountType != AccountTypeUnknown},
+		{"quotas", len(snapshot.Quotas) > 0},
+		{"reset time", resetParsed},
+	}
+	if strings.Contains(strings.ToLower(stripANSI(rawText)), "extra usage") {
+		checks = append(checks, coverageCheck{"extra usage cost", snapshot.CostUsage != nil})
+	}
+	return checks
+}
+
+// coverageScore returns the fraction (0-1) of applicable coverageChecks that
+// passed, a single number to compare parser health across claude versions
+func coverageScore(snapshot *UsageSnapshot, rawText string) float64 {
+	checks := coverageChecks(snapshot, rawText)
+	passed := 0
+	for _, c := range checks {
+		if c.OK {
+			passed++
+		}
+	}
+	return float64(passed) / float64(len(checks))
+}
+
+// writeCoverage prints the query --coverage line, naming any missing fields
+func writeCoverage(w io.Writer, snapshot *UsageSnapshot, rawText string) {
+	checks := coverageChecks(snapshot, rawText)
+	var missing []string
+	for _, c := range checks {
+		if !c.OK {
+			missing = append(missing, c.Name)
+		}
+	}
+	line := fmt.Sprintf("Parse coverage: %.0f%% (%d/%d)", coverageScore(snapshot, rawText)*100, len(checks)-len(missing), len(checks))
+	if len(missing) > 0 {
+		line += ", missing: " + strings.Join(missing, ", ")
+	}
+	fmt.Fprintln(w, line)
+}
+
+// claudeProfile identifies the claude account in use: claude keeps its
+// login in CLAUDE_CONFIG_DIR, or ~/.claude by default
+func claudeProfile() string {
+	if dir := os.Getenv("CLAUDE_CONFIG_DIR"); dir != "" {
+		if abs, err := filepath.Abs(dir); err == nil {
+			return abs
+		}
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".claude")
+}
+
+// cachePathForProfile returns the query cache file for a claude profile
+// under the XDG cache dir. The file name carries a hash of the profile so
+// each account caches independently.
+func cachePathForProfile(profile string) string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	sum := sha256.Sum256([]byte(profile))
+	return filepath.Join(cacheDir, "claude-o-meter", "usage-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// cachedQuery implements query --cache-ttl: a snapshot cached at cachePath
+// within ttl is returned without spawning claude; otherwise runQuery runs and
+// a successful result is cached. An empty cachePath disables the cache.
+func cachedQuery(opts *QueryOptions, cachePath string, ttl time.Duration, stderr io.Writer) (*UsageSnapshot, string, error) {
+	if cachePath == "" {
+		return runQuery(opts)
+	}
+	if cached := loadLastGoodSnapshot(cachePath, ttl, time.Now()); cached != nil {
+		return cached, "", nil
+	}
+	snapshot, rawOutput, err := runQuery(opts)
+	if err == nil && !isFailureSnapshot(snapshot) {
+		if err := writeSnapshotToFile(snapshot, cachePath); err != nil {
+			fmt.Fprintf(stderr, "Warning: failed to update cache: %v\n", err)
+		}
+	}
+	return snapshot, rawOutput, err
+}
+
+// streamQueries implements query --stream: it queries right away and then
+// every interval, writing each snapshot as one compact JSON line to stdout,
+// until ctx is cancelled. A query in flight when ctx is cancelled still
+// finishes and its line is written. Failed queries are reported on stderr and
+// skipped; a closed stdout ends the stream.
+func streamQueries(ctx context.Context, opts *QueryOptions, interval time.Duration, style DurationStyle, stdout, stderr io.Writer) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		snapshot, _, err := runQuery(opts)
+		if err != nil {
+			fmt.Fprintf(stderr, "Query failed: %v\n", err)
+		} else {
+			applyDurationStyle(snapshot, style)
+			jsonBytes, _ := json.Marshal(snapshot)
+			if _, err := fmt.Fprintln(stdout, string(jsonBytes)); isBrokenPipe(err) {
+				return
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// alertCode implements query --alert-below: it reports the quota below
+// threshold on stderr and returns alertExitCode, or 0 if none is (or the
+// threshold is 0)
+func alertCode(snapshot *UsageSnapshot, threshold float64, stderr io.Writer) int {
+	if threshold <= 0 {
+		return 0
+	}
+	q := quotaBelow(snapshot.Quotas, threshold)
+	if q == nil {
+		return 0
+	}
+	name := string(q.Type)
+	if q.Model != "" {
+		name = q.Model
+	}
+	fmt.Fprintf(stderr, "Alert: %s quota at %.0f%% remaining (below %g%%)\n", name, q.PercentRemaining, threshold)
+	return alertExitCode
+}
+
+func runDaemonCommand(args []string) {
+	daemonFlags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	interval := daemonFlags.Duration("i", 60*time.Second, "Query interval")
+	intervalLong := daemonFlags.Duration("interval", 60*time.Second, "Query interval")
+	outputFile := daemonFlags.String("f", "", "Output file path (default: $XDG_RUNTIME_DIR/claude-o-meter/usage.json)")
+	outputFileLong := daemonFlags.String("file", "", "Output file path (default: $XDG_RUNTIME_DIR/claude-o-meter/usage.json)")
+	enableDbus := daemonFlags.Bool("b", false, "Enable D-Bus service for external refresh triggers")
+	enableDbusLong := daemonFlags.Bool("dbus", false, "Enable D-Bus service for external refresh triggers")
+	debug := daemonFlags.Bool("debug", false, "Print claude CLI output in real-time")
+	notifyThreshold := daemonFlags.Int("t", 0, "Notify when session usage >= this percentage (0 = disabled)")
+	notifyThresholdLong := daemonFlags.Int("notify-threshold", 0, "Notify when session usage >= this percentage (0 = disabled)")
+	notifyTimeout := daemonFlags.Duration("notify-timeout", 0, "Notification display timeout (0 = never auto-close, default = server decides)")
+	notifyIcon := daemonFlags.String("notify-icon", "", "Path to notification icon (PNG/SVG)")
+	maxRetries := daemonFlags.Int("max-retries", 0, "Retry a failed claude spawn up to N times per query")
+	socketPath := daemonFlags.String("socket", "", "Serve the latest snapshot as a JSON line on this Unix socket")
+	httpAddr := daemonFlags.String("http", "", "Serve the latest snapshot over HTTP on this address (e.g. 127.0.0.1:8765)")
+	historyFile := daemonFlags.String("history", "", "Append each snapshot as a JSON line to this file (reopened on SIGUSR2)")
+	splitDir := daemonFlags.String("split-dir", "", "Also write each quota as plain files (session.pct, session.reset, ...) in this directory")
+	baselineFile := daemonFlags.String("baseline-file", "", "Keep each quota's first reading after a reset in this file and report used_since_reset")
+	org := daemonFlags.String("org", "", "Organization the usage is expected for (warns if claude reports another)")
+	strictAccountType := daemonFlags.Bool("strict-account-type", false, "Report unknown instead of guessing max when no plan header is found")
+	jsonMode := daemonFlags.Bool("json-mode", false, "Read usage from claude /usage --json, falling back to scraping the TUI if unsupported")
+	rawInput := daemonFlags.String("raw-input", "", "Parse marker-delimited raw transcripts from this FIFO instead of spawning claude")
+	completionMarkers := daemonFlags.String("completion-markers", "", "Comma-separated output substrings that mean usage has rendered (default: \"% used,% left\")")
+	extraResetKeywords := daemonFlags.String("reset-keywords", "", "Comma-separated extra phrases that mark a reset line (e.g. \"refills in\")")
+	onlyErrors := daemonFlags.Bool("only-errors", false, "Write the output file only while queries fail (auth error, no data) and remove it on recovery")
+	notifyErrors := daemonFlags.Bool("notify-errors", false, "Notify once when queries start failing")
+	onAlert := daemonFlags.String("on-alert", "", "Shell command to run instead of a notification when --notify-threshold is crossed (usage in CLAUDE_SESSION_USED etc.)")
+	// Hidden: set by the config command
+	printConfig := daemonFlags.Bool("print-config", false, "Print the resolved settings as JSON and exit")
+	help := daemonFlags.Bool("h", false, "Show help")
+	helpLong := daemonFlags.Bool("help", false, "Show help")
+
+	daemonFlags.Parse(args)
+
+	if *help || *helpLong {
+		printUsage()
+		os.Exit(0)
+	}
+
+	// Determine which flags were used
+	actualInterval := *interval
+	if *intervalLong != 60*time.Second {
+		actualInterval = *intervalLong
+	}
+
+	actualOutputFile := *outputFile
+	if *outputFileLong != "" {
+		actualOutputFile = *outputFileLong
+	}
+
+	actualEnableDbus := *enableDbus || *enableDbusLong
+
+	// Determine notification threshold
+	actualNotifyThreshold := *notifyThreshold
+	if *notifyThresholdLong != 0 {
+		actualNotifyThreshold = *notifyThresholdLong
+	}
+
+	// Validate threshold
+	if actualNotifyThreshold < 0 || actualNotifyThreshold > 100 {
+		fmt.Fprintln(os.Stderr, "Error: --notify-threshold must be between 0 and 100")
+		os.Exit(1)
+	}
+
+	if *onAlert != "" && actualNotifyThreshold == 0 {
+		fmt.Fprintln(os.Stderr, "Error: --on-alert requires --notify-threshold")
+		os.Exit(1)
+	}
+
+	if actualOutputFile == "" {
+		actualOutputFile = defaultSnapshotPath()
+	}
+
+	if *maxRetries < 0 {
+		fmt.Fprintln(os.Stderr, "Error: --max-retries must not be negative")
+		os.Exit(1)
+	}
+
+	if *printConfig {
+		writeResolvedConfig(os.Stdout, "daemon", daemonFlags, nil, args,
+			map[string]string{"i": "interval", "f": "file", "b": "dbus", "t": "notify-threshold"},
+			map[string]string{
+				"interval":         clampQueryInterval(actualInterval).String(),
+				"file":             actualOutputFile,
+				"dbus":             strconv.FormatBool(actualEnableDbus),
+				"notify-threshold": strconv.Itoa(actualNotifyThreshold),
+			})
+		return
+	}
+
+	// Build notification config if threshold or error notifications are set
+	var notifyConfig *NotifyConfig
+	if actualNotifyThreshold > 0 || *notifyErrors {
+		// Convert timeout duration to milliseconds
+		// 0 duration means "never auto-close" (0 in DBus)
+		// If user didn't set it, use -1 to let server decide
+		var timeoutMs int32 = -1 // server default
+		if *notifyTimeout > 0 {
+			timeoutMs = int32(notifyTimeout.Milliseconds())
+		} else if *notifyTimeout == 0 && daemonFlags.Lookup("notify-timeout").Value.String() != "0s" {
+			// User didn't specify, use server default
+			timeoutMs = -1
+		} else {
+			// User explicitly set 0, means never auto-close
+			timeoutMs = 0
+		}
+
+		notifyConfig = &NotifyConfig{
+			Threshold: actualNotifyThreshold,
+			TimeoutMs: timeoutMs,
+			IconPath:  *notifyIcon,
+			OnErrors:  *notifyErrors,
+			OnAlert:   *onAlert,
+		}
+	}
+
+	var rawTranscripts chan string
+	if *rawInput != "" {
+		if _, err := os.Stat(*rawInput); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --raw-input: %v\n", err)
+			os.Exit(1)
+		}
+		rawTranscripts = make(chan string)
+		go streamRawInput(*rawInput, rawTranscripts)
+	}
+
+	// Refresh requests from D-Bus
+	refreshChan := make(chan struct{}, 1)
+
+	queryOpts := &QueryOptions{
+		Timeout:           30 * time.Second,
+		Debug:             *debug,
+		MaxRetries:        *maxRetries,
+		RetryBackoff:      2 * time.Second,
+		StrictAccountType: *strictAccountType,
+		Org:               *org,
+		CompletionMarkers: splitCompletionMarkers(*completionMarkers),
+		ResetKeywords:     splitResetKeywords(*extraResetKeywords),
+		JSONMode:          *jsonMode,
+	}
+	runDaemon(DaemonOptions{
+		Interval:       clampQueryInterval(actualInterval),
+		OutputFile:     actualOutputFile,
+		SocketPath:     *socketPath,
+		HTTPAddr:       *httpAddr,
+		HistoryFile:    *historyFile,
+		SplitDir:       *splitDir,
+		BaselineFile:   *baselineFile,
+		RawTranscripts: rawTranscripts,
+		Query:          queryOpts,
+		EnableDbus:     actualEnableDbus,
+		RefreshChan:    refreshChan,
+		OnlyErrors:     *onlyErrors,
+		Notify:         notifyConfig,
+	})
+}
+
+func runHyprPanelCommand(args []string) {
+	hyprFlags := flag.NewFlagSet("hyprpanel", flag.ExitOnError)
+	inputFile := hyprFlags.String("f", "", "Input file path (default: $XDG_RUNTIME_DIR/claude-o-meter/usage.json)")
+	inputFileLong := hyprFlags.String("file", "", "Input file path (default: $XDG_RUNTIME_DIR/claude-o-meter/usage.json)")
+	maxAge := hyprFlags.Duration("max-age", 0, "Report data older than this as stale (0 = disabled)")
+	display := hyprFlags.String("display", "session", "Quota that drives text and class: session, weekly, opus, sonnet, worst")
+	durationStyle := hyprFlags.String("duration-style", "short", "Time remaining format: short, long, minutes, coarse")
+	resetAs := hyprFlags.String("reset-as", "duration", "Show resets as a duration or local clock time: duration, clock")
+	displayTZ := hyprFlags.String("display-tz", "", "IANA zone for clock reset times, e.g. Europe/Berlin (default: local time)")
+	timeLayout := hyprFlags.String("time-layout", "", "Go time layout for clock reset times, e.g. \"15:04 MST\" (default: \"15:04\")")
+	metric := hyprFlags.String("metric", "used", "Percentage shown in text: used (higher is worse) or remaining (higher is better)")
+	remaining := hyprFlags.Bool("remaining", false, "Shorthand for --metric remaining, for depleting gauges")
+	lastGoodWindow := hyprFlags.Duration("last-good-window", 15*time.Minute, "Show <file>.last-good this recent when the file holds an error state (0 = disabled)")
+	watch := hyprFlags.Duration("watch", 0, "Re-read the file at this interval and print a JSON line each time (0 = print once)")
+	decimals := hyprFlags.Int("decimals", 0, "Decimal places for displayed percentages")
+	textFormat := hyprFlags.String("text-format", "", "Text template with {s}, {w}, {opus}, {sonnet} used-percent tokens (default: \"<used>% <plan>\")")
+	embedSnapshot := hyprFlags.Bool("embed-snapshot", false, "Include the full usage snapshot as a \"snapshot\" field")
+	altMeta := hyprFlags.Bool("alt-meta", false, "Encode account type and quota count into alt, e.g. \"max-4q-low\"")
+	classLow := hyprFlags.String("class-low", "", "Name emitted instead of \"low\" in class/alt")
+	classMedium := hyprFlags.String("class-medium", "", "Name emitted instead of \"medium\" in class/alt")
+	classHigh := hyprFlags.String("class-high", "", "Name emitted instead of \"high\" in class/alt")
+	classError := hyprFlags.String("class-error", "", "Name emitted instead of \"error\" in class/alt")
+	stripEmoji := hyprFlags.Bool("strip-emoji", false, "Remove emoji and other non-ASCII symbols from text and tooltip")
+	ascii := hyprFlags.Bool("ascii", false, "Same as --strip-emoji")
+	help := hyprFlags.Bool("h", false, "Show help")
+	helpLong := hyprFlags.Bool("help", false, "Show help")
+
+	hyprFlags.Parse(args)
+
+	if *help || *helpLong {
+		printUsage()
+		os.Exit(0)
+	}
+
+	actualInputFile := *inputFile
+	if *inputFileLong != "" {
+		actualInputFile = *inputFileLong
+	}
+
+	if actualInputFile == "" {
+		actualInputFile = defaultSnapshotPath()
+	}
+
+	validDisplay := false
+	for _, mode := range hyprPanelDisplayModes {
+		if *display == mode {
+			validDisplay = true
+			break
+		}
+	}
+	if !validDisplay {
+		fmt.Fprintf(os.Stderr, "Error: --display must be one of: %s\n", strings.Join(hyprPanelDisplayModes, ", "))
+		os.Exit(1)
+	}
+
+	if *watch < 0 {
+		fmt.Fprintln(os.Stderr, "Error: --watch must not be negative")
+		os.Exit(1)
+	}
+
+	if *decimals < 0 || *decimals > maxDecimals {
+		fmt.Fprintf(os.Stderr, "Error: --decimals must be between 0 and %d\n", maxDecimals)
+		os.Exit(1)
+	}
+
+	style, err := parseDurationStyle(*durationStyle)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	resetDisplay, err := parseResetAs(*resetAs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	displayLoc, err := parseDisplayTZ(*displayTZ)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	clockLayout, warning := parseTimeLayout(*timeLayout)
+	if warning != "" {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+	if *remaining {
+		// An explicit --metric that says otherwise is a mistake, not an override
+		metricSet := false
+		hyprFlags.Visit(func(f *flag.Flag) { metricSet = metricSet || f.Name == "metric" })
+		if metricSet && *metric != string(MetricRemaining) {
+			fmt.Fprintf(os.Stderr, "Error: --remaining conflicts with --metric %s\n", *metric)
+			os.Exit(1)
+		}
+		*metric = string(MetricRemaining)
+	}
+	displayMetric, err := parseMetric(*metric)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	hyprOpts := HyprPanelOptions{
+		Display:        *display,
+		DurationStyle:  style,
+		LastGoodWindow: *lastGoodWindow,
+		TextFormat:     *textFormat,
+		Decimals:       *decimals,
+		ResetAs:        resetDisplay,
+		DisplayTZ:      displayLoc,
+		TimeLayout:     clockLayout,
+		Metric:         displayMetric,
+		EmbedSnapshot:  *embedSnapshot,
+		AltMeta:        *altMeta,
+		Classes:        LevelClasses{Low: *classLow, Medium: *classMedium, High: *classHigh, Error: *classError},
+	}
+
+	// Wait for file to exist (blocks until daemon has written)
+	for {
+		if _, err := os.Stat(actualInputFile); err == nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	for {
+		output := hyprPanelOutputForFile(actualInputFile, *maxAge, hyprOpts, time.Now())
+		if *stripEmoji || *ascii {
+			stripHyprPanelSymbols(output)
+		}
+		jsonBytes, _ := json.Marshal(output)
+		if _, err := fmt.Println(string(jsonBytes)); isBrokenPipe(err) {
+			// Nobody is reading anymore (bar restarted, piped into head)
+			return
+		}
+
+		if *watch == 0 {
+			return
+		}
+		// Only the file is re-read here, so sub-second intervals are cheap
+		time.Sleep(*watch)
+	}
+}
+
+// hyprPanelDisplayModes are the accepted values for hyprpanel --display
+var hyprPanelDisplayModes = []string{"session", "weekly", "opus", "sonnet", "worst"}
+
+// hyprPanelOutputForFile reads a daemon snapshot file and formats it for HyprPanel.
+// Every failure maps to a distinct error category in `alt`.
+// A maxAge of 0 disables the staleness check.
+func hyprPanelOutputForFile(path string, maxAge time.Duration, opts HyprPanelOptions, now time.Time) *HyprPanelOutput {
+	fail := func(category, message string) *HyprPanelOutput {
+		return relabelHyprPanelLevels(formatHyprPanelErrorCategory(category, message), opts.Classes)
+	}
+	data, err := readSnapshotData(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fail(hyprPanelErrorFileMissing, "Snapshot file not found: "+path)
+		}
+		return fail(hyprPanelErrorReadFailed, "Failed to read file: "+err.Error())
+	}
+
+	var snapshot UsageSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fail(hyprPanelErrorParse, "Failed to parse JSON: "+err.Error())
+	}
+
+	// Check for auth errors first
+	if snapshot.AuthError != nil {
+		return formatHyprPanelOutput(&snapshot, opts)
+	}
+
+	// Check if the snapshot has valid data (API accounts carry spend instead of quotas).
+	// The daemon writes an error state on failed queries; bridge short blips with
+	// the last good snapshot if it is recent enough.
+	usedLastGood := false
+	if !hasUsageData(&snapshot) {
+		lastGood := loadLastGoodSnapshot(lastGoodPath(path), opts.LastGoodWindow, now)
+		if lastGood == nil {
+			return fail(hyprPanelErrorNoData, "No quota data available")
+		}
+		snapshot = *lastGood
+		usedLastGood = true
+	}
+
+	if maxAge > 0 {
+		capturedAt, err := time.Parse(time.RFC3339, snapshot.CapturedAt)
+		if err != nil {
+			return fail(hyprPanelErrorParse, "Invalid captured_at timestamp: "+snapshot.CapturedAt)
+		}
+		if age := now.Sub(capturedAt); age > maxAge {
+			return fail(hyprPanelErrorStale,
+				fmt.Sprintf("Usage data is stale (captured %s ago)", formatDurationStyle(int64(age.Seconds()), opts.DurationStyle)))
+		}
+	}
+
+	output := formatHyprPanelOutput(&snapshot, opts)
+	if usedLastGood {
+		output.Tooltip += "\nLast query failed, showing data captured at " + snapshot.CapturedAt
+	}
+	return output
+}
+
+// hasUsageData reports whether a snapshot carries usage figures, as opposed to
+// the error state the daemon writes when a query fails
+func hasUsageData(snapshot *UsageSnapshot) bool {
+	return len(snapshot.Quotas) > 0 || snapshot.APIUsage != nil
+}
+
+// lastGoodPath returns the file the daemon keeps the last successful snapshot in
+func lastGoodPath(outputFile string) string {
+	return outputFile + ".last-good"
+}
+
+// saveLastGood copies a healthy, complete snapshot to the output file's
+// last-good path. Other snapshots, and streaming to "-", are skipped.
+func saveLastGood(snapshot *UsageSnapshot, outputFile string) error {
+	if outputFile == "-" || isFailureSnapshot(snapshot) || snapshot.Incomplete {
+		return nil
+	}
+	return writeSnapshotToFile(snapshot, lastGoodPath(outputFile))
+}
+
+// loadLastGoodSnapshot reads the last-good snapshot if it was captured within
+// window of now. Returns nil if it is missing, unreadable, too old, or window is 0.
+func loadLastGoodSnapshot(path string, window time.Duration, now time.Time) *UsageSnapshot {
+	if window <= 0 {
+		return nil
+	}
+	data, err := readSnapshotData(path)
+	if err != nil {
+		return nil
+	}
+	var snapshot UsageSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil || !hasUsageData(&snapshot) {
+		return nil
+	}
+	capturedAt, err := time.Parse(time.RFC3339, snapshot.CapturedAt)
+	if err != nil || now.Sub(capturedAt) > window {
+		return nil
+	}
+	return &snapshot
+}
+
+// badgeColors are the shields.io-style message colors per usage level
+var badgeColors = map[string]string{
+	"low":    "#4c1",
+	"medium": "#dfb317",
+	"high":   "#e05d44",
+	"api":    "#007ec6",
+	"error":  "#9f9f9f",
+}
+
+// badgeSVGTemplate is a flat shields.io-style badge. Arguments: total width,
+// label width, message width, color, label center, message center, label,
+// message (centers are in tenths of a pixel, as the text is scaled by 0.1).
+const badgeSVGTemplate = `<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[7]s: %[8]s">
+  <title>%[7]s: %[8]s</title>
+  <linearGradient id="s" x2="0" y2="100%%">
+    <stop offset="0" stop-color="#bbb" stop-opacity=".1"/>
+    <stop offset="1" stop-opacity=".1"/>
+  </linearGradient>
+  <clipPath id="r">
+    <rect width="%[1]d" height="20" rx="3" fill="#fff"/>
+  </clipPath>
+  <g clip-path="url(#r)">
+    <rect width="%[2]d" height="20" fill="#555"/>
+    <rect x="%[2]d" width="%[3]d" height="20" fill="%[4]s"/>
+    <rect width="%[1]d" height="20" fill="url(#s)"/>
+  </g>
+  <g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="110">
+    <text x="%[5]d" y="150" fill="#010101" fill-opacity=".3" transform="scale(.1)">%[7]s</text>
+    <text x="%[5]d" y="140" transform="scale(.1)">%[7]s</text>
+    <text x="%[6]d" y="150" fill="#010101" fill-opacity=".3" transform="scale(.1)">%[8]s</text>
+    <text x="%[6]d" y="140" transform="scale(.1)">%[8]s</text>
+  </g>
+</svg>
+`
+
+// badgeTextWidth approximates the rendered width of badge text in pixels
+// (Verdana 11px averages about 7px per character), plus padding
+func badgeTextWidth(text string) int {
+	return len([]rune(text))*7 + 10
+}
+
+// badgeReading is what a badge-like output shows for a snapshot
+type badgeReading struct {
+	Value string // "73%" or "$1.23"; empty in an error state
+	Unit  string // What Value measures: "used" or "spent"
+	State string // Error state instead of a value: "no data", "suspended" or "auth error"
+	Level string // Color level (see badgeColors)
+}
+
+// readBadge returns the session quota's used percentage (the worst quota's
+// without a session quota), the API spend, or an error state
+func readBadge(snapshot *UsageSnapshot) badgeReading {
+	switch {
+	case snapshot == nil:
+		return badgeReading{State: "no data", Level: "error"}
+	case snapshot.AuthError != nil && snapshot.AuthError.Code == AuthErrorSuspended:
+		return badgeReading{State: "suspended", Level: "error"}
+	case snapshot.AuthError != nil:
+		return badgeReading{State: "auth error", Level: "error"}
+	case len(snapshot.Quotas) > 0:
+		q := snapshot.Session()
+		if q == nil {
+			q = snapshot.Worst()
+		}
+		used := 100 - q.PercentRemaining
+		return badgeReading{Value: fmt.Sprintf("%.0f%%", used), Unit: "used", Level: usageLevel(used)}
+	case snapshot.APIUsage != nil && snapshot.APIUsage.Spent != nil:
+		return badgeReading{Value: fmt.Sprintf("$%.2f", *snapshot.APIUsage.Spent), Unit: "spent", Level: "api"}
+	default:
+		return badgeReading{State: "no data", Level: "error"}
+	}
+}
+
+// badgeMessage returns the badge message and its color level for a snapshot
+// (see readBadge)
+func badgeMessage(snapshot *UsageSnapshot) (string, string) {
+	r := readBadge(snapshot)
+	if r.State != "" {
+		return r.State, r.Level
+	}
+	return r.Value + " " + r.Unit, r.Level
+}
+
+// renderBadgeSVG renders a shields.io-style "claude | 73% used" badge,
+// colored by usage level
+func renderBadgeSVG(snapshot *UsageSnapshot) string {
+	label := "claude"
+	message, level := badgeMessage(snapshot)
+
+	labelWidth := badgeTextWidth(label)
+	messageWidth := badgeTextWidth(message)
+	return fmt.Sprintf(badgeSVGTemplate,
+		labelWidth+messageWidth, labelWidth, messageWidth, badgeColors[level],
+		labelWidth*5, labelWidth*10+messageWidth*5,
+		html.EscapeString(label), html.EscapeString(message))
+}
+
+func runBadgeCommand(args []string) {
+	badgeFlags := flag.NewFlagSet("badge", flag.ExitOnError)
+	inputFile := badgeFlags.String("f", "", "Input file path (default: $XDG_RUNTIME_DIR/claude-o-meter/usage.json)")
+	inputFileLong := badgeFlags.String("file", "", "Input file path (default: $XDG_RUNTIME_DIR/claude-o-meter/usage.json)")
+	outFile := badgeFlags.String("out", "", "Write the SVG to this file instead of stdout")
+	help := badgeFlags.Bool("h", false, "Show help")
+	helpLong := badgeFlags.Bool("help", false, "Show help")
+
+	badgeFlags.Parse(args)
+
+	if *help || *helpLong {
+		printUsage()
+		os.Exit(0)
+	}
+
+	actualInputFile := *inputFile
+	if *inputFileLong != "" {
+		actualInputFile = *inputFileLong
+	}
+
+	if actualInputFile == "" {
+		actualInputFile = defaultSnapshotPath()
+	}
+
+	data, err := readSnapshotData(actualInputFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	var snapshot UsageSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to parse JSON: %v\n", err)
+		os.Exit(1)
+	}
+
+	svg := renderBadgeSVG(&snapshot)
+	if *outFile == "" {
+		fmt.Print(svg)
+		return
+	}
+	if err := os.WriteFile(*outFile, []byte(svg), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// sketchybarColors are ARGB label colors per usage level
+var sketchybarColors = map[string]string{
+	"low":    "0xff44cc11",
+	"medium": "0xffdfb317",
+	"high":   "0xffe05d44",
+	"api":    "0xff007ec6",
+	"error":  "0xff9f9f9f",
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// formatSketchybar renders a snapshot as sketchybar arguments updating
+// itemName: the badge value without its unit so it fits a menu bar ("73%",
+// "$1.23", "!" for an auth error, "--" without data) as the label, colored
+// by level (see readBadge). Values are shell-quoted, so the output is meant
+// for eval.
+func formatSketchybar(snapshot *UsageSnapshot, itemName string) string {
+	r := readBadge(snapshot)
+	label := r.Value
+	switch {
+	case r.State == "no data":
+		label = "--"
+	case r.State != "":
+		label = "!"
+	}
+	return fmt.Sprintf("--set %s label=%s label.color=%s",
+		shellQuote(itemName), shellQuote(label), sketchybarColors[r.Level])
+}
+
+func runSketchybarCommand(args []string) {
+	sketchyFlags := flag.NewFlagSet("sketchybar", flag.ExitOnError)
+	inputFile := sketchyFlags.String("f", "", "Input file path (default: $XDG_RUNTIME_DIR/claude-o-meter/usage.json)")
+	inputFileLong := sketchyFlags.String("file", "", "Input file path (default: $XDG_RUNTIME_DIR/claude-o-meter/usage.json)")
+	item := sketchyFlags.String("item", "claude", "sketchybar item to update")
+	help := sketchyFlags.Bool("h", false, "Show help")
+	helpLong := sketchyFlags.Bool("help", false, "Show help")
+
+	sketchyFlags.Parse(args)
+
+	if *help || *helpLong {
+		printUsage()
+		os.Exit(0)
+	}
+
+	actualInputFile := *inputFile
+	if *inputFileLong != "" {
+		actualInputFile = *inputFileLong
+	}
+
+	if actualInputFile == "" {
+		actualInputFile = defaultSnapshotPath()
+	}
+
+	// A missing or unreadable file is shown as an error state, like hyprpanel
+	var snapshot *UsageSnapshot
+	if data, err := readSnapshotData(actualInputFile); err == nil {
+		var parsed UsageSnapshot
+		if err := json.Unmarshal(data, &parsed); err == nil {
+			snapshot = &parsed
+		}
+	}
+
+	fmt.Println(formatSketchybar(snapshot, *item))
+}
+
+// formatMOTD renders a snapshot as one line for login banners, e.g.
+// "Claude Max — Session 73% used (2h14m), Weekly 40% used". The session
+// duration is measured from now, so an older snapshot file stays accurate.
+func formatMOTD(snapshot *UsageSnapshot, now time.Time) string {
+	switch {
+	case snapshot == nil:
+		return "Claude: no usage data"
+	case snapshot.AuthError != nil && snapshot.AuthError.Code == AuthErrorSuspended:
+		return "Claude: account suspended"
+	case snapshot.AuthError != nil:
+		return "Claude: not logged in"
+	}
+
+	name := "Claude"
+	switch snapshot.AccountType {
+	case AccountTypeMax:
+		name = "Claude Max"
+	case AccountTypePro:
+		name = "Claude Pro"
+	case AccountTypeAPI:
+		name = "Claude API"
+	}
+
+	var parts []string
+	if q := snapshot.Session(); q != nil {
+		part := fmt.Sprintf("Session %.0f%% used", 100-q.PercentRemaining)
+		if resetTime, ok := quotaResetTime(q, snapshot.CapturedAt); ok && resetTime.After(now) {
+			remaining := strings.ReplaceAll(formatDuration(int64(resetTime.Sub(now).Seconds())), " ", "")
+			part += fmt.Sprintf(" (%s)", remaining)
+		}
+		parts = append(parts, part)
+	}
+	if q := snapshot.Weekly(); q != nil {
+		parts = append(parts, fmt.Sprintf("Weekly %.0f%% used", 100-q.PercentRemaining))
+	}
+	if len(parts) == 0 && snapshot.APIUsage != nil && snapshot.APIUsage.Spent != nil {
+		parts = append(parts, fmt.Sprintf("$%.2f spent", *snapshot.APIUsage.Spent))
+	}
+	if len(parts) == 0 {
+		return name + ": no usage data"
+	}
+	return name + " — " + strings.Join(parts, ", ")
+}
+
+func runMOTDCommand(args []string) {
+	motdFlags := flag.NewFlagSet("motd", flag.ExitOnError)
+	inputFile := motdFlags.String("f", "", "Input file path (default: $XDG_RUNTIME_DIR/claude-o-meter/usage.json)")
+	inputFileLong := motdFlags.String("file", "", "Input file path (default: $XDG_RUNTIME_DIR/claude-o-meter/usage.json)")
+	query := motdFlags.Bool("query", false, "Query claude instead of reading the snapshot file")
+	timeout := motdFlags.Duration("timeout", 30*time.Second, "Timeout for the claude process (--query)")
+	maxRetries := motdFlags.Int("max-retries", 0, "Retry a failed claude spawn up to N times (--query)")
+	claudeBin := motdFlags.String("claude-bin", "", "Path to the claude binary (--query, default: auto-detect)")
+	help := motdFlags.Bool("h", false, "Show help")
+	helpLong := motdFlags.Bool("help", false, "Show help")
+
+	motdFlags.Parse(args)
+
+	if *help || *helpLong {
+		printUsage()
+		os.Exit(0)
+	}
+
+	if *maxRetries < 0 {
+		fmt.Fprintln(os.Stderr, "Error: --max-retries must not be negative")
+		os.Exit(1)
+	}
+
+	if *query {
+		snapshot, _, err := runQuery(&QueryOptions{
+			Timeout:      *timeout,
+			MaxRetries:   *maxRetries,
+			RetryBackoff: 2 * time.Second,
+			ClaudeBin:    *claudeBin,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(formatMOTD(snapshot, time.Now()))
+		return
+	}
+
+	actualInputFile := *inputFile
+	if *inputFileLong != "" {
+		actualInputFile = *inputFileLong
+	}
+
+	if actualInputFile == "" {
+		actualInputFile = defaultSnapshotPath()
+	}
+
+	// A missing or unreadable file is shown as "no usage data" rather than
+	// failing, so a banner script never breaks the login
+	var snapshot *UsageSnapshot
+	if data, err := readSnapshotData(actualInputFile); err == nil {
+		var parsed UsageSnapshot
+		if err := json.Unmarshal(data, &parsed); err == nil {
+			snapshot = &parsed
+		}
+	}
+
+	fmt.Println(formatMOTD(snapshot, time.Now()))
+}
+
+// doctorResult is the outcome of one doctor check. A failed critical check
+// means queries cannot work; other failures degrade the output.
+type doctorResult struct {
+	Name     string
+	OK       bool
+	Critical bool
+	Detail   string
+}
+
+// doctorTimezone is a zone that needs the system tzdata to load; reset
+// times printed with a timezone fall back to local time without it
+const doctorTimezone = "Europe/Berlin"
+
+// checkClaudeBinary verifies that the claude CLI (claudeBin, or the one on
+// PATH if empty) exists and reports its version
+func checkClaudeBinary(ctx context.Context, claudeBin string) doctorResult {
+	result := doctorResult{Name: "claude CLI", Critical: true}
+	if claudeBin == "" {
+		var err error
+		claudeBin, err = findClaudeBinary()
+		if err != nil {
+			result.Detail = err.Error()
+			return result
+		}
+	}
+	out, err := exec.CommandContext(ctx, claudeBin, "--version").Output()
+	if err != nil {
+		result.Detail = fmt.Sprintf("%s --version failed: %v", claudeBin, err)
+		return result
+	}
+	result.OK = true
+	result.Detail = fmt.Sprintf("%s (%s)", claudeBin, strings.TrimSpace(string(out)))
+	return result
+}
 
-Refresh options:
-  -d, --debug      Print confirmation message
+// checkPTY verifies that a pseudo-terminal can be allocated; claude is run
+// in one directly, so no expect or script wrapper is needed
+func checkPTY(openPTY func() (*os.File, *os.File, error)) doctorResult {
+	result := doctorResult{Name: "PTY", Critical: true}
+	ptmx, tty, err := openPTY()
+	if err != nil {
+		result.Detail = fmt.Sprintf("cannot allocate a pseudo-terminal: %v", err)
+		return result
+	}
+	ptmx.Close()
+	tty.Close()
+	result.OK = true
+	result.Detail = "pseudo-terminal available"
+	return result
+}
 
-Examples:
-  claude-o-meter                           # Query once, output to stdout
-  claude-o-meter query                     # Same as above
-  claude-o-meter query --raw               # Include raw CLI output
-  claude-o-meter query --hyprpanel-json    # Output for HyprPanel (one-shot)
-  claude-o-meter daemon -i 60s -f /tmp/claude.json -b
-  claude-o-meter hyprpanel -f /tmp/claude.json  # Read file, output HyprPanel JSON
-  claude-o-meter refresh                        # Trigger daemon to refresh now
+// checkAuth runs one usage query and reports whether claude is logged in
+// and returned usage data
+func checkAuth(opts *QueryOptions) doctorResult {
+	result := doctorResult{Name: "auth", Critical: true}
+	snapshot, _, err := runQuery(opts)
+	switch {
+	case err != nil:
+		result.Detail = fmt.Sprintf("usage query failed: %v", err)
+	case snapshot.AuthError != nil:
+		result.Detail = fmt.Sprintf("%s: %s", snapshot.AuthError.Code, snapshot.AuthError.Message)
+	case !hasUsageData(snapshot):
+		result.Detail = "logged in, but no usage data was found in the output"
+	default:
+		result.OK = true
+		result.Detail = fmt.Sprintf("logged in (%s account)", snapshot.AccountType)
+	}
+	return result
+}
 
-Requires the 'claude' CLI to be installed and authenticated.
-`, Version)
+// checkTimezoneData verifies that the system tzdata can resolve zone
+func checkTimezoneData(zone string) doctorResult {
+	result := doctorResult{Name: "tzdata"}
+	if _, err := time.LoadLocation(zone); err != nil {
+		result.Detail = fmt.Sprintf("cannot load %s (%v); reset times will assume local time", zone, err)
+		return result
+	}
+	result.OK = true
+	result.Detail = zone + " resolves"
+	return result
 }
 
-func main() {
-	if len(os.Args) < 2 {
-		// Default to query command
-		runQueryCommand(os.Args[1:])
-		return
+// writeDoctorReport prints one line per check and returns the exit code:
+// 1 if any critical check failed, 0 otherwise
+func writeDoctorReport(w io.Writer, results []doctorResult) int {
+	code := 0
+	for _, r := range results {
+		status := "ok"
+		if !r.OK {
+			status = "warn"
+			if r.Critical {
+				status = "FAIL"
+				code = 1
+			}
+		}
+		fmt.Fprintf(w, "[%-4s] %-10s %s\n", status, r.Name, r.Detail)
 	}
+	return code
+}
 
-	switch os.Args[1] {
-	case "query":
-		runQueryCommand(os.Args[2:])
-	case "daemon":
-		runDaemonCommand(os.Args[2:])
-	case "hyprpanel":
-		runHyprPanelCommand(os.Args[2:])
-	case "refresh":
-		runRefreshCommand(os.Args[2:])
-	case "-h", "--help", "help":
+func runDoctorCommand(args []string) {
+	doctorFlags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	claudeBin := doctorFlags.String("claude-bin", "", "Path to the claude binary (default: auto-detect)")
+	timeout := doctorFlags.Duration("timeout", 30*time.Second, "Timeout for the claude process")
+	skipAuth := doctorFlags.Bool("skip-auth", false, "Skip the auth check (which runs one usage query)")
+	help := doctorFlags.Bool("h", false, "Show help")
+	helpLong := doctorFlags.Bool("help", false, "Show help")
+
+	doctorFlags.Parse(args)
+
+	if *help || *helpLong {
 		printUsage()
 		os.Exit(0)
-	case "-v", "--version", "version":
-		fmt.Printf("claude-o-meter %s\n", Version)
-		os.Exit(0)
-	default:
-		// Check if it's a flag for query command
-		if strings.HasPrefix(os.Args[1], "-") {
-			runQueryCommand(os.Args[1:])
-		} else {
-			fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", os.Args[1])
-			printUsage()
-			os.Exit(1)
-		}
 	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	claudeResult := checkClaudeBinary(ctx, *claudeBin)
+	cancel()
+
+	results := []doctorResult{
+		claudeResult,
+		checkPTY(pty.Open),
+		checkTimezoneData(doctorTimezone),
+	}
+	// The auth probe needs claude itself, so skip it if claude is missing
+	if !*skipAuth && claudeResult.OK {
+		results = append(results, checkAuth(&QueryOptions{Timeout: *timeout, ClaudeBin: *claudeBin}))
+	}
+
+	os.Exit(writeDoctorReport(os.Stdout, results))
 }
 
-func runQueryCommand(args []string) {
-	queryFlags := flag.NewFlagSet("query", flag.ExitOnError)
-	debug := queryFlags.Bool("d", false, "Enable debug mode")
-	debugLong := queryFlags.Bool("debug", false, "Enable debug mode")
-	raw := queryFlags.Bool("r", false, "Include raw output")
-	rawLong := queryFlags.Bool("raw", false, "Include raw output")
-	hyprpanelJSON := queryFlags.Bool("hyprpanel-json", false, "Output in HyprPanel format")
-	help := queryFlags.Bool("h", false, "Show help")
-	helpLong := queryFlags.Bool("help", false, "Show help")
+func runRefreshCommand(args []string) {
+	refreshFlags := flag.NewFlagSet("refresh", flag.ExitOnError)
+	debug := refreshFlags.Bool("d", false, "Enable debug output")
+	debugLong := refreshFlags.Bool("debug", false, "Enable debug output")
+	help := refreshFlags.Bool("h", false, "Show help")
+	helpLong := refreshFlags.Bool("help", false, "Show help")
 
-	queryFlags.Parse(args)
+	refreshFlags.Parse(args)
 
 	if *help || *helpLong {
 		printUsage()
 		os.Exit(0)
 	}
 
-	includeRaw := *debug || *debugLong || *raw || *rawLong
 	debugMode := *debug || *debugLong
-	timeout := 30 * time.Second
 
-	snapshot, rawOutput, err := runQuery(includeRaw, timeout, debugMode)
+	conn, err := dbus.SessionBus()
 	if err != nil {
-		// Print raw CLI output for debugging (mimics --debug behavior on failure)
-		if rawOutput != "" {
-			fmt.Fprintln(os.Stderr, "--- Raw CLI Output ---")
-			fmt.Fprintln(os.Stderr, stripANSI(rawOutput))
-			fmt.Fprintln(os.Stderr, "---")
-		}
-		if *hyprpanelJSON {
-			output := formatHyprPanelError(err.Error())
-			jsonBytes, _ := json.Marshal(output)
-			fmt.Println(string(jsonBytes))
-			os.Exit(0) // Don't exit with error for HyprPanel
-		}
-		errResp := ErrorResponse{
-			Error:   "Failed to get usage data",
-			Details: err.Error(),
-		}
-		jsonBytes, _ := json.MarshalIndent(errResp, "", "  ")
-		fmt.Fprintln(os.Stderr, string(jsonBytes))
+		fmt.Fprintf(os.Stderr, "Failed to connect to session bus: %v\n", err)
 		os.Exit(1)
 	}
+	defer conn.Close()
 
-	if *hyprpanelJSON {
-		output := formatHyprPanelOutput(snapshot)
-		jsonBytes, _ := json.Marshal(output)
-		fmt.Println(string(jsonBytes))
-		return
-	}
-
-	jsonBytes, err := json.MarshalIndent(snapshot, "", "  ")
-	if err != nil {
-		errResp := ErrorResponse{
-			Error:   "Failed to encode JSON",
-			Details: err.Error(),
-		}
-		jsonBytes, _ := json.MarshalIndent(errResp, "", "  ")
-		fmt.Fprintln(os.Stderr, string(jsonBytes))
+	obj := conn.Object(dbusServiceName, dbusObjectPath)
+	call := obj.Call(dbusInterface+".RefreshNow", 0)
+	if call.Err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to call RefreshNow: %v\n", call.Err)
 		os.Exit(1)
 	}
 
-	fmt.Println(string(jsonBytes))
+	if debugMode {
+		fmt.Println("Refresh triggered successfully")
+	}
 }
 
-func runDaemonCommand(args []string) {
-	daemonFlags := flag.NewFlagSet("daemon", flag.ExitOnError)
-	interval := daemonFlags.Duration("i", 60*time.Second, "Query interval")
-	intervalLong := daemonFlags.Duration("interval", 60*time.Second, "Query interval")
-	outputFile := daemonFlags.String("f", "", "Output file path (required)")
-	outputFileLong := daemonFlags.String("file", "", "Output file path (required)")
-	enableDbus := daemonFlags.Bool("b", false, "Enable D-Bus service for external refresh triggers")
-	enableDbusLong := daemonFlags.Bool("dbus", false, "Enable D-Bus service for external refresh triggers")
-	debug := daemonFlags.Bool("debug", false, "Print claude CLI output in real-time")
-	notifyThreshold := daemonFlags.Int("t", 0, "Notify when session usage >= this percentage (0 = disabled)")
-	notifyThresholdLong := daemonFlags.Int("notify-threshold", 0, "Notify when session usage >= this percentage (0 = disabled)")
-	notifyTimeout := daemonFlags.Duration("notify-timeout", 0, "Notification display timeout (0 = never auto-close, default = server decides)")
-	notifyIcon := daemonFlags.String("notify-icon", "", "Path to notification icon (PNG/SVG)")
-	help := daemonFlags.Bool("h", false, "Show help")
-	helpLong := daemonFlags.Bool("help", false, "Show help")
+func runSparklineCommand(args []string) {
+	sparkFlags := flag.NewFlagSet("sparkline", flag.ExitOnError)
+	inputFile := sparkFlags.String("f", "", "History file path (required)")
+	inputFileLong := sparkFlags.String("file", "", "History file path (required)")
+	quotaName := sparkFlags.String("quota", "session", "Quota to plot: session, weekly, opus, sonnet")
+	count := sparkFlags.Int("count", 20, "Number of most recent values to plot")
+	since := sparkFlags.String("since", "", "Only plot snapshots newer than a duration or RFC3339 time")
+	help := sparkFlags.Bool("h", false, "Show help")
+	helpLong := sparkFlags.Bool("help", false, "Show help")
 
-	daemonFlags.Parse(args)
+	sparkFlags.Parse(args)
 
 	if *help || *helpLong {
 		printUsage()
 		os.Exit(0)
 	}
 
-	// Determine which flags were used
-	actualInterval := *interval
-	if *intervalLong != 60*time.Second {
-		actualInterval = *intervalLong
+	actualInputFile := *inputFile
+	if *inputFileLong != "" {
+		actualInputFile = *inputFileLong
 	}
 
-	actualOutputFile := *outputFile
-	if *outputFileLong != "" {
-		actualOutputFile = *outputFileLong
+	if actualInputFile == "" {
+		fmt.Fprintln(os.Stderr, "Error: -f/--file is required for sparkline mode")
+		os.Exit(1)
 	}
 
-	actualEnableDbus := *enableDbus || *enableDbusLong
-
-	// Determine notification threshold
-	actualNotifyThreshold := *notifyThreshold
-	if *notifyThresholdLong != 0 {
-		actualNotifyThreshold = *notifyThresholdLong
+	if *count <= 0 {
+		fmt.Fprintln(os.Stderr, "Error: --count must be positive")
+		os.Exit(1)
 	}
 
-	// Validate threshold
-	if actualNotifyThreshold < 0 || actualNotifyThreshold > 100 {
-		fmt.Fprintln(os.Stderr, "Error: --notify-threshold must be between 0 and 100")
-		os.Exit(1)
+	var input io.Reader = os.Stdin
+	if actualInputFile != "-" {
+		f, err := os.Open(actualInputFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		input = f
 	}
 
-	if actualOutputFile == "" {
-		fmt.Fprintln(os.Stderr, "Error: -f/--file is required for daemon mode")
+	snapshots, err := readSnapshotHistory(input)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
-	// Build notification config if threshold is set
-	var notifyConfig *NotifyConfig
-	if actualNotifyThreshold > 0 {
-		// Convert timeout duration to milliseconds
-		// 0 duration means "never auto-close" (0 in DBus)
-		// If user didn't set it, use -1 to let server decide
-		var timeoutMs int32 = -1 // server default
-		if *notifyTimeout > 0 {
-			timeoutMs = int32(notifyTimeout.Milliseconds())
-		} else if *notifyTimeout == 0 && daemonFlags.Lookup("notify-timeout").Value.String() != "0s" {
-			// User didn't specify, use server default
-			timeoutMs = -1
-		} else {
-			// User explicitly set 0, means never auto-close
-			timeoutMs = 0
+	if *since != "" {
+		cutoff, err := parseSinceCutoff(*since, time.Now())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
 		}
+		snapshots = filterSince(snapshots, cutoff)
+	}
 
-		notifyConfig = &NotifyConfig{
-			Threshold: actualNotifyThreshold,
-			TimeoutMs: timeoutMs,
-			IconPath:  *notifyIcon,
+	var values []float64
+	for _, snapshot := range snapshots {
+		if q := findQuota(snapshot.Quotas, *quotaName); q != nil {
+			values = append(values, 100-q.PercentRemaining)
 		}
 	}
+	if len(values) > *count {
+		values = values[len(values)-*count:]
+	}
 
-	timeout := 30 * time.Second
-	runDaemon(actualInterval, actualOutputFile, timeout, *debug, actualEnableDbus, notifyConfig)
+	fmt.Println(sparkline(values))
 }
 
-func runHyprPanelCommand(args []string) {
-	hyprFlags := flag.NewFlagSet("hyprpanel", flag.ExitOnError)
-	inputFile := hyprFlags.String("f", "", "Input file path (required)")
-	inputFileLong := hyprFlags.String("file", "", "Input file path (required)")
-	help := hyprFlags.Bool("h", false, "Show help")
-	helpLong := hyprFlags.Bool("help", false, "Show help")
+func runSeriesCommand(args []string) {
+	seriesFlags := flag.NewFlagSet("series", flag.ExitOnError)
+	dir := seriesFlags.String("d", "", "Directory of snapshot *.json files (required)")
+	dirLong := seriesFlags.String("dir", "", "Directory of snapshot *.json files (required)")
+	asCSV := seriesFlags.Bool("csv", false, "Print CSV instead of a JSON array")
+	help := seriesFlags.Bool("h", false, "Show help")
+	helpLong := seriesFlags.Bool("help", false, "Show help")
 
-	hyprFlags.Parse(args)
+	seriesFlags.Parse(args)
 
 	if *help || *helpLong {
 		printUsage()
 		os.Exit(0)
 	}
 
-	actualInputFile := *inputFile
-	if *inputFileLong != "" {
-		actualInputFile = *inputFileLong
+	actualDir := *dir
+	if *dirLong != "" {
+		actualDir = *dirLong
 	}
 
-	if actualInputFile == "" {
-		fmt.Fprintln(os.Stderr, "Error: -f/--file is required for hyprpanel mode")
+	if actualDir == "" {
+		fmt.Fprintln(os.Stderr, "Error: -d/--dir is required for series mode")
 		os.Exit(1)
 	}
 
-	// Wait for file to exist (blocks until daemon has written)
-	for {
-		if _, err := os.Stat(actualInputFile); err == nil {
-			break
+	snapshots, err := loadSeries(actualDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	points := seriesPoints(snapshots)
+
+	if *asCSV {
+		if err := writeSeriesCSV(os.Stdout, points); err != nil && !isBrokenPipe(err) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
 		}
-		time.Sleep(500 * time.Millisecond)
+		return
 	}
 
-	// Read and parse the file
-	data, err := os.ReadFile(actualInputFile)
+	jsonBytes, _ := json.MarshalIndent(points, "", "  ")
+	fmt.Println(string(jsonBytes))
+}
+
+// tryLock takes an exclusive flock on path without waiting. It returns the
+// open lock file (close it to release), or nil if another process holds it.
+func tryLock(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
-		output := formatHyprPanelError("Failed to read file: " + err.Error())
-		jsonBytes, _ := json.Marshal(output)
-		fmt.Println(string(jsonBytes))
-		return
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
 	}
+	return f, nil
+}
 
-	var snapshot UsageSnapshot
-	if err := json.Unmarshal(data, &snapshot); err != nil {
-		output := formatHyprPanelError("Failed to parse JSON: " + err.Error())
-		jsonBytes, _ := json.Marshal(output)
-		fmt.Println(string(jsonBytes))
-		return
+// runOneshot queries once and writes the snapshot to outputFile the way the
+// daemon does: atomically, with the next seq after the file's current one, a
+// last-good copy on success, and an error state on failure. An incomplete
+// result does not replace a complete snapshot. lockPath serializes runs, so
+// overlapping timer fires cannot spawn claude twice; a run that finds the
+// lock held returns ran = false without querying.
+func runOneshot(outputFile, lockPath string, opts *QueryOptions) (ran bool, err error) {
+	lock, err := tryLock(lockPath)
+	if err != nil {
+		return false, err
+	}
+	if lock == nil {
+		return false, nil
 	}
+	defer lock.Close()
 
-	// Check for auth errors first
-	if snapshot.AuthError != nil {
-		output := formatHyprPanelAuthError(snapshot.AuthError)
-		jsonBytes, _ := json.Marshal(output)
-		fmt.Println(string(jsonBytes))
-		return
+	var seq uint64
+	previous, _ := readSnapshotFile(outputFile)
+	if previous != nil {
+		seq = previous.Seq
 	}
 
-	// Check if the snapshot has valid data
-	if len(snapshot.Quotas) == 0 {
-		output := formatHyprPanelError("No quota data available")
-		jsonBytes, _ := json.Marshal(output)
-		fmt.Println(string(jsonBytes))
-		return
+	snapshot, _, queryErr := runQuery(opts)
+	if queryErr != nil {
+		errResp := &UsageSnapshot{
+			SchemaVersion: snapshotSchemaVersion,
+			AccountType:   AccountTypeUnknown,
+			CapturedAt:    time.Now().Format(time.RFC3339),
+		}
+		if err := writeSequencedSnapshot(errResp, outputFile, &seq); err != nil {
+			log.Printf("Failed to write error state: %v", err)
+		}
+		return true, queryErr
 	}
 
-	output := formatHyprPanelOutput(&snapshot)
-	jsonBytes, _ := json.Marshal(output)
-	fmt.Println(string(jsonBytes))
+	if snapshot.Incomplete && previous != nil && !previous.Incomplete && hasUsageData(previous) {
+		log.Printf("Query output was truncated, keeping previous snapshot")
+		return true, nil
+	}
+	if err := writeSequencedSnapshot(snapshot, outputFile, &seq); err != nil {
+		return true, fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := saveLastGood(snapshot, outputFile); err != nil {
+		log.Printf("Failed to write last-good snapshot: %v", err)
+	}
+	return true, nil
 }
 
-func runRefreshCommand(args []string) {
-	refreshFlags := flag.NewFlagSet("refresh", flag.ExitOnError)
-	debug := refreshFlags.Bool("d", false, "Enable debug output")
-	debugLong := refreshFlags.Bool("debug", false, "Enable debug output")
-	help := refreshFlags.Bool("h", false, "Show help")
-	helpLong := refreshFlags.Bool("help", false, "Show help")
+func runOneshotCommand(args []string) {
+	oneshotFlags := flag.NewFlagSet("oneshot", flag.ExitOnError)
+	outputFile := oneshotFlags.String("f", "", "Output file path (default: $XDG_RUNTIME_DIR/claude-o-meter/usage.json)")
+	outputFileLong := oneshotFlags.String("file", "", "Output file path (default: $XDG_RUNTIME_DIR/claude-o-meter/usage.json)")
+	lockFile := oneshotFlags.String("lock", "", "Lock file that keeps runs from overlapping (default: <file>.lock)")
+	timeout := oneshotFlags.Duration("timeout", 30*time.Second, "Timeout for the claude process")
+	maxRetries := oneshotFlags.Int("max-retries", 0, "Retry a failed claude spawn up to N times")
+	claudeBin := oneshotFlags.String("claude-bin", "", "Path to the claude binary (default: auto-detect)")
+	help := oneshotFlags.Bool("h", false, "Show help")
+	helpLong := oneshotFlags.Bool("help", false, "Show help")
 
-	refreshFlags.Parse(args)
+	oneshotFlags.Parse(args)
 
 	if *help || *helpLong {
 		printUsage()
 		os.Exit(0)
 	}
 
-	debugMode := *debug || *debugLong
-
-	conn, err := dbus.SessionBus()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to connect to session bus: %v\n", err)
+	actualOutputFile := *outputFile
+	if *outputFileLong != "" {
+		actualOutputFile = *outputFileLong
+	}
+	if actualOutputFile == "" {
+		actualOutputFile = defaultSnapshotPath()
+	}
+	if actualOutputFile == "-" {
+		fmt.Fprintln(os.Stderr, "Error: oneshot writes a file; use query for stdout")
 		os.Exit(1)
 	}
-	defer conn.Close()
+	lockPath := *lockFile
+	if lockPath == "" {
+		lockPath = actualOutputFile + ".lock"
+	}
 
-	obj := conn.Object(dbusServiceName, dbusObjectPath)
-	call := obj.Call(dbusInterface+".RefreshNow", 0)
-	if call.Err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to call RefreshNow: %v\n", call.Err)
+	if *maxRetries < 0 {
+		fmt.Fprintln(os.Stderr, "Error: --max-retries must not be negative")
 		os.Exit(1)
 	}
 
-	if debugMode {
-		fmt.Println("Refresh triggered successfully")
+	ran, err := runOneshot(actualOutputFile, lockPath, &QueryOptions{
+		Timeout:      *timeout,
+		MaxRetries:   *maxRetries,
+		RetryBackoff: 2 * time.Second,
+		ClaudeBin:    *claudeBin,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if !ran {
+		log.Printf("Another oneshot holds %s, skipping this run", lockPath)
 	}
 }
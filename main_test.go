@@ -1,7 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestDetectAuthError(t *testing.T) {
@@ -86,6 +104,26 @@ func TestDetectAuthError(t *testing.T) {
 			input:    "Choose the text style that looks best\nTo change this later, run /theme",
 			wantCode: AuthErrorSetupRequired,
 		},
+		{
+			name:     "account suspended",
+			input:    "Your account has been suspended. Contact support for more information.",
+			wantCode: AuthErrorSuspended,
+		},
+		{
+			name:     "subscription paused",
+			input:    "Your Claude Max subscription is paused. Resume it to continue.",
+			wantCode: AuthErrorSuspended,
+		},
+		{
+			name:     "payment failed",
+			input:    "⚠ Payment failed. Please update your payment method to keep using Claude.",
+			wantCode: AuthErrorSuspended,
+		},
+		{
+			name:     "payment notice next to quota data - no error",
+			input:    "⚠ Payment failed. Please update your payment method.\nCurrent session\n50% used\nResets at 6am",
+			wantNil:  true,
+		},
 		{
 			name:     "normal usage - no error",
 			input:    "Current session: 50% used. Resets at 6am",
@@ -126,6 +164,30 @@ func TestDetectAuthError(t *testing.T) {
 	}
 }
 
+func TestParseClaudeOutput_AccountSuspended(t *testing.T) {
+	fixture, err := os.ReadFile(filepath.Join("testdata", "account_suspended.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := parseClaudeOutput(string(fixture), false, false, nil, nil)
+
+	// The banner must not pass as a successful query with no quotas
+	if snapshot.AuthError == nil || snapshot.AuthError.Code != AuthErrorSuspended {
+		t.Fatalf("AuthError = %+v, want %s", snapshot.AuthError, AuthErrorSuspended)
+	}
+	if !strings.Contains(snapshot.AuthError.Message, "payment") {
+		t.Errorf("Message = %q, want a payment hint", snapshot.AuthError.Message)
+	}
+	if snapshot.AccountType != AccountTypeUnknown {
+		t.Errorf("AccountType = %q, want %q", snapshot.AccountType, AccountTypeUnknown)
+	}
+
+	output := formatHyprPanelOutput(snapshot, HyprPanelOptions{Display: "session"})
+	if output.Alt != "account_suspended" || output.Tooltip != snapshot.AuthError.Message {
+		t.Errorf("hyprpanel = %+v, want alt account_suspended with the message as tooltip", output)
+	}
+}
+
 func TestFormatHyprPanelAuthError(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -174,6 +236,16 @@ func TestFormatHyprPanelAuthError(t *testing.T) {
 			wantAlt:   "setup_required",
 			wantClass: "auth_error",
 		},
+		{
+			name: "account suspended",
+			authError: &AuthError{
+				Code:    AuthErrorSuspended,
+				Message: "Account suspended",
+			},
+			wantText:  "Claude",
+			wantAlt:   "account_suspended",
+			wantClass: "auth_error",
+		},
 		{
 			name:      "nil error",
 			authError: nil,
@@ -270,7 +342,7 @@ func TestParseResetTime_StopsAtQuotaBoundary(t *testing.T) {
 		"Resets 5d 3h",               // 5 - this should NOT be matched for session
 	}
 
-	resetText, resetTime, duration := parseResetTime(lines, 1)
+	resetText, resetTime, duration := parseResetTime(lines, 0, 1, true, nil, nil)
 
 	// Should return empty since no reset was found before the quota boundary
 	if resetText != "" {
@@ -284,6 +356,90 @@ func TestParseResetTime_StopsAtQuotaBoundary(t *testing.T) {
 	}
 }
 
+func TestParseResetTime_PrefersNearestResetLine(t *testing.T) {
+	// Some weekly blocks list a reset per metric; the one adjacent to the
+	// percentage line belongs to this quota, not the first one in the window.
+	lines := []string{
+		"Current week (all models)", // 0
+		"Resets in 3 days",          // 1 - closest to the percentage line
+		"45% used",                  // 2 - startIdx
+		"",                          // 3
+		"",                          // 4
+		"Resets Monday 9am",         // 5 - belongs to another metric
+	}
+
+	resetText, _, duration := parseResetTime(lines, 0, 2, true, nil, nil)
+	if resetText != "Resets in 3 days" {
+		t.Errorf("resetText = %q, want %q", resetText, "Resets in 3 days")
+	}
+	if duration == nil || *duration < 3*86400-5 || *duration > 3*86400+5 {
+		t.Errorf("duration = %v, want ~%d", duration, 3*86400)
+	}
+
+	// Below the percentage line the first reset is also the nearest
+	lines = []string{
+		"Current week (all models)", // 0
+		"45% used",                  // 1 - startIdx
+		"Resets in 2 days",          // 2
+		"Resets in 6 days",          // 3
+	}
+	if resetText, _, _ := parseResetTime(lines, 0, 1, true, nil, nil); resetText != "Resets in 2 days" {
+		t.Errorf("resetText = %q, want %q", resetText, "Resets in 2 days")
+	}
+
+	// Never look back past our own heading into the previous quota
+	lines = []string{
+		"Current session",           // 0
+		"50% used",                  // 1
+		"Resets in 2h",              // 2 - session reset
+		"Current week (all models)", // 3
+		"40% used",                  // 4 - startIdx
+	}
+	if resetText, _, _ := parseResetTime(lines, 3, 4, true, nil, nil); resetText != "" {
+		t.Errorf("resetText = %q, want empty (previous quota's reset)", resetText)
+	}
+
+	// The percentage on the heading line leaves no room to look back, even
+	// when this quota's reset comes after a blank line
+	snapshot := parseClaudeOutput("Claude Max\nCurrent session\n20% used\nResets in 2h\nCurrent week (all models) · 40% used\n\nResets in 5d\n", false, false, nil, nil)
+	if weekly := snapshot.Weekly(); weekly == nil || weekly.ResetText != "Resets in 5d" {
+		t.Errorf("weekly quota = %+v, want ResetText %q", weekly, "Resets in 5d")
+	}
+}
+
+func TestParseResetTime_Epoch(t *testing.T) {
+	want := time.Now().Add(3 * time.Hour).Truncate(time.Second)
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"seconds", fmt.Sprintf("resetsAt: %d", want.Unix())},
+		{"milliseconds", fmt.Sprintf(`"resets_at": %d,`, want.UnixMilli())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := []string{"Current session", "12% used", tt.line}
+			resetText, resetTime, duration := parseResetTime(lines, 0, 1, true, nil, nil)
+			if resetText != tt.line {
+				t.Errorf("resetText = %q, want %q", resetText, tt.line)
+			}
+			if resetTime == nil || !resetTime.Equal(want) {
+				t.Fatalf("resetTime = %v, want %v", resetTime, want)
+			}
+			if duration == nil || *duration < 3*3600-5 || *duration > 3*3600 {
+				t.Errorf("duration = %v, want ~%d", duration, 3*3600)
+			}
+		})
+	}
+
+	// An epoch in the past gives the time but no duration
+	past := time.Now().Add(-time.Hour).Unix()
+	lines := []string{"Current session", "12% used", fmt.Sprintf("resetsAt: %d", past)}
+	if _, resetTime, duration := parseResetTime(lines, 0, 1, true, nil, nil); resetTime == nil || resetTime.Unix() != past || duration != nil {
+		t.Errorf("past epoch: resetTime = %v, duration = %v; want %d and no duration", resetTime, duration, past)
+	}
+}
+
 func TestParseResetTime_FindsResetBeforeBoundary(t *testing.T) {
 	// This test verifies that parseResetTime still finds reset times
 	// that appear before a quota boundary.
@@ -297,7 +453,7 @@ func TestParseResetTime_FindsResetBeforeBoundary(t *testing.T) {
 		"Resets 5d 3h",               // 6 - weekly reset
 	}
 
-	resetText, resetTime, duration := parseResetTime(lines, 1)
+	resetText, resetTime, duration := parseResetTime(lines, 0, 1, true, nil, nil)
 
 	if resetText == "" {
 		t.Error("parseResetTime should find reset text before quota boundary")
@@ -331,7 +487,7 @@ func TestParseQuotas_SessionResetNotMatchedFromWeekly(t *testing.T) {
 │  Resets 5d 3h
 │`
 
-	quotas := parseQuotas(input)
+	quotas := parseQuotas(input, nil, nil)
 
 	if len(quotas) < 2 {
 		t.Fatalf("expected at least 2 quotas, got %d", len(quotas))
@@ -377,3 +533,4936 @@ func TestParseQuotas_SessionResetNotMatchedFromWeekly(t *testing.T) {
 		}
 	}
 }
+
+func TestParseQuotas_LimitText(t *testing.T) {
+	input := `· Claude Max · user@example.com
+│
+│  Current session
+│  Max 5x: up to ~225 messages / 5h
+│  20% used
+│  Resets 3h
+│
+│  Current week (all models)
+│  50% used
+│  Resets 5d 3h
+│
+│  Current week (sonnet only)
+│  10% used
+│  Max 5x: up to ~1,200 messages / week                     │
+│`
+
+	quotas := parseQuotas(input, nil, nil)
+
+	want := map[string]string{
+		"session": "Max 5x: up to ~225 messages / 5h",
+		"weekly":  "",
+		"sonnet":  "Max 5x: up to ~1,200 messages / week",
+	}
+	for name, limitText := range want {
+		q := findQuota(quotas, name)
+		if q == nil {
+			t.Errorf("quota %s missing from %+v", name, quotas)
+			continue
+		}
+		if q.LimitText != limitText {
+			t.Errorf("quota %s LimitText = %q, want %q", name, q.LimitText, limitText)
+		}
+	}
+}
+
+func TestParseQuotas_Label(t *testing.T) {
+	input := `· Claude Max · user@example.com
+│
+│  Current session                                          │
+│  20% used
+│
+│  Current week (all models)
+│  50% used
+│
+│  Current week (Sonnet only)
+│  10% used
+│`
+
+	quotas := parseQuotas(input, nil, nil)
+
+	want := map[string]string{
+		"session": "Current session",
+		"weekly":  "Current week (all models)",
+		"sonnet":  "Current week (Sonnet only)",
+	}
+	if len(quotas) != len(want) {
+		t.Fatalf("got %d quotas, want %d", len(quotas), len(want))
+	}
+	for name, label := range want {
+		q := findQuota(quotas, name)
+		if q == nil {
+			t.Errorf("quota %s missing from %+v", name, quotas)
+			continue
+		}
+		if q.Label != label {
+			t.Errorf("quota %s Label = %q, want %q", name, q.Label, label)
+		}
+	}
+}
+
+func TestParseQuotas_SkipsPlanMultiplier(t *testing.T) {
+	input := `· Claude Max · user@example.com
+│
+│  Current session
+│  Max 5x · 5 % boost · 1234% of baseline
+│  20% used
+│  Resets 3h
+│
+│  Current week (all models)
+│  Max 20x
+│  60% Remaining
+│  Resets 5d 3h
+│`
+
+	quotas := parseQuotas(input, nil, nil)
+
+	want := map[string]float64{"session": 80, "weekly": 60}
+	for name, remaining := range want {
+		q := findQuota(quotas, name)
+		if q == nil {
+			t.Errorf("quota %s missing from %+v", name, quotas)
+			continue
+		}
+		if q.PercentRemaining != remaining {
+			t.Errorf("quota %s PercentRemaining = %v, want %v", name, q.PercentRemaining, remaining)
+		}
+	}
+}
+
+func TestParsePercentage_RequiresWording(t *testing.T) {
+	tests := []struct {
+		input  string
+		want   float64
+		wantOK bool
+	}{
+		{"5x", 0, false},
+		{"5 %", 0, false},
+		{"1234% used", 0, false},
+		{"12% usedup", 0, false},
+		{"12% used", 88, true},
+		{"12% Left", 12, true},
+		{"12% remaining", 12, true},
+		{"│  -3% left", 0, true},
+	}
+	for _, tt := range tests {
+		got, ok := parsePercentage(tt.input)
+		if ok != tt.wantOK || got != tt.want {
+			t.Errorf("parsePercentage(%q) = %v, %v, want %v, %v", tt.input, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestRunQuery_RetriesTransientFailures(t *testing.T) {
+	calls := 0
+	opts := &QueryOptions{
+		Timeout:      time.Second,
+		MaxRetries:   3,
+		RetryBackoff: time.Millisecond,
+		Executor: func(ctx context.Context, opts *QueryOptions) (string, error) {
+			calls++
+			if calls < 3 {
+				return "", errors.New("failed to execute claude CLI: exit status 1")
+			}
+			return "Current session\n25% used\nResets 2h", nil
+		},
+	}
+
+	snapshot, _, err := runQuery(opts)
+	if err != nil {
+		t.Fatalf("runQuery() error = %v, want nil", err)
+	}
+	if calls != 3 {
+		t.Errorf("executor called %d times, want 3", calls)
+	}
+	if len(snapshot.Quotas) != 1 || snapshot.Quotas[0].PercentRemaining != 75 {
+		t.Errorf("unexpected quotas after retry: %+v", snapshot.Quotas)
+	}
+}
+
+func TestRunQuery_DoesNotRetryNonRetryableErrors(t *testing.T) {
+	calls := 0
+	opts := &QueryOptions{
+		Timeout:      time.Second,
+		MaxRetries:   3,
+		RetryBackoff: time.Millisecond,
+		Executor: func(ctx context.Context, opts *QueryOptions) (string, error) {
+			calls++
+			return "", errClaudeNotFound
+		},
+	}
+
+	if _, _, err := runQuery(opts); !errors.Is(err, errClaudeNotFound) {
+		t.Errorf("runQuery() error = %v, want errClaudeNotFound", err)
+	}
+	if calls != 1 {
+		t.Errorf("executor called %d times, want 1", calls)
+	}
+}
+
+func TestRunQuery_EmptyOutputIsAnError(t *testing.T) {
+	for _, output := range []string{"", "  \r\n\t\n"} {
+		calls := 0
+		opts := &QueryOptions{
+			Timeout:      time.Second,
+			MaxRetries:   1,
+			RetryBackoff: time.Millisecond,
+			Executor: func(ctx context.Context, opts *QueryOptions) (string, error) {
+				calls++
+				return output, nil
+			},
+		}
+
+		snapshot, _, err := runQuery(opts)
+		if !errors.Is(err, errNoClaudeOutput) {
+			t.Errorf("runQuery(%q) error = %v, want errNoClaudeOutput", output, err)
+		}
+		if snapshot != nil {
+			t.Errorf("runQuery(%q) snapshot = %+v, want nil", output, snapshot)
+		}
+		if calls != 2 {
+			t.Errorf("runQuery(%q) called executor %d times, want 2 (retried)", output, calls)
+		}
+	}
+}
+
+func TestRunQuery_DoesNotRetryAuthErrors(t *testing.T) {
+	calls := 0
+	opts := &QueryOptions{
+		Timeout:      time.Second,
+		MaxRetries:   3,
+		RetryBackoff: time.Millisecond,
+		Executor: func(ctx context.Context, opts *QueryOptions) (string, error) {
+			calls++
+			return "Your session expired. Please log in again.", nil
+		},
+	}
+
+	snapshot, _, err := runQuery(opts)
+	if err != nil {
+		t.Fatalf("runQuery() error = %v, want nil", err)
+	}
+	if calls != 1 {
+		t.Errorf("executor called %d times, want 1", calls)
+	}
+	if snapshot.AuthError == nil || snapshot.AuthError.Code != AuthErrorTokenExpired {
+		t.Errorf("snapshot.AuthError = %+v, want token_expired", snapshot.AuthError)
+	}
+}
+
+func TestHyprPanelOutputForFile_ErrorCategories(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+		return path
+	}
+
+	fresh := `{"account_type":"max","quotas":[{"type":"session","percent_remaining":60}],"captured_at":"2026-01-10T11:59:00Z"}`
+	stale := `{"account_type":"max","quotas":[{"type":"session","percent_remaining":60}],"captured_at":"2026-01-10T10:00:00Z"}`
+
+	tests := []struct {
+		name    string
+		path    string
+		maxAge  time.Duration
+		wantAlt string
+	}{
+		{
+			name:    "missing file",
+			path:    filepath.Join(dir, "does-not-exist.json"),
+			wantAlt: "file_missing",
+		},
+		{
+			name:    "unreadable path",
+			path:    dir,
+			wantAlt: "read_error",
+		},
+		{
+			name:    "malformed JSON",
+			path:    writeFile("bad.json", "{not json"),
+			wantAlt: "parse_error",
+		},
+		{
+			name:    "no quotas",
+			path:    writeFile("empty.json", `{"account_type":"unknown","quotas":null,"captured_at":"2026-01-10T11:59:00Z"}`),
+			wantAlt: "no_data",
+		},
+		{
+			name:    "stale data",
+			path:    writeFile("stale.json", stale),
+			maxAge:  10 * time.Minute,
+			wantAlt: "stale",
+		},
+		{
+			name:    "stale check disabled",
+			path:    writeFile("stale-ok.json", stale),
+			wantAlt: "low",
+		},
+		{
+			name:    "fresh data",
+			path:    writeFile("fresh.json", fresh),
+			maxAge:  10 * time.Minute,
+			wantAlt: "low",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := hyprPanelOutputForFile(tt.path, tt.maxAge, HyprPanelOptions{Display: "session"}, now)
+			if got.Alt != tt.wantAlt {
+				t.Errorf("hyprPanelOutputForFile().Alt = %q, want %q (tooltip: %q)", got.Alt, tt.wantAlt, got.Tooltip)
+			}
+			if got.Tooltip == "" {
+				t.Error("hyprPanelOutputForFile().Tooltip should not be empty")
+			}
+		})
+	}
+}
+
+func TestParseClaudeOutput_StripsSpinnerFrames(t *testing.T) {
+	input := "⠋⠙⠹ Loading usage…\r⠸ \r" +
+		"│  Current session\n" +
+		"⠼⠴ 30% used\n" +
+		"│  Resets 2h\n" +
+		"|\r/\r-\r\\\n" +
+		"│  Current week (all models)\n" +
+		"│  45% used\n" +
+		"│  Resets 5d 3h\n"
+
+	snapshot := parseClaudeOutput(input, true, false, nil, nil)
+
+	if len(snapshot.Quotas) != 2 {
+		t.Fatalf("expected 2 quotas, got %d: %+v", len(snapshot.Quotas), snapshot.Quotas)
+	}
+	if snapshot.Quotas[0].PercentRemaining != 70 {
+		t.Errorf("session PercentRemaining = %v, want 70", snapshot.Quotas[0].PercentRemaining)
+	}
+	if snapshot.Quotas[1].PercentRemaining != 55 {
+		t.Errorf("weekly PercentRemaining = %v, want 55", snapshot.Quotas[1].PercentRemaining)
+	}
+	if strings.ContainsAny(snapshot.RawOutput, "⠋⠙⠹⠸⠼⠴|/\\") || strings.Contains(snapshot.RawOutput, "-\r") {
+		t.Errorf("RawOutput still contains spinner glyphs: %q", snapshot.RawOutput)
+	}
+}
+
+func TestStripSpinnerFrames_KeepsRegularText(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "box border is not a spinner",
+			input: "│  50% used",
+			want:  "│  50% used",
+		},
+		{
+			name:  "negative number is kept",
+			input: "-3% left",
+			want:  "-3% left",
+		},
+		{
+			name:  "indentation is preserved",
+			input: "header\n  ⠧ Current session",
+			want:  "header\n  Current session",
+		},
+		{
+			name:  "bullet and table cell are kept",
+			input: "- Current session\n| 50% used |\n\\ note",
+			want:  "- Current session\n| 50% used |\n\\ note",
+		},
+		{
+			name:  "lone ascii frames are dropped",
+			input: "  |\r/\n-\nCurrent session",
+			want:  "\r\n\nCurrent session",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripSpinnerFrames(tt.input); got != tt.want {
+				t.Errorf("stripSpinnerFrames(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSinceCutoff(t *testing.T) {
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{
+			name:  "relative duration",
+			value: "24h",
+			want:  time.Date(2026, 1, 9, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "absolute RFC3339",
+			value: "2026-01-10T08:00:00+01:00",
+			want:  time.Date(2026, 1, 10, 7, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "negative duration",
+			value:   "-1h",
+			wantErr: true,
+		},
+		{
+			name:    "garbage",
+			value:   "yesterday",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSinceCutoff(tt.value, now)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseSinceCutoff(%q) error = nil, want error", tt.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSinceCutoff(%q) error = %v", tt.value, err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseSinceCutoff(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterSince(t *testing.T) {
+	snapshots := []*UsageSnapshot{
+		{CapturedAt: "2026-01-09T10:00:00Z"},
+		{CapturedAt: "not a timestamp"},
+		{CapturedAt: "2026-01-10T09:00:00Z"},
+		{CapturedAt: "2026-01-10T11:30:00Z"},
+	}
+	cutoff := time.Date(2026, 1, 10, 9, 0, 0, 0, time.UTC)
+
+	got := filterSince(snapshots, cutoff)
+
+	if len(got) != 2 {
+		t.Fatalf("filterSince() returned %d snapshots, want 2", len(got))
+	}
+	if got[0].CapturedAt != "2026-01-10T09:00:00Z" || got[1].CapturedAt != "2026-01-10T11:30:00Z" {
+		t.Errorf("filterSince() = [%s %s], want the two snapshots at or after the cutoff", got[0].CapturedAt, got[1].CapturedAt)
+	}
+}
+
+func TestSparkline(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		want   string
+	}{
+		{
+			name:   "empty series",
+			values: nil,
+			want:   "",
+		},
+		{
+			name:   "flat series",
+			values: []float64{40, 40, 40, 40},
+			want:   "▄▄▄▄",
+		},
+		{
+			name:   "rising series",
+			values: []float64{0, 15, 30, 45, 60, 75, 90, 100},
+			want:   "▁▂▃▄▅▆▇█",
+		},
+		{
+			name:   "out of range values are clamped",
+			values: []float64{-10, 120},
+			want:   "▁█",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sparkline(tt.values); got != tt.want {
+				t.Errorf("sparkline(%v) = %q, want %q", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadSnapshotHistory(t *testing.T) {
+	input := `{"account_type":"max","quotas":[{"type":"session","percent_remaining":90}],"captured_at":"2026-01-10T10:00:00Z"}
+
+{not json}
+{"account_type":"max","quotas":[{"type":"session","percent_remaining":60},{"type":"model_specific","model":"opus","percent_remaining":20}],"captured_at":"2026-01-10T11:00:00Z"}
+`
+
+	snapshots, err := readSnapshotHistory(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("readSnapshotHistory() error = %v", err)
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("readSnapshotHistory() returned %d snapshots, want 2", len(snapshots))
+	}
+
+	if q := findQuota(snapshots[1].Quotas, "opus"); q == nil || q.PercentRemaining != 20 {
+		t.Errorf("findQuota(opus) = %+v, want opus quota at 20%%", q)
+	}
+	if q := findQuota(snapshots[0].Quotas, "weekly"); q != nil {
+		t.Errorf("findQuota(weekly) = %+v, want nil", q)
+	}
+}
+
+func TestDefaultSnapshotPath(t *testing.T) {
+	tests := []struct {
+		name       string
+		runtimeDir string
+		want       string
+	}{
+		{
+			name:       "XDG_RUNTIME_DIR set",
+			runtimeDir: "/run/user/1000",
+			want:       "/run/user/1000/claude-o-meter/usage.json",
+		},
+		{
+			name:       "XDG_RUNTIME_DIR unset",
+			runtimeDir: "",
+			want:       "/tmp/claude-o-meter/usage.json",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_RUNTIME_DIR", tt.runtimeDir)
+			if got := defaultSnapshotPath(); got != tt.want {
+				t.Errorf("defaultSnapshotPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatHyprPanelOutput_Display(t *testing.T) {
+	snapshot := &UsageSnapshot{
+		AccountType: AccountTypeMax,
+		Quotas: []Quota{
+			{Type: QuotaTypeWeekly, PercentRemaining: 40},
+			{Type: QuotaTypeModelSpecific, Model: "sonnet", PercentRemaining: 70},
+			{Type: QuotaTypeSession, PercentRemaining: 90},
+			{Type: QuotaTypeModelSpecific, Model: "opus", PercentRemaining: 10},
+		},
+	}
+
+	tests := []struct {
+		display   string
+		wantText  string
+		wantClass string
+	}{
+		{display: "session", wantText: "10% Max", wantClass: "low"},
+		{display: "weekly", wantText: "60% Max", wantClass: "medium"},
+		{display: "opus", wantText: "90% Max", wantClass: "high"},
+		{display: "sonnet", wantText: "30% Max", wantClass: "low"},
+		{display: "worst", wantText: "90% Max", wantClass: "high"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.display, func(t *testing.T) {
+			got := formatHyprPanelOutput(snapshot, HyprPanelOptions{Display: tt.display})
+			if got.Text != tt.wantText {
+				t.Errorf("Text = %q, want %q", got.Text, tt.wantText)
+			}
+			if got.Class != tt.wantClass {
+				t.Errorf("Class = %q, want %q", got.Class, tt.wantClass)
+			}
+			if !strings.Contains(got.Tooltip, "Session: 10% used") || !strings.Contains(got.Tooltip, "Weekly: 60% used") {
+				t.Errorf("Tooltip = %q, want session and weekly selected by type", got.Tooltip)
+			}
+		})
+	}
+}
+
+func TestFormatHyprPanelOutput_DisplayFallsBackToFirstQuota(t *testing.T) {
+	snapshot := &UsageSnapshot{
+		AccountType: AccountTypePro,
+		Quotas: []Quota{
+			{Type: QuotaTypeSession, PercentRemaining: 75},
+		},
+	}
+
+	got := formatHyprPanelOutput(snapshot, HyprPanelOptions{Display: "opus"})
+	if got.Text != "25% Pro" {
+		t.Errorf("Text = %q, want %q", got.Text, "25% Pro")
+	}
+}
+
+func TestFormatHyprPanelOutput_TextFormat(t *testing.T) {
+	sessionAndWeekly := &UsageSnapshot{
+		AccountType: AccountTypeMax,
+		Quotas: []Quota{
+			{Type: QuotaTypeSession, PercentRemaining: 27.4},
+			{Type: QuotaTypeWeekly, PercentRemaining: 60},
+		},
+	}
+	sessionOnly := &UsageSnapshot{
+		AccountType: AccountTypePro,
+		Quotas: []Quota{
+			{Type: QuotaTypeSession, PercentRemaining: 27.4},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		snapshot *UsageSnapshot
+		format   string
+		wantText string
+	}{
+		{"session and weekly", sessionAndWeekly, "S{s} W{w}", "S73 W40"},
+		{"session only", sessionOnly, "S{s} W{w}", "S73 W"},
+		{"absent model quotas", sessionAndWeekly, "{opus}/{sonnet}", "/"},
+		{"default", sessionAndWeekly, "", "73% Max"},
+		{"default session only", sessionOnly, "", "73% Pro"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := formatHyprPanelOutput(tt.snapshot, HyprPanelOptions{Display: "session", TextFormat: tt.format})
+			if got.Text != tt.wantText {
+				t.Errorf("Text = %q, want %q", got.Text, tt.wantText)
+			}
+			if got.Class != "medium" {
+				t.Errorf("Class = %q, want %q (still driven by --display)", got.Class, "medium")
+			}
+		})
+	}
+}
+
+func TestFormatPercent(t *testing.T) {
+	tests := []struct {
+		value    float64
+		decimals int
+		want     string
+	}{
+		{99.6, 0, "100"},
+		{99.6, 1, "99.6"},
+		{72.5, 0, "73"},
+		{73.5, 0, "74"},
+		{12.25, 1, "12.3"},
+		{0, 2, "0.00"},
+	}
+	for _, tt := range tests {
+		if got := formatPercent(tt.value, tt.decimals); got != tt.want {
+			t.Errorf("formatPercent(%v, %d) = %q, want %q", tt.value, tt.decimals, got, tt.want)
+		}
+	}
+}
+
+func TestFormatHyprPanelOutput_Decimals(t *testing.T) {
+	snapshot := &UsageSnapshot{
+		AccountType: AccountTypeMax,
+		Quotas: []Quota{
+			{Type: QuotaTypeSession, PercentRemaining: 0.4},
+			{Type: QuotaTypeWeekly, PercentRemaining: 50},
+		},
+	}
+
+	tests := []struct {
+		decimals    int
+		format      string
+		wantText    string
+		wantTooltip string
+	}{
+		{0, "", "100% Max", "Session: 100% used"},
+		{1, "", "99.6% Max", "Session: 99.6% used"},
+		{0, "S{s} W{w}", "S100 W50", "Weekly: 50% used"},
+		{1, "S{s} W{w}", "S99.6 W50.0", "Weekly: 50.0% used"},
+	}
+	for _, tt := range tests {
+		got := formatHyprPanelOutput(snapshot, HyprPanelOptions{Display: "session", TextFormat: tt.format, Decimals: tt.decimals})
+		if got.Text != tt.wantText {
+			t.Errorf("decimals=%d format=%q: Text = %q, want %q", tt.decimals, tt.format, got.Text, tt.wantText)
+		}
+		if !strings.Contains(got.Tooltip, tt.wantTooltip) {
+			t.Errorf("decimals=%d: Tooltip = %q, want it to contain %q", tt.decimals, got.Tooltip, tt.wantTooltip)
+		}
+	}
+}
+
+func TestParsePercentage_Clamps(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		want        float64
+		wantWarning string
+	}{
+		{
+			name:  "in range used",
+			input: "30% used",
+			want:  70,
+		},
+		{
+			name:        "over 100 used",
+			input:       "105% used",
+			want:        0,
+			wantWarning: `clamped out-of-range percentage "105% used"`,
+		},
+		{
+			name:        "negative left",
+			input:       "-3% left",
+			want:        0,
+			wantWarning: `clamped out-of-range percentage "-3% left"`,
+		},
+		{
+			name:        "over 100 left",
+			input:       "140% left",
+			want:        100,
+			wantWarning: `clamped out-of-range percentage "140% left"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parsePercentage(tt.input)
+			if !ok {
+				t.Fatalf("parsePercentage(%q) ok = false, want true", tt.input)
+			}
+			if got != tt.want {
+				t.Errorf("parsePercentage(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+
+			snapshot := parseClaudeOutput("Claude Max\nCurrent session\n"+tt.input+"\nResets in 2h\n", false, false, nil, nil)
+			if len(snapshot.Quotas) != 1 || snapshot.Quotas[0].PercentRemaining != tt.want {
+				t.Fatalf("Quotas = %+v, want one quota at %v%% remaining", snapshot.Quotas, tt.want)
+			}
+			clampWarnings := slices.DeleteFunc(slices.Clone(snapshot.Warnings), func(w string) bool {
+				return !strings.HasPrefix(w, "clamped")
+			})
+			if tt.wantWarning == "" && len(clampWarnings) != 0 {
+				t.Errorf("Warnings = %q, want no clamp warning", snapshot.Warnings)
+			}
+			if tt.wantWarning != "" && !slices.Equal(clampWarnings, []string{tt.wantWarning}) {
+				t.Errorf("Warnings = %q, want %q", snapshot.Warnings, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestQueryCommand_EnvHyprPanel(t *testing.T) {
+	t.Setenv("CLAUDE_O_METER_HYPRPANEL", "1")
+	executor := func(ctx context.Context, opts *QueryOptions) (string, error) {
+		return "Claude Max\nCurrent session\n25% used\nResets 2h", nil
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := queryCommand(nil, &stdout, &stderr, executor); code != 0 {
+		t.Fatalf("queryCommand() exit code = %d, stderr: %s", code, stderr.String())
+	}
+
+	var output HyprPanelOutput
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		t.Fatalf("stdout is not HyprPanel JSON: %v\n%s", err, stdout.String())
+	}
+	if output.Text != "25% Max" {
+		t.Errorf("Text = %q, want %q", output.Text, "25% Max")
+	}
+}
+
+func TestApplyEnvDefaults_FlagsOverride(t *testing.T) {
+	t.Setenv("CLAUDE_O_METER_TIMEOUT", "5s")
+	t.Setenv("CLAUDE_O_METER_CLAUDE_BIN", "/env/claude")
+
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	timeout := fs.Duration("timeout", 30*time.Second, "")
+	claudeBin := fs.String("claude-bin", "", "")
+
+	if err := applyEnvDefaults(fs, queryEnvVars); err != nil {
+		t.Fatalf("applyEnvDefaults() error = %v", err)
+	}
+	if err := fs.Parse([]string{"--claude-bin", "/flag/claude"}); err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	if *timeout != 5*time.Second {
+		t.Errorf("timeout = %v, want 5s from environment", *timeout)
+	}
+	if *claudeBin != "/flag/claude" {
+		t.Errorf("claude-bin = %q, want flag value to override environment", *claudeBin)
+	}
+}
+
+func TestQueryCommand_LongBoolFlagOverridesEnv(t *testing.T) {
+	t.Setenv("CLAUDE_O_METER_DEBUG", "1")
+	t.Setenv("CLAUDE_O_METER_RAW", "true")
+
+	for _, tt := range []struct {
+		args      []string
+		wantDebug bool
+		wantRaw   bool
+	}{
+		{nil, true, true},
+		{[]string{"--debug=false"}, false, true},
+		{[]string{"--debug=false", "--raw=false"}, false, false},
+	} {
+		var got *QueryOptions
+		executor := func(ctx context.Context, opts *QueryOptions) (string, error) {
+			got = opts
+			return "Current session\n25% used\nResets in 2h", nil
+		}
+		var stdout, stderr bytes.Buffer
+		if code := queryCommand(tt.args, &stdout, &stderr, executor); code != 0 {
+			t.Fatalf("%q: exit code = %d, stderr: %s", tt.args, code, stderr.String())
+		}
+		if got.Debug != tt.wantDebug || got.IncludeRaw != (tt.wantDebug || tt.wantRaw) {
+			t.Errorf("%q: Debug = %v, IncludeRaw = %v; want %v, %v", tt.args, got.Debug, got.IncludeRaw, tt.wantDebug, tt.wantDebug || tt.wantRaw)
+		}
+	}
+}
+
+func TestApplyEnvDefaults_InvalidValue(t *testing.T) {
+	t.Setenv("CLAUDE_O_METER_TIMEOUT", "soon")
+
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	fs.Duration("timeout", 30*time.Second, "")
+
+	if err := applyEnvDefaults(fs, map[string]string{"CLAUDE_O_METER_TIMEOUT": "timeout"}); err == nil {
+		t.Error("applyEnvDefaults() error = nil, want error for invalid duration")
+	}
+}
+
+func TestParseClaudeOutput_APIAccount(t *testing.T) {
+	input := "╭──────────────────────────────╮\n" +
+		"│ Claude API · dev@example.com │\n" +
+		"│                              │\n" +
+		"│ Total cost: $1,012.34        │\n" +
+		"│ Credit balance: $87.66       │\n" +
+		"╰──────────────────────────────╯\n"
+
+	snapshot := parseClaudeOutput(input, false, false, nil, nil)
+
+	if snapshot.AccountType != AccountTypeAPI {
+		t.Fatalf("AccountType = %q, want %q", snapshot.AccountType, AccountTypeAPI)
+	}
+	if snapshot.AuthError != nil {
+		t.Fatalf("AuthError = %+v, want nil", snapshot.AuthError)
+	}
+	if len(snapshot.Quotas) != 0 {
+		t.Errorf("expected no quotas, got %+v", snapshot.Quotas)
+	}
+	if snapshot.APIUsage == nil || snapshot.APIUsage.Spent == nil || snapshot.APIUsage.CreditBalance == nil {
+		t.Fatalf("APIUsage = %+v, want spent and credit balance", snapshot.APIUsage)
+	}
+	if *snapshot.APIUsage.Spent != 1012.34 {
+		t.Errorf("Spent = %v, want 1012.34", *snapshot.APIUsage.Spent)
+	}
+	if *snapshot.APIUsage.CreditBalance != 87.66 {
+		t.Errorf("CreditBalance = %v, want 87.66", *snapshot.APIUsage.CreditBalance)
+	}
+
+	output := formatHyprPanelOutput(snapshot, HyprPanelOptions{Display: "session"})
+	if output.Text != "$1012.34 API" {
+		t.Errorf("Text = %q, want %q", output.Text, "$1012.34 API")
+	}
+	if output.Class != "api" {
+		t.Errorf("Class = %q, want %q", output.Class, "api")
+	}
+	if !strings.Contains(output.Tooltip, "Credit balance: $87.66") {
+		t.Errorf("Tooltip = %q, want credit balance line", output.Tooltip)
+	}
+}
+
+func TestParseClaudeOutput_APICredits(t *testing.T) {
+	fixture, err := os.ReadFile(filepath.Join("testdata", "api_credits.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := parseClaudeOutput(string(fixture), false, false, nil, nil)
+
+	// No "Claude API" header: the credits line alone identifies the account
+	if snapshot.AccountType != AccountTypeAPI {
+		t.Fatalf("AccountType = %q, want %q", snapshot.AccountType, AccountTypeAPI)
+	}
+	usage := snapshot.APIUsage
+	if usage == nil || usage.CreditBalance == nil || usage.CreditTotal == nil || usage.Spent == nil {
+		t.Fatalf("APIUsage = %+v, want balance, total and spent", usage)
+	}
+	if *usage.CreditBalance != 37.5 || *usage.CreditTotal != 50 || *usage.Spent != 12.5 {
+		t.Errorf("APIUsage = {balance %v, total %v, spent %v}, want {37.5, 50, 12.5}", *usage.CreditBalance, *usage.CreditTotal, *usage.Spent)
+	}
+
+	output := formatHyprPanelOutput(snapshot, HyprPanelOptions{Display: "session"})
+	if output.Text != "$37.50/$50 API" {
+		t.Errorf("Text = %q, want %q", output.Text, "$37.50/$50 API")
+	}
+	if !strings.Contains(output.Tooltip, "Credits: $37.50 of $50.00 remaining") {
+		t.Errorf("Tooltip = %q, want credits line", output.Tooltip)
+	}
+	if got := formatMOTD(snapshot, time.Now()); got != "Claude API — $12.50 spent" {
+		t.Errorf("formatMOTD() = %q, want %q", got, "Claude API — $12.50 spent")
+	}
+}
+
+func TestRetryPartialRead(t *testing.T) {
+	good := []byte(`{"account_type":"max","quotas":[]}`)
+	tests := []struct {
+		name      string
+		reads     [][]byte
+		want      string
+		wantCalls int
+	}{
+		// The reader caught the file mid-rename, then sees the new content
+		{"empty then good", [][]byte{{}, good}, string(good), 2},
+		{"truncated then good", [][]byte{good[:10], good}, string(good), 2},
+		{"good", [][]byte{good}, string(good), 1},
+		// Still empty on the second read: the caller reports the parse error
+		{"empty twice", [][]byte{{}, {}}, "", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			read := func() ([]byte, error) {
+				data := tt.reads[calls]
+				calls++
+				return data, nil
+			}
+			got, err := retryPartialRead(read, 0)
+			if err != nil {
+				t.Fatalf("retryPartialRead() error = %v", err)
+			}
+			if string(got) != tt.want || calls != tt.wantCalls {
+				t.Errorf("retryPartialRead() = %q after %d reads, want %q after %d", got, calls, tt.want, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestHyprPanelOutputForFile_APIAccountIsNotNoData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.json")
+	content := `{"account_type":"api","quotas":null,"api_usage":{"spent":4.5},"captured_at":"2026-01-10T11:59:00Z"}`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got := hyprPanelOutputForFile(path, 0, HyprPanelOptions{Display: "session"}, time.Now())
+	if got.Alt != "api" || got.Text != "$4.50 API" {
+		t.Errorf("hyprPanelOutputForFile() = %+v, want api output with $4.50", got)
+	}
+}
+
+func TestSnapshotSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "claude-o-meter.sock")
+
+	socket, err := listenSnapshotSocket(path)
+	if err != nil {
+		t.Fatalf("listenSnapshotSocket() error = %v", err)
+	}
+
+	readLine := func() []byte {
+		t.Helper()
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		defer conn.Close()
+		data, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatalf("ReadAll() error = %v", err)
+		}
+		if !bytes.HasSuffix(data, []byte("\n")) || bytes.Count(data, []byte("\n")) != 1 {
+			t.Fatalf("response is not a single JSON line: %q", data)
+		}
+		return data
+	}
+
+	var errResp ErrorResponse
+	if err := json.Unmarshal(readLine(), &errResp); err != nil || errResp.Error == "" {
+		t.Errorf("before first update: got %+v (err %v), want error response", errResp, err)
+	}
+
+	socket.Update(&UsageSnapshot{
+		AccountType: AccountTypeMax,
+		Quotas:      []Quota{{Type: QuotaTypeSession, PercentRemaining: 64}},
+		CapturedAt:  "2026-01-10T12:00:00Z",
+	})
+
+	var snapshot UsageSnapshot
+	if err := json.Unmarshal(readLine(), &snapshot); err != nil {
+		t.Fatalf("response is not a snapshot: %v", err)
+	}
+	if snapshot.AccountType != AccountTypeMax || len(snapshot.Quotas) != 1 || snapshot.Quotas[0].PercentRemaining != 64 {
+		t.Errorf("decoded snapshot = %+v, want the updated snapshot", snapshot)
+	}
+
+	if err := socket.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("socket file still exists after Close(): %v", err)
+	}
+}
+
+func TestFormatHyprPanelOutput_Warnings(t *testing.T) {
+	quotas := []Quota{{Type: QuotaTypeSession, PercentRemaining: 80}}
+
+	clean := formatHyprPanelOutput(&UsageSnapshot{AccountType: AccountTypeMax, Quotas: quotas}, HyprPanelOptions{Display: "session"})
+	if clean.Class != "low" {
+		t.Errorf("without warnings: Class = %q, want %q", clean.Class, "low")
+	}
+
+	degraded := formatHyprPanelOutput(&UsageSnapshot{
+		AccountType: AccountTypeMax,
+		Quotas:      quotas,
+		Warnings:    []string{"account type inferred from quota layout"},
+	}, HyprPanelOptions{Display: "session"})
+	if degraded.Class != "low warn" {
+		t.Errorf("with warnings: Class = %q, want %q", degraded.Class, "low warn")
+	}
+	if degraded.Alt != "low" {
+		t.Errorf("with warnings: Alt = %q, want %q", degraded.Alt, "low")
+	}
+	if !strings.Contains(degraded.Tooltip, "account type inferred") {
+		t.Errorf("with warnings: Tooltip = %q, want the warning listed", degraded.Tooltip)
+	}
+}
+
+func TestParseClaudeOutput_Warnings(t *testing.T) {
+	tests := []struct {
+		name         string
+		input        string
+		wantWarnings int
+	}{
+		{
+			name:         "explicit account and parsed reset",
+			input:        "Claude Max\nCurrent session\n25% used\nResets 2h",
+			wantWarnings: 0,
+		},
+		{
+			name:         "inferred account",
+			input:        "Current session\n25% used\nResets 2h",
+			wantWarnings: 1,
+		},
+		{
+			name:         "inferred account and unparsed reset",
+			input:        "Current session\n25% used\nResets soon",
+			wantWarnings: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snapshot := parseClaudeOutput(tt.input, false, false, nil, nil)
+			if len(snapshot.Warnings) != tt.wantWarnings {
+				t.Errorf("Warnings = %q, want %d warnings", snapshot.Warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestParseAbsoluteTime_DateWithoutTime(t *testing.T) {
+	tests := []string{
+		"Resets Monday, Jan 6",
+		"Resets Jan 6",
+		"Resets Mon Jan 6 (UTC)",
+	}
+
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			resetTime, duration := parseAbsoluteTime(input)
+			if resetTime == nil {
+				t.Fatalf("parseAbsoluteTime(%q) returned nil reset time", input)
+			}
+			if resetTime.Month() != time.January || resetTime.Day() != 6 {
+				t.Errorf("reset date = %s, want Jan 6", resetTime.Format("Jan 2"))
+			}
+			if resetTime.Hour() != 0 || resetTime.Minute() != 0 {
+				t.Errorf("reset time = %s, want midnight", resetTime.Format("15:04"))
+			}
+			if duration == nil || *duration <= 0 {
+				t.Errorf("duration = %v, want a positive duration until the next Jan 6", duration)
+			}
+		})
+	}
+}
+
+func TestParseClaudeOutput_DateOnlyResetWarns(t *testing.T) {
+	input := "Claude Max\nCurrent week (all models)\n40% used\nResets Monday, Jan 6"
+
+	snapshot := parseClaudeOutput(input, false, false, nil, nil)
+
+	if len(snapshot.Quotas) != 1 || snapshot.Quotas[0].ResetsAt == nil {
+		t.Fatalf("expected one quota with a reset time, got %+v", snapshot.Quotas)
+	}
+	if len(snapshot.Warnings) != 1 || !strings.Contains(snapshot.Warnings[0], "assumed midnight") {
+		t.Errorf("Warnings = %q, want an assumed-midnight warning", snapshot.Warnings)
+	}
+}
+
+// closedPipe returns the write end of a pipe whose reader is already gone
+func closedPipe(t *testing.T) *os.File {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe() error: %v", err)
+	}
+	r.Close()
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+func TestWriteSnapshotToFile_ClosedStdout(t *testing.T) {
+	orig := snapshotStdout
+	snapshotStdout = closedPipe(t)
+	t.Cleanup(func() { snapshotStdout = orig })
+
+	snapshot := &UsageSnapshot{
+		AccountType: AccountTypeMax,
+		Quotas:      []Quota{{Type: QuotaTypeSession, PercentRemaining: 80}},
+	}
+	// The daemon logs this and keeps going, so it must be an error, not a crash
+	err := writeSnapshotToFile(snapshot, "-")
+	if !isBrokenPipe(err) {
+		t.Errorf("writeSnapshotToFile() error = %v, want EPIPE", err)
+	}
+}
+
+func TestQueryCommand_ClosedStdout(t *testing.T) {
+	var stderr bytes.Buffer
+	code := queryCommand([]string{"--from-file", filepath.Join("testdata", "usage_max.txt"), "--hyprpanel-json"}, closedPipe(t), &stderr, nil)
+	if code != 0 {
+		t.Errorf("queryCommand() exit code = %d, want 0; stderr: %s", code, stderr.String())
+	}
+}
+
+func TestWriteSnapshotToFile_Stdout(t *testing.T) {
+	var buf bytes.Buffer
+	orig := snapshotStdout
+	snapshotStdout = &buf
+	t.Cleanup(func() { snapshotStdout = orig })
+
+	ticks := []float64{80, 55}
+	for _, remaining := range ticks {
+		snapshot := &UsageSnapshot{
+			AccountType: AccountTypeMax,
+			Quotas:      []Quota{{Type: QuotaTypeSession, PercentRemaining: remaining}},
+			CapturedAt:  "2026-01-10T12:00:00Z",
+		}
+		if err := writeSnapshotToFile(snapshot, "-"); err != nil {
+			t.Fatalf("writeSnapshotToFile(-) error = %v", err)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(ticks) {
+		t.Fatalf("got %d lines, want %d: %q", len(lines), len(ticks), buf.String())
+	}
+	for i, line := range lines {
+		var snapshot UsageSnapshot
+		if err := json.Unmarshal([]byte(line), &snapshot); err != nil {
+			t.Fatalf("line %d is not valid JSON: %v", i+1, err)
+		}
+		if snapshot.Quotas[0].PercentRemaining != ticks[i] {
+			t.Errorf("line %d PercentRemaining = %v, want %v", i+1, snapshot.Quotas[0].PercentRemaining, ticks[i])
+		}
+	}
+	if _, err := os.Stat("-"); !errors.Is(err, os.ErrNotExist) {
+		t.Error("writeSnapshotToFile(-) should not create a file named -")
+	}
+}
+
+func TestParseClaudeOutput_TruncatedTranscript(t *testing.T) {
+	complete := "Claude Max\n" +
+		"│  Current session\n" +
+		"│  30% used\n" +
+		"│  Resets 2h\n" +
+		"│  Current week (all models)\n" +
+		"│  45% used\n" +
+		"│  Resets 5d 3h\n"
+	// Killed mid-render: the weekly percentage line is cut off
+	truncated := "Claude Max\n" +
+		"│  Current session\n" +
+		"│  30% used\n" +
+		"│  Resets 2h\n" +
+		"│  Current week (all models)\n" +
+		"│  4"
+
+	if snapshot := parseClaudeOutput(complete, false, false, nil, nil); snapshot.Incomplete {
+		t.Errorf("complete transcript marked incomplete: %q", snapshot.Warnings)
+	}
+
+	snapshot := parseClaudeOutput(truncated, false, false, nil, nil)
+	if !snapshot.Incomplete {
+		t.Fatal("truncated transcript should be marked incomplete")
+	}
+	if len(snapshot.Quotas) != 1 {
+		t.Errorf("expected the session quota to survive, got %+v", snapshot.Quotas)
+	}
+	found := false
+	for _, w := range snapshot.Warnings {
+		if strings.Contains(w, "truncated") && strings.Contains(w, "Current week (all models)") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Warnings = %q, want a truncation warning naming the weekly heading", snapshot.Warnings)
+	}
+}
+
+func TestParseClaudeOutput_QuotaLabelInProse(t *testing.T) {
+	// Tips and banners that mention a quota are not headings, so they must not
+	// mark an otherwise complete snapshot incomplete
+	for _, prose := range []string{
+		"Tip: your current session resets soon, plan accordingly",
+		"Current session limits apply to Claude Code and claude.ai",
+		"Opus usage counts toward your weekly limit",
+	} {
+		input := "Claude Max\n" +
+			prose + "\n\n\n\n\n\n" +
+			"│  Current session\n" +
+			"│  30% used\n" +
+			"│  Resets 2h\n" +
+			"│  Current week (all models)\n" +
+			"│  45% used\n" +
+			"│  Resets 5d 3h\n"
+		snapshot := parseClaudeOutput(input, false, false, nil, nil)
+		if snapshot.Incomplete {
+			t.Errorf("prose %q marked the snapshot incomplete: %q", prose, snapshot.Warnings)
+		}
+	}
+
+	for line, want := range map[string]string{
+		"│  Current session":                     "current session",
+		"Current week (all models) · resets Mon": "current week (all models)",
+		"│  Current week (all models)":           "current week (all models)",
+		"Current session ████▌ 12% used":         "current session",
+		"Opus usage · Mon":                       "opus usage",
+		"Tip: your current session ends":         "",
+	} {
+		if got := quotaHeadingLabel(line); got != want {
+			t.Errorf("quotaHeadingLabel(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
+
+func TestClampQueryInterval(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	if got := clampQueryInterval(500 * time.Millisecond); got != minQueryInterval {
+		t.Errorf("clampQueryInterval(500ms) = %s, want %s", got, minQueryInterval)
+	}
+	if !strings.Contains(logs.String(), "below the minimum") {
+		t.Errorf("expected a clamping warning, got log output %q", logs.String())
+	}
+
+	logs.Reset()
+	if got := clampQueryInterval(60 * time.Second); got != 60*time.Second {
+		t.Errorf("clampQueryInterval(60s) = %s, want 60s", got)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("unexpected warning for a valid interval: %q", logs.String())
+	}
+}
+
+func TestWriteSequencedSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	var seq uint64
+
+	for want := uint64(1); want <= 2; want++ {
+		snapshot := &UsageSnapshot{AccountType: AccountTypeMax, CapturedAt: "2026-01-10T12:00:00Z"}
+		if err := writeSequencedSnapshot(snapshot, path, &seq); err != nil {
+			t.Fatalf("writeSequencedSnapshot() error = %v", err)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var written UsageSnapshot
+		if err := json.Unmarshal(data, &written); err != nil {
+			t.Fatal(err)
+		}
+		if written.Seq != want {
+			t.Errorf("write %d: seq = %d, want %d", want, written.Seq, want)
+		}
+	}
+
+	// A failed write does not consume a sequence number
+	badPath := filepath.Join(path, "not-a-dir", "usage.json")
+	if err := writeSequencedSnapshot(&UsageSnapshot{}, badPath, &seq); err == nil {
+		t.Fatal("expected an error writing below a regular file")
+	}
+	if seq != 2 {
+		t.Errorf("seq after failed write = %d, want 2", seq)
+	}
+}
+
+func TestFormatHyprPanelOutput_BudgetHigh(t *testing.T) {
+	quotas := []Quota{{Type: QuotaTypeSession, PercentRemaining: 90}}
+
+	tests := []struct {
+		name      string
+		cost      *CostUsage
+		wantAlt   string
+		wantClass string
+	}{
+		{
+			name:      "no extra usage",
+			cost:      nil,
+			wantAlt:   "low",
+			wantClass: "low",
+		},
+		{
+			name:      "spend well below budget",
+			cost:      &CostUsage{Spent: 40, Budget: 100},
+			wantAlt:   "low",
+			wantClass: "low",
+		},
+		{
+			name:      "spend near budget",
+			cost:      &CostUsage{Spent: 95.5, Budget: 100},
+			wantAlt:   "high",
+			wantClass: "high budget_high",
+		},
+		{
+			name:      "unlimited never warns",
+			cost:      &CostUsage{Spent: 5000, Unlimited: true},
+			wantAlt:   "low",
+			wantClass: "low",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := formatHyprPanelOutput(&UsageSnapshot{
+				AccountType: AccountTypePro,
+				Quotas:      quotas,
+				CostUsage:   tt.cost,
+			}, HyprPanelOptions{Display: "session"})
+			if got.Alt != tt.wantAlt {
+				t.Errorf("Alt = %q, want %q", got.Alt, tt.wantAlt)
+			}
+			if got.Class != tt.wantClass {
+				t.Errorf("Class = %q, want %q", got.Class, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestFormatDurationStyle(t *testing.T) {
+	seconds := int64(2*24*60*60 + 3*60*60 + 4*60) // 2d 3h 4m
+
+	tests := []struct {
+		style   DurationStyle
+		seconds int64
+		want    string
+	}{
+		{style: DurationStyleShort, seconds: seconds, want: "2d 3h 4m"},
+		{style: DurationStyleLong, seconds: seconds, want: "2 days, 3 hours, 4 minutes"},
+		{style: DurationStyleMinutes, seconds: seconds, want: "3064m"},
+		{style: "", seconds: seconds, want: "2d 3h 4m"},
+		{style: DurationStyleLong, seconds: 60*60 + 60, want: "1 hour, 1 minute"},
+		{style: DurationStyleLong, seconds: 0, want: "0 minutes"},
+		{style: DurationStyleCoarse, seconds: seconds, want: "2d"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%d", tt.style, tt.seconds), func(t *testing.T) {
+			if got := formatDurationStyle(tt.seconds, tt.style); got != tt.want {
+				t.Errorf("formatDurationStyle(%d, %q) = %q, want %q", tt.seconds, tt.style, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatISODuration(t *testing.T) {
+	tests := []struct {
+		seconds int64
+		want    string
+	}{
+		{2*60*60 + 14*60, "PT2H14M"},
+		{24*60*60 + 3*60*60, "P1DT3H"},
+		{6*24*60*60 + 22*60*60 + 5*60 + 9, "P6DT22H5M9S"},
+		{2 * 24 * 60 * 60, "P2D"},
+		{45, "PT45S"},
+		{0, "PT0S"},
+		{-30, "PT0S"},
+	}
+	for _, tt := range tests {
+		if got := formatISODuration(tt.seconds); got != tt.want {
+			t.Errorf("formatISODuration(%d) = %q, want %q", tt.seconds, got, tt.want)
+		}
+	}
+}
+
+func TestCoarseDuration(t *testing.T) {
+	tests := []struct {
+		seconds int64
+		want    string
+	}{
+		{7880, "2h"},
+		{90000, "1d"},
+		{3*24*60*60 + 4*60*60 + 5*60, "3d"},
+		{14*60 + 59, "14m"},
+		{0, "0m"},
+		{-30, "0m"},
+	}
+	for _, tt := range tests {
+		if got := coarseDuration(tt.seconds); got != tt.want {
+			t.Errorf("coarseDuration(%d) = %q, want %q", tt.seconds, got, tt.want)
+		}
+	}
+}
+
+func TestParseDurationStyle(t *testing.T) {
+	for _, value := range []string{"short", "long", "minutes", "coarse"} {
+		if _, err := parseDurationStyle(value); err != nil {
+			t.Errorf("parseDurationStyle(%q) error = %v", value, err)
+		}
+	}
+	if _, err := parseDurationStyle("verbose"); err == nil {
+		t.Error("parseDurationStyle(\"verbose\") error = nil, want error")
+	}
+}
+
+func TestSnapshotSchemaVersion(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := queryCommand([]string{"--from-file", filepath.Join("testdata", "usage_max.txt")}, &stdout, &stderr, nil); code != 0 {
+		t.Fatalf("queryCommand() exit code = %d, stderr: %s", code, stderr.String())
+	}
+	var fresh map[string]any
+	if err := json.Unmarshal(stdout.Bytes(), &fresh); err != nil {
+		t.Fatalf("output is not JSON: %v", err)
+	}
+	if got := fresh["schema_version"]; got != float64(snapshotSchemaVersion) {
+		t.Errorf("schema_version = %v, want %d", got, snapshotSchemaVersion)
+	}
+
+	// Files from releases before the field existed read as version 0
+	path := filepath.Join(t.TempDir(), "old.json")
+	if err := os.WriteFile(path, []byte(`{"account_type":"max","quotas":[],"captured_at":"2026-01-10T11:59:00Z"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old, err := readSnapshotFile(path)
+	if err != nil {
+		t.Fatalf("readSnapshotFile() error = %v", err)
+	}
+	if old.SchemaVersion != 0 {
+		t.Errorf("old file SchemaVersion = %d, want 0", old.SchemaVersion)
+	}
+}
+
+func TestQueryCommand_FromFile(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := queryCommand([]string{"--from-file", filepath.Join("testdata", "usage_max.txt")}, &stdout, &stderr, nil)
+	if code != 0 {
+		t.Fatalf("queryCommand() exit code = %d, stderr: %s", code, stderr.String())
+	}
+
+	var snapshot UsageSnapshot
+	if err := json.Unmarshal(stdout.Bytes(), &snapshot); err != nil {
+		t.Fatalf("stdout is not a snapshot: %v\n%s", err, stdout.String())
+	}
+	if snapshot.AccountType != AccountTypeMax || snapshot.Email != "user@example.com" {
+		t.Errorf("account = %q/%q, want max/user@example.com", snapshot.AccountType, snapshot.Email)
+	}
+
+	want := map[string]float64{"session": 88, "weekly": 59, "sonnet": 93}
+	for name, remaining := range want {
+		q := findQuota(snapshot.Quotas, name)
+		if q == nil {
+			t.Errorf("quota %s missing from %+v", name, snapshot.Quotas)
+			continue
+		}
+		if q.PercentRemaining != remaining {
+			t.Errorf("quota %s PercentRemaining = %v, want %v", name, q.PercentRemaining, remaining)
+		}
+	}
+	if q := findQuota(snapshot.Quotas, "session"); q != nil && q.TimeRemainingHuman != "2h 30m" {
+		t.Errorf("session TimeRemainingHuman = %q, want %q", q.TimeRemainingHuman, "2h 30m")
+	}
+}
+
+func TestQueryCommand_FromFileMissing(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := queryCommand([]string{"--from-file", filepath.Join(t.TempDir(), "missing.txt")}, &stdout, &stderr, nil)
+	if code == 0 {
+		t.Errorf("queryCommand() exit code = 0, want failure for a missing transcript")
+	}
+}
+
+func TestClaudeUsageArgs_NoPermissionBypass(t *testing.T) {
+	for _, arg := range claudeUsageArgs {
+		if strings.Contains(arg, "dangerously-skip-permissions") {
+			t.Errorf("claude is spawned with %q; /usage must not bypass permission prompts", arg)
+		}
+	}
+	if len(claudeUsageArgs) == 0 || claudeUsageArgs[len(claudeUsageArgs)-1] != "/usage" {
+		t.Errorf("claudeUsageArgs = %q, want the /usage command", claudeUsageArgs)
+	}
+}
+
+func TestHyprPanelOutputForFile_LastGoodFallback(t *testing.T) {
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	errorState := `{"account_type":"unknown","quotas":null,"captured_at":"2026-01-10T11:59:00Z"}`
+	good := func(capturedAt string) string {
+		return `{"account_type":"max","quotas":[{"type":"session","percent_remaining":70}],"captured_at":"` + capturedAt + `"}`
+	}
+
+	tests := []struct {
+		name     string
+		primary  string
+		lastGood string // "" = no last-good file
+		window   time.Duration
+		wantAlt  string
+		wantText string
+	}{
+		{
+			name:     "error state with fresh last-good",
+			primary:  errorState,
+			lastGood: good("2026-01-10T11:50:00Z"),
+			window:   15 * time.Minute,
+			wantAlt:  "low",
+			wantText: "30% Max",
+		},
+		{
+			name:     "error state with old last-good",
+			primary:  errorState,
+			lastGood: good("2026-01-10T11:00:00Z"),
+			window:   15 * time.Minute,
+			wantAlt:  "no_data",
+			wantText: "--",
+		},
+		{
+			name:     "error state without last-good",
+			primary:  errorState,
+			window:   15 * time.Minute,
+			wantAlt:  "no_data",
+			wantText: "--",
+		},
+		{
+			name:     "fallback disabled",
+			primary:  errorState,
+			lastGood: good("2026-01-10T11:50:00Z"),
+			window:   0,
+			wantAlt:  "no_data",
+			wantText: "--",
+		},
+		{
+			name:     "good primary wins over last-good",
+			primary:  `{"account_type":"max","quotas":[{"type":"session","percent_remaining":10}],"captured_at":"2026-01-10T11:59:00Z"}`,
+			lastGood: good("2026-01-10T11:50:00Z"),
+			window:   15 * time.Minute,
+			wantAlt:  "high",
+			wantText: "90% Max",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "usage.json")
+			if err := os.WriteFile(path, []byte(tt.primary), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.lastGood != "" {
+				if err := os.WriteFile(lastGoodPath(path), []byte(tt.lastGood), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got := hyprPanelOutputForFile(path, 0, HyprPanelOptions{Display: "session", LastGoodWindow: tt.window}, now)
+			if got.Alt != tt.wantAlt || got.Text != tt.wantText {
+				t.Errorf("hyprPanelOutputForFile() = %q/%q, want %q/%q", got.Text, got.Alt, tt.wantText, tt.wantAlt)
+			}
+		})
+	}
+}
+
+func TestRunQuery_RecordsMetrics(t *testing.T) {
+	metrics := &QueryMetrics{}
+
+	failing := &QueryOptions{
+		Timeout:      time.Second,
+		MaxRetries:   1,
+		RetryBackoff: time.Millisecond,
+		Metrics:      metrics,
+		Executor: func(ctx context.Context, opts *QueryOptions) (string, error) {
+			return "", errors.New("failed to execute claude CLI: exit status 1")
+		},
+	}
+	if _, _, err := runQuery(failing); err == nil {
+		t.Fatal("runQuery() error = nil, want failure")
+	}
+	if metrics.FailuresTotal != 2 || metrics.SuccessTotal != 0 {
+		t.Errorf("after failing query: failures=%d success=%d, want 2 and 0", metrics.FailuresTotal, metrics.SuccessTotal)
+	}
+
+	succeeding := &QueryOptions{
+		Timeout: time.Second,
+		Metrics: metrics,
+		Executor: func(ctx context.Context, opts *QueryOptions) (string, error) {
+			time.Sleep(2 * time.Millisecond)
+			return "Current session\n25% used\nResets 2h", nil
+		},
+	}
+	if _, _, err := runQuery(succeeding); err != nil {
+		t.Fatalf("runQuery() error = %v", err)
+	}
+	if metrics.SuccessTotal != 1 {
+		t.Errorf("SuccessTotal = %d, want 1", metrics.SuccessTotal)
+	}
+	if metrics.LastDurationSeconds <= 0 {
+		t.Errorf("LastDurationSeconds = %v, want a positive duration", metrics.LastDurationSeconds)
+	}
+}
+
+func TestDetectModelFallback(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "opus limit notice",
+			input: "│  Current week (Opus)\n│  100% used\n│  Opus limit reached, using Sonnet until 6pm (Europe/Berlin)\n",
+			want:  "using sonnet until 6pm (Europe/Berlin)",
+		},
+		{
+			name:  "now using with trailing period",
+			input: "Limit reached · now using Sonnet 4 until Jan 6, 1am.",
+			want:  "using sonnet until Jan 6, 1am",
+		},
+		{
+			name:  "no notice",
+			input: "│  Current session\n│  25% used\n│  Resets 2h\n",
+			want:  "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectModelFallback(tt.input); got != tt.want {
+				t.Errorf("detectModelFallback() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatHyprPanelOutput_ModelFallbackTooltip(t *testing.T) {
+	snapshot := parseClaudeOutput("Claude Max\nCurrent session\n25% used\nResets 2h\nOpus limit reached, using Sonnet until 6pm\n", false, false, nil, nil)
+	if snapshot.ModelFallback != "using sonnet until 6pm" {
+		t.Fatalf("ModelFallback = %q, want %q", snapshot.ModelFallback, "using sonnet until 6pm")
+	}
+
+	output := formatHyprPanelOutput(snapshot, HyprPanelOptions{Display: "session"})
+	if !strings.Contains(output.Tooltip, "Fallback: using sonnet until 6pm") {
+		t.Errorf("Tooltip = %q, want the fallback notice", output.Tooltip)
+	}
+}
+
+func TestParsePercentage_CommaDecimal(t *testing.T) {
+	tests := []struct {
+		input string
+		want  float64
+	}{
+		{input: "7,5 % used", want: 92.5},
+		{input: "7.5% used", want: 92.5},
+		{input: "12,25% left", want: 12.25},
+		{input: "Opus 4,1 · 12,25% left", want: 12.25},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, ok := parsePercentage(tt.input)
+			if !ok {
+				t.Fatalf("parsePercentage(%q) ok = false, want true", tt.input)
+			}
+			if got != tt.want {
+				t.Errorf("parsePercentage(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+
+	// Only the percentage itself is normalized: a stray "7,5," in front of it
+	// is not rewritten into "7.5," and the "1" after it is not read as 1% used
+	if got, ok := parsePercentage("7,5,1% used"); ok {
+		t.Errorf("parsePercentage(%q) = %v, want no match", "7,5,1% used", got)
+	}
+	if got := malformedPercentage("7,5,1% used"); got != "7,5,1% used" {
+		t.Errorf("malformedPercentage() = %q, want the figure as shown", got)
+	}
+	if got := clampedPercentage("105,5% used"); got != "105,5% used" {
+		t.Errorf("clampedPercentage() = %q, want the figure as shown", got)
+	}
+}
+
+func TestParseCostUsage_UnlimitedWithSpend(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		wantSpent float64
+	}{
+		{"spend after unlimited", "Extra usage\nUnlimited\n$12.30 spent", 12.30},
+		{"spend before unlimited", "Extra usage\n$1,012.30 spent\nUnlimited", 1012.30},
+		{"no spend", "Extra usage\nUnlimited", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseCostUsage(tt.input, nil)
+			if got == nil || !got.Unlimited {
+				t.Fatalf("parseCostUsage(%q) = %+v, want unlimited", tt.input, got)
+			}
+			if got.Spent != tt.wantSpent {
+				t.Errorf("parseCostUsage(%q).Spent = %v, want %v", tt.input, got.Spent, tt.wantSpent)
+			}
+		})
+	}
+
+	snapshot := &UsageSnapshot{
+		AccountType: AccountTypeMax,
+		Quotas:      []Quota{{Type: QuotaTypeSession, PercentRemaining: 50}},
+		CostUsage:   &CostUsage{Unlimited: true, Spent: 12.30},
+	}
+	got := formatHyprPanelOutput(snapshot, HyprPanelOptions{Display: "session"})
+	if !strings.Contains(got.Tooltip, "Extra: $12.30 (unlimited)") {
+		t.Errorf("Tooltip = %q, want it to show the unlimited spend", got.Tooltip)
+	}
+}
+
+func TestParseCostUsage_Separators(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		wantSpent  float64
+		wantBudget float64
+	}{
+		{
+			name:       "thousands groups",
+			input:      "Extra usage\n$1,234 / $2,000 spent",
+			wantSpent:  1234,
+			wantBudget: 2000,
+		},
+		{
+			name:       "comma decimals",
+			input:      "Extra usage\n$7,50 / $100 spent",
+			wantSpent:  7.5,
+			wantBudget: 100,
+		},
+		{
+			name:       "thousands group with dot decimals",
+			input:      "Extra usage\n$1,234.56 / $5,000.00 spent",
+			wantSpent:  1234.56,
+			wantBudget: 5000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseCostUsage(tt.input, nil)
+			if got == nil {
+				t.Fatalf("parseCostUsage(%q) = nil", tt.input)
+			}
+			if got.Spent != tt.wantSpent || got.Budget != tt.wantBudget {
+				t.Errorf("parseCostUsage(%q) = %v / %v, want %v / %v", tt.input, got.Spent, got.Budget, tt.wantSpent, tt.wantBudget)
+			}
+		})
+	}
+}
+
+func TestQueryCommand_Explain(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	args := []string{"--from-file", filepath.Join("testdata", "usage_max.txt"), "--explain"}
+	if code := queryCommand(args, &stdout, &stderr, nil); code != 0 {
+		t.Fatalf("queryCommand() exit code = %d, stderr: %s", code, stderr.String())
+	}
+
+	wantLines := []string{
+		`explain: account: line 2 "· Claude Max · user@example.com" matched max header`,
+		`explain: quota: line 4 "│  Current session" matched label "current session"`,
+		`explain: quota: line 5 "│  12% used" -> 88% remaining`,
+		`explain: reset: line 6 "│  Resets 2h 30m" -> relative 2h 30m`,
+		`explain: quota: line 13 "│  7% used" -> 93% remaining`,
+		`explain: email: user@example.com`,
+	}
+	for _, want := range wantLines {
+		if !strings.Contains(stderr.String(), want+"\n") {
+			t.Errorf("explanation missing %q\ngot:\n%s", want, stderr.String())
+		}
+	}
+
+	// The snapshot itself still goes to stdout untouched
+	var snapshot UsageSnapshot
+	if err := json.Unmarshal(stdout.Bytes(), &snapshot); err != nil {
+		t.Errorf("stdout is not a snapshot: %v", err)
+	}
+}
+
+func TestParseClaudeOutput_NilExplainer(t *testing.T) {
+	// A nil sink must be safe everywhere explain output is produced
+	snapshot := parseClaudeOutput("Current session\n25% used\nResets soon\nExtra usage\n$5 / $10 spent", false, false, nil, nil)
+	if len(snapshot.Quotas) != 1 || snapshot.CostUsage == nil {
+		t.Errorf("unexpected snapshot: %+v", snapshot)
+	}
+}
+
+func TestAppendLogReopensAfterRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "history.jsonl")
+	rotated := path + ".1"
+
+	history, err := openAppendLog(path)
+	if err != nil {
+		t.Fatalf("openAppendLog() error = %v", err)
+	}
+	defer history.Close()
+
+	write := func(seq uint64) {
+		t.Helper()
+		if err := history.WriteSnapshot(&UsageSnapshot{Seq: seq, RawOutput: "raw"}); err != nil {
+			t.Fatalf("WriteSnapshot(%d) error = %v", seq, err)
+		}
+	}
+	readSeqs := func(p string) []uint64 {
+		t.Helper()
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatalf("ReadFile(%s) error = %v", p, err)
+		}
+		var seqs []uint64
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var snapshot UsageSnapshot
+			if err := json.Unmarshal([]byte(line), &snapshot); err != nil {
+				t.Fatalf("line %q is not a snapshot: %v", line, err)
+			}
+			if snapshot.RawOutput != "" {
+				t.Errorf("history line kept raw output: %q", line)
+			}
+			seqs = append(seqs, snapshot.Seq)
+		}
+		return seqs
+	}
+
+	write(1)
+	write(2)
+
+	// Rotate the file out from under the writer without signalling it
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	write(3)
+
+	// Rotate again and reopen explicitly, as SIGUSR2 does
+	if err := os.Rename(path, rotated+".2"); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	if err := history.Reopen(); err != nil {
+		t.Fatalf("Reopen() error = %v", err)
+	}
+	write(4)
+
+	if got := readSeqs(rotated); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("rotated file seqs = %v, want [1 2]", got)
+	}
+	if got := readSeqs(rotated + ".2"); len(got) != 1 || got[0] != 3 {
+		t.Errorf("second rotated file seqs = %v, want [3]", got)
+	}
+	if got := readSeqs(path); len(got) != 1 || got[0] != 4 {
+		t.Errorf("current file seqs = %v, want [4]", got)
+	}
+}
+
+func TestReadRawTranscripts(t *testing.T) {
+	fixture, err := os.ReadFile(filepath.Join("testdata", "usage_max.txt"))
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	second := strings.Replace(string(fixture), "12% used", "80% used", 1)
+
+	input := string(fixture) + "\n" + rawTranscriptMarker + "\n" +
+		second + "\n" + rawTranscriptMarker + "\r\n" +
+		"partial transcript without marker\n"
+
+	out := make(chan string, 4)
+	if err := readRawTranscripts(strings.NewReader(input), out); err != nil {
+		t.Fatalf("readRawTranscripts() error = %v", err)
+	}
+	close(out)
+
+	var snapshots []*UsageSnapshot
+	for transcript := range out {
+		snapshots = append(snapshots, parseClaudeOutput(transcript, false, false, nil, nil))
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("got %d snapshots, want 2", len(snapshots))
+	}
+
+	wantUsed := []float64{12, 80}
+	for i, snapshot := range snapshots {
+		if snapshot.AccountType != AccountTypeMax {
+			t.Errorf("snapshot %d account type = %s, want %s", i, snapshot.AccountType, AccountTypeMax)
+		}
+		session := findQuota(snapshot.Quotas, "session")
+		if session == nil {
+			t.Fatalf("snapshot %d has no session quota", i)
+		}
+		if used := 100 - session.PercentRemaining; used != wantUsed[i] {
+			t.Errorf("snapshot %d session used = %v, want %v", i, used, wantUsed[i])
+		}
+	}
+}
+
+func TestQuotaBelow(t *testing.T) {
+	quotas := []Quota{
+		{Type: QuotaTypeSession, PercentRemaining: 40},
+		{Type: QuotaTypeWeekly, PercentRemaining: 8},
+		{Type: QuotaTypeModelSpecific, Model: "sonnet", PercentRemaining: 15},
+	}
+
+	tests := []struct {
+		name      string
+		quotas    []Quota
+		threshold float64
+		wantType  QuotaType
+	}{
+		{"below threshold", quotas, 10, QuotaTypeWeekly},
+		{"all above threshold", quotas, 5, ""},
+		{"equal is not below", quotas, 8, ""},
+		{"no quotas", nil, 50, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := quotaBelow(tt.quotas, tt.threshold)
+			if tt.wantType == "" {
+				if got != nil {
+					t.Errorf("quotaBelow() = %+v, want nil", got)
+				}
+				return
+			}
+			if got == nil || got.Type != tt.wantType {
+				t.Errorf("quotaBelow() = %+v, want %s quota", got, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestQueryCommand_AlertBelow(t *testing.T) {
+	fixture := filepath.Join("testdata", "usage_max.txt")
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantStderr string
+	}{
+		{"above threshold", []string{"--alert-below", "50"}, 0, ""},
+		{"below threshold", []string{"--alert-below", "60"}, alertExitCode, "weekly quota at 59% remaining"},
+		{"hyprpanel below threshold", []string{"--hyprpanel-json", "--alert-below", "90"}, alertExitCode, "weekly quota at 59% remaining"},
+		{"disabled", nil, 0, ""},
+		{"out of range", []string{"--alert-below", "101"}, 1, "--alert-below must be between 0 and 100"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			args := append([]string{"--from-file", fixture}, tt.args...)
+			code := queryCommand(args, &stdout, &stderr, nil)
+			if code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d (stderr: %s)", code, tt.wantCode, stderr.String())
+			}
+			if tt.wantStderr == "" && stderr.Len() != 0 {
+				t.Errorf("stderr = %q, want empty", stderr.String())
+			}
+			if !strings.Contains(stderr.String(), tt.wantStderr) {
+				t.Errorf("stderr = %q, want it to contain %q", stderr.String(), tt.wantStderr)
+			}
+			if tt.wantCode != 1 && stdout.Len() == 0 {
+				t.Error("stdout is empty, want the usual output")
+			}
+		})
+	}
+}
+
+func TestDetectAccountType_Strict(t *testing.T) {
+	// No plan header, only quota-like content
+	ambiguous := "Current session\n25% used\nResets 2h\n"
+
+	if got := detectAccountType(ambiguous, false, nil); got != AccountTypeMax {
+		t.Errorf("detectAccountType(strict=false) = %s, want %s", got, AccountTypeMax)
+	}
+	if got := detectAccountType(ambiguous, true, nil); got != AccountTypeUnknown {
+		t.Errorf("detectAccountType(strict=true) = %s, want %s", got, AccountTypeUnknown)
+	}
+
+	// A real header is still honored in strict mode
+	if got := detectAccountType("Claude Pro\n"+ambiguous, true, nil); got != AccountTypePro {
+		t.Errorf("detectAccountType(header, strict=true) = %s, want %s", got, AccountTypePro)
+	}
+
+	snapshot := parseClaudeOutput(ambiguous, false, true, nil, nil)
+	if snapshot.AccountType != AccountTypeUnknown || len(snapshot.Quotas) != 1 {
+		t.Errorf("strict parse = %s with %d quotas, want unknown with 1 quota", snapshot.AccountType, len(snapshot.Quotas))
+	}
+}
+
+func TestParseClaudeOutput_ClockSkew(t *testing.T) {
+	now := time.Now().UTC()
+	resetLine := func(absolute time.Time, relative time.Duration) string {
+		return fmt.Sprintf("Resets %s (UTC) (in %dh %dm)",
+			absolute.Format("3pm"), int(relative.Hours()), int(relative.Minutes())%60)
+	}
+	parseSession := func(resetText string) (*Quota, []string) {
+		t.Helper()
+		snapshot := parseClaudeOutput("Claude Max\nCurrent session\n25% used\n"+resetText+"\n", false, false, nil, nil)
+		q := findQuota(snapshot.Quotas, "session")
+		if q == nil || q.ResetsAt == nil || q.TimeRemainingSeconds == nil {
+			t.Fatalf("session quota for %q = %+v, want a parsed reset", resetText, q)
+		}
+		return q, snapshot.Warnings
+	}
+	hasSkewWarning := func(warnings []string) bool {
+		for _, w := range warnings {
+			if strings.Contains(w, "clock skew") {
+				return true
+			}
+		}
+		return false
+	}
+	resetsAt := func(q *Quota) time.Time {
+		resetTime, _ := time.Parse(time.RFC3339, *q.ResetsAt)
+		return resetTime
+	}
+
+	// Absolute time 7-8h ahead by the host clock, but claude says 2h: the
+	// absolute time wins and the disagreement is flagged
+	skewed := now.Truncate(time.Hour).Add(8 * time.Hour)
+	q, warnings := parseSession(resetLine(skewed, 2*time.Hour))
+	if !resetsAt(q).Equal(skewed) {
+		t.Errorf("ResetsAt = %s, want %s (absolute wins)", *q.ResetsAt, skewed.Format(time.RFC3339))
+	}
+	if remaining := time.Duration(*q.TimeRemainingSeconds) * time.Second; remaining < 7*time.Hour {
+		t.Errorf("TimeRemainingSeconds = %s, want the 7-8h to the absolute time", remaining)
+	}
+	if !hasSkewWarning(warnings) {
+		t.Errorf("Warnings = %q, want a clock skew warning", warnings)
+	}
+
+	// Absolute and relative agree: the absolute time is used, no warning
+	agreeing := now.Truncate(time.Hour).Add(3 * time.Hour)
+	q, warnings = parseSession(resetLine(agreeing, agreeing.Sub(now)))
+	if !resetsAt(q).Equal(agreeing) {
+		t.Errorf("ResetsAt = %s, want %s", *q.ResetsAt, agreeing.Format(time.RFC3339))
+	}
+	if hasSkewWarning(warnings) {
+		t.Errorf("unexpected warning for agreeing reset times: %q", warnings)
+	}
+
+	// Only one of the two: each is used on its own, without a warning
+	q, warnings = parseSession("Resets in 2h 30m")
+	if *q.TimeRemainingSeconds != int64((2*time.Hour+30*time.Minute).Seconds()) || hasSkewWarning(warnings) {
+		t.Errorf("relative only: TimeRemainingSeconds = %d, Warnings = %q, want 9000 and no skew warning", *q.TimeRemainingSeconds, warnings)
+	}
+	q, warnings = parseSession("Resets " + agreeing.Format("3pm") + " (UTC)")
+	if !resetsAt(q).Equal(agreeing) || hasSkewWarning(warnings) {
+		t.Errorf("absolute only: ResetsAt = %s, Warnings = %q, want %s and no skew warning", *q.ResetsAt, warnings, agreeing.Format(time.RFC3339))
+	}
+
+	// A bare date only means midnight, so the exact relative duration wins
+	// and neither clock skew nor an assumed midnight is reported
+	dateOnly := now.Add(50 * time.Hour)
+	q, warnings = parseSession("Resets " + dateOnly.Format("Jan 2") + " (in 2d 2h)")
+	if *q.TimeRemainingSeconds != int64((50*time.Hour).Seconds()) || len(warnings) != 0 {
+		t.Errorf("date only: TimeRemainingSeconds = %d, Warnings = %q, want 180000 and no warnings", *q.TimeRemainingSeconds, warnings)
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "Rewrite golden files in testdata")
+
+func TestRenderBadgeSVG_Golden(t *testing.T) {
+	snapshot := &UsageSnapshot{
+		AccountType: AccountTypeMax,
+		Quotas: []Quota{
+			{Type: QuotaTypeWeekly, PercentRemaining: 60},
+			{Type: QuotaTypeSession, PercentRemaining: 27},
+		},
+		CapturedAt: "2026-01-10T12:00:00Z",
+	}
+
+	got := renderBadgeSVG(snapshot)
+	golden := filepath.Join("testdata", "badge_session.svg")
+	if *updateGolden {
+		if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v (run with -update to create it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("renderBadgeSVG() mismatch with %s:\n%s", golden, got)
+	}
+}
+
+func TestBadgeMessage(t *testing.T) {
+	spent := 12.5
+	tests := []struct {
+		name        string
+		snapshot    *UsageSnapshot
+		wantMessage string
+		wantLevel   string
+	}{
+		{"session low", &UsageSnapshot{Quotas: []Quota{{Type: QuotaTypeSession, PercentRemaining: 90}}}, "10% used", "low"},
+		{"session high", &UsageSnapshot{Quotas: []Quota{{Type: QuotaTypeSession, PercentRemaining: 5}}}, "95% used", "high"},
+		{"api", &UsageSnapshot{APIUsage: &APIUsage{Spent: &spent}}, "$12.50 spent", "api"},
+		{"auth error", &UsageSnapshot{AuthError: &AuthError{Code: AuthErrorTokenExpired}}, "auth error", "error"},
+		{"suspended", &UsageSnapshot{AuthError: &AuthError{Code: AuthErrorSuspended}}, "suspended", "error"},
+		{"error state", &UsageSnapshot{AccountType: AccountTypeUnknown}, "no data", "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message, level := badgeMessage(tt.snapshot)
+			if message != tt.wantMessage || level != tt.wantLevel {
+				t.Errorf("badgeMessage() = %q, %q, want %q, %q", message, level, tt.wantMessage, tt.wantLevel)
+			}
+		})
+	}
+}
+
+func TestCheckClaudeBinary(t *testing.T) {
+	dir := t.TempDir()
+	fake := filepath.Join(dir, "claude")
+	if err := os.WriteFile(fake, []byte("#!/bin/sh\necho '2.1.0 (Claude Code)'\n"), 0755); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	got := checkClaudeBinary(context.Background(), fake)
+	if !got.OK || !strings.Contains(got.Detail, "2.1.0 (Claude Code)") {
+		t.Errorf("checkClaudeBinary(fake) = %+v, want OK with version", got)
+	}
+
+	got = checkClaudeBinary(context.Background(), filepath.Join(dir, "missing"))
+	if got.OK || !got.Critical {
+		t.Errorf("checkClaudeBinary(missing) = %+v, want a critical failure", got)
+	}
+}
+
+func TestCheckPTY(t *testing.T) {
+	got := checkPTY(func() (*os.File, *os.File, error) {
+		return nil, nil, errors.New("no /dev/ptmx")
+	})
+	if got.OK || !got.Critical || !strings.Contains(got.Detail, "no /dev/ptmx") {
+		t.Errorf("checkPTY(failing) = %+v, want a critical failure naming the error", got)
+	}
+}
+
+func TestCheckAuth(t *testing.T) {
+	fixture, err := os.ReadFile(filepath.Join("testdata", "usage_max.txt"))
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		output     string
+		err        error
+		wantOK     bool
+		wantDetail string
+	}{
+		{"logged in", string(fixture), nil, true, "max account"},
+		{"expired", "Your session expired. Please log in again.", nil, false, string(AuthErrorTokenExpired)},
+		{"spawn failed", "", errClaudeNotFound, false, "usage query failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := checkAuth(&QueryOptions{
+				Timeout: time.Second,
+				Executor: func(ctx context.Context, opts *QueryOptions) (string, error) {
+					return tt.output, tt.err
+				},
+			})
+			if got.OK != tt.wantOK || !strings.Contains(got.Detail, tt.wantDetail) {
+				t.Errorf("checkAuth() = %+v, want OK=%v with detail containing %q", got, tt.wantOK, tt.wantDetail)
+			}
+		})
+	}
+}
+
+func TestCheckTimezoneData(t *testing.T) {
+	if got := checkTimezoneData("UTC"); !got.OK {
+		t.Errorf("checkTimezoneData(UTC) = %+v, want OK", got)
+	}
+	got := checkTimezoneData("Nowhere/Atlantis")
+	if got.OK || got.Critical {
+		t.Errorf("checkTimezoneData(invalid) = %+v, want a non-critical failure", got)
+	}
+}
+
+func TestWriteDoctorReport(t *testing.T) {
+	var out bytes.Buffer
+	code := writeDoctorReport(&out, []doctorResult{
+		{Name: "claude CLI", OK: true, Critical: true, Detail: "/usr/bin/claude"},
+		{Name: "tzdata", Detail: "missing"},
+	})
+	if code != 0 {
+		t.Errorf("exit code with only a non-critical failure = %d, want 0", code)
+	}
+	if !strings.Contains(out.String(), "[ok  ] claude CLI") || !strings.Contains(out.String(), "[warn] tzdata") {
+		t.Errorf("report = %q, want ok and warn lines", out.String())
+	}
+
+	out.Reset()
+	code = writeDoctorReport(&out, []doctorResult{{Name: "PTY", Critical: true, Detail: "none"}})
+	if code != 1 || !strings.Contains(out.String(), "[FAIL] PTY") {
+		t.Errorf("critical failure: code = %d, report = %q, want 1 and a FAIL line", code, out.String())
+	}
+}
+
+func TestParseClaudeOutput_MalformedNumbers(t *testing.T) {
+	input := "Claude Max\n" +
+		"Current session\n1O% used\nResets in 2h\n" +
+		"Current week (all models)\n40% used\nResets Feb 30, 2027, 1am (UTC)\n" +
+		"Extra usage\n$,/$50.00 spent\n"
+	snapshot := parseClaudeOutput(input, false, false, nil, nil)
+
+	// The corrupt session percentage must not become 0% or borrow the weekly 40%
+	if q := snapshot.Session(); q != nil {
+		t.Errorf("session quota = %+v, want none for a corrupt percentage", q)
+	}
+	if q := snapshot.Weekly(); q == nil || q.PercentRemaining != 60 || q.ResetsAt != nil {
+		t.Errorf("weekly quota = %+v, want 60%% remaining and no reset for Feb 30", q)
+	}
+	if snapshot.CostUsage != nil {
+		t.Errorf("CostUsage = %+v, want nil for an unparsable amount", snapshot.CostUsage)
+	}
+	for _, want := range []string{
+		`could not parse percentage "1O% used"`,
+		`could not parse weekly reset time "Resets Feb 30, 2027, 1am (UTC)"`,
+		`could not parse extra usage amount "$,/$50.00 spent"`,
+	} {
+		if !slices.Contains(snapshot.Warnings, want) {
+			t.Errorf("Warnings = %q, want %q", snapshot.Warnings, want)
+		}
+	}
+	for _, w := range snapshot.Warnings {
+		if strings.Contains(w, "truncated") {
+			t.Errorf("unexpected truncation warning %q for a corrupt percentage", w)
+		}
+	}
+}
+
+func TestParseResetTime_InvalidNumbers(t *testing.T) {
+	for _, text := range []string{"Resets 13pm", "Resets 5:75am", "Resets Apr 31, 2027, 1am", "Resets Feb 30"} {
+		if resetTime, _ := parseAbsoluteTime(text); resetTime != nil {
+			t.Errorf("parseAbsoluteTime(%q) = %s, want nil rather than a normalized time", text, resetTime)
+		}
+	}
+	if got := parseRelativeReset("Resets in 99999999999999999999d 2h"); got != 0 {
+		t.Errorf("parseRelativeReset(overflow) = %d, want 0 rather than just the hours", got)
+	}
+	if got := parseRelativeReset("Resets in 1d 2h 3m"); got != 24*60*60+2*60*60+3*60 {
+		t.Errorf("parseRelativeReset(1d 2h 3m) = %d, want %d", got, 24*60*60+2*60*60+3*60)
+	}
+}
+
+func TestParseAbsoluteTime_NamedTimes(t *testing.T) {
+	loc, err := time.LoadLocation("UTC")
+	if err != nil {
+		t.Fatalf("LoadLocation() error = %v", err)
+	}
+
+	tests := []struct {
+		input    string
+		wantHour int
+	}{
+		{"Resets at midnight (UTC)", 0},
+		{"Resets at Midnight (UTC)", 0},
+		{"Resets at noon (UTC)", 12},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			now := time.Now().In(loc)
+			resetTime, duration := parseAbsoluteTime(tt.input)
+			if resetTime == nil || duration == nil {
+				t.Fatalf("parseAbsoluteTime(%q) = nil, want a reset time", tt.input)
+			}
+			got := resetTime.In(loc)
+			if got.Hour() != tt.wantHour || got.Minute() != 0 {
+				t.Errorf("reset time = %s, want %02d:00", got.Format(time.RFC3339), tt.wantHour)
+			}
+			// Never in the past, and at most a day ahead (tomorrow if already passed today)
+			if !got.After(now) || got.Sub(now) > 24*time.Hour {
+				t.Errorf("reset time = %s, want within the next 24h of %s", got.Format(time.RFC3339), now.Format(time.RFC3339))
+			}
+		})
+	}
+
+	// Midnight today has always passed, so it rolls over to tomorrow
+	resetTime, _ := parseAbsoluteTime("Resets at midnight (UTC)")
+	now := time.Now().In(loc)
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, loc)
+	if resetTime == nil || !resetTime.Equal(tomorrow) {
+		t.Errorf("midnight reset = %v, want %s", resetTime, tomorrow.Format(time.RFC3339))
+	}
+
+	// A date with a named time is not date-only
+	if isDateOnlyReset("Resets Jan 6, midnight") {
+		t.Error("isDateOnlyReset(\"Jan 6, midnight\") = true, want false")
+	}
+}
+
+func TestSnapshotHTTP_Watch(t *testing.T) {
+	h := newSnapshotHTTP()
+	server := httptest.NewServer(h.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/usage")
+	if err != nil {
+		t.Fatalf("GET /usage error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("GET /usage before first update: status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	h.Update(&UsageSnapshot{AccountType: AccountTypeMax, Seq: 1})
+
+	// A watcher that already has seq 1 blocks until seq 2 is published
+	type result struct {
+		status   int
+		snapshot UsageSnapshot
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(server.URL + "/usage/watch?since=1&timeout=10s")
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		var snapshot UsageSnapshot
+		err = json.NewDecoder(resp.Body).Decode(&snapshot)
+		done <- result{status: resp.StatusCode, snapshot: snapshot, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		t.Fatalf("watch returned before a new snapshot was published: %+v", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	h.Update(&UsageSnapshot{AccountType: AccountTypeMax, Seq: 2})
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatalf("watch error = %v", r.err)
+		}
+		if r.status != http.StatusOK || r.snapshot.Seq != 2 {
+			t.Errorf("watch = status %d seq %d, want 200 seq 2", r.status, r.snapshot.Seq)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not unblock after a new snapshot was published")
+	}
+
+	// A stale seq is answered immediately
+	resp, err = http.Get(server.URL + "/usage/watch?since=1")
+	if err != nil {
+		t.Fatalf("GET /usage/watch error = %v", err)
+	}
+	var snapshot UsageSnapshot
+	json.NewDecoder(resp.Body).Decode(&snapshot)
+	resp.Body.Close()
+	if snapshot.Seq != 2 {
+		t.Errorf("watch with stale seq returned seq %d, want 2", snapshot.Seq)
+	}
+
+	// No update within the timeout: 204
+	resp, err = http.Get(server.URL + "/usage/watch?since=2&timeout=50ms")
+	if err != nil {
+		t.Fatalf("GET /usage/watch error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("watch timeout: status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+}
+
+func TestQuerySuccessLogLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		snapshot *UsageSnapshot
+		want     string
+	}{
+		{
+			name: "unknown account with quotas",
+			snapshot: &UsageSnapshot{
+				AccountType: AccountTypeUnknown,
+				Quotas: []Quota{
+					{Type: QuotaTypeWeekly, PercentRemaining: 60},
+					{Type: QuotaTypeSession, PercentRemaining: 75},
+				},
+				Warnings: []string{"could not parse session reset time \"soon\""},
+			},
+			want: `Query successful: unknown account (plan not detected), 2 quotas, session at 25% used, 1 warning: could not parse session reset time "soon"`,
+		},
+		{
+			name: "no session quota",
+			snapshot: &UsageSnapshot{
+				AccountType: AccountTypeMax,
+				Quotas: []Quota{
+					{Type: QuotaTypeWeekly, PercentRemaining: 60},
+					{Type: QuotaTypeModelSpecific, Model: "opus", PercentRemaining: 10},
+				},
+			},
+			want: "Query successful: max account, 2 quotas, opus at 90% used",
+		},
+		{
+			name: "single quota, several warnings",
+			snapshot: &UsageSnapshot{
+				AccountType: AccountTypePro,
+				Quotas:      []Quota{{Type: QuotaTypeSession, PercentRemaining: 40}},
+				Warnings:    []string{"a", "b"},
+			},
+			want: "Query successful: pro account, 1 quota, session at 60% used, 2 warnings: a; b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := querySuccessLogLine(tt.snapshot); got != tt.want {
+				t.Errorf("querySuccessLogLine() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseOrganization_ActiveInSwitcher(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name: "marker",
+			input: `· Claude Max · user@example.com
+│ Your organizations
+│   ○ Personal
+│   ● Acme Corp
+│   ○ Side Project
+│
+│ Current session
+│ 20% used`,
+			want: "Acme Corp",
+		},
+		{
+			name: "active suffix",
+			input: `Organizations:
+  Personal
+  Acme Corp (active)
+
+Current session
+20% used`,
+			want: "Acme Corp",
+		},
+		{
+			name:  "no switcher",
+			input: "user@example.com's Acme Corp\nCurrent session\n20% used",
+			want:  "Acme Corp",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseOrganization(tt.input); got != tt.want {
+				t.Errorf("parseOrganization() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunQuery_StampsRequestedOrg(t *testing.T) {
+	transcript := "Claude Max\nOrganizations\n● Acme Corp\n○ Personal\n\nCurrent session\n20% used\n"
+	run := func(org string) *UsageSnapshot {
+		t.Helper()
+		snapshot, _, err := runQuery(&QueryOptions{
+			Timeout: time.Second,
+			Org:     org,
+			Executor: func(ctx context.Context, opts *QueryOptions) (string, error) {
+				return transcript, nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("runQuery() error = %v", err)
+		}
+		return snapshot
+	}
+
+	if snapshot := run("acme corp"); snapshot.Organization != "Acme Corp" || len(snapshot.Warnings) != 0 {
+		t.Errorf("matching org: Organization = %q, Warnings = %q, want Acme Corp and no warnings", snapshot.Organization, snapshot.Warnings)
+	}
+	snapshot := run("Personal")
+	if len(snapshot.Warnings) != 1 || !strings.Contains(snapshot.Warnings[0], `not the requested "Personal"`) {
+		t.Errorf("mismatched org: Warnings = %q, want a mismatch warning", snapshot.Warnings)
+	}
+}
+
+func TestFormatQuotaReset(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.Local)
+	resetsAt := now.Add(2*time.Hour + 30*time.Minute).Format(time.RFC3339)
+	weeklyResetsAt := now.Add(3 * 24 * time.Hour).Format(time.RFC3339)
+	seconds := int64(5 * 60 * 60)
+
+	tests := []struct {
+		name       string
+		quota      Quota
+		capturedAt string
+		resetAs    ResetAs
+		want       string
+	}{
+		{"duration", Quota{ResetsAt: &resetsAt}, "", ResetAsDuration, "2h 30m"},
+		{"clock", Quota{ResetsAt: &resetsAt}, "", ResetAsClock, "14:30"},
+		{"clock beyond a day", Quota{ResetsAt: &weeklyResetsAt}, "", ResetAsClock, "Fri 12:00"},
+		// Stale file with only a duration: 5h from a capture 2h ago is 3h from now
+		{"stale duration", Quota{TimeRemainingSeconds: &seconds}, now.Add(-2 * time.Hour).Format(time.RFC3339), ResetAsDuration, "3h"},
+		{"stale clock", Quota{TimeRemainingSeconds: &seconds}, now.Add(-2 * time.Hour).Format(time.RFC3339), ResetAsClock, "15:00"},
+		{"no reset", Quota{}, now.Format(time.RFC3339), ResetAsClock, "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := formatQuotaReset(&tt.quota, tt.capturedAt, tt.resetAs, DurationStyleShort, nil, "", now)
+			if got != tt.want {
+				t.Errorf("formatQuotaReset() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDisplayTZ(t *testing.T) {
+	newYork, err := parseDisplayTZ("America/New_York")
+	if err != nil {
+		t.Skipf("tzdata unavailable: %v", err)
+	}
+	if _, err := parseDisplayTZ("Mars/Olympus"); err == nil {
+		t.Error("parseDisplayTZ(Mars/Olympus) error = nil, want error")
+	}
+	if loc, err := parseDisplayTZ(""); loc != nil || err != nil {
+		t.Errorf("parseDisplayTZ(\"\") = %v, %v, want nil, nil", loc, err)
+	}
+
+	// 18:30 UTC is 14:30 in New York (EDT, UTC-4) on this date
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	resetsAt := "2026-03-10T18:30:00Z"
+	q := Quota{ResetsAt: &resetsAt}
+	if got := formatQuotaReset(&q, "", ResetAsClock, DurationStyleShort, newYork, "", now); got != "14:30" {
+		t.Errorf("formatQuotaReset() in America/New_York = %q, want 14:30", got)
+	}
+
+	snapshot := &UsageSnapshot{Quotas: []Quota{q}}
+	applyDisplayTZ(snapshot, newYork)
+	if got := *snapshot.Quotas[0].ResetsAt; got != "2026-03-10T14:30:00-04:00" {
+		t.Errorf("applyDisplayTZ() ResetsAt = %q, want 2026-03-10T14:30:00-04:00", got)
+	}
+}
+
+func TestFormatHyprPanelOutput_ResetAsClock(t *testing.T) {
+	resetTime := time.Now().Add(90 * time.Minute).Truncate(time.Minute)
+	resetsAt := resetTime.Format(time.RFC3339)
+	snapshot := &UsageSnapshot{
+		AccountType: AccountTypeMax,
+		Quotas:      []Quota{{Type: QuotaTypeSession, PercentRemaining: 75, ResetsAt: &resetsAt}},
+		CapturedAt:  time.Now().Format(time.RFC3339),
+	}
+	clock := resetTime.In(time.Local).Format("15:04")
+
+	got := formatHyprPanelOutput(snapshot, HyprPanelOptions{Display: "session", ResetAs: ResetAsClock, TextFormat: "{s}% until {reset_clock}"})
+	if got.Text != "25% until "+clock {
+		t.Errorf("Text = %q, want %q", got.Text, "25% until "+clock)
+	}
+	if !strings.Contains(got.Tooltip, "Session: 25% used (resets "+clock+")") {
+		t.Errorf("Tooltip = %q, want the session reset as a clock time", got.Tooltip)
+	}
+
+	got = formatHyprPanelOutput(snapshot, HyprPanelOptions{Display: "session", TextFormat: "{s}% {reset_coarse}"})
+	if got.Text != "25% 1h" {
+		t.Errorf("Text = %q, want %q", got.Text, "25% 1h")
+	}
+
+	got = formatHyprPanelOutput(snapshot, HyprPanelOptions{Display: "session"})
+	if !strings.Contains(got.Tooltip, "left)") {
+		t.Errorf("Tooltip = %q, want durations by default", got.Tooltip)
+	}
+}
+
+func TestFormatSketchybar(t *testing.T) {
+	spent := 1.5
+	tests := []struct {
+		name     string
+		snapshot *UsageSnapshot
+		item     string
+		want     string
+	}{
+		{
+			name: "normal",
+			snapshot: &UsageSnapshot{
+				AccountType: AccountTypeMax,
+				Quotas: []Quota{
+					{Type: QuotaTypeWeekly, PercentRemaining: 90},
+					{Type: QuotaTypeSession, PercentRemaining: 27},
+				},
+			},
+			item: "claude",
+			want: "--set 'claude' label='73%' label.color=0xffdfb317",
+		},
+		{
+			name:     "error state",
+			snapshot: &UsageSnapshot{AccountType: AccountTypeUnknown},
+			item:     "claude",
+			want:     "--set 'claude' label='--' label.color=0xff9f9f9f",
+		},
+		{
+			name:     "missing file",
+			snapshot: nil,
+			item:     "it's claude",
+			want:     `--set 'it'\''s claude' label='--' label.color=0xff9f9f9f`,
+		},
+		{
+			name:     "auth error",
+			snapshot: &UsageSnapshot{AuthError: &AuthError{Code: AuthErrorTokenExpired}},
+			item:     "claude",
+			want:     "--set 'claude' label='!' label.color=0xff9f9f9f",
+		},
+		{
+			name:     "api spend",
+			snapshot: &UsageSnapshot{AccountType: AccountTypeAPI, APIUsage: &APIUsage{Spent: &spent}},
+			item:     "claude",
+			want:     "--set 'claude' label='$1.50' label.color=0xff007ec6",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatSketchybar(tt.snapshot, tt.item); got != tt.want {
+				t.Errorf("formatSketchybar() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatHyprPanelOutput_Metric(t *testing.T) {
+	tests := []struct {
+		name      string
+		remaining float64
+		metric    Metric
+		wantText  string
+		wantClass string
+	}{
+		{"used, mostly free", 90, MetricUsed, "10% Max", "low"},
+		{"remaining, mostly free", 90, MetricRemaining, "90% Max", "low"},
+		{"used, half", 40, MetricUsed, "60% Max", "medium"},
+		{"remaining, half", 40, MetricRemaining, "40% Max", "medium"},
+		{"used, nearly exhausted", 5, MetricUsed, "95% Max", "high"},
+		{"remaining, nearly exhausted", 5, MetricRemaining, "5% Max", "high"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snapshot := &UsageSnapshot{
+				AccountType: AccountTypeMax,
+				Quotas: []Quota{
+					{Type: QuotaTypeSession, PercentRemaining: tt.remaining},
+					{Type: QuotaTypeWeekly, PercentRemaining: 70},
+				},
+			}
+			got := formatHyprPanelOutput(snapshot, HyprPanelOptions{Display: "session", Metric: tt.metric})
+			if got.Text != tt.wantText {
+				t.Errorf("Text = %q, want %q", got.Text, tt.wantText)
+			}
+			// A naive threshold on the displayed number would turn 90% remaining red
+			if got.Class != tt.wantClass {
+				t.Errorf("Class = %q, want %q", got.Class, tt.wantClass)
+			}
+		})
+	}
+
+	snapshot := &UsageSnapshot{
+		AccountType: AccountTypeMax,
+		Quotas: []Quota{
+			{Type: QuotaTypeSession, PercentRemaining: 90},
+			{Type: QuotaTypeWeekly, PercentRemaining: 70},
+		},
+	}
+	got := formatHyprPanelOutput(snapshot, HyprPanelOptions{Display: "session", Metric: MetricRemaining})
+	if got.Percentage == nil || *got.Percentage != 90 {
+		t.Errorf("remaining Percentage = %v, want 90", got.Percentage)
+	}
+	got = formatHyprPanelOutput(snapshot, HyprPanelOptions{Display: "session"})
+	if got.Percentage == nil || *got.Percentage != 10 {
+		t.Errorf("used Percentage = %v, want 10", got.Percentage)
+	}
+	if got := formatHyprPanelOutput(nil, HyprPanelOptions{}); got.Percentage != nil {
+		t.Errorf("error state Percentage = %d, want unset", *got.Percentage)
+	}
+
+	got = formatHyprPanelOutput(snapshot, HyprPanelOptions{Display: "session", Metric: MetricRemaining, TextFormat: "S{s} W{w}"})
+	if got.Text != "S90 W70" {
+		t.Errorf("template Text = %q, want %q", got.Text, "S90 W70")
+	}
+}
+
+func TestMetricLevel_Remaining(t *testing.T) {
+	// Remaining counts down, so the low numbers are the severe ones
+	tests := []struct {
+		value float64
+		want  string
+	}{
+		{100, "low"},
+		{50, "low"},
+		{49, "medium"},
+		{20, "medium"},
+		{19, "high"},
+		{0, "high"},
+	}
+	for _, tt := range tests {
+		if got := metricLevel(tt.value, MetricRemaining); got != tt.want {
+			t.Errorf("metricLevel(%v, remaining) = %q, want %q", tt.value, got, tt.want)
+		}
+		// The same quota in the used metric lands on the same level
+		if used := metricLevel(100-tt.value, MetricUsed); used != tt.want {
+			t.Errorf("metricLevel(%v, used) = %q, want %q", 100-tt.value, used, tt.want)
+		}
+	}
+}
+
+func TestFormatHyprPanelOutput_EmbedSnapshot(t *testing.T) {
+	resetsAt := "2026-01-10T17:00:00Z"
+	seconds := int64(3600)
+	snapshot := &UsageSnapshot{
+		AccountType: AccountTypeMax,
+		Quotas: []Quota{
+			{Type: QuotaTypeSession, PercentRemaining: 27.5, ResetsAt: &resetsAt, TimeRemainingSeconds: &seconds, TimeRemainingHuman: "1h"},
+			{Type: QuotaTypeWeekly, PercentRemaining: 60},
+		},
+		CapturedAt: "2026-01-10T16:00:00Z",
+		Warnings:   []string{"example warning"},
+	}
+
+	plain, err := json.Marshal(formatHyprPanelOutput(snapshot, HyprPanelOptions{Display: "session"}))
+	if err != nil {
+		t.Fatalf("json.Marshal() error: %v", err)
+	}
+	if strings.Contains(string(plain), `"snapshot"`) {
+		t.Errorf("snapshot embedded without EmbedSnapshot: %s", plain)
+	}
+
+	data, err := json.Marshal(formatHyprPanelOutput(snapshot, HyprPanelOptions{Display: "session", EmbedSnapshot: true}))
+	if err != nil {
+		t.Fatalf("json.Marshal() error: %v", err)
+	}
+	var decoded HyprPanelOutput
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal() error: %v", err)
+	}
+	if decoded.Text != "73% Max" {
+		t.Errorf("Text = %q, want %q", decoded.Text, "73% Max")
+	}
+	if !reflect.DeepEqual(decoded.Snapshot, snapshot) {
+		t.Errorf("embedded snapshot = %+v, want %+v", decoded.Snapshot, snapshot)
+	}
+}
+
+func TestParseQuotas_AvailabilityResetPhrasing(t *testing.T) {
+	tests := []struct {
+		name      string
+		resetLine string
+		want      int64
+	}{
+		{"available again", "Available again in 2h", 2 * 3600},
+		{"use again", "You can use Opus again in 45m", 45 * 60},
+		{"back in", "Back in 1h 30m", 90 * 60},
+		{"unlocks in", "Unlocks in 3 days", 3 * 86400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text := "Current week (Opus)\n100% used\n" + tt.resetLine + "\n"
+			quotas := parseQuotas(text, nil, nil)
+			if len(quotas) != 1 {
+				t.Fatalf("parseQuotas() returned %d quotas, want 1", len(quotas))
+			}
+			q := quotas[0]
+			if q.ResetText != tt.resetLine {
+				t.Errorf("ResetText = %q, want %q", q.ResetText, tt.resetLine)
+			}
+			if q.TimeRemainingSeconds == nil {
+				t.Fatal("TimeRemainingSeconds = nil, want a duration")
+			}
+			if got := *q.TimeRemainingSeconds; got < tt.want-5 || got > tt.want+5 {
+				t.Errorf("TimeRemainingSeconds = %d, want ~%d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitResetKeywords(t *testing.T) {
+	if looksLikeResetLine("refills in 2h", nil) {
+		t.Fatal("\"refills in\" matched without being given")
+	}
+	keywords := splitResetKeywords(" Refills In , ,cooldown ends")
+	if want := []string{"refills in", "cooldown ends"}; !reflect.DeepEqual(keywords, want) {
+		t.Fatalf("splitResetKeywords() = %q, want %q", keywords, want)
+	}
+	for _, line := range []string{"refills in 2h", "cooldown ends in 5m"} {
+		if !looksLikeResetLine(line, keywords) {
+			t.Errorf("looksLikeResetLine(%q) = false with the extra keywords", line)
+		}
+	}
+	if len(resetKeywords) != 4 {
+		t.Errorf("resetKeywords has %d entries, want the 4 defaults untouched", len(resetKeywords))
+	}
+}
+
+func TestRunQuery_ResetKeywordsOption(t *testing.T) {
+	executor := func(ctx context.Context, opts *QueryOptions) (string, error) {
+		return "Current session\n25% used\nRefills in 2h", nil
+	}
+	query := func(keywords []string) Quota {
+		snapshot, _, err := runQuery(&QueryOptions{Timeout: time.Second, Executor: executor, ResetKeywords: keywords})
+		if err != nil || len(snapshot.Quotas) != 1 {
+			t.Fatalf("runQuery() = %+v, %v, want one quota", snapshot, err)
+		}
+		return snapshot.Quotas[0]
+	}
+
+	if q := query([]string{"refills in"}); q.ResetText != "Refills in 2h" || q.TimeRemainingSeconds == nil {
+		t.Errorf("with keyword: ResetText = %q, TimeRemainingSeconds = %v", q.ResetText, q.TimeRemainingSeconds)
+	}
+	// The keyword belongs to that query only
+	if q := query(nil); q.ResetText != "" {
+		t.Errorf("without keyword: ResetText = %q, want none", q.ResetText)
+	}
+}
+
+func TestLooksLikeResetLine_AvailabilityNeedsDuration(t *testing.T) {
+	for line, want := range map[string]bool{
+		"back in 1h 30m":                 true,
+		"you can use opus again in 45m":  true,
+		"come back in a moment":          false,
+		"try again in the settings menu": false,
+	} {
+		if got := looksLikeResetLine(line, nil); got != want {
+			t.Errorf("looksLikeResetLine(%q) = %v, want %v", line, got, want)
+		}
+	}
+}
+
+func TestChangedBeyond(t *testing.T) {
+	snap := func(quotas ...Quota) *UsageSnapshot {
+		return &UsageSnapshot{AccountType: AccountTypeMax, Quotas: quotas}
+	}
+	session := func(remaining float64) Quota {
+		return Quota{Type: QuotaTypeSession, PercentRemaining: remaining}
+	}
+	opus := func(remaining float64) Quota {
+		return Quota{Type: QuotaTypeModelSpecific, Model: "opus", PercentRemaining: remaining}
+	}
+
+	tests := []struct {
+		name      string
+		prev, cur *UsageSnapshot
+		threshold float64
+		want      bool
+	}{
+		{"no previous snapshot", nil, snap(session(50)), 1, true},
+		{"identical", snap(session(50), opus(80)), snap(session(50), opus(80)), 1, false},
+		{"moved below rounding", snap(session(50)), snap(session(49.7)), 1, false},
+		{"moved one point", snap(session(50)), snap(session(49)), 1, true},
+		{"small move across a rounding edge", snap(session(50.6)), snap(session(50.4)), 1, true},
+		{"below custom threshold", snap(session(50), opus(80)), snap(session(46), opus(80)), 5, false},
+		{"reaches custom threshold", snap(session(50), opus(80)), snap(session(50), opus(75)), 5, true},
+		{"usage went down", snap(session(20)), snap(session(100)), 1, true},
+		{"quota appeared", snap(session(50)), snap(session(50), opus(80)), 1, true},
+		{"quota replaced", snap(session(50), opus(80)), snap(session(50), Quota{Type: QuotaTypeWeekly, PercentRemaining: 80}), 1, true},
+		{"both empty", snap(), snap(), 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := changedBeyond(tt.prev, tt.cur, tt.threshold); got != tt.want {
+				t.Errorf("changedBeyond() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryCommand_ChangedFrom(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "last.json")
+	args := []string{"--from-file", filepath.Join("testdata", "usage_max.txt"), "--changed-from", stateFile}
+
+	var stdout, stderr bytes.Buffer
+	if code := queryCommand(args, &stdout, &stderr, nil); code != 0 {
+		t.Fatalf("first run exit code = %d, want 0; stderr: %s", code, stderr.String())
+	}
+	first, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatalf("state file not written on change: %v", err)
+	}
+
+	stdout.Reset()
+	if code := queryCommand(args, &stdout, &stderr, nil); code != unchangedExitCode {
+		t.Fatalf("second run exit code = %d, want %d; stderr: %s", code, unchangedExitCode, stderr.String())
+	}
+	if stdout.Len() == 0 {
+		t.Error("unchanged run printed nothing, want the snapshot")
+	}
+	second, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Error("state file rewritten although usage was unchanged")
+	}
+}
+
+func TestSoonestReset(t *testing.T) {
+	at := func(ts string) *string { return &ts }
+	tests := []struct {
+		name   string
+		quotas []Quota
+		want   string // "" = nil
+	}{
+		{"no quotas", nil, ""},
+		{"no resets", []Quota{{Type: QuotaTypeSession}, {Type: QuotaTypeWeekly}}, ""},
+		{"single", []Quota{{Type: QuotaTypeSession, ResetsAt: at("2026-01-10T17:00:00Z")}}, "2026-01-10T17:00:00Z"},
+		{
+			"mixed with reset-less",
+			[]Quota{
+				{Type: QuotaTypeWeekly, ResetsAt: at("2026-01-12T08:00:00Z")},
+				{Type: QuotaTypeModelSpecific, Model: "opus"},
+				{Type: QuotaTypeSession, ResetsAt: at("2026-01-10T17:00:00Z")},
+			},
+			"2026-01-10T17:00:00Z",
+		},
+		{
+			"offsets compared as instants",
+			[]Quota{
+				{Type: QuotaTypeSession, ResetsAt: at("2026-01-10T18:30:00+01:00")},
+				{Type: QuotaTypeWeekly, ResetsAt: at("2026-01-10T17:45:00Z")},
+			},
+			"2026-01-10T18:30:00+01:00",
+		},
+		{"unparseable skipped", []Quota{{Type: QuotaTypeSession, ResetsAt: at("soon")}, {Type: QuotaTypeWeekly, ResetsAt: at("2026-01-12T08:00:00Z")}}, "2026-01-12T08:00:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := soonestReset(tt.quotas)
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("soonestReset() = %v, want nil", got)
+				}
+				return
+			}
+			want, _ := time.Parse(time.RFC3339, tt.want)
+			if got == nil || !got.Equal(want) {
+				t.Errorf("soonestReset() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseClaudeOutput_ValidUntil(t *testing.T) {
+	snapshot := parseClaudeOutput("Current session\n27% used\nResets in 2h\n\nCurrent week (all models)\n40% used\nResets in 3d\n", false, false, nil, nil)
+	if snapshot.ValidUntil == nil {
+		t.Fatal("ValidUntil = nil, want the session reset")
+	}
+	if *snapshot.ValidUntil != *snapshot.Quotas[0].ResetsAt {
+		t.Errorf("ValidUntil = %s, want session reset %s", *snapshot.ValidUntil, *snapshot.Quotas[0].ResetsAt)
+	}
+
+	snapshot = parseClaudeOutput("Current session\n27% used\n", false, false, nil, nil)
+	if snapshot.ValidUntil != nil {
+		t.Errorf("ValidUntil = %s, want omitted without resets", *snapshot.ValidUntil)
+	}
+}
+
+func TestWriteOnlyErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	var seq uint64
+
+	success := &UsageSnapshot{AccountType: AccountTypeMax, Quotas: []Quota{{Type: QuotaTypeSession, PercentRemaining: 60}}}
+	authFailure := &UsageSnapshot{
+		AccountType: AccountTypeUnknown,
+		AuthError:   &AuthError{Code: "token_expired", Message: "Session has expired"},
+	}
+	queryFailure := &UsageSnapshot{AccountType: AccountTypeUnknown}
+
+	if err := writeOnlyErrors(success, path, &seq); err != nil {
+		t.Fatalf("success tick: %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("success tick wrote the file (stat err = %v)", err)
+	}
+
+	if err := writeOnlyErrors(authFailure, path, &seq); err != nil {
+		t.Fatalf("auth failure tick: %v", err)
+	}
+	written, err := readSnapshotFile(path)
+	if err != nil {
+		t.Fatalf("auth failure tick did not write the file: %v", err)
+	}
+	if written.AuthError == nil || written.AuthError.Code != "token_expired" || written.Seq != 1 {
+		t.Errorf("written snapshot = %+v, want the auth error with seq 1", written)
+	}
+
+	if err := writeOnlyErrors(queryFailure, path, &seq); err != nil {
+		t.Fatalf("query failure tick: %v", err)
+	}
+	if written, err := readSnapshotFile(path); err != nil || written.Seq != 2 {
+		t.Errorf("query failure tick: snapshot = %+v, err = %v; want seq 2", written, err)
+	}
+
+	// Recovery clears the error state
+	if err := writeOnlyErrors(success, path, &seq); err != nil {
+		t.Fatalf("recovery tick: %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("recovery tick left the file in place (stat err = %v)", err)
+	}
+}
+
+func TestWriteOnlyErrors_Stdout(t *testing.T) {
+	var buf bytes.Buffer
+	orig := snapshotStdout
+	snapshotStdout = &buf
+	t.Cleanup(func() { snapshotStdout = orig })
+	var seq uint64
+
+	success := &UsageSnapshot{AccountType: AccountTypeMax, Quotas: []Quota{{Type: QuotaTypeSession, PercentRemaining: 60}}}
+	if err := writeOnlyErrors(success, "-", &seq); err != nil || buf.Len() != 0 {
+		t.Fatalf("success tick: err = %v, output = %q; want nothing", err, buf.String())
+	}
+	if err := writeOnlyErrors(&UsageSnapshot{AccountType: AccountTypeUnknown}, "-", &seq); err != nil || buf.Len() == 0 {
+		t.Errorf("failure tick: err = %v, output = %q; want a JSON line", err, buf.String())
+	}
+}
+
+func TestFormatHyprPanelOutput_AltMeta(t *testing.T) {
+	quotas := func(remaining ...float64) []Quota {
+		types := []QuotaType{QuotaTypeSession, QuotaTypeWeekly, QuotaTypeModelSpecific, QuotaTypeModelSpecific}
+		var qs []Quota
+		for i, r := range remaining {
+			qs = append(qs, Quota{Type: types[i], PercentRemaining: r})
+		}
+		return qs
+	}
+	tests := []struct {
+		name      string
+		snapshot  *UsageSnapshot
+		wantAlt   string
+		wantClass string
+	}{
+		{"max with four quotas", &UsageSnapshot{AccountType: AccountTypeMax, Quotas: quotas(90, 70, 60, 50)}, "max-4q-low", "low"},
+		{"pro with two quotas", &UsageSnapshot{AccountType: AccountTypePro, Quotas: quotas(10, 70)}, "pro-2q-high", "high"},
+		{"unknown plan", &UsageSnapshot{AccountType: AccountTypeUnknown, Quotas: quotas(40)}, "unknown-1q-medium", "medium"},
+		{"error state keeps plain alt", &UsageSnapshot{AccountType: AccountTypeUnknown}, "error", "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := formatHyprPanelOutput(tt.snapshot, HyprPanelOptions{Display: "session", AltMeta: true})
+			if got.Alt != tt.wantAlt {
+				t.Errorf("Alt = %q, want %q", got.Alt, tt.wantAlt)
+			}
+			if got.Class != tt.wantClass {
+				t.Errorf("Class = %q, want %q", got.Class, tt.wantClass)
+			}
+		})
+	}
+
+	// Without the option alt stays the bare level
+	snapshot := &UsageSnapshot{AccountType: AccountTypeMax, Quotas: quotas(90, 70, 60, 50)}
+	if got := formatHyprPanelOutput(snapshot, HyprPanelOptions{Display: "session"}); got.Alt != "low" {
+		t.Errorf("Alt without AltMeta = %q, want %q", got.Alt, "low")
+	}
+}
+
+func TestParseClaudeOutput_WeekdayResetHint(t *testing.T) {
+	output := "Current week (Opus only)\n████ 35% used\nOpus · Mon\n"
+	snapshot := parseClaudeOutput(output, false, false, nil, nil)
+	if len(snapshot.Quotas) != 1 {
+		t.Fatalf("got %d quotas, want 1", len(snapshot.Quotas))
+	}
+	q := snapshot.Quotas[0]
+	if q.ResetText != "Opus · Mon" {
+		t.Errorf("ResetText = %q, want %q", q.ResetText, "Opus · Mon")
+	}
+	if q.ResetsAt == nil || q.TimeRemainingSeconds == nil {
+		t.Fatalf("reset not computed: %+v", q)
+	}
+	resetAt, err := time.Parse(time.RFC3339, *q.ResetsAt)
+	if err != nil {
+		t.Fatalf("ResetsAt %q: %v", *q.ResetsAt, err)
+	}
+	resetAt = resetAt.In(time.Local)
+	if resetAt.Weekday() != time.Monday || resetAt.Hour() != 0 || resetAt.Minute() != 0 {
+		t.Errorf("ResetsAt = %s, want a Monday midnight", resetAt)
+	}
+	if d := time.Until(resetAt); d <= 0 || d > 7*24*time.Hour {
+		t.Errorf("ResetsAt = %s is not within the next week", resetAt)
+	}
+	found := false
+	for _, w := range snapshot.Warnings {
+		if strings.Contains(w, "weekday hint") && strings.Contains(w, "opus") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Warnings = %q, want a weekday hint warning", snapshot.Warnings)
+	}
+
+	// Session quotas and explicit reset lines are not affected
+	output = "Current session\n35% used\nMon\n\nCurrent week (Opus only)\n35% used\nResets in 2h\nOpus · Mon\n"
+	snapshot = parseClaudeOutput(output, false, false, nil, nil)
+	if len(snapshot.Quotas) != 2 {
+		t.Fatalf("got %d quotas, want 2", len(snapshot.Quotas))
+	}
+	if snapshot.Quotas[0].ResetsAt != nil {
+		t.Errorf("session ResetsAt = %s, want nil", *snapshot.Quotas[0].ResetsAt)
+	}
+	if snapshot.Quotas[1].ResetText != "Resets in 2h" {
+		t.Errorf("opus ResetText = %q, want the reset line", snapshot.Quotas[1].ResetText)
+	}
+}
+
+func TestNextWeekdayMidnight(t *testing.T) {
+	// 2026-01-07 is a Wednesday
+	now := time.Date(2026, 1, 7, 15, 30, 0, 0, time.UTC)
+	tests := []struct {
+		weekday time.Weekday
+		want    time.Time
+	}{
+		{time.Thursday, time.Date(2026, 1, 8, 0, 0, 0, 0, time.UTC)},
+		{time.Monday, time.Date(2026, 1, 12, 0, 0, 0, 0, time.UTC)},
+		{time.Wednesday, time.Date(2026, 1, 14, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := nextWeekdayMidnight(now, tt.weekday); !got.Equal(tt.want) {
+			t.Errorf("nextWeekdayMidnight(%s) = %s, want %s", tt.weekday, got, tt.want)
+		}
+	}
+}
+
+func TestParseWeekdayHint(t *testing.T) {
+	tests := []struct {
+		text string
+		want time.Weekday
+		ok   bool
+	}{
+		{"Opus · Mon", time.Monday, true},
+		{"Sonnet · Thursday", time.Thursday, true},
+		{"│ Sat │", time.Saturday, true},
+		{"Month to date", 0, false},
+		{"Saturated", 0, false},
+		{"Opus only", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseWeekdayHint(tt.text)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("parseWeekdayHint(%q) = %v, %v; want %v, %v", tt.text, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestLoadSeries(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// File names deliberately out of capture order
+	write("a.json", `{"account_type":"max","quotas":[{"type":"session","percent_remaining":40},{"type":"weekly","percent_remaining":80}],"captured_at":"2026-01-10T14:00:00Z"}`)
+	write("b.json", `{"account_type":"max","quotas":[{"type":"session","percent_remaining":90}],"captured_at":"2026-01-10T12:00:00+01:00"}`)
+	write("c.json", `{"account_type":"max","quotas":[{"type":"weekly","percent_remaining":75}],"captured_at":"2026-01-10T13:00:00Z"}`)
+	write("broken.json", `{"account_type":`)
+	write("undated.json", `{"account_type":"max","quotas":[],"captured_at":"yesterday"}`)
+	write("notes.txt", "not a snapshot")
+	if err := os.Mkdir(filepath.Join(dir, "nested.json"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, err := loadSeries(dir)
+	if err != nil {
+		t.Fatalf("loadSeries() error: %v", err)
+	}
+	var got []string
+	for _, s := range snapshots {
+		got = append(got, s.CapturedAt)
+	}
+	want := []string{"2026-01-10T12:00:00+01:00", "2026-01-10T13:00:00Z", "2026-01-10T14:00:00Z"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("captured_at order = %q, want %q", got, want)
+	}
+
+	var buf bytes.Buffer
+	if err := writeSeriesCSV(&buf, seriesPoints(snapshots)); err != nil {
+		t.Fatalf("writeSeriesCSV() error: %v", err)
+	}
+	wantCSV := "captured_at,session_used,weekly_used\n" +
+		"2026-01-10T12:00:00+01:00,10,\n" +
+		"2026-01-10T13:00:00Z,,25\n" +
+		"2026-01-10T14:00:00Z,60,20\n"
+	if buf.String() != wantCSV {
+		t.Errorf("CSV =\n%s\nwant\n%s", buf.String(), wantCSV)
+	}
+
+	jsonBytes, err := json.Marshal(seriesPoints(snapshots)[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantJSON := `[{"captured_at":"2026-01-10T12:00:00+01:00","session_used":10,"weekly_used":null},` +
+		`{"captured_at":"2026-01-10T13:00:00Z","session_used":null,"weekly_used":25}]`
+	if string(jsonBytes) != wantJSON {
+		t.Errorf("JSON = %s, want %s", jsonBytes, wantJSON)
+	}
+}
+
+func TestLoadSeries_MissingDir(t *testing.T) {
+	if _, err := loadSeries(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("loadSeries() on a missing directory returned no error")
+	}
+}
+
+func TestHasCompletionMarker(t *testing.T) {
+	if !hasCompletionMarker("Current session 42% used", defaultCompletionMarkers) {
+		t.Error("default markers missed \"% used\"")
+	}
+	localized := splitCompletionMarkers(" % utilisé,% restant ")
+	if !reflect.DeepEqual(localized, []string{"% utilisé", "% restant"}) {
+		t.Fatalf("splitCompletionMarkers() = %q", localized)
+	}
+	if hasCompletionMarker("Session actuelle 42 % utilisé", defaultCompletionMarkers) {
+		t.Error("default markers matched localized output")
+	}
+	if !hasCompletionMarker("Session actuelle 42 % utilisé", localized) {
+		t.Error("custom marker not matched")
+	}
+}
+
+func TestExecuteClaudeCLI_CustomCompletionMarker(t *testing.T) {
+	// A localized claude that keeps running after rendering usage; only the
+	// completion marker can end the poll loop before the timeout
+	fake := filepath.Join(t.TempDir(), "claude")
+	script := "#!/bin/sh\necho 'Session actuelle'\necho '42 % utilisé'\nexec sleep 30\n"
+	if err := os.WriteFile(fake, []byte(script), 0755); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	opts := &QueryOptions{
+		Timeout:           10 * time.Second,
+		ClaudeBin:         fake,
+		CompletionMarkers: []string{"% utilisé"},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+	start := time.Now()
+	output, err := executeClaudeCLI(ctx, opts)
+	if err != nil {
+		t.Fatalf("executeClaudeCLI() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("executeClaudeCLI() took %s, want completion on the custom marker", elapsed)
+	}
+	if !strings.Contains(output, "42 % utilisé") {
+		t.Errorf("output = %q, want the usage line", output)
+	}
+}
+
+func TestRunQuery_SetupScreenShortCircuits(t *testing.T) {
+	// First-run claude sits on its setup screen and never prints "% used";
+	// the poll loop must give up on it right away instead of timing out
+	fixture, err := filepath.Abs(filepath.Join("testdata", "setup_required.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := filepath.Join(t.TempDir(), "claude")
+	script := "#!/bin/sh\ncat '" + fixture + "'\nexec sleep 30\n"
+	if err := os.WriteFile(fake, []byte(script), 0755); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	start := time.Now()
+	snapshot, _, err := runQuery(&QueryOptions{Timeout: 10 * time.Second, ClaudeBin: fake})
+	if err != nil {
+		t.Fatalf("runQuery() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("runQuery() took %s, want it to stop at the setup screen", elapsed)
+	}
+	if snapshot.AuthError == nil || snapshot.AuthError.Code != AuthErrorSetupRequired {
+		t.Errorf("AuthError = %+v, want %s", snapshot.AuthError, AuthErrorSetupRequired)
+	}
+}
+
+func TestQueryCommand_SetupRequired(t *testing.T) {
+	fixture := filepath.Join("testdata", "setup_required.txt")
+	for _, mode := range []struct {
+		name string
+		args []string
+	}{
+		{"json", []string{"--from-file", fixture}},
+		{"hyprpanel", []string{"--from-file", fixture, "--hyprpanel-json"}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := queryCommand(mode.args, &stdout, &stderr, nil)
+			if code != setupRequiredExitCode {
+				t.Errorf("exit code = %d, want %d", code, setupRequiredExitCode)
+			}
+			if !strings.Contains(stderr.String(), "run `claude` once interactively") {
+				t.Errorf("stderr = %q, want the setup hint", stderr.String())
+			}
+			if !strings.Contains(stdout.String(), "setup_required") {
+				t.Errorf("stdout = %q, want the setup_required state", stdout.String())
+			}
+		})
+	}
+}
+
+func TestParseUTCOffset(t *testing.T) {
+	tests := []struct {
+		text       string
+		wantOffset int // seconds east of UTC
+		wantNil    bool
+	}{
+		{text: "Resets 18:59 (+02:00)", wantOffset: 2 * 3600},
+		{text: "Resets 6pm (-0500)", wantOffset: -5 * 3600},
+		{text: "Resets 18:59 UTC+2", wantOffset: 2 * 3600},
+		{text: "Resets 9am GMT-03:30", wantOffset: -(3*3600 + 30*60)},
+		{text: "Resets 9am UTC+5:45", wantOffset: 5*3600 + 45*60},
+		{text: "Resets 6pm (Europe/Berlin)", wantNil: true},
+		{text: "Resets 18:59 (+15:00)", wantNil: true},
+		{text: "Resets in 2h 30m", wantNil: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			loc := parseUTCOffset(tt.text)
+			if tt.wantNil {
+				if loc != nil {
+					t.Errorf("parseUTCOffset() = %v, want nil", loc)
+				}
+				return
+			}
+			if loc == nil {
+				t.Fatal("parseUTCOffset() = nil")
+			}
+			if _, offset := time.Date(2026, 1, 10, 12, 0, 0, 0, loc).Zone(); offset != tt.wantOffset {
+				t.Errorf("offset = %d, want %d", offset, tt.wantOffset)
+			}
+		})
+	}
+}
+
+func TestParseAbsoluteTime_UTCOffset(t *testing.T) {
+	tests := []struct {
+		text       string
+		hour, min  int
+		wantOffset int
+	}{
+		{"Resets 18:59 (+02:00)", 18, 59, 2 * 3600},
+		{"Resets 6pm (-0500)", 18, 0, -5 * 3600},
+		{"Resets 07:15 UTC+2", 7, 15, 2 * 3600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			resetTime, duration := parseAbsoluteTime(tt.text)
+			if resetTime == nil || duration == nil {
+				t.Fatalf("parseAbsoluteTime() = %v, %v; want a future reset", resetTime, duration)
+			}
+			if _, offset := resetTime.Zone(); offset != tt.wantOffset {
+				t.Errorf("zone offset = %d, want %d", offset, tt.wantOffset)
+			}
+			if resetTime.Hour() != tt.hour || resetTime.Minute() != tt.min {
+				t.Errorf("reset clock = %02d:%02d, want %02d:%02d", resetTime.Hour(), resetTime.Minute(), tt.hour, tt.min)
+			}
+			// The duration must be measured against the real instant, not the host zone
+			want := int64(time.Until(*resetTime).Seconds())
+			if *duration < want-5 || *duration > want+5 || *duration > 24*3600 {
+				t.Errorf("duration = %d, want ~%d (within a day)", *duration, want)
+			}
+		})
+	}
+}
+
+// lineCountingWriter cancels a context once it has seen n lines
+type lineCountingWriter struct {
+	buf    bytes.Buffer
+	n      int
+	cancel context.CancelFunc
+}
+
+func (w *lineCountingWriter) Write(p []byte) (int, error) {
+	n, err := w.buf.Write(p)
+	if strings.Count(w.buf.String(), "\n") >= w.n {
+		w.cancel()
+	}
+	return n, err
+}
+
+func TestStreamQueries(t *testing.T) {
+	transcript, err := os.ReadFile(filepath.Join("testdata", "usage_max.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	opts := &QueryOptions{
+		Timeout: time.Second,
+		Executor: func(ctx context.Context, opts *QueryOptions) (string, error) {
+			calls++
+			return string(transcript), nil
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out := &lineCountingWriter{n: 2, cancel: cancel}
+	var stderr bytes.Buffer
+	streamQueries(ctx, opts, 10*time.Millisecond, DurationStyleShort, out, &stderr)
+
+	lines := strings.Split(strings.TrimSuffix(out.buf.String(), "\n"), "\n")
+	if len(lines) != 2 || calls != 2 {
+		t.Fatalf("got %d lines from %d queries, want 2 and 2:\n%s", len(lines), calls, out.buf.String())
+	}
+	for i, line := range lines {
+		var snapshot UsageSnapshot
+		if err := json.Unmarshal([]byte(line), &snapshot); err != nil {
+			t.Errorf("line %d is not a snapshot: %v", i+1, err)
+		} else if len(snapshot.Quotas) == 0 {
+			t.Errorf("line %d has no quotas", i+1)
+		}
+	}
+	if stderr.Len() != 0 {
+		t.Errorf("stderr = %q, want empty", stderr.String())
+	}
+}
+
+func TestParseClaudeOutput_WrappedHeading(t *testing.T) {
+	// claude wrapped at 80 columns splits the weekly heading across two lines
+	text := strings.Join([]string{
+		"│ Current session                                  │",
+		"│ ██████ 27% used                                  │",
+		"│ Resets in 2h                                     │",
+		"│ Current week (all                                │",
+		"│ models)                                          │",
+		"│ ████ 40% used                                    │",
+		"│ Resets in 3d                                     │",
+		"│ Current week (Opus                               │",
+		"│ only) 10% used                                   │",
+	}, "\n")
+
+	quotas := parseClaudeOutput(text, false, false, nil, nil).Quotas
+	if len(quotas) != 3 {
+		t.Fatalf("parseClaudeOutput() returned %d quotas, want 3: %+v", len(quotas), quotas)
+	}
+	weekly := findQuota(quotas, "weekly")
+	if weekly == nil {
+		t.Fatal("wrapped weekly heading not recognized")
+	}
+	if weekly.PercentRemaining != 60 || weekly.Label != "Current week (all models)" {
+		t.Errorf("weekly = %g%% remaining, label %q; want 60, %q", weekly.PercentRemaining, weekly.Label, "Current week (all models)")
+	}
+	if opus := findQuota(quotas, "opus"); opus == nil || opus.PercentRemaining != 90 {
+		t.Errorf("opus = %+v, want 90%% remaining", opus)
+	}
+}
+
+func TestUnwrapQuotaHeading(t *testing.T) {
+	tests := []struct {
+		lines []string
+		want  string
+		ok    bool
+	}{
+		{[]string{"Current week (all", "models)"}, "Current week (all models)", true},
+		{[]string{"│ Current week (Sonnet │", "│ only) │"}, "Current week (Sonnet only)", true},
+		// Unwrapped headings and headings wholly on the next line are left alone
+		{[]string{"Current week (all models)", "40% used"}, "", false},
+		{[]string{"Resets in 2h", "Current week (all models)"}, "", false},
+		{[]string{"Current week (all"}, "", false},
+		// A bordered line does not continue on an unbordered one
+		{[]string{"│ Current week (all │", "models)"}, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := unwrapQuotaHeading(tt.lines, 0)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("unwrapQuotaHeading(%q) = %q, %v; want %q, %v", tt.lines, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestDewrapQuotaHeadings(t *testing.T) {
+	text := "│ Current session │\r\n│ 27% used │\r│ Current week (all │\n│ models) │\n│ 40% used │\nCurrent week (Sonnet\nonly)\n10% used"
+	want := "│ Current session │\r\n│ 27% used │\rCurrent week (all models)\n│ 40% used │\nCurrent week (Sonnet only)\n10% used"
+	if got := dewrapQuotaHeadings(text, nil); got != want {
+		t.Errorf("dewrapQuotaHeadings() =\n%q\nwant\n%q", got, want)
+	}
+
+	// Unrelated lines are never merged
+	plain := "Current session\n27% used\nResets in 2h\n\nCurrent week (all models)\n40% used\n"
+	if got := dewrapQuotaHeadings(plain, nil); got != plain {
+		t.Errorf("dewrapQuotaHeadings() changed unwrapped output:\n%q", got)
+	}
+
+	snapshot := parseClaudeOutput("Current week (all\nmodels)\n40% used\nResets in 3d\n", false, false, nil, nil)
+	if len(snapshot.Quotas) != 1 || snapshot.Quotas[0].Type != QuotaTypeWeekly || snapshot.Quotas[0].PercentRemaining != 60 {
+		t.Errorf("Quotas = %+v, want one weekly quota at 60%% remaining", snapshot.Quotas)
+	}
+}
+
+func TestSupportedQuotaTypes(t *testing.T) {
+	jsonBytes, err := json.Marshal(supportedQuotaTypes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []quotaTypeEntry
+	if err := json.Unmarshal(jsonBytes, &entries); err != nil {
+		t.Fatalf("output is not a JSON list: %v", err)
+	}
+	if len(entries) != len(quotaLabels) {
+		t.Errorf("got %d entries, want %d", len(entries), len(quotaLabels))
+	}
+	listed := make(map[string]quotaTypeEntry, len(entries))
+	for _, e := range entries {
+		listed[e.Label] = e
+	}
+	for label, info := range quotaLabels {
+		e, ok := listed[label]
+		if !ok {
+			t.Errorf("label %q missing from output", label)
+			continue
+		}
+		if e.Type != info.qType || e.Model != info.model {
+			t.Errorf("label %q = %s/%q, want %s/%q", label, e.Type, e.Model, info.qType, info.model)
+		}
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i-1].Label >= entries[i].Label {
+			t.Errorf("entries not sorted: %q before %q", entries[i-1].Label, entries[i].Label)
+		}
+	}
+}
+
+func TestCachePathForProfile(t *testing.T) {
+	cacheHome := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cacheHome)
+
+	work := cachePathForProfile("/home/me/.claude")
+	personal := cachePathForProfile("/home/me/.claude-personal")
+	if work == personal {
+		t.Fatalf("both profiles resolve to %s", work)
+	}
+	for _, path := range []string{work, personal} {
+		if filepath.Dir(path) != filepath.Join(cacheHome, "claude-o-meter") {
+			t.Errorf("cache path %s is not under $XDG_CACHE_HOME/claude-o-meter", path)
+		}
+	}
+	if again := cachePathForProfile("/home/me/.claude"); again != work {
+		t.Errorf("cachePathForProfile() not stable: %s then %s", work, again)
+	}
+}
+
+func TestQueryCommand_CacheIsPerProfile(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	transcript, err := os.ReadFile(filepath.Join("testdata", "usage_max.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	working := func(ctx context.Context, opts *QueryOptions) (string, error) {
+		calls++
+		return string(transcript), nil
+	}
+	failing := func(ctx context.Context, opts *QueryOptions) (string, error) {
+		calls++
+		return "", errors.New("claude unavailable")
+	}
+	args := []string{"--cache-ttl", "1h"}
+
+	// Profile A populates its cache
+	t.Setenv("CLAUDE_CONFIG_DIR", filepath.Join(t.TempDir(), "a"))
+	var stdout, stderr bytes.Buffer
+	if code := queryCommand(args, &stdout, &stderr, working); code != 0 {
+		t.Fatalf("profile A exit code = %d, stderr: %s", code, stderr.String())
+	}
+
+	// ...and is served from it without spawning claude
+	stdout.Reset()
+	if code := queryCommand(args, &stdout, &stderr, failing); code != 0 || calls != 1 {
+		t.Fatalf("cached profile A: exit code = %d after %d spawns, want 0 after 1; stderr: %s", code, calls, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), `"quotas"`) {
+		t.Errorf("cached output = %q, want the snapshot", stdout.String())
+	}
+
+	// Profile B must not see profile A's cache
+	t.Setenv("CLAUDE_CONFIG_DIR", filepath.Join(t.TempDir(), "b"))
+	stdout.Reset()
+	stderr.Reset()
+	if code := queryCommand(args, &stdout, &stderr, failing); code != 1 || calls != 2 {
+		t.Errorf("profile B: exit code = %d after %d spawns, want a fresh (failing) query", code, calls)
+	}
+}
+
+func TestCoverageScore(t *testing.T) {
+	complete, err := os.ReadFile(filepath.Join("testdata", "usage_max.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial := `Current session
+  ████████                                           16% used
+
+Extra usage
+  Spent on extra usage this month
+`
+	tests := []struct {
+		name    string
+		rawText string
+		want    float64
+	}{
+		{"complete transcript", string(complete), 1},
+		// no reset line, extra usage mentioned but no cost parsed
+		{"partial transcript", partial, 0.5},
+		{"empty output", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snapshot := parseClaudeOutput(tt.rawText, false, false, nil, nil)
+			if got := coverageScore(snapshot, tt.rawText); got != tt.want {
+				t.Errorf("coverageScore() = %v, want %v (checks: %+v)", got, tt.want, coverageChecks(snapshot, tt.rawText))
+			}
+		})
+	}
+}
+
+func TestQueryCommand_Coverage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := queryCommand([]string{"--from-file", filepath.Join("testdata", "usage_max.txt"), "--coverage"}, &stdout, &stderr, nil)
+	if code != 0 {
+		t.Fatalf("exit code = %d, stderr: %s", code, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "Parse coverage: 100% (3/3)") {
+		t.Errorf("stderr = %q, want the coverage line", stderr.String())
+	}
+	if strings.Contains(stdout.String(), "coverage") {
+		t.Errorf("coverage leaked into stdout: %q", stdout.String())
+	}
+}
+
+func TestParseQuotas_PastClockTimeRollover(t *testing.T) {
+	// Pick a fixed offset where it is around noon, so an hour ago is still today
+	offset := 12 - time.Now().UTC().Hour()
+	if offset < -11 {
+		offset += 24
+	}
+	zone := time.FixedZone("", offset*3600)
+	now := time.Now().In(zone)
+	clock := now.Add(-time.Hour).Format("15:04")
+	resetLine := fmt.Sprintf("  Resets %s (%+03d:00)\n", clock, offset)
+	text := "Current session\n" +
+		"  ████                                               8% used\n" +
+		resetLine +
+		"\n" +
+		"Current week (all models)\n" +
+		"  ██████████                                         20% used\n" +
+		resetLine
+
+	byType := map[QuotaType]Quota{}
+	for _, q := range parseQuotas(text, nil, nil) {
+		byType[q.Type] = q
+	}
+
+	// The session window rolls a past clock time over to tomorrow
+	session := byType[QuotaTypeSession]
+	if session.TimeRemainingSeconds == nil {
+		t.Fatalf("session quota has no duration: %+v", session)
+	}
+	if got := *session.TimeRemainingSeconds; got < 22*3600 || got > 24*3600 {
+		t.Errorf("session duration = %d, want about 23h (tomorrow)", got)
+	}
+
+	// A weekly quota showing a past time has already reset today
+	weekly := byType[QuotaTypeWeekly]
+	if weekly.TimeRemainingSeconds != nil {
+		t.Errorf("weekly duration = %d, want none for a past reset", *weekly.TimeRemainingSeconds)
+	}
+	if weekly.ResetsAt == nil {
+		t.Fatalf("weekly quota has no reset time: %+v", weekly)
+	}
+	resetsAt, err := time.Parse(time.RFC3339, *weekly.ResetsAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resetsAt.After(now) || now.Sub(resetsAt) > time.Hour+time.Minute {
+		t.Errorf("weekly resets_at = %s, want today at %s", *weekly.ResetsAt, clock)
+	}
+}
+
+func TestResolveConfig_Sources(t *testing.T) {
+	t.Setenv("CLAUDE_O_METER_TIMEOUT", "45s")
+	t.Setenv("CLAUDE_O_METER_CLAUDE_BIN", "/env/claude")
+	t.Setenv("CLAUDE_O_METER_RAW", "true")
+
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	fs.Duration("timeout", 30*time.Second, "")
+	fs.String("claude-bin", "", "")
+	fs.Bool("r", false, "")
+	fs.Bool("debug", false, "")
+	fs.Int("decimals", 0, "")
+	args := []string{"--claude-bin", "/flag/claude", "--debug", "--decimals=2"}
+
+	if err := applyEnvDefaults(fs, queryEnvVars); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]configSetting{
+		"timeout":    {Flag: "timeout", Value: "45s", Source: "env", Env: "CLAUDE_O_METER_TIMEOUT"},
+		"claude-bin": {Flag: "claude-bin", Value: "/flag/claude", Source: "flag"},
+		"r":          {Flag: "r", Value: "true", Source: "env", Env: "CLAUDE_O_METER_RAW"},
+		"debug":      {Flag: "debug", Value: "true", Source: "flag"},
+		"decimals":   {Flag: "decimals", Value: "2", Source: "flag"},
+	}
+	settings := resolveConfig(fs, queryEnvVars, args, nil, nil)
+	if len(settings) != len(want) {
+		t.Fatalf("got %d settings, want %d: %+v", len(settings), len(want), settings)
+	}
+	for _, got := range settings {
+		if got != want[got.Flag] {
+			t.Errorf("setting %s = %+v, want %+v", got.Flag, got, want[got.Flag])
+		}
+	}
+}
+
+func TestQueryCommand_PrintConfig(t *testing.T) {
+	t.Setenv("CLAUDE_O_METER_TIMEOUT", "45s")
+	var stdout, stderr bytes.Buffer
+	code := queryCommand([]string{"--print-config", "--max-retries", "2"}, &stdout, &stderr, nil)
+	if code != 0 {
+		t.Fatalf("exit code = %d, stderr: %s", code, stderr.String())
+	}
+
+	var out struct {
+		Command  string          `json:"command"`
+		Settings []configSetting `json:"settings"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, stdout.String())
+	}
+	bySetting := map[string]configSetting{}
+	for _, s := range out.Settings {
+		bySetting[s.Flag] = s
+	}
+	if got := bySetting["timeout"]; got.Value != "45s" || got.Source != "env" {
+		t.Errorf("timeout = %+v, want 45s from env", got)
+	}
+	if got := bySetting["max-retries"]; got.Value != "2" || got.Source != "flag" {
+		t.Errorf("max-retries = %+v, want 2 from flag", got)
+	}
+	if got := bySetting["interval"]; got.Value != "1m0s" || got.Source != "default" {
+		t.Errorf("interval = %+v, want default 1m0s", got)
+	}
+	if _, ok := bySetting["print-config"]; ok {
+		t.Error("hidden print-config flag listed in settings")
+	}
+}
+
+// daemonConfig runs "config daemon" with args and returns its settings by flag
+func daemonConfig(t *testing.T, args ...string) map[string]configSetting {
+	t.Helper()
+	out, err := os.CreateTemp(t.TempDir(), "config")
+	if err != nil {
+		t.Fatalf("CreateTemp() error: %v", err)
+	}
+	defer out.Close()
+	orig := os.Stdout
+	os.Stdout = out
+	runDaemonCommand(append([]string{"--print-config"}, args...))
+	os.Stdout = orig
+
+	data, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	var config struct {
+		Settings []configSetting `json:"settings"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, data)
+	}
+	bySetting := map[string]configSetting{}
+	for _, s := range config.Settings {
+		bySetting[s.Flag] = s
+	}
+	return bySetting
+}
+
+func TestDaemonCommand_PrintConfigEffective(t *testing.T) {
+	settings := daemonConfig(t, "-i", "30s")
+	if got := settings["interval"]; got.Value != "30s" || got.Source != "flag" {
+		t.Errorf("interval = %+v, want 30s from flag", got)
+	}
+	for _, short := range []string{"i", "f", "b", "t"} {
+		if _, ok := settings[short]; ok {
+			t.Errorf("short flag %q listed separately from its long form", short)
+		}
+	}
+	if got := settings["file"]; got.Value != defaultSnapshotPath() || got.Source != "default" {
+		t.Errorf("file = %+v, want default %s", got, defaultSnapshotPath())
+	}
+
+	settings = daemonConfig(t, "-i", "1s")
+	if got := settings["interval"]; got.Value != minQueryInterval.String() || got.Source != "flag" {
+		t.Errorf("interval = %+v, want clamped %s from flag", got, minQueryInterval)
+	}
+}
+
+func TestQueryCommand_PrintRegexes(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := queryCommand([]string{"--print-regexes"}, &stdout, &stderr, nil); code != 0 {
+		t.Fatalf("exit code = %d, stderr: %s", code, stderr.String())
+	}
+	var sources map[string]any
+	if err := json.Unmarshal(stdout.Bytes(), &sources); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, stdout.String())
+	}
+	for _, name := range []string{
+		"ansiPattern", "proPattern", "maxPattern", "apiPattern", "percentPattern",
+		"daysPattern", "hoursPattern", "minutesPattern", "timeOnlyPattern", "clock24Pattern",
+		"epochResetPattern", "fullDatePattern", "dateNoYearPattern", "dateOnlyPattern",
+		"weekdayHintPattern", "timezonePattern", "emailHeaderPattern", "orgHeaderPattern",
+		"costPattern", "apiCreditsPattern", "notLoggedInPattern", "setupRequiredPattern",
+		"instanceConflictPattern", "lineBreakPattern",
+	} {
+		if source, _ := sources[name].(string); source == "" {
+			t.Errorf("pattern %q missing from --print-regexes output", name)
+		}
+	}
+	if got := sources["percentPattern"]; got != percentPattern.String() {
+		t.Errorf("percentPattern source = %q, want %q", got, percentPattern.String())
+	}
+	if got := fmt.Sprint(sources["completionMarkers"]); got != "[% used % left]" {
+		t.Errorf("completionMarkers = %s, want the defaults", got)
+	}
+}
+
+func TestQueryCommand_PrintRegexesWithOverrides(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	args := []string{"--reset-keywords", "Refills In", "--completion-markers", "% utilisé", "--print-regexes"}
+	if code := queryCommand(args, &stdout, &stderr, nil); code != 0 {
+		t.Fatalf("exit code = %d, stderr: %s", code, stderr.String())
+	}
+	var lists struct {
+		ResetKeywords     []string `json:"resetKeywords"`
+		CompletionMarkers []string `json:"completionMarkers"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &lists); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, stdout.String())
+	}
+	if want := append(append([]string{}, resetKeywords...), "refills in"); !reflect.DeepEqual(lists.ResetKeywords, want) {
+		t.Errorf("resetKeywords = %q, want %q", lists.ResetKeywords, want)
+	}
+	if want := []string{"% utilisé"}; !reflect.DeepEqual(lists.CompletionMarkers, want) {
+		t.Errorf("completionMarkers = %q, want %q", lists.CompletionMarkers, want)
+	}
+}
+
+func TestParseClaudeOutput_AccountSwitcher(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		wantEmail string
+		wantOrg   string
+		wantType  AccountType
+	}{
+		{
+			name: "marker",
+			input: `Accounts
+  ○ · Claude Pro · old@example.com
+  ● · Claude Max · work@example.com's Acme Corp
+
+│ Current session
+│ 20% used`,
+			wantEmail: "work@example.com",
+			wantOrg:   "Acme Corp",
+			wantType:  AccountTypeMax,
+		},
+		{
+			name: "current suffix",
+			input: `Switch account
+  work@example.com · Claude Max (current)
+  personal@example.com · Claude Pro
+
+Current session
+20% used`,
+			wantEmail: "work@example.com",
+			wantType:  AccountTypeMax,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snapshot := parseClaudeOutput(tt.input, false, true, nil, nil)
+			if snapshot.Email != tt.wantEmail {
+				t.Errorf("Email = %q, want %q", snapshot.Email, tt.wantEmail)
+			}
+			if snapshot.Organization != tt.wantOrg {
+				t.Errorf("Organization = %q, want %q", snapshot.Organization, tt.wantOrg)
+			}
+			if snapshot.AccountType != tt.wantType {
+				t.Errorf("AccountType = %q, want %q", snapshot.AccountType, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestSplitAccountSwitcher_SingleAccount(t *testing.T) {
+	text := " · Claude Max · user@example.com\n\nuser@example.com's Acme Corp\nCurrent session\n20% used"
+	if entry, rest := splitAccountSwitcher(text); entry != "" || rest != text {
+		t.Errorf("splitAccountSwitcher() = %q, %q; want no entry and text unchanged", entry, rest)
+	}
+}
+
+func TestParseClaudeOutput_PlanHeaderWithOrgSwitcher(t *testing.T) {
+	// Two lines with an email, but no account list: the org switcher entry
+	// must not make the plan header look like an inactive account
+	input := " · Claude Pro · user@example.com\n\n● user@example.com's Organization\n\nCurrent session\n20% used\n"
+	if entry, rest := splitAccountSwitcher(input); entry != "" || rest != input {
+		t.Errorf("splitAccountSwitcher() = %q, %q; want no entry and text unchanged", entry, rest)
+	}
+	snapshot := parseClaudeOutput(input, false, false, nil, nil)
+	if snapshot.AccountType != AccountTypePro || snapshot.PlanName == "" {
+		t.Errorf("AccountType = %q, PlanName = %q; want pro with a plan name", snapshot.AccountType, snapshot.PlanName)
+	}
+	if snapshot.Email != "user@example.com" {
+		t.Errorf("Email = %q, want %q", snapshot.Email, "user@example.com")
+	}
+}
+
+func TestSessionThresholdAlert_HookOncePerCrossing(t *testing.T) {
+	hookLog := filepath.Join(t.TempDir(), "hook.log")
+	alert := &sessionThresholdAlert{config: &NotifyConfig{
+		Threshold: 80,
+		OnAlert:   `echo "$CLAUDE_SESSION_USED $CLAUDE_WEEKLY_USED $CLAUDE_ALERT_THRESHOLD" >> ` + hookLog,
+	}}
+	snapshot := func(sessionUsed float64) *UsageSnapshot {
+		return &UsageSnapshot{Quotas: []Quota{
+			{Type: QuotaTypeSession, PercentRemaining: 100 - sessionUsed},
+			{Type: QuotaTypeWeekly, PercentRemaining: 60},
+		}}
+	}
+
+	// Hooks run in the background; wait for each one's line before the next
+	// check so the order in the log is stable
+	var got string
+	waitForLines := func(n int) {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			data, _ := os.ReadFile(hookLog)
+			if got = string(data); strings.Count(got, "\n") >= n {
+				return
+			}
+		}
+		t.Fatalf("hook log = %q after 5s, want %d lines", got, n)
+	}
+
+	// Two crossings: 85 (then staying above at 90), and 95 after dropping to 40
+	lines := 0
+	for _, used := range []float64{50, 85, 90, 40, 95} {
+		wasSent := alert.sent
+		alert.check(snapshot(used))
+		if alert.sent && !wasSent {
+			lines++
+			waitForLines(lines)
+		}
+	}
+
+	if want := "85 40 80\n95 40 80\n"; got != want {
+		t.Errorf("hook invocations = %q, want %q", got, want)
+	}
+}
+
+func TestSessionThresholdAlert_NoSessionQuota(t *testing.T) {
+	hookLog := filepath.Join(t.TempDir(), "hook.log")
+	alert := &sessionThresholdAlert{config: &NotifyConfig{
+		Threshold: 80,
+		OnAlert:   `echo "$CLAUDE_WEEKLY_USED" >> ` + hookLog,
+	}}
+
+	// Without a session quota the most used quota decides, not whichever
+	// happens to come first
+	alert.check(&UsageSnapshot{Quotas: []Quota{
+		{Type: QuotaTypeWeekly, PercentRemaining: 60},
+		{Type: QuotaTypeModelSpecific, Model: "opus", PercentRemaining: 15},
+	}})
+	if !alert.sent {
+		t.Fatal("no alert for a snapshot whose worst quota is above the threshold")
+	}
+	var got string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		data, _ := os.ReadFile(hookLog)
+		if got = string(data); got != "" {
+			break
+		}
+	}
+	if got != "40\n" {
+		t.Errorf("hook output = %q, want %q", got, "40\n")
+	}
+}
+
+func TestFormatMOTD(t *testing.T) {
+	now := time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
+	resetsAt := now.Add(2*time.Hour + 14*time.Minute).Format(time.RFC3339)
+
+	healthy := &UsageSnapshot{
+		AccountType: AccountTypeMax,
+		Quotas: []Quota{
+			{Type: QuotaTypeSession, PercentRemaining: 27, ResetsAt: &resetsAt},
+			{Type: QuotaTypeWeekly, PercentRemaining: 60},
+		},
+		CapturedAt: now.Add(-10 * time.Minute).Format(time.RFC3339),
+	}
+	authError := &UsageSnapshot{
+		AccountType: AccountTypeUnknown,
+		AuthError:   &AuthError{Code: "not_logged_in", Message: "Not logged in"},
+	}
+
+	tests := []struct {
+		name     string
+		snapshot *UsageSnapshot
+		want     string
+	}{
+		{"healthy", healthy, "Claude Max — Session 73% used (2h14m), Weekly 40% used"},
+		{"auth error", authError, "Claude: not logged in"},
+		{"suspended", &UsageSnapshot{AuthError: &AuthError{Code: AuthErrorSuspended}}, "Claude: account suspended"},
+		{"no snapshot", nil, "Claude: no usage data"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatMOTD(tt.snapshot, now); got != tt.want {
+				t.Errorf("formatMOTD() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteSplitFiles(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "split")
+	snapshot := &UsageSnapshot{Quotas: []Quota{
+		{Type: QuotaTypeSession, PercentRemaining: 27, TimeRemainingHuman: "2h 14m"},
+		{Type: QuotaTypeWeekly, PercentRemaining: 60, TimeRemainingHuman: "3d 4h"},
+		{Type: QuotaTypeModelSpecific, Model: "opus", PercentRemaining: 92.6},
+	}}
+	if err := writeSplitFiles(snapshot, dir); err != nil {
+		t.Fatalf("writeSplitFiles() error = %v", err)
+	}
+
+	want := map[string]string{
+		"session.pct":   "73\n",
+		"session.reset": "2h 14m\n",
+		"weekly.pct":    "40\n",
+		"weekly.reset":  "3d 4h\n",
+		"opus.pct":      "7\n",
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(want) {
+		t.Errorf("got %d files, want %d", len(entries), len(want))
+	}
+	for name, content := range want {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if string(data) != content {
+			t.Errorf("%s = %q, want %q", name, data, content)
+		}
+	}
+
+	// An auth error has no quotas; stale values must not linger
+	if err := writeSplitFiles(&UsageSnapshot{AuthError: &AuthError{Code: AuthErrorNotLoggedIn}}, dir); err != nil {
+		t.Fatalf("writeSplitFiles() error = %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("files left after auth error: %v", entries)
+	}
+}
+
+func TestQueryCommand_DebugParseTrace(t *testing.T) {
+	fixture := filepath.Join("testdata", "usage_max.txt")
+
+	var stdout, stderr bytes.Buffer
+	if code := queryCommand([]string{"--from-file", fixture, "--debug"}, &stdout, &stderr, nil); code != 0 {
+		t.Fatalf("exit code = %d, stderr: %s", code, stderr.String())
+	}
+	var snapshot UsageSnapshot
+	if err := json.Unmarshal(stdout.Bytes(), &snapshot); err != nil {
+		t.Fatalf("output is not JSON: %v", err)
+	}
+	debug := snapshot.Debug
+	if debug == nil {
+		t.Fatal("debug object missing with --debug")
+	}
+	if debug.AccountLine != 2 || debug.EmailLine != 2 {
+		t.Errorf("account_line = %d, email_line = %d, want both 2 (the header)", debug.AccountLine, debug.EmailLine)
+	}
+	want := []QuotaDebug{
+		{Label: "Current session", HeadingLine: 4, PercentLine: 5, ResetLine: 6, ResetVariant: "relative"},
+		{Label: "Current week (all models)", HeadingLine: 8, PercentLine: 9, ResetLine: 10, ResetVariant: "relative"},
+		{Label: "Current week (Sonnet only)", HeadingLine: 12, PercentLine: 13, ResetLine: 14, ResetVariant: "relative"},
+	}
+	if !reflect.DeepEqual(debug.Quotas, want) {
+		t.Errorf("quotas = %+v, want %+v", debug.Quotas, want)
+	}
+	if len(debug.Trace) == 0 {
+		t.Error("trace is empty")
+	}
+
+	// Without --debug the object is left out entirely
+	stdout.Reset()
+	if code := queryCommand([]string{"--from-file", fixture}, &stdout, &stderr, nil); code != 0 {
+		t.Fatalf("exit code = %d, stderr: %s", code, stderr.String())
+	}
+	if strings.Contains(stdout.String(), `"debug"`) {
+		t.Errorf("debug object present without --debug: %s", stdout.String())
+	}
+}
+
+func TestParseAbsoluteTime_Variant(t *testing.T) {
+	tests := map[string]string{
+		"Resets Jan 4, 2026, 1am (Europe/Berlin)": "full_date",
+		"Resets Jan 4, 1am":                       "date_no_year",
+		"Resets 6am (Europe/Berlin)":              "time_only",
+		"Resets midnight":                         "time_only",
+		"Resets 18:59":                            "clock_24",
+		"Resets Monday, Jan 6":                    "date_only",
+		"Resets soon":                             "",
+	}
+	for text, want := range tests {
+		if _, _, got := parseAbsoluteTimeRollover(text, true); got != want {
+			t.Errorf("parseAbsoluteTimeRollover(%q) variant = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestDetectInstanceConflict(t *testing.T) {
+	tests := []struct {
+		output string
+		want   bool
+	}{
+		{"\x1b[31mError: Another claude instance is already running.\x1b[0m\r\nClose it and try again.", true},
+		{"Another process is already running with this config", true},
+		{"Could not acquire lock on /home/me/.claude/.lock", true},
+		{"Lock file ~/.claude/ide.lock is held by pid 4242", true},
+		{"Current session\n12% used\nResets 2h", false},
+		{"Already running /usage…", false},
+	}
+	for _, tt := range tests {
+		if got := detectInstanceConflict(tt.output); got != tt.want {
+			t.Errorf("detectInstanceConflict(%q) = %v, want %v", tt.output, got, tt.want)
+		}
+	}
+}
+
+func TestRunQuery_InstanceConflict(t *testing.T) {
+	calls := 0
+	_, _, err := runQuery(&QueryOptions{
+		Timeout:    time.Second,
+		MaxRetries: 2,
+		Executor: func(ctx context.Context, opts *QueryOptions) (string, error) {
+			calls++
+			return "Error: Another claude instance is already running.", errors.New("command timed out after 1s")
+		},
+	})
+	if !errors.Is(err, errInstanceConflict) {
+		t.Fatalf("runQuery() error = %v, want errInstanceConflict", err)
+	}
+	if calls != 1 {
+		t.Errorf("executor called %d times, want 1 (a conflict is not retried)", calls)
+	}
+	if !strings.Contains(err.Error(), "close the interactive claude session") {
+		t.Errorf("error %q does not say how to fix it", err)
+	}
+}
+
+func TestBestOf(t *testing.T) {
+	resetsAt := "2026-01-10T18:00:00Z"
+	truncated := &UsageSnapshot{Incomplete: true, Quotas: []Quota{
+		{Type: QuotaTypeSession, ResetsAt: &resetsAt},
+		{Type: QuotaTypeWeekly, ResetsAt: &resetsAt},
+		{Type: QuotaTypeModelSpecific, Model: "opus"},
+	}}
+	sessionOnly := &UsageSnapshot{Quotas: []Quota{{Type: QuotaTypeSession, ResetsAt: &resetsAt}}}
+	full := &UsageSnapshot{Quotas: []Quota{
+		{Type: QuotaTypeSession, ResetsAt: &resetsAt},
+		{Type: QuotaTypeWeekly, ResetsAt: &resetsAt},
+	}}
+	fullNoReset := &UsageSnapshot{Quotas: []Quota{
+		{Type: QuotaTypeSession, ResetsAt: &resetsAt},
+		{Type: QuotaTypeWeekly},
+	}}
+	fullWarned := &UsageSnapshot{Warnings: []string{"assumed midnight"}, Quotas: full.Quotas}
+	fullLater := &UsageSnapshot{Quotas: full.Quotas}
+
+	tests := []struct {
+		name      string
+		snapshots []*UsageSnapshot
+		want      *UsageSnapshot
+	}{
+		{"more quotas", []*UsageSnapshot{sessionOnly, full}, full},
+		{"complete beats truncated", []*UsageSnapshot{truncated, sessionOnly}, sessionOnly},
+		{"more reset times", []*UsageSnapshot{full, fullNoReset}, full},
+		{"fewer warnings", []*UsageSnapshot{fullWarned, full}, full},
+		{"tie goes to later", []*UsageSnapshot{full, fullLater}, fullLater},
+		{"nil skipped", []*UsageSnapshot{nil, sessionOnly, nil}, sessionOnly},
+		{"none", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bestOf(tt.snapshots); got != tt.want {
+				t.Errorf("bestOf() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunQuery_Captures(t *testing.T) {
+	partial := "Claude Max\nCurrent session\n25% used\nResets in 2h\n"
+	full := partial + "Current week (all models)\n40% used\nResets in 3d\n"
+	outputs := []string{partial, full, partial}
+	calls := 0
+	snapshot, rawOutput, err := runQuery(&QueryOptions{
+		Timeout:  time.Second,
+		Captures: 3,
+		Executor: func(ctx context.Context, opts *QueryOptions) (string, error) {
+			calls++
+			return outputs[calls-1], nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("runQuery() error = %v", err)
+	}
+	if len(snapshot.Quotas) != 2 || rawOutput != full {
+		t.Errorf("runQuery() = %d quotas from %q, want the 2-quota capture", len(snapshot.Quotas), rawOutput)
+	}
+	// The second capture is complete, so the third is never spawned
+	if calls != 2 {
+		t.Errorf("executor called %d times, want 2", calls)
+	}
+}
+
+func TestRunQuery_JSONMode(t *testing.T) {
+	resetsAt := time.Now().Add(2 * time.Hour).Truncate(time.Second).Format(time.RFC3339)
+	response := `{"account_type":"max","email":"user@example.com","quotas":[` +
+		`{"type":"session","percent_remaining":73,"resets_at":"` + resetsAt + `"},` +
+		`{"type":"weekly","percent_remaining":40}]}`
+	tuiCalls := 0
+	tui := func(ctx context.Context, opts *QueryOptions) (string, error) {
+		tuiCalls++
+		fixture, err := os.ReadFile(filepath.Join("testdata", "usage_max.txt"))
+		return string(fixture), err
+	}
+
+	opts := &QueryOptions{
+		Timeout:  time.Second,
+		JSONMode: true,
+		Executor: tui,
+		JSONExecutor: func(ctx context.Context, opts *QueryOptions) (string, error) {
+			return response + "\n", nil
+		},
+	}
+	snapshot, _, err := runQuery(opts)
+	if err != nil {
+		t.Fatalf("runQuery() error = %v", err)
+	}
+	if tuiCalls != 0 {
+		t.Errorf("TUI executor called %d times, want 0 in JSON mode", tuiCalls)
+	}
+	if snapshot.AccountType != AccountTypeMax || snapshot.Email != "user@example.com" || len(snapshot.Quotas) != 2 {
+		t.Fatalf("snapshot = %+v, want the JSON response's account and quotas", snapshot)
+	}
+	session := snapshot.Session()
+	if session.PercentRemaining != 73 || session.TimeRemainingSeconds == nil || session.TimeRemainingHuman == "" {
+		t.Errorf("session = %+v, want 73%% remaining with derived time remaining", session)
+	}
+	if snapshot.SchemaVersion != snapshotSchemaVersion || snapshot.CapturedAt == "" || snapshot.ValidUntil == nil || *snapshot.ValidUntil != resetsAt {
+		t.Errorf("snapshot = %+v, want schema version, captured_at and valid_until filled in", snapshot)
+	}
+
+	// A claude without JSON mode prints text instead: scrape the TUI, and stop trying JSON
+	opts = &QueryOptions{
+		Timeout:  time.Second,
+		JSONMode: true,
+		Executor: tui,
+		JSONExecutor: func(ctx context.Context, opts *QueryOptions) (string, error) {
+			return "Unknown command: /usage --json", errors.New("exit status 1")
+		},
+	}
+	snapshot, _, err = runQuery(opts)
+	if err != nil {
+		t.Fatalf("runQuery() fallback error = %v", err)
+	}
+	if tuiCalls != 1 || len(snapshot.Quotas) == 0 {
+		t.Errorf("fallback: TUI calls = %d, quotas = %d, want 1 call with quotas", tuiCalls, len(snapshot.Quotas))
+	}
+	if opts.JSONMode {
+		t.Error("JSONMode still set after claude proved not to support it")
+	}
+}
+
+func TestRunQuery_JSONModeFailures(t *testing.T) {
+	tui := func(ctx context.Context, opts *QueryOptions) (string, error) {
+		fixture, err := os.ReadFile(filepath.Join("testdata", "usage_max.txt"))
+		return string(fixture), err
+	}
+	tests := []struct {
+		name     string
+		output   string
+		err      error
+		keepJSON bool
+	}{
+		{"unknown flag", "error: unknown option '--json'", errors.New("exit status 1"), false},
+		{"non-zero exit without output", "", errors.New("exit status 2"), false},
+		{"truncated response", `{"account_type":"max","quo`, nil, true},
+		{"failure with output", "Error: API overloaded", errors.New("exit status 1"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &QueryOptions{
+				Timeout:  time.Second,
+				JSONMode: true,
+				Executor: tui,
+				JSONExecutor: func(ctx context.Context, opts *QueryOptions) (string, error) {
+					return tt.output, tt.err
+				},
+			}
+			snapshot, _, err := runQuery(opts)
+			if err != nil || len(snapshot.Quotas) == 0 {
+				t.Fatalf("runQuery() = %+v, %v; want the TUI fallback's quotas", snapshot, err)
+			}
+			if opts.JSONMode != tt.keepJSON {
+				t.Errorf("JSONMode = %v after the fallback, want %v", opts.JSONMode, tt.keepJSON)
+			}
+		})
+	}
+}
+
+func TestRunQuery_JSONModeSharesTimeout(t *testing.T) {
+	var jsonBudget, tuiBudget time.Duration
+	budget := func(ctx context.Context) time.Duration {
+		deadline, _ := ctx.Deadline()
+		return time.Until(deadline)
+	}
+	opts := &QueryOptions{
+		Timeout:  4 * time.Second,
+		JSONMode: true,
+		Executor: func(ctx context.Context, opts *QueryOptions) (string, error) {
+			tuiBudget = budget(ctx)
+			fixture, err := os.ReadFile(filepath.Join("testdata", "usage_max.txt"))
+			return string(fixture), err
+		},
+		JSONExecutor: func(ctx context.Context, opts *QueryOptions) (string, error) {
+			jsonBudget = budget(ctx)
+			time.Sleep(100 * time.Millisecond)
+			return "", errors.New("exit status 1")
+		},
+	}
+	if _, _, err := runQuery(opts); err != nil {
+		t.Fatalf("runQuery() error = %v", err)
+	}
+	if jsonBudget > 2*time.Second {
+		t.Errorf("JSON attempt got %s, want at most half of the 4s timeout", jsonBudget)
+	}
+	if tuiBudget > 4*time.Second-100*time.Millisecond {
+		t.Errorf("TUI fallback got %s, want what the JSON attempt left of the 4s timeout", tuiBudget)
+	}
+}
+
+func TestUsageSnapshot_QuotaSelectors(t *testing.T) {
+	full := &UsageSnapshot{Quotas: []Quota{
+		{Type: QuotaTypeModelSpecific, Model: "sonnet", PercentRemaining: 93},
+		{Type: QuotaTypeWeekly, PercentRemaining: 59},
+		{Type: QuotaTypeModelSpecific, Model: "opus", PercentRemaining: 12},
+		{Type: QuotaTypeSession, PercentRemaining: 88},
+	}}
+	sessionOnly := &UsageSnapshot{Quotas: []Quota{{Type: QuotaTypeSession, PercentRemaining: 40}}}
+	empty := &UsageSnapshot{}
+
+	remaining := func(q *Quota) string {
+		if q == nil {
+			return "nil"
+		}
+		return fmt.Sprintf("%s/%s %g", q.Type, q.Model, q.PercentRemaining)
+	}
+	tests := []struct {
+		name string
+		got  *Quota
+		want string
+	}{
+		// Order in Quotas must not matter
+		{"full session", full.Session(), "session/ 88"},
+		{"full weekly", full.Weekly(), "weekly/ 59"},
+		{"full opus", full.Model("opus"), "model_specific/opus 12"},
+		{"full sonnet", full.Model("sonnet"), "model_specific/sonnet 93"},
+		{"full worst", full.Worst(), "model_specific/opus 12"},
+		{"unknown model", full.Model("haiku"), "nil"},
+		{"model named like a type", full.Model("session"), "nil"},
+		{"session only weekly", sessionOnly.Weekly(), "nil"},
+		{"session only worst", sessionOnly.Worst(), "session/ 40"},
+		{"empty session", empty.Session(), "nil"},
+		{"empty worst", empty.Worst(), "nil"},
+	}
+	for _, tt := range tests {
+		if got := remaining(tt.got); got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	// Selectors return pointers into Quotas, not copies
+	full.Session().PercentRemaining = 50
+	if full.Quotas[3].PercentRemaining != 50 {
+		t.Error("Session() returned a copy")
+	}
+}
+
+func TestFormatters_NoSessionQuota(t *testing.T) {
+	// Without a session quota the formatters fall back to the worst quota,
+	// not whichever happens to come first
+	snapshot := &UsageSnapshot{
+		AccountType: AccountTypeMax,
+		Quotas: []Quota{
+			{Type: QuotaTypeWeekly, PercentRemaining: 70},
+			{Type: QuotaTypeModelSpecific, Model: "opus", PercentRemaining: 10},
+		},
+	}
+	if msg, _ := badgeMessage(snapshot); msg != "90% used" {
+		t.Errorf("badgeMessage() = %q, want %q", msg, "90% used")
+	}
+	if got := formatSketchybar(snapshot, "claude"); !strings.Contains(got, "label='90%'") {
+		t.Errorf("formatSketchybar() = %q, want the opus quota", got)
+	}
+}
+
+func TestQuotaBaselines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "baseline.json")
+	start := time.Date(2026, 1, 5, 8, 0, 0, 0, time.UTC)
+	sessionReset := start.Add(3 * time.Hour).Format(time.RFC3339)
+	weeklyReset := start.Add(4 * 24 * time.Hour).Format(time.RFC3339)
+
+	reading := func(at time.Time, sessionUsed, weeklyUsed float64, sessionResetsAt string) *UsageSnapshot {
+		return &UsageSnapshot{
+			CapturedAt: at.Format(time.RFC3339),
+			Quotas: []Quota{
+				{Type: QuotaTypeSession, PercentRemaining: 100 - sessionUsed, ResetsAt: &sessionResetsAt},
+				{Type: QuotaTypeWeekly, PercentRemaining: 100 - weeklyUsed, ResetsAt: &weeklyReset},
+			},
+		}
+	}
+	sinceReset := func(snapshot *UsageSnapshot) (float64, float64) {
+		t.Helper()
+		session, weekly := snapshot.Session().UsedSinceReset, snapshot.Weekly().UsedSinceReset
+		if session == nil || weekly == nil {
+			t.Fatalf("used_since_reset not set: %+v", snapshot.Quotas)
+		}
+		return *session, *weekly
+	}
+
+	// The first reading becomes the baseline
+	baselines := loadBaselines(path)
+	first := reading(start, 10, 30, sessionReset)
+	if !baselines.apply(first) {
+		t.Error("apply() on first reading = false, want a new baseline")
+	}
+	if s, w := sinceReset(first); s != 0 || w != 0 {
+		t.Errorf("first reading: since reset = %v, %v; want 0, 0", s, w)
+	}
+	if err := baselines.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Later readings are diffed against it, also after a restart
+	baselines = loadBaselines(path)
+	later := reading(start.Add(2*time.Hour), 45, 38, sessionReset)
+	if baselines.apply(later) {
+		t.Error("apply() without a reset = true, want baselines unchanged")
+	}
+	if s, w := sinceReset(later); s != 35 || w != 8 {
+		t.Errorf("before reset: since reset = %v, %v; want 35, 8", s, w)
+	}
+
+	// Once the session reset time has passed, the next reading is its new baseline
+	nextReset := start.Add(8 * time.Hour).Format(time.RFC3339)
+	afterReset := reading(start.Add(3*time.Hour+10*time.Minute), 4, 39, nextReset)
+	if !baselines.apply(afterReset) {
+		t.Error("apply() after the reset = false, want a new session baseline")
+	}
+	if s, w := sinceReset(afterReset); s != 0 || w != 9 {
+		t.Errorf("after reset: since reset = %v, %v; want 0, 9", s, w)
+	}
+	if got := baselines[quotaKey(afterReset.Session())]; got.Used != 4 || got.ResetsAt != nextReset {
+		t.Errorf("session baseline = %+v, want used 4 resetting at %s", got, nextReset)
+	}
+
+	// A point of jitter below the baseline (45 -> 44) is not a reset
+	baselines = quotaBaselines{}
+	baselines.apply(reading(start, 45, 30, sessionReset))
+	jitter := reading(start.Add(time.Minute), 44, 30, sessionReset)
+	if baselines.apply(jitter) {
+		t.Error("apply() after a 1 point drop = true, want baselines unchanged")
+	}
+	if s, _ := sinceReset(jitter); s != 0 {
+		t.Errorf("after jitter: session since reset = %v, want 0", s)
+	}
+
+	// Usage dropping clearly also means a reset, even if the reset time was unknown
+	dropped := reading(start.Add(2*time.Minute), 1, 30, sessionReset)
+	if !baselines.apply(dropped) {
+		t.Error("apply() after a large drop = false, want a new session baseline")
+	}
+	if got := baselines[quotaKey(dropped.Session())]; got.Used != 1 {
+		t.Errorf("session baseline after a drop = %+v, want used 1", got)
+	}
+}
+
+func TestRunOneshot_Lock(t *testing.T) {
+	dir := t.TempDir()
+	outputFile := filepath.Join(dir, "usage.json")
+	lockPath := outputFile + ".lock"
+	calls := 0
+	opts := &QueryOptions{
+		Timeout: time.Second,
+		Executor: func(ctx context.Context, opts *QueryOptions) (string, error) {
+			calls++
+			return "Claude Max\nCurrent session\n25% used\nResets in 2h\nCurrent week (all models)\n40% used\nResets in 3d\n", nil
+		},
+	}
+
+	// A concurrent run holds the lock, so this one must not query
+	held, err := tryLock(lockPath)
+	if err != nil || held == nil {
+		t.Fatalf("tryLock() = %v, %v", held, err)
+	}
+	ran, err := runOneshot(outputFile, lockPath, opts)
+	if err != nil || ran {
+		t.Errorf("runOneshot() with lock held = %v, %v, want false, nil", ran, err)
+	}
+	if calls != 0 {
+		t.Errorf("executor called %d times with lock held, want 0", calls)
+	}
+	if _, err := os.Stat(outputFile); !os.IsNotExist(err) {
+		t.Errorf("output file written with lock held: %v", err)
+	}
+	held.Close()
+
+	for want := uint64(1); want <= 2; want++ {
+		ran, err = runOneshot(outputFile, lockPath, opts)
+		if err != nil || !ran {
+			t.Fatalf("runOneshot() = %v, %v, want true, nil", ran, err)
+		}
+		snapshot, err := readSnapshotFile(outputFile)
+		if err != nil {
+			t.Fatalf("readSnapshotFile() error = %v", err)
+		}
+		if snapshot.Seq != want {
+			t.Errorf("seq = %d, want %d", snapshot.Seq, want)
+		}
+	}
+	if _, err := readSnapshotFile(lastGoodPath(outputFile)); err != nil {
+		t.Errorf("last-good snapshot not written: %v", err)
+	}
+}
+
+func TestFormatHyprPanelOutput_LevelClasses(t *testing.T) {
+	classes := LevelClasses{Low: "ok", High: "critical", Error: "broken"}
+	tests := []struct {
+		name      string
+		snapshot  *UsageSnapshot
+		wantAlt   string
+		wantClass string
+	}{
+		{
+			name:      "low",
+			snapshot:  &UsageSnapshot{AccountType: AccountTypeMax, Quotas: []Quota{{Type: QuotaTypeSession, PercentRemaining: 80}}},
+			wantAlt:   "ok",
+			wantClass: "ok",
+		},
+		{
+			name:      "medium keeps default",
+			snapshot:  &UsageSnapshot{AccountType: AccountTypeMax, Quotas: []Quota{{Type: QuotaTypeSession, PercentRemaining: 40}}},
+			wantAlt:   "medium",
+			wantClass: "medium",
+		},
+		{
+			name: "high with budget and warnings",
+			snapshot: &UsageSnapshot{
+				AccountType: AccountTypeMax,
+				Quotas:      []Quota{{Type: QuotaTypeSession, PercentRemaining: 10}},
+				CostUsage:   &CostUsage{Spent: 95, Budget: 100},
+				Warnings:    []string{"account type inferred from quota layout"},
+			},
+			wantAlt:   "critical",
+			wantClass: "critical budget_high warn",
+		},
+		{
+			name:      "error",
+			snapshot:  &UsageSnapshot{AccountType: AccountTypeUnknown},
+			wantAlt:   "broken",
+			wantClass: "broken",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := formatHyprPanelOutput(tt.snapshot, HyprPanelOptions{Display: "session", Classes: classes})
+			if got.Alt != tt.wantAlt || got.Class != tt.wantClass {
+				t.Errorf("alt, class = %q, %q, want %q, %q", got.Alt, got.Class, tt.wantAlt, tt.wantClass)
+			}
+		})
+	}
+
+	// Error categories in alt stay machine-readable; only the class is renamed
+	got := hyprPanelOutputForFile(filepath.Join(t.TempDir(), "missing.json"), 0, HyprPanelOptions{Display: "session", Classes: classes}, time.Now())
+	if got.Alt != hyprPanelErrorFileMissing || got.Class != "broken" {
+		t.Errorf("missing file: alt, class = %q, %q, want %q, %q", got.Alt, got.Class, hyprPanelErrorFileMissing, "broken")
+	}
+}
+
+func TestParseClaudeOutput_PlanName(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		wantAccount AccountType
+		wantPlan    string
+	}{
+		{"max 20x", "Claude Max 20x · user@x\nCurrent session\n25% used\n", AccountTypeMax, "Claude Max 20x"},
+		{"max 5x in parentheses", "· Claude Max (5x) · user@example.com\nCurrent session\n25% used\n", AccountTypeMax, "Claude Max (5x)"},
+		{"pro without tier", "Claude Pro · user@example.com\nCurrent session\n25% used\n", AccountTypePro, "Claude Pro"},
+		{"no header", "Current session\n25% used\n", AccountTypeMax, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snapshot := parseClaudeOutput(tt.input, false, false, nil, nil)
+			if snapshot.AccountType != tt.wantAccount || snapshot.PlanName != tt.wantPlan {
+				t.Errorf("AccountType, PlanName = %q, %q, want %q, %q", snapshot.AccountType, snapshot.PlanName, tt.wantAccount, tt.wantPlan)
+			}
+		})
+	}
+}
+
+func TestSnapshotHTTP_Shutdown(t *testing.T) {
+	h := newSnapshotHTTP()
+	h.Update(&UsageSnapshot{AccountType: AccountTypeMax, Seq: 1})
+
+	// Hold /usage inside the handler so it is in flight when shutdown starts
+	entered := make(chan struct{})
+	watching := make(chan struct{})
+	release := make(chan struct{})
+	handler := h.Handler()
+	h.server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/usage":
+			close(entered)
+			<-release
+		case "/usage/watch":
+			close(watching)
+		}
+		handler.ServeHTTP(w, r)
+	})}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go h.server.Serve(listener)
+	url := "http://" + listener.Addr().String()
+
+	type result struct {
+		status int
+		err    error
+	}
+	usage := make(chan result, 1)
+	watch := make(chan result, 1)
+	get := func(path string, done chan<- result) {
+		resp, err := http.Get(url + path)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		var snapshot UsageSnapshot
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&snapshot)
+		}
+		done <- result{status: resp.StatusCode, err: err}
+	}
+	go get("/usage/watch?since=1&timeout=1m", watch)
+	go get("/usage", usage)
+	<-entered
+	<-watching
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- h.Shutdown(5 * time.Second) }()
+
+	// The held watch is answered right away instead of blocking the drain
+	select {
+	case r := <-watch:
+		if r.err != nil || r.status != http.StatusNoContent {
+			t.Errorf("watch during shutdown = %+v, want 204", r)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("watch request still held during shutdown")
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown() returned with a request in flight: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if r := <-usage; r.err != nil || r.status != http.StatusOK {
+		t.Errorf("in-flight /usage = %+v, want 200 with the snapshot", r)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+}
+
+func TestRunQuery_ContextStopsRetries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	_, _, err := runQuery(&QueryOptions{
+		Timeout:      time.Second,
+		MaxRetries:   3,
+		RetryBackoff: time.Minute,
+		Context:      ctx,
+		Executor: func(context.Context, *QueryOptions) (string, error) {
+			calls++
+			cancel() // shutdown arrives while the first spawn runs
+			return "", nil
+		},
+	})
+	if err == nil {
+		t.Fatal("runQuery() error = nil, want the failed spawn's error")
+	}
+	if calls != 1 {
+		t.Errorf("executor called %d times after cancellation, want 1", calls)
+	}
+
+	// Once shutdown has begun, no new query is spawned at all
+	calls = 0
+	for _, captures := range []int{1, 3} {
+		_, _, err = runQuery(&QueryOptions{
+			Timeout:    time.Second,
+			Captures:   captures,
+			CaptureGap: time.Minute,
+			JSONMode:   true,
+			Context:    ctx,
+			Executor: func(context.Context, *QueryOptions) (string, error) {
+				calls++
+				return "", nil
+			},
+			JSONExecutor: func(context.Context, *QueryOptions) (string, error) {
+				calls++
+				return "", nil
+			},
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("runQuery(captures %d) with cancelled context: error = %v, want context.Canceled", captures, err)
+		}
+	}
+	if calls != 0 {
+		t.Errorf("executor called %d times with a cancelled context, want 0", calls)
+	}
+}
+
+func TestParseCostUsage_ScopedEntries(t *testing.T) {
+	input := "Current session\n25% used\n\nExtra usage\n$5.00 / $20.00 spent this month\n$120.50 spent all time\n"
+	got := parseCostUsage(input, nil)
+	if got == nil {
+		t.Fatalf("parseCostUsage(%q) = nil", input)
+	}
+	// The budgeted line stays the primary figure for existing consumers
+	if got.Spent != 5 || got.Budget != 20 {
+		t.Errorf("Spent, Budget = %v, %v, want 5, 20", got.Spent, got.Budget)
+	}
+	want := []CostEntry{
+		{Scope: "monthly", Spent: 5, Budget: 20},
+		{Scope: "total", Spent: 120.5},
+	}
+	if !slices.Equal(got.Entries, want) {
+		t.Errorf("Entries = %+v, want %+v", got.Entries, want)
+	}
+
+	// Unlimited extra usage keeps every spend line too
+	unlimited := parseCostUsage("Extra usage\nUnlimited\n$12.30 spent this month\n$480.00 spent all time\n", nil)
+	wantUnlimited := []CostEntry{
+		{Scope: "monthly", Spent: 12.3},
+		{Scope: "total", Spent: 480},
+	}
+	if unlimited == nil || !unlimited.Unlimited || unlimited.Spent != 12.3 || !slices.Equal(unlimited.Entries, wantUnlimited) {
+		t.Errorf("unlimited section = %+v, want unlimited, spent 12.30 and entries %+v", unlimited, wantUnlimited)
+	}
+
+	// A single cost line needs no entries
+	single := parseCostUsage("Extra usage\n$5.00 / $20.00 spent\n", nil)
+	if single == nil || single.Entries != nil {
+		t.Errorf("single cost line: %+v, want no entries", single)
+	}
+}
+
+func TestStripNonASCIISymbols(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"plain ascii", "Session: 25% used (2h left)", "Session: 25% used (2h left)"},
+		{"leading warning glyph", "⚠️ Best-effort data", "Best-effort data"},
+		{"trailing emoji", "Max 🔥", "Max"},
+		{"emoji between words", "73% ✅ Max", "73% Max"},
+		{"zwj sequence", "👩‍💻 coding", "coding"},
+		{"multi-line tooltip", "Session: 25% used\n⏳ Weekly: 40% used 📈\nExtra: $5.00", "Session: 25% used\nWeekly: 40% used\nExtra: $5.00"},
+		{"letters in other scripts", "Organisation: Müller GmbH · 東京", "Organisation: Müller GmbH 東京"},
+		{"no-break space", "25% used", "25% used"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripNonASCIISymbols(tt.input); got != tt.want {
+				t.Errorf("stripNonASCIISymbols(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+
+	output := stripHyprPanelSymbols(formatHyprPanelOutput(&UsageSnapshot{
+		AccountType:   AccountTypeMax,
+		Quotas:        []Quota{{Type: QuotaTypeSession, PercentRemaining: 75}},
+		ModelFallback: "🤖 Sonnet",
+	}, HyprPanelOptions{Display: "session"}))
+	if !strings.Contains(output.Tooltip, "Fallback: Sonnet") || strings.ContainsRune(output.Tooltip, '🤖') {
+		t.Errorf("Tooltip = %q, want the emoji removed", output.Tooltip)
+	}
+}
+
+func TestTimeLayout(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	resetsAt := "2026-03-10T18:30:00Z"
+	q := Quota{Type: QuotaTypeSession, PercentRemaining: 60, ResetsAt: &resetsAt}
+	if got := formatQuotaReset(&q, "", ResetAsClock, DurationStyleShort, time.UTC, "15:04 MST", now); got != "18:30 UTC" {
+		t.Errorf("formatQuotaReset() with layout 15:04 MST = %q, want %q", got, "18:30 UTC")
+	}
+	if got := formatResetClock(now.Add(72*time.Hour), now, time.UTC, time.RFC1123); got != "Fri, 13 Mar 2026 12:00:00 UTC" {
+		t.Errorf("formatResetClock() with RFC1123 = %q, want %q", got, "Fri, 13 Mar 2026 12:00:00 UTC")
+	}
+
+	tests := []struct {
+		layout      string
+		want        string
+		wantWarning bool
+	}{
+		{"", "", false},
+		{"15:04 MST", "15:04 MST", false},
+		{time.RFC1123, time.RFC1123, false},
+		{"   ", "", true},
+		{"soon", "", true},
+	}
+	for _, tt := range tests {
+		got, warning := parseTimeLayout(tt.layout)
+		if got != tt.want || (warning != "") != tt.wantWarning {
+			t.Errorf("parseTimeLayout(%q) = %q, %q, want %q (warning: %v)", tt.layout, got, warning, tt.want, tt.wantWarning)
+		}
+	}
+
+	// The layout reaches the HyprPanel tooltip and {reset_clock}
+	resetTime := time.Now().Add(90 * time.Minute).Truncate(time.Minute).UTC()
+	resetsAt = resetTime.Format(time.RFC3339)
+	snapshot := &UsageSnapshot{
+		AccountType: AccountTypeMax,
+		Quotas:      []Quota{{Type: QuotaTypeSession, PercentRemaining: 60, ResetsAt: &resetsAt}},
+	}
+	want := resetTime.Format("15:04 MST")
+	got := formatHyprPanelOutput(snapshot, HyprPanelOptions{
+		Display:    "session",
+		ResetAs:    ResetAsClock,
+		DisplayTZ:  time.UTC,
+		TimeLayout: "15:04 MST",
+		TextFormat: "{s}% until {reset_clock}",
+	})
+	if got.Text != "40% until "+want {
+		t.Errorf("Text = %q, want %q", got.Text, "40% until "+want)
+	}
+	if !strings.Contains(got.Tooltip, "resets "+want) {
+		t.Errorf("Tooltip = %q, want it to contain %q", got.Tooltip, "resets "+want)
+	}
+}
+
+func TestRunDaemon_RawInputIgnoresRefresh(t *testing.T) {
+	outputFile := filepath.Join(t.TempDir(), "usage.json")
+	transcripts := make(chan string)
+	// Unbuffered, so a send returns only once the loop has taken the request;
+	// a second send then also proves the first was fully handled
+	refresh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		runDaemon(DaemonOptions{
+			Interval:       time.Minute,
+			OutputFile:     outputFile,
+			RawTranscripts: transcripts,
+			Query:          &QueryOptions{Timeout: time.Second},
+			RefreshChan:    refresh,
+		})
+		close(done)
+	}()
+	refreshTwice := func() {
+		for range 2 {
+			select {
+			case refresh <- struct{}{}:
+			case <-time.After(5 * time.Second):
+				t.Fatal("daemon did not take the refresh request")
+			}
+		}
+	}
+
+	// Before any transcript a refresh must not write an error state
+	refreshTwice()
+	if _, err := os.Stat(outputFile); !os.IsNotExist(err) {
+		t.Fatalf("refresh before the first transcript wrote the snapshot: %v", err)
+	}
+
+	transcripts <- "Claude Max\nCurrent session\n25% used\nResets in 2h\n"
+	var first *UsageSnapshot
+	deadline := time.Now().Add(5 * time.Second)
+	for first == nil || first.Seq != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("snapshot for the transcript was not written")
+		}
+		first, _ = readSnapshotFile(outputFile)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	refreshTwice()
+	after, err := readSnapshotFile(outputFile)
+	if err != nil {
+		t.Fatalf("readSnapshotFile() error = %v", err)
+	}
+	if after.Seq != 1 || after.CapturedAt != first.CapturedAt {
+		t.Errorf("refresh rewrote the snapshot: seq %d captured %s, want seq 1 captured %s", after.Seq, after.CapturedAt, first.CapturedAt)
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon did not stop on SIGTERM")
+	}
+}